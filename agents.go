@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// defaultAgentID names the built-in agent used when none is selected.
+const defaultAgentID = "default"
+
+// AgentConfig is an agent defined under "agents" in the config. An agent
+// adds its own instructions to the system prompt and may pick a default
+// model, a default mode ("act", "plan" or "review") and a tool subset.
+type AgentConfig struct {
+	ID           string   `json:"id"`
+	Name         string   `json:"name"`
+	Description  string   `json:"description,omitempty"`
+	SystemPrompt string   `json:"systemPrompt,omitempty"`
+	Tools        []string `json:"tools,omitempty"`
+	Model        string   `json:"model,omitempty"`
+	Mode         string   `json:"mode,omitempty"`
+}
+
+func defaultAgent() AgentConfig {
+	return AgentConfig{ID: defaultAgentID, Name: "Default Agent"}
+}
+
+// configuredAgents returns the built-in default agent followed by the agents
+// from the config. A configured agent with the default ID replaces it.
+func (s *Service) configuredAgents() []AgentConfig {
+	agents := []AgentConfig{defaultAgent()}
+
+	entries, ok := s.configValue("agents").([]interface{})
+	if !ok {
+		return agents
+	}
+	for _, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			continue
+		}
+		var agent AgentConfig
+		if err := json.Unmarshal(data, &agent); err != nil {
+			fmt.Printf("Warning: Invalid agent config: %v\n", err)
+			continue
+		}
+		agent.ID = strings.TrimSpace(agent.ID)
+		if agent.ID == "" {
+			continue
+		}
+		if agent.Name == "" {
+			agent.Name = agent.ID
+		}
+		if agent.ID == defaultAgentID {
+			agents[0] = agent
+			continue
+		}
+		agents = append(agents, agent)
+	}
+	return agents
+}
+
+// agentByID returns the agent with the given ID, falling back to the default
+// agent for an empty or unknown ID.
+func (s *Service) agentByID(id string) AgentConfig {
+	agents := s.configuredAgents()
+	for _, agent := range agents {
+		if agent.ID == id {
+			return agent
+		}
+	}
+	return agents[0]
+}
+
+// modeFor returns the mode for message: an explicit mode tag wins, then the
+// agent's default mode.
+func (a AgentConfig) modeFor(message string) agentMode {
+	if strings.HasPrefix(message, "[MODE:") {
+		return parseAgentMode(message)
+	}
+	switch agentMode(strings.ToLower(a.Mode)) {
+	case agentModePlan:
+		return agentModePlan
+	case agentModeReview:
+		return agentModeReview
+	default:
+		return agentModeAct
+	}
+}
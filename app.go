@@ -32,12 +32,19 @@ func NewApp() *App {
 // so we can call the runtime methods
 func (a *App) startup(ctx context.Context) {
 	a.ctx = ctx
+	a.service.SetEventEmitter(func(name string, data ...interface{}) {
+		wailsruntime.EventsEmit(ctx, name, data...)
+	})
 	fmt.Println("OpenSpace 应用已启动")
 }
 
 // shutdown is called when the app is closing.
 func (a *App) shutdown(ctx context.Context) {
 	fmt.Println("正在关闭应用...")
+	_ = a.service.StopWatch()
+	if err := a.service.Shutdown(shutdownTimeout); err != nil {
+		fmt.Printf("Warning: Shutdown did not complete cleanly: %v\n", err)
+	}
 }
 
 // Greet returns a greeting for the given name
@@ -61,6 +68,15 @@ func (a *App) GetServerStatus() string {
 	return "running"
 }
 
+// GetSystemStatus 获取进行中的操作数量
+func (a *App) GetSystemStatus() (string, error) {
+	data, err := json.Marshal(a.service.GetSystemStatus())
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal system status: %w", err)
+	}
+	return string(data), nil
+}
+
 // GetConfig 获取配置信息
 func (a *App) GetConfig() (string, error) {
 	config, err := a.service.GetConfig()
@@ -77,7 +93,7 @@ func (a *App) GetConfig() (string, error) {
 // UpdateConfig 更新配置
 func (a *App) UpdateConfig(configData string) (string, error) {
 	if configData == "" {
-		return "", fmt.Errorf("config data cannot be empty")
+		return "", invalidArgument("config data cannot be empty")
 	}
 	config, err := a.service.UpdateConfig(configData)
 	if err != nil {
@@ -90,6 +106,40 @@ func (a *App) UpdateConfig(configData string) (string, error) {
 	return string(data), nil
 }
 
+// PatchConfig 按路径局部更新配置，例如 {"customServices[0].enabled": false}
+func (a *App) PatchConfig(patchData string) (string, error) {
+	if patchData == "" {
+		return "", invalidArgument("config patch cannot be empty")
+	}
+	config, err := a.service.PatchConfig(patchData)
+	if err != nil {
+		return "", fmt.Errorf("failed to patch config: %w", err)
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal updated config: %w", err)
+	}
+	return string(data), nil
+}
+
+// GetDefaultModel 获取未指定模型时使用的默认模型
+func (a *App) GetDefaultModel() string {
+	return a.service.GetDefaultModel()
+}
+
+// SetDefaultModel 设置默认模型（service::model），传空字符串清除
+func (a *App) SetDefaultModel(model string) (string, error) {
+	route, err := a.service.SetDefaultModel(model)
+	if err != nil {
+		return "", withErrorDetails(fmt.Errorf("failed to set default model: %w", err), map[string]interface{}{"model": model})
+	}
+	data, err := json.Marshal(route)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal route: %w", err)
+	}
+	return string(data), nil
+}
+
 // GetProviders 获取提供者和默认模型
 func (a *App) GetProviders() (string, error) {
 	providers, err := a.service.GetProviders()
@@ -103,6 +153,21 @@ func (a *App) GetProviders() (string, error) {
 	return string(data), nil
 }
 
+// GetModels 获取具备指定能力的模型列表，filter 为逗号分隔的能力（tools、vision、json）
+func (a *App) GetModels(filter string) (string, error) {
+	var required []string
+	for _, capability := range strings.Split(filter, ",") {
+		if capability = strings.ToLower(strings.TrimSpace(capability)); capability != "" {
+			required = append(required, capability)
+		}
+	}
+	data, err := json.Marshal(a.service.GetModels(required))
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal models: %w", err)
+	}
+	return string(data), nil
+}
+
 // ListProviders 获取所有提供者列表
 func (a *App) ListProviders() (string, error) {
 	providers, err := a.service.ListProviders()
@@ -210,7 +275,7 @@ func (a *App) GetSessionStatus() (string, error) {
 // GetSessionDetails 获取会话详情
 func (a *App) GetSessionDetails(sessionID string) (string, error) {
 	if sessionID == "" {
-		return "", fmt.Errorf("session ID cannot be empty")
+		return "", invalidArgument("session ID cannot be empty")
 	}
 	session, err := a.service.GetSession(sessionID)
 	if err != nil {
@@ -226,7 +291,7 @@ func (a *App) GetSessionDetails(sessionID string) (string, error) {
 // GetSessionMessages 获取会话消息
 func (a *App) GetSessionMessages(sessionID string, limit string) (string, error) {
 	if sessionID == "" {
-		return "", fmt.Errorf("session ID cannot be empty")
+		return "", invalidArgument("session ID cannot be empty")
 	}
 
 	limitInt := 0
@@ -250,10 +315,73 @@ func (a *App) GetSessionMessages(sessionID string, limit string) (string, error)
 	return string(data), nil
 }
 
+// CompactStorage 整理会话存储并报告回收的空间
+func (a *App) CompactStorage() (string, error) {
+	result, err := a.service.CompactStorage()
+	if err != nil {
+		return "", fmt.Errorf("failed to compact storage: %w", err)
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal result: %w", err)
+	}
+	return string(data), nil
+}
+
+// ExportAll 导出配置和全部会话为 zip，返回临时文件路径
+func (a *App) ExportAll(maskKeys bool) (string, error) {
+	path, err := a.service.ExportAll(maskKeys)
+	if err != nil {
+		return "", fmt.Errorf("failed to export data: %w", err)
+	}
+	return path, nil
+}
+
+// ImportAll 从 ExportAll 生成的 zip 恢复配置和会话，strategy 为 skip、overwrite 或 rename
+func (a *App) ImportAll(archivePath string, strategy string) (string, error) {
+	if archivePath == "" {
+		return "", invalidArgument("archive path cannot be empty")
+	}
+	result, err := a.service.ImportAll(archivePath, strategy)
+	if err != nil {
+		return "", withErrorDetails(fmt.Errorf("failed to import data: %w", err), map[string]interface{}{"path": archivePath})
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal result: %w", err)
+	}
+	return string(data), nil
+}
+
+// ClearCache 清空 LLM 响应缓存，返回删除的条目数
+func (a *App) ClearCache() (int, error) {
+	removed, err := a.service.ClearCache()
+	if err != nil {
+		return removed, fmt.Errorf("failed to clear cache: %w", err)
+	}
+	return removed, nil
+}
+
+// GetArchivedMessages 获取会话中已归档的历史消息
+func (a *App) GetArchivedMessages(sessionID string) (string, error) {
+	if sessionID == "" {
+		return "", invalidArgument("session ID cannot be empty")
+	}
+	messages, err := a.service.GetArchivedMessages(sessionID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get archived messages: %w", err)
+	}
+	data, err := json.Marshal(messages)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal messages: %w", err)
+	}
+	return string(data), nil
+}
+
 // GetSessionChildren 获取子会话
 func (a *App) GetSessionChildren(sessionID string) (string, error) {
 	if sessionID == "" {
-		return "", fmt.Errorf("session ID cannot be empty")
+		return "", invalidArgument("session ID cannot be empty")
 	}
 	children, err := a.service.GetSessionChildren(sessionID)
 	if err != nil {
@@ -269,7 +397,7 @@ func (a *App) GetSessionChildren(sessionID string) (string, error) {
 // GetSessionTodo 获取待办事项
 func (a *App) GetSessionTodo(sessionID string) (string, error) {
 	if sessionID == "" {
-		return "", fmt.Errorf("session ID cannot be empty")
+		return "", invalidArgument("session ID cannot be empty")
 	}
 	todos, err := a.service.GetSessionTodo(sessionID)
 	if err != nil {
@@ -282,10 +410,39 @@ func (a *App) GetSessionTodo(sessionID string) (string, error) {
 	return string(data), nil
 }
 
+// GetSessionToolStats 获取会话中各工具的调用次数和总耗时
+func (a *App) GetSessionToolStats(sessionID string) (string, error) {
+	if sessionID == "" {
+		return "", invalidArgument("session ID cannot be empty")
+	}
+	stats, err := a.service.GetSessionToolStats(sessionID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get session tool stats: %w", err)
+	}
+	data, err := json.Marshal(stats)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal tool stats: %w", err)
+	}
+	return string(data), nil
+}
+
+// GetAllTodos 获取所有会话的待办事项，按会话分组；默认不含已完成项
+func (a *App) GetAllTodos(includeCompleted bool) (string, error) {
+	todos, err := a.service.GetAllTodos(includeCompleted)
+	if err != nil {
+		return "", fmt.Errorf("failed to get todos: %w", err)
+	}
+	data, err := json.Marshal(todos)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal todos: %w", err)
+	}
+	return string(data), nil
+}
+
 // GetSessionDiff 获取会话差异
 func (a *App) GetSessionDiff(sessionID string, messageID string) (string, error) {
 	if sessionID == "" {
-		return "", fmt.Errorf("session ID cannot be empty")
+		return "", invalidArgument("session ID cannot be empty")
 	}
 	diff, err := a.service.GetSessionDiff(sessionID, messageID)
 	if err != nil {
@@ -314,10 +471,10 @@ func (a *App) CreateSession(title string, parentID string) (string, error) {
 	return string(data), nil
 }
 
-// DeleteSession 删除会话
+// DeleteSession 删除会话（移入回收站）
 func (a *App) DeleteSession(sessionID string) (string, error) {
 	if sessionID == "" {
-		return "", fmt.Errorf("session ID cannot be empty")
+		return "", invalidArgument("session ID cannot be empty")
 	}
 	err := a.service.DeleteSession(sessionID)
 	if err != nil {
@@ -326,13 +483,51 @@ func (a *App) DeleteSession(sessionID string) (string, error) {
 	return `{"success": true}`, nil
 }
 
+// GetTrash 获取回收站中的会话
+func (a *App) GetTrash() (string, error) {
+	trash, err := a.service.GetTrash()
+	if err != nil {
+		return "", fmt.Errorf("failed to get trash: %w", err)
+	}
+	data, err := json.Marshal(trash)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal trash: %w", err)
+	}
+	return string(data), nil
+}
+
+// RestoreSession 从回收站恢复会话
+func (a *App) RestoreSession(sessionID string) (string, error) {
+	if sessionID == "" {
+		return "", invalidArgument("session ID cannot be empty")
+	}
+	session, err := a.service.RestoreSession(sessionID)
+	if err != nil {
+		return "", fmt.Errorf("failed to restore session: %w", err)
+	}
+	data, err := json.Marshal(session)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal session: %w", err)
+	}
+	return string(data), nil
+}
+
+// PurgeTrash 清空回收站
+func (a *App) PurgeTrash() (string, error) {
+	purged, err := a.service.PurgeTrash()
+	if err != nil {
+		return "", fmt.Errorf("failed to purge trash: %w", err)
+	}
+	return fmt.Sprintf(`{"purged": %d}`, purged), nil
+}
+
 // UpdateSession 更新会话
 func (a *App) UpdateSession(sessionID string, title string) (string, error) {
 	if sessionID == "" {
-		return "", fmt.Errorf("session ID cannot be empty")
+		return "", invalidArgument("session ID cannot be empty")
 	}
 	if title == "" {
-		return "", fmt.Errorf("title cannot be empty")
+		return "", invalidArgument("title cannot be empty")
 	}
 	session, err := a.service.UpdateSession(sessionID, title)
 	if err != nil {
@@ -345,17 +540,73 @@ func (a *App) UpdateSession(sessionID string, title string) (string, error) {
 	return string(data), nil
 }
 
+// SetSessionDeterministic 开启或关闭会话的可复现模式（temperature 0、固定 seed）
+func (a *App) SetSessionDeterministic(sessionID string, enabled bool) (string, error) {
+	if sessionID == "" {
+		return "", invalidArgument("session ID cannot be empty")
+	}
+	session, err := a.service.SetSessionDeterministic(sessionID, enabled)
+	if err != nil {
+		return "", fmt.Errorf("failed to update session: %w", err)
+	}
+	data, err := json.Marshal(session)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal session: %w", err)
+	}
+	return string(data), nil
+}
+
+// SetSessionGenerationParams 设置会话的生成参数（temperature、topP、maxTokens），
+// 优先级：会话 > 服务 > 内置默认值；传入空对象清除会话设置
+func (a *App) SetSessionGenerationParams(sessionID string, paramsData string) (string, error) {
+	if sessionID == "" {
+		return "", invalidArgument("session ID cannot be empty")
+	}
+	var params GenerationParams
+	if err := json.Unmarshal([]byte(paramsData), &params); err != nil {
+		return "", invalidArgument(fmt.Sprintf("invalid JSON in generation params: %v", err))
+	}
+	session, err := a.service.SetSessionGenerationParams(sessionID, params)
+	if err != nil {
+		return "", fmt.Errorf("failed to update session: %w", err)
+	}
+	data, err := json.Marshal(session)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal session: %w", err)
+	}
+	return string(data), nil
+}
+
 // SendMessage 发送消息到会话
 func (a *App) SendMessage(sessionID string, message string, model string, agent string) (string, error) {
 	if sessionID == "" {
-		return "", fmt.Errorf("session ID cannot be empty")
+		return "", invalidArgument("session ID cannot be empty")
 	}
 	if message == "" {
-		return "", fmt.Errorf("message cannot be empty")
+		return "", invalidArgument("message cannot be empty")
 	}
 	response, err := a.service.SendMessage(sessionID, message, model, agent)
 	if err != nil {
-		return "", fmt.Errorf("failed to send message: %w", err)
+		return "", withErrorDetails(fmt.Errorf("failed to send message: %w", err), map[string]interface{}{"sessionId": sessionID, "model": model})
+	}
+	data, err := json.Marshal(response)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal response: %w", err)
+	}
+	return string(data), nil
+}
+
+// SendMessageWithAttachments 发送带图片附件的消息，附件为 data URL 或工作区路径
+func (a *App) SendMessageWithAttachments(sessionID string, message string, model string, agent string, attachments []string) (string, error) {
+	if sessionID == "" {
+		return "", invalidArgument("session ID cannot be empty")
+	}
+	if message == "" && len(attachments) == 0 {
+		return "", invalidArgument("message cannot be empty")
+	}
+	response, err := a.service.SendMessageWithAttachments(sessionID, message, model, agent, attachments)
+	if err != nil {
+		return "", withErrorDetails(fmt.Errorf("failed to send message: %w", err), map[string]interface{}{"sessionId": sessionID, "model": model})
 	}
 	data, err := json.Marshal(response)
 	if err != nil {
@@ -364,13 +615,47 @@ func (a *App) SendMessage(sessionID string, message string, model string, agent
 	return string(data), nil
 }
 
+// AttachFileToMessage 将工作区文件附加到会话的下一条消息
+func (a *App) AttachFileToMessage(sessionID string, path string) (string, error) {
+	if sessionID == "" {
+		return "", invalidArgument("session ID cannot be empty")
+	}
+	if path == "" {
+		return "", invalidArgument("path cannot be empty")
+	}
+	attachment, err := a.service.AttachFileToMessage(sessionID, path)
+	if err != nil {
+		return "", withErrorDetails(fmt.Errorf("failed to attach file: %w", err), map[string]interface{}{"sessionId": sessionID, "path": path})
+	}
+	data, err := json.Marshal(attachment)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal attachment: %w", err)
+	}
+	return string(data), nil
+}
+
+// GetPendingAttachments 获取会话下一条消息的附件
+func (a *App) GetPendingAttachments(sessionID string) (string, error) {
+	data, err := json.Marshal(a.service.GetPendingAttachments(sessionID))
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal attachments: %w", err)
+	}
+	return string(data), nil
+}
+
+// RemoveFileAttachment 移除会话下一条消息的附件
+func (a *App) RemoveFileAttachment(sessionID string, path string) error {
+	a.service.RemoveFileAttachment(sessionID, path)
+	return nil
+}
+
 // SendMessageAsync 异步发送消息
 func (a *App) SendMessageAsync(sessionID string, message string, model string, agent string) (string, error) {
 	if sessionID == "" {
-		return "", fmt.Errorf("session ID cannot be empty")
+		return "", invalidArgument("session ID cannot be empty")
 	}
 	if message == "" {
-		return "", fmt.Errorf("message cannot be empty")
+		return "", invalidArgument("message cannot be empty")
 	}
 
 	// Use the service's async method
@@ -382,10 +667,96 @@ func (a *App) SendMessageAsync(sessionID string, message string, model string, a
 	return fmt.Sprintf(`{"processingId": "%s", "status": "processing"}`, processingID), nil
 }
 
+// RegenerateWithModel 使用指定模型重新生成最后一条回复，原回复保留为变体
+func (a *App) RegenerateWithModel(sessionID string, model string) (string, error) {
+	if sessionID == "" {
+		return "", invalidArgument("session ID cannot be empty")
+	}
+	if model == "" {
+		return "", invalidArgument("model cannot be empty")
+	}
+	response, err := a.service.RegenerateWithModel(sessionID, model)
+	if err != nil {
+		return "", withErrorDetails(fmt.Errorf("failed to regenerate reply: %w", err), map[string]interface{}{"sessionId": sessionID, "model": model})
+	}
+	data, err := json.Marshal(response)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal response: %w", err)
+	}
+	return string(data), nil
+}
+
+// SelectVariant 选择回复的某个变体作为后续上下文
+func (a *App) SelectVariant(sessionID string, messageID string, variantIndex int) (string, error) {
+	if sessionID == "" {
+		return "", invalidArgument("session ID cannot be empty")
+	}
+	if messageID == "" {
+		return "", invalidArgument("message ID cannot be empty")
+	}
+	message, err := a.service.SelectVariant(sessionID, messageID, variantIndex)
+	if err != nil {
+		return "", fmt.Errorf("failed to select variant: %w", err)
+	}
+	data, err := json.Marshal(message)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal message: %w", err)
+	}
+	return string(data), nil
+}
+
+// ContinueSession 让中断的代理运行继续执行
+func (a *App) ContinueSession(sessionID string) (string, error) {
+	if sessionID == "" {
+		return "", invalidArgument("session ID cannot be empty")
+	}
+	response, err := a.service.ContinueSession(sessionID)
+	if err != nil {
+		return "", fmt.Errorf("failed to continue session: %w", err)
+	}
+	data, err := json.Marshal(response)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal response: %w", err)
+	}
+	return string(data), nil
+}
+
+// EstimateRequest 估算发送消息时的请求大小（不发起请求）
+func (a *App) EstimateRequest(sessionID string, message string, model string) (string, error) {
+	if sessionID == "" {
+		return "", invalidArgument("session ID cannot be empty")
+	}
+	estimate, err := a.service.EstimateRequest(sessionID, message, model)
+	if err != nil {
+		return "", fmt.Errorf("failed to estimate request: %w", err)
+	}
+	data, err := json.Marshal(estimate)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal estimate: %w", err)
+	}
+	return string(data), nil
+}
+
+// GetAsyncResult 获取异步消息的处理结果
+func (a *App) GetAsyncResult(processingID string) (string, error) {
+	if processingID == "" {
+		return "", invalidArgument("processing ID cannot be empty")
+	}
+	result, err := a.service.GetAsyncResult(processingID)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal result: %w", err)
+	}
+	return string(data), nil
+}
+
 // AbortSession 中断会话
 func (a *App) AbortSession(sessionID string) (string, error) {
 	if sessionID == "" {
-		return "", fmt.Errorf("session ID cannot be empty")
+		return "", invalidArgument("session ID cannot be empty")
 	}
 
 	// Call service cancellation
@@ -397,18 +768,18 @@ func (a *App) AbortSession(sessionID string) (string, error) {
 // SummarizeSession 总结会话
 func (a *App) SummarizeSession(sessionID string, providerID string, modelID string) (string, error) {
 	if sessionID == "" {
-		return "", fmt.Errorf("session ID cannot be empty")
+		return "", invalidArgument("session ID cannot be empty")
 	}
 	if providerID == "" {
-		return "", fmt.Errorf("provider ID cannot be empty")
+		return "", invalidArgument("provider ID cannot be empty")
 	}
 	if modelID == "" {
-		return "", fmt.Errorf("model ID cannot be empty")
+		return "", invalidArgument("model ID cannot be empty")
 	}
 
 	summary, err := a.service.SummarizeSession(sessionID, providerID, modelID)
 	if err != nil {
-		return "", fmt.Errorf("failed to summarize session: %w", err)
+		return "", withErrorDetails(fmt.Errorf("failed to summarize session: %w", err), map[string]interface{}{"sessionId": sessionID, "provider": providerID, "model": modelID})
 	}
 	data, err := json.Marshal(summary)
 	if err != nil {
@@ -433,7 +804,7 @@ func (a *App) GetFiles(path string) (string, error) {
 // FindFilesByName 按名称查找文件
 func (a *App) FindFilesByName(query string, fileType string, limit int) (string, error) {
 	if query == "" {
-		return "", fmt.Errorf("query cannot be empty")
+		return "", invalidArgument("query cannot be empty")
 	}
 	if limit < 0 {
 		return "", fmt.Errorf("limit must be non-negative")
@@ -452,9 +823,11 @@ func (a *App) FindFilesByName(query string, fileType string, limit int) (string,
 // FindText 搜索文本
 func (a *App) FindText(pattern string) (string, error) {
 	if pattern == "" {
-		return "", fmt.Errorf("pattern cannot be empty")
+		return "", invalidArgument("pattern cannot be empty")
 	}
-	results, err := a.service.FindText(pattern)
+	ctx, done := a.service.beginSearch()
+	defer done()
+	results, err := a.service.FindTextContext(ctx, pattern, false)
 	if err != nil {
 		return "", fmt.Errorf("failed to find text: %w", err)
 	}
@@ -468,9 +841,11 @@ func (a *App) FindText(pattern string) (string, error) {
 // FindSymbol 查找符号
 func (a *App) FindSymbol(query string) (string, error) {
 	if query == "" {
-		return "", fmt.Errorf("query cannot be empty")
+		return "", invalidArgument("query cannot be empty")
 	}
-	results, err := a.service.FindSymbol(query)
+	ctx, done := a.service.beginSearch()
+	defer done()
+	results, err := a.service.FindSymbolContext(ctx, query)
 	if err != nil {
 		return "", fmt.Errorf("failed to find symbol: %w", err)
 	}
@@ -481,6 +856,11 @@ func (a *App) FindSymbol(query string) (string, error) {
 	return string(data), nil
 }
 
+// CancelSearch 取消正在进行的文本/符号搜索
+func (a *App) CancelSearch() {
+	a.service.CancelSearch()
+}
+
 // GetFileStatus 获取文件状态
 func (a *App) GetFileStatus() (string, error) {
 	status, err := a.service.GetFileStatus()
@@ -497,7 +877,7 @@ func (a *App) GetFileStatus() (string, error) {
 // GetFileContent 获取文件内容
 func (a *App) GetFileContent(path string) (string, error) {
 	if path == "" {
-		return "", fmt.Errorf("path cannot be empty")
+		return "", invalidArgument("path cannot be empty")
 	}
 	content, err := a.service.GetFileContent(path)
 	if err != nil {
@@ -510,28 +890,67 @@ func (a *App) GetFileContent(path string) (string, error) {
 	return string(data), nil
 }
 
+// GetFileContentRange 分段获取文件内容（用于大文件）
+func (a *App) GetFileContentRange(path string, offset int, length int) (string, error) {
+	if path == "" {
+		return "", invalidArgument("path cannot be empty")
+	}
+	content, err := a.service.GetFileContentRange(path, int64(offset), int64(length))
+	if err != nil {
+		return "", fmt.Errorf("failed to get file content range: %w", err)
+	}
+	data, err := json.Marshal(content)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal content: %w", err)
+	}
+	return string(data), nil
+}
+
 // SaveFileContent 保存文件内容
 func (a *App) SaveFileContent(path string, content string) error {
 	if path == "" {
-		return fmt.Errorf("path cannot be empty")
+		return invalidArgument("path cannot be empty")
 	}
 	if content == "" {
-		return fmt.Errorf("content cannot be empty")
+		return invalidArgument("content cannot be empty")
 	}
 
-	// Ensure directory exists
-	dir := filepath.Dir(path)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return fmt.Errorf("failed to create directory: %w", err)
+	return a.service.SaveFileContent(path, content)
+}
+
+// ListBackups 获取会话的文件备份列表
+func (a *App) ListBackups(sessionID string) (string, error) {
+	backups, err := a.service.ListBackups(sessionID)
+	if err != nil {
+		return "", fmt.Errorf("failed to list backups: %w", err)
 	}
+	data, err := json.Marshal(backups)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal backups: %w", err)
+	}
+	return string(data), nil
+}
 
-	return os.WriteFile(path, []byte(content), 0644)
+// RestoreBackup 恢复文件备份
+func (a *App) RestoreBackup(sessionID string, backupID string) (string, error) {
+	if backupID == "" {
+		return "", invalidArgument("backup ID cannot be empty")
+	}
+	backup, err := a.service.RestoreBackup(sessionID, backupID)
+	if err != nil {
+		return "", fmt.Errorf("failed to restore backup: %w", err)
+	}
+	data, err := json.Marshal(backup)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal backup: %w", err)
+	}
+	return string(data), nil
 }
 
 // RunCommand 执行系统命令
 func (a *App) RunCommand(command string) (string, error) {
 	if command == "" {
-		return "", fmt.Errorf("command cannot be empty")
+		return "", invalidArgument("command cannot be empty")
 	}
 	output, err := a.service.RunCommand(command)
 	if err != nil {
@@ -542,7 +961,7 @@ func (a *App) RunCommand(command string) (string, error) {
 
 func (a *App) RunCommandDetailed(command string) (string, error) {
 	if command == "" {
-		return "", fmt.Errorf("command cannot be empty")
+		return "", invalidArgument("command cannot be empty")
 	}
 
 	output, err := a.service.RunCommand(command)
@@ -563,13 +982,14 @@ func (a *App) RunCommandDetailed(command string) (string, error) {
 
 func (a *App) RunCommandDetailedWithCwd(command string, cwd string) (string, error) {
 	if command == "" {
-		return "", fmt.Errorf("command cannot be empty")
+		return "", invalidArgument("command cannot be empty")
 	}
 
 	runResult, err := a.service.RunCommandWithCwd(command, cwd)
 	result := map[string]interface{}{
 		"success":  err == nil,
 		"output":   runResult.Output,
+		"stderr":   runResult.Stderr,
 		"cwd":      runResult.Cwd,
 		"shell":    runResult.Shell,
 		"branch":   runResult.Branch,
@@ -586,6 +1006,65 @@ func (a *App) RunCommandDetailedWithCwd(command string, cwd string) (string, err
 	return string(data), nil
 }
 
+// StartBackgroundCommand 在后台启动命令，返回用于读取输出和停止命令的句柄
+func (a *App) StartBackgroundCommand(command string, cwd string) (string, error) {
+	if strings.TrimSpace(command) == "" {
+		return "", invalidArgument("command cannot be empty")
+	}
+	handle, err := a.service.StartBackgroundCommand(command, cwd)
+	if err != nil {
+		return "", fmt.Errorf("failed to start background command: %w", err)
+	}
+	data, err := json.Marshal(map[string]string{"handle": handle})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal background command: %w", err)
+	}
+	return string(data), nil
+}
+
+// GetBackgroundCommandOutput 获取后台命令自上次读取以来的新输出
+func (a *App) GetBackgroundCommandOutput(handle string) (string, error) {
+	if handle == "" {
+		return "", invalidArgument("handle cannot be empty")
+	}
+	out, err := a.service.GetBackgroundCommandOutput(handle)
+	if err != nil {
+		return "", fmt.Errorf("failed to get background command output: %w", err)
+	}
+	data, err := json.Marshal(out)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal background command output: %w", err)
+	}
+	return string(data), nil
+}
+
+// SendCommandInput 向后台命令的标准输入写入一行内容（不支持全屏交互程序）
+func (a *App) SendCommandInput(handle string, input string) error {
+	if handle == "" {
+		return invalidArgument("handle cannot be empty")
+	}
+	if err := a.service.SendCommandInput(handle, input); err != nil {
+		return fmt.Errorf("failed to send command input: %w", err)
+	}
+	return nil
+}
+
+// StopBackgroundCommand 停止后台命令及其启动的进程，返回剩余输出
+func (a *App) StopBackgroundCommand(handle string) (string, error) {
+	if handle == "" {
+		return "", invalidArgument("handle cannot be empty")
+	}
+	out, err := a.service.StopBackgroundCommand(handle)
+	if err != nil {
+		return "", fmt.Errorf("failed to stop background command: %w", err)
+	}
+	data, err := json.Marshal(out)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal background command output: %w", err)
+	}
+	return string(data), nil
+}
+
 // GetAgents 获取代理列表
 func (a *App) GetAgents() (string, error) {
 	agents, err := a.service.GetAgents()
@@ -599,6 +1078,22 @@ func (a *App) GetAgents() (string, error) {
 	return string(data), nil
 }
 
+// GetModelRouting 获取处理指定模型的服务及原因
+func (a *App) GetModelRouting(model string) (string, error) {
+	if model == "" {
+		return "", invalidArgument("model cannot be empty")
+	}
+	route, err := a.service.GetModelRouting(model)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve model: %w", err)
+	}
+	data, err := json.Marshal(route)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal model routing: %w", err)
+	}
+	return string(data), nil
+}
+
 // GetCommands 获取命令列表
 func (a *App) GetCommands() (string, error) {
 	commands, err := a.service.GetCommands()
@@ -612,6 +1107,19 @@ func (a *App) GetCommands() (string, error) {
 	return string(data), nil
 }
 
+// GetToolSpecs 获取代理可用的工具及其参数定义
+func (a *App) GetToolSpecs() (string, error) {
+	tools, err := a.service.GetToolSpecs()
+	if err != nil {
+		return "", fmt.Errorf("failed to get tool specs: %w", err)
+	}
+	data, err := json.Marshal(tools)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal tool specs: %w", err)
+	}
+	return string(data), nil
+}
+
 // SubmitPrompt 提交 TUI 提示
 func (a *App) SubmitPrompt() (string, error) {
 	// Simplified - return success for now
@@ -679,9 +1187,24 @@ func (a *App) SetWorkspaceDirectory(path string) error {
 	return a.service.SetWorkspaceDirectory(path)
 }
 
+// WatchDirectory 监听目录变更并通过 fs:change 事件通知前端
+func (a *App) WatchDirectory(path string) error {
+	if a.ctx == nil {
+		return fmt.Errorf("app context not initialized")
+	}
+	return a.service.WatchDirectory(path, func(events []FileChangeEvent) {
+		wailsruntime.EventsEmit(a.ctx, fileChangeEventName, events)
+	})
+}
+
+// StopWatch 停止目录监听
+func (a *App) StopWatch() error {
+	return a.service.StopWatch()
+}
+
 func (a *App) RevealInExplorer(path string) error {
 	if strings.TrimSpace(path) == "" {
-		return fmt.Errorf("path cannot be empty")
+		return invalidArgument("path cannot be empty")
 	}
 	if !filepath.IsAbs(path) {
 		wd, _ := os.Getwd()
@@ -704,7 +1227,7 @@ func (a *App) RevealInExplorer(path string) error {
 
 func (a *App) CreateFile(path string) error {
 	if strings.TrimSpace(path) == "" {
-		return fmt.Errorf("path cannot be empty")
+		return invalidArgument("path cannot be empty")
 	}
 	if !filepath.IsAbs(path) {
 		wd, _ := os.Getwd()
@@ -722,7 +1245,7 @@ func (a *App) CreateFile(path string) error {
 
 func (a *App) CreateFolder(path string) error {
 	if strings.TrimSpace(path) == "" {
-		return fmt.Errorf("path cannot be empty")
+		return invalidArgument("path cannot be empty")
 	}
 	if !filepath.IsAbs(path) {
 		wd, _ := os.Getwd()
@@ -736,7 +1259,7 @@ func (a *App) CreateFolder(path string) error {
 
 func (a *App) RenamePath(oldPath string, newPath string) error {
 	if strings.TrimSpace(oldPath) == "" || strings.TrimSpace(newPath) == "" {
-		return fmt.Errorf("paths cannot be empty")
+		return invalidArgument("paths cannot be empty")
 	}
 	if !filepath.IsAbs(oldPath) {
 		wd, _ := os.Getwd()
@@ -760,7 +1283,7 @@ func (a *App) RenamePath(oldPath string, newPath string) error {
 
 func (a *App) DeletePath(path string) error {
 	if strings.TrimSpace(path) == "" {
-		return fmt.Errorf("path cannot be empty")
+		return invalidArgument("path cannot be empty")
 	}
 	if !filepath.IsAbs(path) {
 		wd, _ := os.Getwd()
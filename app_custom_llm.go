@@ -21,7 +21,7 @@ func (a *App) GetCustomLLMServices() (string, error) {
 // AddCustomLLMService 添加新的自定义LLM服务
 func (a *App) AddCustomLLMService(configData string) (string, error) {
 	if configData == "" {
-		return "", fmt.Errorf("config data cannot be empty")
+		return "", invalidArgument("config data cannot be empty")
 	}
 	service, err := a.service.AddCustomLLMService(configData)
 	if err != nil {
@@ -37,14 +37,14 @@ func (a *App) AddCustomLLMService(configData string) (string, error) {
 // UpdateCustomLLMService 更新自定义LLM服务
 func (a *App) UpdateCustomLLMService(serviceID string, configData string) (string, error) {
 	if serviceID == "" {
-		return "", fmt.Errorf("service ID cannot be empty")
+		return "", invalidArgument("service ID cannot be empty")
 	}
 	if configData == "" {
-		return "", fmt.Errorf("config data cannot be empty")
+		return "", invalidArgument("config data cannot be empty")
 	}
 	service, err := a.service.UpdateCustomLLMService(serviceID, configData)
 	if err != nil {
-		return "", fmt.Errorf("failed to update custom LLM service: %w", err)
+		return "", withErrorDetails(fmt.Errorf("failed to update custom LLM service: %w", err), map[string]interface{}{"serviceId": serviceID})
 	}
 	data, err := json.Marshal(service)
 	if err != nil {
@@ -56,19 +56,51 @@ func (a *App) UpdateCustomLLMService(serviceID string, configData string) (strin
 // DeleteCustomLLMService 删除自定义LLM服务
 func (a *App) DeleteCustomLLMService(serviceID string) (string, error) {
 	if serviceID == "" {
-		return "", fmt.Errorf("service ID cannot be empty")
+		return "", invalidArgument("service ID cannot be empty")
 	}
 	err := a.service.DeleteCustomLLMService(serviceID)
 	if err != nil {
-		return "", fmt.Errorf("failed to delete custom LLM service: %w", err)
+		return "", withErrorDetails(fmt.Errorf("failed to delete custom LLM service: %w", err), map[string]interface{}{"serviceId": serviceID})
 	}
 	return `{"success": true}`, nil
 }
 
+// SetCustomLLMServiceEnabled 启用或停用自定义LLM服务
+func (a *App) SetCustomLLMServiceEnabled(serviceID string, enabled bool) (string, error) {
+	if serviceID == "" {
+		return "", invalidArgument("service ID cannot be empty")
+	}
+	service, err := a.service.SetCustomLLMServiceEnabled(serviceID, enabled)
+	if err != nil {
+		return "", withErrorDetails(fmt.Errorf("failed to update custom LLM service: %w", err), map[string]interface{}{"serviceId": serviceID})
+	}
+	data, err := json.Marshal(service)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal service: %w", err)
+	}
+	return string(data), nil
+}
+
+// ReorderCustomLLMServices 按给定的服务ID顺序重排自定义LLM服务
+func (a *App) ReorderCustomLLMServices(ids []string) (string, error) {
+	if len(ids) == 0 {
+		return "", invalidArgument("service IDs cannot be empty")
+	}
+	services, err := a.service.ReorderCustomLLMServices(ids)
+	if err != nil {
+		return "", fmt.Errorf("failed to reorder custom LLM services: %w", err)
+	}
+	data, err := json.Marshal(services)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal services: %w", err)
+	}
+	return string(data), nil
+}
+
 // TestCustomLLMService 测试自定义LLM服务
 func (a *App) TestCustomLLMService(configData string) (string, error) {
 	if configData == "" {
-		return "", fmt.Errorf("config data cannot be empty")
+		return "", invalidArgument("config data cannot be empty")
 	}
 	result, err := a.service.TestCustomLLMService(configData)
 	if err != nil {
@@ -84,17 +116,17 @@ func (a *App) TestCustomLLMService(configData string) (string, error) {
 // SendCustomLLMMessage 发送消息到自定义LLM服务
 func (a *App) SendCustomLLMMessage(sessionID string, message string, serviceID string) (string, error) {
 	if sessionID == "" {
-		return "", fmt.Errorf("session ID cannot be empty")
+		return "", invalidArgument("session ID cannot be empty")
 	}
 	if message == "" {
-		return "", fmt.Errorf("message cannot be empty")
+		return "", invalidArgument("message cannot be empty")
 	}
 	if serviceID == "" {
-		return "", fmt.Errorf("service ID cannot be empty")
+		return "", invalidArgument("service ID cannot be empty")
 	}
 	response, err := a.service.SendCustomLLMMessage(nil, sessionID, message, serviceID)
 	if err != nil {
-		return "", fmt.Errorf("failed to send message to custom LLM service: %w", err)
+		return "", withErrorDetails(fmt.Errorf("failed to send message to custom LLM service: %w", err), map[string]interface{}{"sessionId": sessionID, "serviceId": serviceID})
 	}
 	data, err := json.Marshal(response)
 	if err != nil {
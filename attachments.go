@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// defaultMaxAttachmentBytes caps the size of one image attachment before
+// encoding; the "maxAttachmentBytes" config overrides it.
+const defaultMaxAttachmentBytes = 5 * 1024 * 1024
+
+// maxAttachmentsPerMessage caps how many images one message may carry.
+const maxAttachmentsPerMessage = 10
+
+// imageAttachment is an image sent with a user message. Workspace files are
+// stored in the session by path and re-read when the history is replayed;
+// images given as data URLs are stored inline.
+type imageAttachment struct {
+	Path      string
+	MediaType string
+	Data      []byte
+}
+
+func (a imageAttachment) dataURL() string {
+	return "data:" + a.MediaType + ";base64," + base64.StdEncoding.EncodeToString(a.Data)
+}
+
+// part is the message part stored in the session for the attachment.
+func (a imageAttachment) part() map[string]interface{} {
+	part := map[string]interface{}{
+		"type":      "image",
+		"mediaType": a.MediaType,
+	}
+	if a.Path != "" {
+		part["path"] = a.Path
+	} else {
+		part["url"] = a.dataURL()
+	}
+	return part
+}
+
+// loadAttachments loads every attachment reference of a message.
+func (s *Service) loadAttachments(refs []string) ([]imageAttachment, error) {
+	if len(refs) > maxAttachmentsPerMessage {
+		return nil, fmt.Errorf("%w: at most %d attachments per message", ErrInvalidArgument, maxAttachmentsPerMessage)
+	}
+	var images []imageAttachment
+	for _, ref := range refs {
+		if strings.TrimSpace(ref) == "" {
+			continue
+		}
+		image, err := s.loadAttachment(ref)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+// loadAttachment reads an image given as a data URL or a workspace path.
+func (s *Service) loadAttachment(ref string) (imageAttachment, error) {
+	limit := s.configInt("maxAttachmentBytes", defaultMaxAttachmentBytes)
+	ref = strings.TrimSpace(ref)
+
+	if strings.HasPrefix(ref, "data:") {
+		header, payload, ok := strings.Cut(strings.TrimPrefix(ref, "data:"), ",")
+		if !ok || !strings.HasSuffix(header, ";base64") {
+			return imageAttachment{}, fmt.Errorf("%w: attachment must be a base64 data URL", ErrInvalidArgument)
+		}
+		if base64.StdEncoding.DecodedLen(len(payload)) > limit+2 {
+			return imageAttachment{}, fmt.Errorf("%w: attachment exceeds %d bytes", ErrInvalidArgument, limit)
+		}
+		data, err := base64.StdEncoding.DecodeString(payload)
+		if err != nil {
+			return imageAttachment{}, fmt.Errorf("%w: invalid attachment data: %v", ErrInvalidArgument, err)
+		}
+		return newImageAttachment("", strings.TrimSuffix(header, ";base64"), data, limit)
+	}
+
+	resolved, err := s.workspaceFilePath(ref)
+	if err != nil {
+		return imageAttachment{}, fmt.Errorf("%w: %v", ErrInvalidArgument, err)
+	}
+	f, err := os.Open(resolved)
+	if err != nil {
+		return imageAttachment{}, fmt.Errorf("failed to open attachment: %w", err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, int64(limit)+1))
+	if err != nil {
+		return imageAttachment{}, fmt.Errorf("failed to read attachment: %w", err)
+	}
+	return newImageAttachment(ref, "", data, limit)
+}
+
+// newImageAttachment checks the size and that the data is an image. An
+// empty mediaType is sniffed from the data.
+func newImageAttachment(path, mediaType string, data []byte, limit int) (imageAttachment, error) {
+	if len(data) > limit {
+		return imageAttachment{}, fmt.Errorf("%w: attachment exceeds %d bytes", ErrInvalidArgument, limit)
+	}
+	if mediaType == "" {
+		mediaType = http.DetectContentType(data)
+	}
+	if !strings.HasPrefix(mediaType, "image/") {
+		return imageAttachment{}, fmt.Errorf("%w: attachment is %s, not an image", ErrInvalidArgument, mediaType)
+	}
+	return imageAttachment{Path: path, MediaType: mediaType, Data: data}, nil
+}
+
+// historyAttachments reloads the images stored in a message's parts. Images
+// that can no longer be read are skipped with a warning.
+func (s *Service) historyAttachments(parts []map[string]interface{}) []imageAttachment {
+	var images []imageAttachment
+	for _, part := range parts {
+		ref, _ := part["path"].(string)
+		if ref == "" {
+			ref, _ = part["url"].(string)
+		}
+		if ref == "" {
+			continue
+		}
+		image, err := s.loadAttachment(ref)
+		if err != nil {
+			fmt.Printf("Warning: Skipping attachment from history: %v\n", err)
+			continue
+		}
+		images = append(images, image)
+	}
+	return images
+}
+
+// withImageContent returns messages ready to send: a message carrying
+// "images" gets its content turned into the provider's multi-part form,
+// Anthropic image blocks or OpenAI image_url parts.
+func withImageContent(messages []map[string]interface{}, anthropic bool) []map[string]interface{} {
+	out := make([]map[string]interface{}, len(messages))
+	for i, msg := range messages {
+		images, _ := msg["images"].([]imageAttachment)
+		if _, has := msg["images"]; !has {
+			out[i] = msg
+			continue
+		}
+		converted := make(map[string]interface{}, len(msg))
+		for k, v := range msg {
+			if k != "images" {
+				converted[k] = v
+			}
+		}
+		text, _ := msg["content"].(string)
+		content := []map[string]interface{}{{"type": "text", "text": text}}
+		for _, image := range images {
+			if anthropic {
+				content = append(content, map[string]interface{}{
+					"type": "image",
+					"source": map[string]interface{}{
+						"type":       "base64",
+						"media_type": image.MediaType,
+						"data":       base64.StdEncoding.EncodeToString(image.Data),
+					},
+				})
+			} else {
+				content = append(content, map[string]interface{}{
+					"type":      "image_url",
+					"image_url": map[string]interface{}{"url": image.dataURL()},
+				})
+			}
+		}
+		converted["content"] = content
+		out[i] = converted
+	}
+	return out
+}
+
+// redactImageData returns requestJSON with the base64 image payloads
+// replaced by a placeholder giving their size. Requests are kept in the
+// session and in error messages, where every earlier image would otherwise
+// be stored again on each turn.
+func redactImageData(requestJSON []byte) string {
+	if !bytes.Contains(requestJSON, []byte("base64")) {
+		return string(requestJSON)
+	}
+	var request interface{}
+	if err := json.Unmarshal(requestJSON, &request); err != nil {
+		return string(requestJSON)
+	}
+	redactImageValues(request)
+	data, err := json.MarshalIndent(request, "", "  ")
+	if err != nil {
+		return string(requestJSON)
+	}
+	return string(data)
+}
+
+// redactImageValues replaces data URLs and Anthropic base64 sources in v.
+func redactImageValues(v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if v["type"] == "base64" {
+			if data, ok := v["data"].(string); ok {
+				v["data"] = fmt.Sprintf("[%d bytes of base64 image data omitted]", len(data))
+			}
+		}
+		if url, ok := v["url"].(string); ok && strings.HasPrefix(url, "data:") {
+			if i := strings.Index(url, ";base64,"); i >= 0 {
+				v["url"] = fmt.Sprintf("%s;base64,[%d bytes omitted]", url[:i], len(url)-i-len(";base64,"))
+			}
+		}
+		for _, child := range v {
+			redactImageValues(child)
+		}
+	case []interface{}:
+		for _, child := range v {
+			redactImageValues(child)
+		}
+	}
+}
+
+// userMessageParts returns the stored parts of a user message: its text
+// followed by one part per image and attached file.
+func userMessageParts(message string, attached messageAttachments) []map[string]interface{} {
+	parts := []map[string]interface{}{{"type": "text", "text": message}}
+	for _, image := range attached.images {
+		parts = append(parts, image.part())
+	}
+	for _, f := range attached.files {
+		parts = append(parts, f.part)
+	}
+	return parts
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// maxBackgroundCommands bounds how many background commands may run at
+	// once.
+	maxBackgroundCommands = 8
+	// maxBackgroundOutputBytes is how much output of a background command
+	// is kept; once it writes more, the oldest output is dropped.
+	maxBackgroundOutputBytes = 1 << 20
+	// backgroundStopGrace is how long a stopped command gets to exit before
+	// it is killed.
+	backgroundStopGrace = 3 * time.Second
+	// backgroundStartupWait is how long run_command waits for the first
+	// output of a background command before returning.
+	backgroundStartupWait = 2 * time.Second
+	// backgroundToolOutputBytes is how much new output a tool result shows;
+	// the end is kept.
+	backgroundToolOutputBytes = 20000
+	// maxCommandInputBytes bounds the input of one SendCommandInput call.
+	maxCommandInputBytes = 4096
+	// commandInputTimeout bounds how long SendCommandInput waits for a
+	// command that is not reading its input.
+	commandInputTimeout = 5 * time.Second
+	// backgroundExitedRetention is how long an exited command with unread
+	// output is kept for GetBackgroundCommandOutput.
+	backgroundExitedRetention = 10 * time.Minute
+)
+
+// backgroundCommand is a command started with StartBackgroundCommand. Its
+// output is kept in memory and handed out incrementally.
+type backgroundCommand struct {
+	handle    string
+	command   string
+	cwd       string
+	startedAt time.Time
+	cmd       *exec.Cmd
+	stdin     io.WriteCloser
+	done      chan struct{} // closed once the process has exited
+
+	mu       sync.Mutex
+	output   []byte // the last maxBackgroundOutputBytes written
+	written  int64  // total bytes written
+	read     int64  // bytes written before the last read
+	exitCode int
+	exitedAt time.Time
+}
+
+func (b *backgroundCommand) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.output = append(b.output, p...)
+	if over := len(b.output) - maxBackgroundOutputBytes; over > 0 {
+		b.output = append([]byte(nil), b.output[over:]...)
+	}
+	b.written += int64(len(p))
+	return len(p), nil
+}
+
+// stale reports whether an exited command can be forgotten: its output has
+// all been read or it exited more than backgroundExitedRetention ago.
+func (b *backgroundCommand) stale(now time.Time) bool {
+	if b.running() {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.read == b.written || now.Sub(b.exitedAt) > backgroundExitedRetention
+}
+
+func (b *backgroundCommand) running() bool {
+	select {
+	case <-b.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// BackgroundCommandOutput is what a background command wrote since its
+// output was last read, and whether it is still running.
+type BackgroundCommandOutput struct {
+	Handle    string `json:"handle"`
+	Command   string `json:"command"`
+	Cwd       string `json:"cwd"`
+	StartedAt int64  `json:"startedAt"`
+	Output    string `json:"output"`
+	Dropped   int64  `json:"dropped,omitempty"` // unread bytes no longer kept
+	Running   bool   `json:"running"`
+	ExitCode  int    `json:"exitCode"` // set once Running is false
+}
+
+// next returns the output written since the last call.
+func (b *backgroundCommand) next() BackgroundCommandOutput {
+	running := b.running()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	kept := b.written - int64(len(b.output))
+	var dropped int64
+	start := b.read - kept
+	if start < 0 {
+		dropped = -start
+		start = 0
+	}
+	out := BackgroundCommandOutput{
+		Handle:    b.handle,
+		Command:   b.command,
+		Cwd:       b.cwd,
+		StartedAt: b.startedAt.UnixMilli(),
+		Output:    string(b.output[start:]),
+		Dropped:   dropped,
+		Running:   running,
+		ExitCode:  b.exitCode,
+	}
+	b.read = b.written
+	return out
+}
+
+// StartBackgroundCommand starts command in cwd (the workspace when empty)
+// without waiting for it, and returns a handle for
+// GetBackgroundCommandOutput, SendCommandInput and StopBackgroundCommand.
+// Its stdout and stderr are collected together. Background commands are
+// stopped when the service shuts down.
+func (s *Service) StartBackgroundCommand(command string, cwd string) (string, error) {
+	if strings.TrimSpace(command) == "" {
+		return "", fmt.Errorf("command parameter is required")
+	}
+
+	s.backgroundMux.Lock()
+	defer s.backgroundMux.Unlock()
+	if s.background == nil {
+		s.background = make(map[string]*backgroundCommand)
+	}
+	running := 0
+	now := time.Now()
+	for handle, b := range s.background {
+		if b.stale(now) {
+			delete(s.background, handle)
+		} else if b.running() {
+			running++
+		}
+	}
+	if running >= maxBackgroundCommands {
+		return "", fmt.Errorf("%d background commands are already running; stop one first", running)
+	}
+
+	dir := s.commandDir(cwd)
+	shell, args := s.commandShell(command, dir, "")
+	cmd := exec.Command(shell, args...)
+	hideCommandWindow(cmd)
+	startProcessGroup(cmd)
+	cmd.Dir = dir
+	// A process that left the group can keep the output pipe open after
+	// the command exits; don't let Wait, and so stop, hang on it.
+	cmd.WaitDelay = backgroundStopGrace
+
+	b := &backgroundCommand{
+		handle:    fmt.Sprintf("bg_%d", time.Now().UnixNano()),
+		command:   command,
+		cwd:       dir,
+		startedAt: time.Now(),
+		cmd:       cmd,
+		done:      make(chan struct{}),
+	}
+	cmd.Stdout = b
+	cmd.Stderr = b
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return "", fmt.Errorf("failed to open command input: %w", err)
+	}
+	b.stdin = stdin
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("failed to start command: %w", err)
+	}
+	go func() {
+		err := cmd.Wait()
+		b.mu.Lock()
+		b.exitedAt = time.Now()
+		if err != nil {
+			b.exitCode = 1
+			if ee, ok := err.(*exec.ExitError); ok {
+				b.exitCode = ee.ExitCode()
+			}
+		}
+		b.mu.Unlock()
+		close(b.done)
+	}()
+
+	s.background[b.handle] = b
+	return b.handle, nil
+}
+
+func (s *Service) backgroundCommand(handle string) (*backgroundCommand, error) {
+	s.backgroundMux.Lock()
+	defer s.backgroundMux.Unlock()
+	b, ok := s.background[handle]
+	if !ok {
+		return nil, fmt.Errorf("%w: no background command %s", ErrInvalidArgument, handle)
+	}
+	return b, nil
+}
+
+// GetBackgroundCommandOutput returns what the command wrote since the last
+// call. A command that has exited is forgotten once its last output has
+// been read, or backgroundExitedRetention after it exited.
+func (s *Service) GetBackgroundCommandOutput(handle string) (BackgroundCommandOutput, error) {
+	b, err := s.backgroundCommand(handle)
+	if err != nil {
+		return BackgroundCommandOutput{}, err
+	}
+	out := b.next()
+	if !out.Running {
+		s.backgroundMux.Lock()
+		delete(s.background, handle)
+		s.backgroundMux.Unlock()
+	}
+	return out, nil
+}
+
+// SendCommandInput writes input to the command's stdin, adding a newline
+// unless input ends with one, so a command waiting on a prompt such as a
+// y/n question can be answered. Input is limited to maxCommandInputBytes.
+// Commands still run without a terminal: full-screen programs and anything
+// reading the terminal directly, such as password prompts, are not
+// supported.
+func (s *Service) SendCommandInput(handle string, input string) error {
+	if len(input) > maxCommandInputBytes {
+		return fmt.Errorf("%w: input is %d bytes, over the limit of %d", ErrInvalidArgument, len(input), maxCommandInputBytes)
+	}
+	b, err := s.backgroundCommand(handle)
+	if err != nil {
+		return err
+	}
+	if !b.running() {
+		return fmt.Errorf("background command %s has exited", handle)
+	}
+	if !strings.HasSuffix(input, "\n") {
+		input += "\n"
+	}
+
+	// A command that does not read its input blocks the write once the
+	// pipe is full.
+	written := make(chan error, 1)
+	go func() {
+		_, err := io.WriteString(b.stdin, input)
+		written <- err
+	}()
+	select {
+	case err := <-written:
+		if err != nil {
+			return fmt.Errorf("failed to send input: %w", err)
+		}
+		return nil
+	case <-b.done:
+		return fmt.Errorf("background command %s exited before reading its input", handle)
+	case <-time.After(commandInputTimeout):
+		return fmt.Errorf("background command %s is not reading its input", handle)
+	}
+}
+
+// StopBackgroundCommand stops the command and everything it started, and
+// returns its remaining output. The command gets backgroundStopGrace to
+// exit before it is killed.
+func (s *Service) StopBackgroundCommand(handle string) (BackgroundCommandOutput, error) {
+	b, err := s.backgroundCommand(handle)
+	if err != nil {
+		return BackgroundCommandOutput{}, err
+	}
+	b.stop()
+	s.backgroundMux.Lock()
+	delete(s.background, handle)
+	s.backgroundMux.Unlock()
+	return b.next(), nil
+}
+
+func (b *backgroundCommand) stop() {
+	if !b.running() {
+		return
+	}
+	_ = b.stdin.Close()
+	interruptProcessGroup(b.cmd)
+	select {
+	case <-b.done:
+	case <-time.After(backgroundStopGrace):
+		killProcessGroup(b.cmd)
+		<-b.done
+	}
+}
+
+// writtenBytes returns how many bytes the command has written so far.
+func (b *backgroundCommand) writtenBytes() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.written
+}
+
+// waitForOutput waits until the command has written more than since bytes
+// or exited, for at most timeout.
+func (b *backgroundCommand) waitForOutput(ctx context.Context, since int64, timeout time.Duration) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		if b.writtenBytes() > since {
+			return
+		}
+		select {
+		case <-b.done:
+			return
+		case <-ctx.Done():
+			return
+		case <-deadline.C:
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// stopBackgroundCommands stops every background command, for shutdown,
+// waiting for at most timeout.
+func (s *Service) stopBackgroundCommands(timeout time.Duration) {
+	s.backgroundMux.Lock()
+	commands := make([]*backgroundCommand, 0, len(s.background))
+	for _, b := range s.background {
+		commands = append(commands, b)
+	}
+	s.background = nil
+	s.backgroundMux.Unlock()
+
+	var wg sync.WaitGroup
+	for _, b := range commands {
+		wg.Add(1)
+		go func(b *backgroundCommand) {
+			defer wg.Done()
+			b.stop()
+		}(b)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		fmt.Printf("Warning: Timed out after %s stopping %d background commands\n", timeout, len(commands))
+	}
+}
+
+// formatBackgroundOutput renders output for the model.
+func formatBackgroundOutput(out BackgroundCommandOutput) string {
+	var b strings.Builder
+	if out.Running {
+		fmt.Fprintf(&b, "Background command %s is running.\n", out.Handle)
+	} else {
+		fmt.Fprintf(&b, "Background command %s exited with code %d.\n", out.Handle, out.ExitCode)
+	}
+	if out.Dropped > 0 {
+		fmt.Fprintf(&b, "(%d bytes of earlier output were dropped)\n", out.Dropped)
+	}
+	output := out.Output
+	if len(output) > backgroundToolOutputBytes {
+		output = output[len(output)-backgroundToolOutputBytes:]
+		for len(output) > 0 && !utf8.RuneStart(output[0]) {
+			output = output[1:]
+		}
+		fmt.Fprintf(&b, "(showing the last %d bytes of %d)\n", len(output), len(out.Output))
+	}
+	if output == "" {
+		b.WriteString("No new output.")
+	} else {
+		b.WriteString("New output:\n" + output)
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
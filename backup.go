@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FileBackup describes a copy of a file taken before it was overwritten.
+type FileBackup struct {
+	ID           string `json:"id"`
+	SessionID    string `json:"sessionId"`
+	Name         string `json:"name"`
+	OriginalPath string `json:"originalPath"`
+	CreatedAt    int64  `json:"createdAt"`
+	Size         int64  `json:"size"`
+}
+
+const (
+	manualBackupSession = "manual"
+	backupMetaSuffix    = ".meta.json"
+)
+
+func (s *Service) getBackupsDir() string {
+	if s.backupsDir != "" {
+		return s.backupsDir
+	}
+	return filepath.Join(s.dataDir, "backups")
+}
+
+// backupSessionDir returns the backup directory for a session. Edits that are
+// not tied to a session are grouped under "manual".
+func (s *Service) backupSessionDir(sessionID string) (string, error) {
+	if sessionID == "" {
+		sessionID = manualBackupSession
+	}
+	if sessionID != filepath.Base(sessionID) || sessionID == "." || sessionID == ".." {
+		return "", fmt.Errorf("invalid session ID: %s", sessionID)
+	}
+	return filepath.Join(s.getBackupsDir(), sessionID), nil
+}
+
+// backupFile stores data (the current content of path) as
+// <backups>/<session>/<timestamp>-<name>, with a sidecar recording the
+// original location so it can be restored.
+func (s *Service) backupFile(sessionID string, path string, data []byte) error {
+	dir, err := s.backupSessionDir(sessionID)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create backup directory: %w", err)
+	}
+
+	now := time.Now()
+	id := now.Format("20060102-150405.000000") + "-" + filepath.Base(path)
+	if err := os.WriteFile(filepath.Join(dir, id), data, 0644); err != nil {
+		return fmt.Errorf("failed to write backup: %w", err)
+	}
+
+	meta := FileBackup{
+		ID:           id,
+		SessionID:    filepath.Base(dir),
+		Name:         filepath.Base(path),
+		OriginalPath: path,
+		CreatedAt:    now.UnixMilli(),
+		Size:         int64(len(data)),
+	}
+	metaJSON, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal backup metadata: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, id+backupMetaSuffix), metaJSON, 0644); err != nil {
+		return fmt.Errorf("failed to write backup metadata: %w", err)
+	}
+	return nil
+}
+
+// ListBackups returns the backups taken for a session, newest first.
+func (s *Service) ListBackups(sessionID string) ([]FileBackup, error) {
+	dir, err := s.backupSessionDir(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []FileBackup{}, nil
+		}
+		return nil, err
+	}
+
+	backups := []FileBackup{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), backupMetaSuffix) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		var meta FileBackup
+		if err := json.Unmarshal(data, &meta); err != nil {
+			continue
+		}
+		backups = append(backups, meta)
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].CreatedAt > backups[j].CreatedAt
+	})
+	return backups, nil
+}
+
+// RestoreBackup writes a backup back to its original path. The file being
+// replaced is itself backed up first when backups are enabled.
+func (s *Service) RestoreBackup(sessionID string, backupID string) (FileBackup, error) {
+	dir, err := s.backupSessionDir(sessionID)
+	if err != nil {
+		return FileBackup{}, err
+	}
+	if backupID == "" || backupID != filepath.Base(backupID) {
+		return FileBackup{}, fmt.Errorf("invalid backup ID: %s", backupID)
+	}
+
+	metaJSON, err := os.ReadFile(filepath.Join(dir, backupID+backupMetaSuffix))
+	if err != nil {
+		return FileBackup{}, fmt.Errorf("backup not found: %s", backupID)
+	}
+	var meta FileBackup
+	if err := json.Unmarshal(metaJSON, &meta); err != nil {
+		return FileBackup{}, fmt.Errorf("failed to parse backup metadata: %w", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, backupID))
+	if err != nil {
+		return FileBackup{}, fmt.Errorf("failed to read backup: %w", err)
+	}
+
+	if err := s.saveFileContent(sessionID, meta.OriginalPath, string(data), "asis"); err != nil {
+		return FileBackup{}, err
+	}
+	return meta, nil
+}
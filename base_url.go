@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Chat endpoints per API flavour, relative to the API version segment.
+const (
+	openAIChatPath    = "/chat/completions"
+	anthropicChatPath = "/messages"
+)
+
+// Endpoints used by legacy "providers" entries that set no base_url.
+const (
+	defaultOpenAIEndpoint    = "https://api.openai.com/v1/chat/completions"
+	defaultAnthropicEndpoint = "https://api.anthropic.com/v1/messages"
+)
+
+// apiVersionSegment matches a trailing version segment such as /v1 or
+// /v1beta, the usual end of a pasted base URL.
+var apiVersionSegment = regexp.MustCompile(`/v\d+[a-z0-9]*$`)
+
+// resolveEndpoint turns a base URL into the chat endpoint for provider.
+// Anthropic gets /v1/messages; every other kind speaks the OpenAI API and
+// gets /v1/chat/completions. A bare host or a URL ending in a version
+// segment is completed, trailing slashes are dropped and any other path is
+// kept as given. URLs that do not parse are returned unchanged, so the
+// request reports the problem.
+func resolveEndpoint(provider ProviderKind, baseURL string) string {
+	u, err := url.Parse(strings.TrimSpace(baseURL))
+	if err != nil || u.Host == "" {
+		return baseURL
+	}
+
+	chatPath := openAIChatPath
+	if provider.isAnthropic() {
+		chatPath = anthropicChatPath
+	}
+
+	u.Path = strings.TrimRight(u.Path, "/")
+	u.RawPath = ""
+	switch {
+	case strings.HasSuffix(u.Path, chatPath):
+	case chatPath == openAIChatPath && strings.HasSuffix(u.Path, "/chat"):
+		u.Path += "/completions"
+	case u.Path == "":
+		u.Path = "/v1" + chatPath
+	case apiVersionSegment.MatchString(u.Path):
+		u.Path += chatPath
+	}
+	return u.String()
+}
+
+// normalizeBaseURL checks that raw is an absolute http(s) URL and resolves
+// it to the provider's chat endpoint.
+func normalizeBaseURL(provider ProviderKind, raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", fmt.Errorf("%w: base URL is required", ErrInvalidArgument)
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("%w: base URL %q does not parse: %v", ErrInvalidArgument, raw, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("%w: base URL %q must start with http:// or https://", ErrInvalidArgument, raw)
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("%w: base URL %q has no host", ErrInvalidArgument, raw)
+	}
+	return resolveEndpoint(provider, raw), nil
+}
+
+// legacyProviderService builds a service from an entry of the legacy
+// "providers" config, which records no provider kind, so it is inferred.
+func legacyProviderService(id string, pData map[string]interface{}) CustomLLMService {
+	baseURL, _ := pData["base_url"].(string)
+	provider := inferProviderKind(id, baseURL)
+	if baseURL == "" {
+		switch provider {
+		case ProviderAnthropic:
+			baseURL = defaultAnthropicEndpoint
+		case ProviderOpenAI:
+			baseURL = defaultOpenAIEndpoint
+		}
+	}
+
+	apiKey, _ := pData["api_key"].(string)
+	name, _ := pData["name"].(string)
+	if name == "" {
+		name = id
+	}
+	model, _ := pData["model"].(string)
+
+	return CustomLLMService{
+		ID:           id,
+		Name:         name,
+		BaseURL:      resolveEndpoint(provider, baseURL),
+		APIKey:       apiKey,
+		DefaultModel: model,
+		AuthType:     "bearer",
+		Provider:     provider,
+		Enabled:      true,
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// Shell styles decide how a command is handed to the shell: the arguments
+// it is started with and how the final working directory is reported back.
+const (
+	shellStylePosix      = "posix"
+	shellStyleFish       = "fish"
+	shellStylePowerShell = "powershell"
+	shellStyleCmd        = "cmd"
+)
+
+var shellStyles = []string{shellStylePosix, shellStyleFish, shellStylePowerShell, shellStyleCmd}
+
+// commandShell returns the shell and arguments that run command in dir and
+// print the final working directory after marker: the shell from config
+// "shell" when it is usable, otherwise the detected one.
+func (s *Service) commandShell(command string, dir string, marker string) (string, []string) {
+	if shell, style, ok := s.configuredShell(); ok {
+		return shell, shellArgs(style, command, dir, marker)
+	}
+	return defaultCommandShell(command, dir, marker)
+}
+
+// configuredShell reads config "shell", {"path": "zsh", "style": "posix"}.
+// path is looked up on PATH; style defaults from the shell's name. An
+// unusable setting is reported and ok is false, so the default shell runs.
+func (s *Service) configuredShell() (path string, style string, ok bool) {
+	raw := s.configValue("shell")
+	if raw == nil {
+		return "", "", false
+	}
+	entry, _ := raw.(map[string]interface{})
+	name, _ := entry["path"].(string)
+	if strings.TrimSpace(name) == "" {
+		fmt.Printf("Warning: Config \"shell\" needs a path; using the default shell\n")
+		return "", "", false
+	}
+	path, err := exec.LookPath(strings.TrimSpace(name))
+	if err != nil {
+		fmt.Printf("Warning: Configured shell %q not found, using the default shell: %v\n", name, err)
+		return "", "", false
+	}
+	style, _ = entry["style"].(string)
+	style = strings.ToLower(strings.TrimSpace(style))
+	if style == "" {
+		style = shellStyleFor(path)
+	}
+	if !containsString(shellStyles, style) {
+		fmt.Printf("Warning: Configured shell style %q is not one of %s, using the default shell\n", style, strings.Join(shellStyles, ", "))
+		return "", "", false
+	}
+	return path, style, true
+}
+
+// defaultCommandShell picks pwsh, powershell or cmd on Windows and bash or
+// sh elsewhere.
+func defaultCommandShell(command string, dir string, marker string) (string, []string) {
+	if runtime.GOOS == "windows" {
+		if pwshPath, err := exec.LookPath("pwsh"); err == nil {
+			return pwshPath, shellArgs(shellStylePowerShell, command, dir, marker)
+		}
+		if psPath, err := exec.LookPath("powershell"); err == nil {
+			return psPath, shellArgs(shellStylePowerShell, command, dir, marker)
+		}
+		return "cmd", shellArgs(shellStyleCmd, command, dir, marker)
+	}
+	if bashPath, err := exec.LookPath("bash"); err == nil {
+		return bashPath, shellArgs(shellStylePosix, command, dir, marker)
+	}
+	return "sh", shellArgs(shellStylePosix, command, dir, marker)
+}
+
+// shellStyleFor guesses the style of a shell from its name.
+func shellStyleFor(shellPath string) string {
+	switch detectShellName(shellPath) {
+	case "pwsh", "powershell":
+		return shellStylePowerShell
+	case "cmd":
+		return shellStyleCmd
+	case "fish":
+		return shellStyleFish
+	default:
+		return shellStylePosix
+	}
+}
+
+// shellArgs returns the arguments for a shell of the given style that run
+// command in dir and print the final working directory after marker. An
+// empty marker runs command as it is.
+func shellArgs(style string, command string, dir string, marker string) []string {
+	wrap := func(wrapper func(string, string, string) string) string {
+		if marker == "" {
+			return command
+		}
+		return wrapper(command, dir, marker)
+	}
+	switch style {
+	case shellStylePowerShell:
+		return []string{"-NoProfile", "-NonInteractive", "-ExecutionPolicy", "Bypass", "-Command", wrap(wrapPowerShellCommand)}
+	case shellStyleCmd:
+		return []string{"/C", wrap(wrapCmdCommand)}
+	case shellStyleFish:
+		return []string{"-l", "-c", wrap(wrapFishCommand)}
+	default:
+		return []string{"-lc", wrap(wrapPosixShellCommand)}
+	}
+}
+
+func wrapFishCommand(userCommand string, cwd string, marker string) string {
+	return strings.Join([]string{
+		"cd " + fishSingleQuote(cwd) + " 2>/dev/null",
+		userCommand,
+		"set __openspaceExit $status",
+		"printf \"\\n" + marker + "%s\\n\" (pwd)",
+		"exit $__openspaceExit",
+	}, "\n")
+}
+
+// fishSingleQuote quotes value for fish, where only \\ and \' are escapes
+// inside single quotes.
+func fishSingleQuote(value string) string {
+	escaped := strings.ReplaceAll(value, `\`, `\\`)
+	return "'" + strings.ReplaceAll(escaped, "'", `\'`) + "'"
+}
+
+// runCapturingStderr runs cmd and returns its combined output, in the order
+// it was written, along with its stderr on its own.
+func runCapturingStderr(cmd *exec.Cmd) (combined []byte, stderr []byte, err error) {
+	var all lockedBuffer
+	var errOnly bytes.Buffer
+	cmd.Stdout = &all
+	cmd.Stderr = io.MultiWriter(&errOnly, &all)
+	err = cmd.Run()
+	return all.Bytes(), errOnly.Bytes(), err
+}
+
+// lockedBuffer is a bytes.Buffer that stdout and stderr can be copied into
+// concurrently.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Bytes()
+}
+
+// Commands run without a terminal and with stdin on the null device, so a
+// program waiting for input would either exit at once or sit there until the
+// timeout. run_command refuses the common ones up front instead.
+
+// interactivePrograms need a terminal whatever their arguments.
+var interactivePrograms = map[string]string{
+	"vi":     "editors are not supported; use read_file and save_file",
+	"vim":    "editors are not supported; use read_file and save_file",
+	"nvim":   "editors are not supported; use read_file and save_file",
+	"nano":   "editors are not supported; use read_file and save_file",
+	"emacs":  "editors are not supported; use read_file and save_file",
+	"pico":   "editors are not supported; use read_file and save_file",
+	"micro":  "editors are not supported; use read_file and save_file",
+	"top":    "use a one-shot command such as `ps aux` instead",
+	"htop":   "use a one-shot command such as `ps aux` instead",
+	"btop":   "use a one-shot command such as `ps aux` instead",
+	"watch":  "run the command once instead",
+	"tmux":   "terminal multiplexers are not supported",
+	"screen": "terminal multiplexers are not supported",
+}
+
+// replPrograms start an interactive prompt when run without arguments.
+var replPrograms = map[string]bool{
+	"python": true, "python3": true, "ipython": true, "node": true, "deno": true,
+	"irb": true, "ghci": true, "lua": true, "R": true, "scala": true,
+	"psql": true, "mysql": true, "sqlite3": true, "redis-cli": true, "mongosh": true,
+	"bash": true, "sh": true, "zsh": true, "fish": true, "pwsh": true, "powershell": true,
+}
+
+// commandSeparators split a command line into its simple commands.
+var commandSeparators = regexp.MustCompile(`&&|\|\||[;|&\n]`)
+
+// commandWrappers run the command that follows them.
+var commandWrappers = map[string]bool{"sudo": true, "env": true, "time": true, "nohup": true, "exec": true, "command": true}
+
+// interactiveCommandReason returns why command looks interactive, or "" when
+// it does not. Each command of a pipeline or list is checked.
+func interactiveCommandReason(command string) string {
+	for _, segment := range commandSeparators.Split(command, -1) {
+		fields := strings.Fields(segment)
+		for len(fields) > 0 && (commandWrappers[fields[0]] || isEnvAssignment(fields[0])) {
+			fields = fields[1:]
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		name := strings.TrimSuffix(filepath.Base(fields[0]), ".exe")
+		args := fields[1:]
+		if hint, ok := interactivePrograms[name]; ok {
+			return fmt.Sprintf("`%s` needs a terminal; %s", name, hint)
+		}
+		if replPrograms[name] && (len(args) == 0 || (strings.HasPrefix(name, "python") && hasFlag(args, "i", "--interactive"))) {
+			return fmt.Sprintf("`%s` without a script starts an interactive prompt; pass the code or a file to run", strings.Join(fields, " "))
+		}
+		if len(args) == 0 {
+			continue
+		}
+		switch name {
+		case "npm", "pnpm", "yarn", "bun":
+			if args[0] == "init" && !hasFlag(args[1:], "y", "--yes") {
+				return fmt.Sprintf("`%s init` asks questions; pass --yes", name)
+			}
+		case "git":
+			switch args[0] {
+			case "commit":
+				if !hasFlag(args[1:], "mFC", "--message", "--file", "--reuse-message", "--no-edit") {
+					return "`git commit` opens an editor for the message; pass it with -m"
+				}
+			case "rebase":
+				if hasFlag(args[1:], "i", "--interactive") {
+					return "`git rebase -i` needs an editor; run a non-interactive rebase instead"
+				}
+			case "add":
+				if hasFlag(args[1:], "ip", "--interactive", "--patch") {
+					return "`git add -i`/`-p` prompts for each change; add the files by path instead"
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// isEnvAssignment reports whether field is a NAME=value prefix.
+func isEnvAssignment(field string) bool {
+	i := strings.Index(field, "=")
+	return i > 0 && !strings.ContainsAny(field[:i], "/-.")
+}
+
+// hasFlag reports whether args contain one of the single-letter flags in
+// short, alone or in a cluster such as -am, or one of the long flags, alone
+// or as --flag=value.
+func hasFlag(args []string, short string, long ...string) bool {
+	for _, arg := range args {
+		if arg == "--" {
+			return false
+		}
+		if strings.HasPrefix(arg, "--") {
+			for _, l := range long {
+				if arg == l || strings.HasPrefix(arg, l+"=") {
+					return true
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(arg, "-") && len(arg) > 1 && strings.ContainsAny(arg[1:], short) {
+			return true
+		}
+	}
+	return false
+}
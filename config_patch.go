@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// configPathStep is one step of a config path: an object key or an array
+// index.
+type configPathStep struct {
+	key     string
+	index   int
+	isIndex bool
+}
+
+// configPathSegment matches one dotted segment: a key followed by any
+// number of [n] indexes.
+var configPathSegment = regexp.MustCompile(`^([^\[\]]*)((?:\[\d+\])*)$`)
+
+var configPathIndex = regexp.MustCompile(`\d+`)
+
+// parseConfigPath parses paths such as "cacheResponses",
+// "providers.openai.model" or "customServices[0].enabled".
+func parseConfigPath(path string) ([]configPathStep, error) {
+	if strings.TrimSpace(path) == "" {
+		return nil, fmt.Errorf("%w: empty config path", ErrInvalidArgument)
+	}
+	var steps []configPathStep
+	for _, segment := range strings.Split(path, ".") {
+		m := configPathSegment.FindStringSubmatch(segment)
+		if m == nil || (m[1] == "" && m[2] == "") || (m[1] == "" && len(steps) == 0) {
+			return nil, fmt.Errorf("%w: invalid config path %q", ErrInvalidArgument, path)
+		}
+		if m[1] != "" {
+			steps = append(steps, configPathStep{key: m[1]})
+		}
+		for _, idx := range configPathIndex.FindAllString(m[2], -1) {
+			n, err := strconv.Atoi(idx)
+			if err != nil {
+				return nil, fmt.Errorf("%w: invalid index in config path %q", ErrInvalidArgument, path)
+			}
+			steps = append(steps, configPathStep{index: n, isIndex: true})
+		}
+	}
+	return steps, nil
+}
+
+// setConfigPath sets (or, with remove, deletes) the value at steps below
+// container and returns the updated container. Missing objects are
+// created; an index equal to the array length appends.
+func setConfigPath(container interface{}, steps []configPathStep, value interface{}, remove bool, where string) (interface{}, error) {
+	step := steps[0]
+	last := len(steps) == 1
+
+	if !step.isIndex {
+		obj, ok := container.(map[string]interface{})
+		if container == nil {
+			obj, ok = map[string]interface{}{}, true
+		}
+		if !ok {
+			return nil, fmt.Errorf("%w: %s is not an object", ErrInvalidArgument, where)
+		}
+		path := strings.TrimPrefix(where+"."+step.key, ".")
+		if last {
+			if remove {
+				delete(obj, step.key)
+			} else {
+				obj[step.key] = value
+			}
+			return obj, nil
+		}
+		child, err := setConfigPath(obj[step.key], steps[1:], value, remove, path)
+		if err != nil {
+			return nil, err
+		}
+		obj[step.key] = child
+		return obj, nil
+	}
+
+	arr, ok := container.([]interface{})
+	if container == nil {
+		arr, ok = []interface{}{}, true
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: %s is not an array", ErrInvalidArgument, where)
+	}
+	path := fmt.Sprintf("%s[%d]", where, step.index)
+	if step.index > len(arr) || (step.index == len(arr) && remove) {
+		return nil, fmt.Errorf("%w: %s is out of range (length %d)", ErrInvalidArgument, path, len(arr))
+	}
+	if step.index == len(arr) {
+		arr = append(arr, nil)
+	}
+	if last {
+		if remove {
+			return append(arr[:step.index:step.index], arr[step.index+1:]...), nil
+		}
+		arr[step.index] = value
+		return arr, nil
+	}
+	child, err := setConfigPath(arr[step.index], steps[1:], value, remove, path)
+	if err != nil {
+		return nil, err
+	}
+	arr[step.index] = child
+	return arr, nil
+}
+
+// copyConfig returns a deep copy of config. Changes are made on a copy that
+// replaces s.config once saved, because readers may still hold the maps and
+// slices of the live config.
+func copyConfig(config map[string]interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy config: %w", err)
+	}
+	var copied map[string]interface{}
+	if err := json.Unmarshal(data, &copied); err != nil {
+		return nil, fmt.Errorf("failed to copy config: %w", err)
+	}
+	if copied == nil {
+		copied = map[string]interface{}{}
+	}
+	return copied, nil
+}
+
+// updateConfig applies change to a copy of the config, saves the copy and
+// makes it the live config. Nothing is saved when change fails.
+func (s *Service) updateConfig(change func(config map[string]interface{}) error) error {
+	s.configMux.Lock()
+	defer s.configMux.Unlock()
+	config, err := copyConfig(s.config)
+	if err != nil {
+		return err
+	}
+	if err := change(config); err != nil {
+		return err
+	}
+	if err := s.writeConfigLocked(config); err != nil {
+		return fmt.Errorf("failed to save config: %w", err)
+	}
+	s.config = config
+	return nil
+}
+
+// PatchConfig applies a partial update to the config. patchData is a JSON
+// object mapping paths such as "customServices[0].enabled" to new values;
+// null deletes the key or array element. The read-modify-write happens
+// under the config lock and the result is validated like UpdateConfig, so
+// either every change is saved or none is.
+func (s *Service) PatchConfig(patchData string) (map[string]interface{}, error) {
+	var patch map[string]interface{}
+	if err := json.Unmarshal([]byte(patchData), &patch); err != nil {
+		return nil, fmt.Errorf("%w: invalid JSON in config patch: %v", ErrInvalidArgument, err)
+	}
+	if len(patch) == 0 {
+		return nil, fmt.Errorf("%w: config patch is empty", ErrInvalidArgument)
+	}
+	paths := make([]string, 0, len(patch))
+	for path := range patch {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	s.configMux.Lock()
+	defer s.configMux.Unlock()
+
+	// Work on a copy so a failed patch leaves the live config untouched.
+	config, err := copyConfig(s.config)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range paths {
+		steps, err := parseConfigPath(path)
+		if err != nil {
+			return nil, err
+		}
+		value := patch[path]
+		updated, err := setConfigPath(config, steps, value, value == nil, "")
+		if err != nil {
+			return nil, err
+		}
+		config = updated.(map[string]interface{})
+	}
+
+	warnings, err := validateConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range warnings {
+		fmt.Printf("Warning: Config: %s\n", w)
+	}
+	if err := s.writeConfigLocked(config); err != nil {
+		return nil, err
+	}
+	s.config = config
+	return config, nil
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// JSON types used by the config schema.
+const (
+	jsonBool   = "boolean"
+	jsonNumber = "number"
+	jsonString = "string"
+	jsonArray  = "array"
+	jsonObject = "object"
+)
+
+// scalarConfigKeys are the known top-level settings. A value of the wrong
+// type is kept but reported as a warning; the code reading it falls back to
+// its default.
+var scalarConfigKeys = map[string]string{
+	"_version":              jsonNumber,
+	"allowMockProvider":     jsonBool,
+	"backupBeforeOverwrite": jsonBool,
+	"buildTimeoutSeconds":   jsonNumber,
+	"cacheResponses":        jsonBool,
+	"cacheNonDeterministic": jsonBool,
+	"cacheTTLSeconds":       jsonNumber,
+	"cacheMaxEntries":       jsonNumber,
+	"defaultModel":          jsonString,
+	"injectTodos":           jsonBool,
+	"lintTimeoutSeconds":    jsonNumber,
+	"maxAttachmentBytes":    jsonNumber,
+	"maxConcurrentRequests": jsonNumber,
+	"maxMessagesPerSession": jsonNumber,
+	"maxResponseBytes":      jsonNumber,
+	"orphanedChildPolicy":   jsonString,
+	"readFileMaxBytes":      jsonNumber,
+	"saveFileMaxBytes":      jsonNumber,
+	"shell":                 jsonObject,
+	"systemPromptStyle":     jsonString,
+	"testTimeoutSeconds":    jsonNumber,
+	"toolProgressEvents":    jsonBool,
+	"trashRetentionDays":    jsonNumber,
+}
+
+// customServiceFields are the typed fields of a customServices entry.
+var customServiceFields = map[string]string{
+	"id":                jsonString,
+	"name":              jsonString,
+	"baseUrl":           jsonString,
+	"apiKey":            jsonString,
+	"headers":           jsonObject,
+	"defaultModel":      jsonString,
+	"authType":          jsonString,
+	"provider":          jsonString,
+	"enabled":           jsonBool,
+	"contextLimit":      jsonNumber,
+	"toolCalling":       jsonString,
+	"modelCapabilities": jsonObject,
+	"keepAlive":         jsonString,
+	"temperature":       jsonNumber,
+	"topP":              jsonNumber,
+	"maxTokens":         jsonNumber,
+}
+
+// projectCommandFields are the typed fields of a testCommands, lintCommands
+// or buildCommands entry.
+var projectCommandFields = map[string]string{
+	"marker":  jsonString,
+	"command": jsonString,
+	"script":  jsonString,
+	"fix":     jsonString,
+}
+
+// providerFields are the typed fields of a legacy providers entry.
+var providerFields = map[string]string{
+	"name":     jsonString,
+	"model":    jsonString,
+	"api_key":  jsonString,
+	"base_url": jsonString,
+}
+
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case bool:
+		return jsonBool
+	case float64, int:
+		return jsonNumber
+	case string:
+		return jsonString
+	case []interface{}:
+		return jsonArray
+	case map[string]interface{}:
+		return jsonObject
+	case nil:
+		return "null"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+// configValidator collects the problems found in a config.
+type configValidator struct {
+	problems []string
+}
+
+func (v *configValidator) addf(format string, args ...interface{}) {
+	v.problems = append(v.problems, fmt.Sprintf(format, args...))
+}
+
+// fields checks the typed fields of an object.
+func (v *configValidator) fields(where string, obj map[string]interface{}, schema map[string]string) {
+	for key, want := range schema {
+		value, ok := obj[key]
+		if !ok {
+			continue
+		}
+		if got := jsonType(value); got != want {
+			v.addf("%s.%s: want %s, got %s", where, key, want, got)
+		}
+	}
+}
+
+// stringArray checks that value is an array of strings.
+func (v *configValidator) stringArray(where string, value interface{}) {
+	items, ok := value.([]interface{})
+	if !ok {
+		v.addf("%s: want array, got %s", where, jsonType(value))
+		return
+	}
+	for i, item := range items {
+		if _, ok := item.(string); !ok {
+			v.addf("%s[%d]: want string, got %s", where, i, jsonType(item))
+		}
+	}
+}
+
+// projectCommands checks a list of {marker, command|script} entries.
+func (v *configValidator) projectCommands(where string, value interface{}) {
+	entries, ok := value.([]interface{})
+	if !ok {
+		v.addf("%s: want array, got %s", where, jsonType(value))
+		return
+	}
+	for i, entry := range entries {
+		at := fmt.Sprintf("%s[%d]", where, i)
+		entryMap, ok := entry.(map[string]interface{})
+		if !ok {
+			v.addf("%s: want object, got %s", at, jsonType(entry))
+			continue
+		}
+		v.fields(at, entryMap, projectCommandFields)
+		if marker, _ := entryMap["marker"].(string); strings.TrimSpace(marker) == "" {
+			v.addf("%s.marker is required", at)
+		}
+		command, _ := entryMap["command"].(string)
+		script, _ := entryMap["script"].(string)
+		if strings.TrimSpace(command) == "" && strings.TrimSpace(script) == "" {
+			v.addf("%s needs a command or a script", at)
+		}
+	}
+}
+
+func (v *configValidator) customServices(value interface{}) {
+	services, ok := value.([]interface{})
+	if !ok {
+		v.addf("customServices: want array, got %s", jsonType(value))
+		return
+	}
+	seen := map[string]bool{}
+	for i, svc := range services {
+		where := fmt.Sprintf("customServices[%d]", i)
+		svcMap, ok := svc.(map[string]interface{})
+		if !ok {
+			v.addf("%s: want object, got %s", where, jsonType(svc))
+			continue
+		}
+		v.fields(where, svcMap, customServiceFields)
+		id, _ := svcMap["id"].(string)
+		switch {
+		case strings.TrimSpace(id) == "":
+			v.addf("%s.id is required", where)
+		case seen[id]:
+			v.addf("%s.id %q is used more than once", where, id)
+		}
+		seen[id] = true
+		if baseURL, _ := svcMap["baseUrl"].(string); strings.TrimSpace(baseURL) == "" {
+			v.addf("%s.baseUrl is required", where)
+		}
+		if provider, ok := svcMap["provider"].(string); ok && provider != "" {
+			if _, err := parseProviderKind(provider); err != nil {
+				v.addf("%s.provider %q is not one of openai, anthropic, gemini, ollama or custom", where, provider)
+			}
+		}
+		if models, ok := svcMap["models"]; ok {
+			v.stringArray(where+".models", models)
+		}
+	}
+}
+
+func (v *configValidator) providers(value interface{}) {
+	providers, ok := value.(map[string]interface{})
+	if !ok {
+		v.addf("providers: want object, got %s", jsonType(value))
+		return
+	}
+	for id, p := range providers {
+		where := "providers." + id
+		pData, ok := p.(map[string]interface{})
+		if !ok {
+			v.addf("%s: want object, got %s", where, jsonType(p))
+			continue
+		}
+		v.fields(where, pData, providerFields)
+	}
+}
+
+// validateConfig checks config against the known schema. Structural
+// problems in the sections the app depends on are returned as an
+// ErrInvalidArgument error listing each one; known settings of the wrong
+// type only produce warnings. Unknown keys are kept as they are.
+func validateConfig(config map[string]interface{}) ([]string, error) {
+	v := &configValidator{}
+	if value, ok := config["customServices"]; ok {
+		v.customServices(value)
+	}
+	if value, ok := config["providers"]; ok {
+		v.providers(value)
+	}
+	if value, ok := config["agents"]; ok {
+		if agents, ok := value.([]interface{}); !ok {
+			v.addf("agents: want array, got %s", jsonType(value))
+		} else {
+			for i, agent := range agents {
+				if _, ok := agent.(map[string]interface{}); !ok {
+					v.addf("agents[%d]: want object, got %s", i, jsonType(agent))
+				}
+			}
+		}
+	}
+	for _, key := range []string{"testCommands", "lintCommands", "buildCommands"} {
+		if value, ok := config[key]; ok {
+			v.projectCommands(key, value)
+		}
+	}
+	for _, key := range []string{"fallbacks", "servicePriority"} {
+		if value, ok := config[key]; ok {
+			v.stringArray(key, value)
+		}
+	}
+
+	var warnings []string
+	for key, want := range scalarConfigKeys {
+		if value, ok := config[key]; ok {
+			if got := jsonType(value); got != want {
+				warnings = append(warnings, fmt.Sprintf("%s: want %s, got %s; the default is used", key, want, got))
+			}
+		}
+	}
+
+	sort.Strings(warnings)
+	if len(v.problems) > 0 {
+		sort.Strings(v.problems)
+		return warnings, withErrorDetails(
+			fmt.Errorf("%w: invalid config: %s", ErrInvalidArgument, strings.Join(v.problems, "; ")),
+			map[string]interface{}{"problems": v.problems},
+		)
+	}
+	return warnings, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// customCommand is a prompt template loaded from .openspace/commands/*.md.
+// The file may start with a front-matter block setting name and description;
+// the rest is the template, where {{args}} is replaced by the text typed
+// after the command.
+type customCommand struct {
+	Name        string
+	Description string
+	Template    string
+	Path        string
+}
+
+// customCommandCache keeps the parsed command files until the directory or
+// one of its files changes.
+type customCommandCache struct {
+	mu        sync.Mutex
+	dir       string
+	signature string
+	commands  map[string]customCommand
+}
+
+func customCommandsDir(workspace string) string {
+	return filepath.Join(workspace, ".openspace", "commands")
+}
+
+// customCommandsSignature summarises the command files in dir so a change to
+// any of them can be detected without re-reading their content.
+func customCommandsSignature(dir string) (string, []string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", nil
+	}
+	var b strings.Builder
+	var files []string
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.EqualFold(filepath.Ext(entry.Name()), ".md") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, filepath.Join(dir, entry.Name()))
+		fmt.Fprintf(&b, "%s:%d:%d;", entry.Name(), info.Size(), info.ModTime().UnixNano())
+	}
+	return b.String(), files
+}
+
+// customCommands returns the workspace's custom commands keyed by name.
+func (s *Service) customCommands() map[string]customCommand {
+	dir := customCommandsDir(s.GetWorkspaceDirectory())
+	signature, files := customCommandsSignature(dir)
+
+	c := &s.customCmds
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.commands != nil && c.dir == dir && c.signature == signature {
+		return c.commands
+	}
+
+	commands := map[string]customCommand{}
+	for _, path := range files {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Printf("Warning: Failed to read command %s: %v\n", path, err)
+			continue
+		}
+		cmd := parseCustomCommand(path, string(data))
+		if cmd.Name == "" {
+			continue
+		}
+		commands[cmd.Name] = cmd
+	}
+	c.dir, c.signature, c.commands = dir, signature, commands
+	return commands
+}
+
+// parseCustomCommand reads a command file. The name defaults to the file
+// name without extension.
+func parseCustomCommand(path, content string) customCommand {
+	cmd := customCommand{
+		Name: strings.ToLower(strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))),
+		Path: path,
+	}
+
+	body := strings.ReplaceAll(content, "\r\n", "\n")
+	if strings.HasPrefix(body, "---\n") {
+		if end := strings.Index(body[4:], "\n---"); end >= 0 {
+			header := body[4 : 4+end]
+			body = strings.TrimPrefix(body[4+end+4:], "\n")
+			for _, line := range strings.Split(header, "\n") {
+				key, value, ok := strings.Cut(line, ":")
+				if !ok {
+					continue
+				}
+				value = strings.Trim(strings.TrimSpace(value), `"'`)
+				switch strings.ToLower(strings.TrimSpace(key)) {
+				case "name":
+					if value != "" {
+						cmd.Name = strings.ToLower(strings.TrimPrefix(value, "/"))
+					}
+				case "description":
+					cmd.Description = value
+				}
+			}
+		}
+	}
+	cmd.Template = strings.TrimSpace(body)
+	return cmd
+}
+
+// customCommandSpecs lists the custom commands sorted by name.
+func (s *Service) customCommandSpecs() []SlashCommandSpec {
+	var specs []SlashCommandSpec
+	for _, cmd := range s.customCommands() {
+		specs = append(specs, SlashCommandSpec{
+			Name:        cmd.Name,
+			Description: cmd.Description,
+			Category:    "custom",
+			Usage:       "/" + cmd.Name + " <args>",
+		})
+	}
+	sort.Slice(specs, func(i, j int) bool { return specs[i].Name < specs[j].Name })
+	return specs
+}
+
+// expandCustomCommand turns "/name args" into the named command's prompt,
+// keeping a leading mode tag so the turn runs in the same mode. ok is false
+// when message does not name a custom command.
+func (s *Service) expandCustomCommand(message string) (string, bool) {
+	name, args, ok := parseSlashCommand(message)
+	if !ok {
+		return "", false
+	}
+	cmd, ok := s.customCommands()[name]
+	if !ok {
+		return "", false
+	}
+	prompt := strings.ReplaceAll(cmd.Template, "{{args}}", args)
+	if !strings.Contains(cmd.Template, "{{args}}") && args != "" {
+		prompt = cmd.Template + "\n\n" + args
+	}
+	if tag, _ := splitModeTag(strings.TrimSpace(message)); tag != "" {
+		prompt = tag + " " + prompt
+	}
+	return prompt, true
+}
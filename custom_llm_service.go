@@ -22,12 +22,26 @@ type CustomLLMService struct {
 	Models       []string          `json:"models"`
 	DefaultModel string            `json:"defaultModel"`
 	AuthType     string            `json:"authType"` // "apiKey", "bearer", "none"
-	Provider     string            `json:"provider"` // "openai", "anthropic", "ollama"
+	Provider     ProviderKind      `json:"provider"`
 	Enabled      bool              `json:"enabled"`
-	ContextLimit int               `json:"contextLimit,omitempty"` // Max context tokens (approx)
+	ContextLimit int               `json:"contextLimit,omitempty"` // Max context tokens (approx); 0 uses the model's known window
 	ToolCalling  string            `json:"toolCalling,omitempty"`
+	// ModelCapabilities overrides the built-in capability table per model,
+	// e.g. {"my-model": ["tools", "vision"]}.
+	ModelCapabilities map[string][]string `json:"modelCapabilities,omitempty"`
+	// KeepAlive is sent to Ollama as "keep_alive" so the model stays
+	// loaded between the requests of a tool loop, e.g. "30m", or "-1" to
+	// keep it loaded. Empty uses defaultOllamaKeepAlive.
+	KeepAlive string `json:"keepAlive,omitempty"`
+	// GenerationParams are the service's sampling defaults; sessions can
+	// override them.
+	GenerationParams
 }
 
+// defaultOllamaKeepAlive keeps a local model loaded well past Ollama's own
+// five minute default.
+const defaultOllamaKeepAlive = "30m"
+
 func sanitizeRequestHeaders(h http.Header) map[string][]string {
 	out := make(map[string][]string, len(h))
 	for k, v := range h {
@@ -54,66 +68,98 @@ func sanitizeRequestHeaders(h http.Header) map[string][]string {
 }
 
 func normalizeStoredMessage(msg map[string]interface{}) (string, string, bool) {
+	role, text, _, ok := normalizeStoredMessageParts(msg)
+	return role, text, ok
+}
+
+// storedParts returns a stored message's parts, which are
+// []map[string]interface{} in memory and []interface{} once loaded from disk.
+func storedParts(msg map[string]interface{}) ([]map[string]interface{}, bool) {
+	switch raw := msg["parts"].(type) {
+	case []map[string]interface{}:
+		return raw, true
+	case []interface{}:
+		parts := make([]map[string]interface{}, 0, len(raw))
+		for _, p := range raw {
+			if part, ok := p.(map[string]interface{}); ok {
+				parts = append(parts, part)
+			}
+		}
+		return parts, true
+	default:
+		return nil, false
+	}
+}
+
+// normalizeStoredMessageParts returns a stored message's role, its text (the
+// first text part) and its image parts. A reply with a selected variant
+// yields that variant's content.
+func normalizeStoredMessageParts(msg map[string]interface{}) (string, string, []map[string]interface{}, bool) {
 	infoAny, ok := msg["info"]
 	if !ok {
-		return "", "", false
+		return "", "", nil, false
 	}
 	info, ok := infoAny.(map[string]interface{})
 	if !ok {
-		return "", "", false
+		return "", "", nil, false
 	}
 	role, _ := info["role"].(string)
 
-	partsAny, ok := msg["parts"]
+	parts, ok := storedParts(msg)
 	if !ok {
-		return "", "", false
+		return "", "", nil, false
 	}
-
-	var text string
-	switch parts := partsAny.(type) {
-	case []interface{}:
-		if len(parts) == 0 {
-			return role, "", true
+	if variant := selectedVariant(msg); variant != nil {
+		if variantParts, ok := storedParts(variant); ok {
+			parts = variantParts
 		}
-		if first, ok := parts[0].(map[string]interface{}); ok {
-			text, _ = first["text"].(string)
-		}
-	case []map[string]interface{}:
-		if len(parts) == 0 {
-			return role, "", true
+	}
+
+	text := ""
+	textFound := false
+	var images []map[string]interface{}
+	for _, part := range parts {
+		partType, _ := part["type"].(string)
+		switch {
+		case partType == "image":
+			images = append(images, part)
+		case !textFound && (partType == "text" || partType == ""):
+			text, _ = part["text"].(string)
+			textFound = true
 		}
-		text, _ = parts[0]["text"].(string)
-	default:
-		return "", "", false
 	}
 
-	return role, text, true
+	return role, text, images, true
+}
+
+// defaultContextLimit is the context size, in approximate tokens, assumed
+// when a service does not configure one.
+const defaultContextLimit = 100000
+
+// estimateTokens returns a rough token count for messages (1 token ~= 4 chars)
+func estimateTokens(messages []map[string]interface{}) int {
+	total := 0
+	for _, msg := range messages {
+		if content, ok := msg["content"].(string); ok {
+			total += len(content) / 4
+		}
+	}
+	return total
 }
 
 // prepareMessages prepares and truncates messages to fit context limit
 func (s *Service) prepareMessages(messages []map[string]interface{}, limit int) []map[string]interface{} {
 	if limit <= 0 {
-		limit = 100000 // Default high limit
-	}
-
-	// Calculate rough token count (1 token ~= 4 chars)
-	countTokens := func(msgs []map[string]interface{}) int {
-		total := 0
-		for _, msg := range msgs {
-			if content, ok := msg["content"].(string); ok {
-				total += len(content) / 4
-			}
-		}
-		return total
+		limit = defaultContextLimit // Default high limit
 	}
 
-	if countTokens(messages) <= limit {
+	if estimateTokens(messages) <= limit {
 		return messages
 	}
 
 	// Truncation strategy:
-	// 1. Keep system prompt (usually first message)
-	// 2. Keep the first User message (Task definition) if possible
+	// 1. Keep the leading system messages; their size is fixed overhead
+	// 2. Keep the first conversation message (task definition) if possible
 	// 3. Keep last N messages that fit in the remaining budget
 	// 4. Discard middle messages
 
@@ -122,24 +168,34 @@ func (s *Service) prepareMessages(messages []map[string]interface{}, limit int)
 	}
 
 	result := []map[string]interface{}{}
-
-	// Always keep first message (System Prompt or Initial User Prompt)
-	// Note: The actual System Prompt is often added later in callLLMService,
-	// so messages[0] here is usually the first User message in the session history.
-	firstMsg := messages[0]
-	result = append(result, firstMsg)
-
-	firstContent, _ := firstMsg["content"].(string)
-	currentTokens := len(firstContent) / 4
-
-	// Keep second message if it exists (often Assistant's first reply) to maintain context start
-	if len(messages) > 1 {
-		secondMsg := messages[1]
-		secondContent, _ := secondMsg["content"].(string)
-		secondTokens := len(secondContent) / 4
-		if currentTokens+secondTokens < limit/2 { // Only keep if it doesn't take up too much space
-			result = append(result, secondMsg)
-			currentTokens += secondTokens
+	currentTokens := 0
+	for _, msg := range messages {
+		if role, _ := msg["role"].(string); role != "system" || len(result) == len(messages)-1 {
+			break
+		}
+		content, _ := msg["content"].(string)
+		currentTokens += len(content) / 4
+		result = append(result, msg)
+	}
+	if len(result) == 0 {
+		// No system prompt: always keep the first message.
+		firstContent, _ := messages[0]["content"].(string)
+		currentTokens = len(firstContent) / 4
+		result = append(result, messages[0])
+	}
+	if currentTokens >= limit {
+		fmt.Printf("Warning: System prompt (~%d tokens) leaves no room in the %d token context limit\n", currentTokens, limit)
+	}
+
+	// Keep the next message (the task definition, or the assistant's first
+	// reply) to maintain context start, if it doesn't take up too much space
+	if len(result) < len(messages)-1 {
+		nextMsg := messages[len(result)]
+		nextContent, _ := nextMsg["content"].(string)
+		nextTokens := len(nextContent) / 4
+		if currentTokens+nextTokens < limit/2 {
+			result = append(result, nextMsg)
+			currentTokens += nextTokens
 		}
 	}
 
@@ -157,6 +213,19 @@ func (s *Service) prepareMessages(messages []map[string]interface{}, limit int)
 		}
 
 		if currentTokens+tokens > limit {
+			// Never drop the latest message outright; cut it to what is left.
+			if i == len(messages)-1 {
+				if content, ok := msg["content"].(string); ok && limit > currentTokens {
+					kept := truncateUTF8(content, (limit-currentTokens)*4)
+					truncated := make(map[string]interface{}, len(msg))
+					for k, v := range msg {
+						truncated[k] = v
+					}
+					truncated["content"] = kept + "\n... (truncated to fit the context limit)"
+					currentTokens += len(kept) / 4
+					keptTailMessages = append(keptTailMessages, truncated)
+				}
+			}
 			break
 		}
 
@@ -191,7 +260,7 @@ func (s *Service) TestCustomLLMService(configData string) (map[string]interface{
 	var req *http.Request
 	var err error
 
-	if config.Provider == "anthropic" {
+	if config.Provider.isAnthropic() {
 		testData := map[string]interface{}{
 			"model": config.DefaultModel,
 			"messages": []map[string]interface{}{
@@ -208,7 +277,7 @@ func (s *Service) TestCustomLLMService(configData string) (map[string]interface{
 			return nil, fmt.Errorf("failed to marshal test data: %w", err)
 		}
 
-		req, err = http.NewRequest("POST", config.BaseURL, strings.NewReader(string(jsonData)))
+		req, err = http.NewRequest("POST", resolveEndpoint(config.Provider, config.BaseURL), strings.NewReader(string(jsonData)))
 		if err != nil {
 			return nil, fmt.Errorf("failed to create request: %w", err)
 		}
@@ -233,7 +302,7 @@ func (s *Service) TestCustomLLMService(configData string) (map[string]interface{
 			return nil, fmt.Errorf("failed to marshal test data: %w", err)
 		}
 
-		req, err = http.NewRequest("POST", config.BaseURL, strings.NewReader(string(jsonData)))
+		req, err = http.NewRequest("POST", resolveEndpoint(config.Provider, config.BaseURL), strings.NewReader(string(jsonData)))
 		if err != nil {
 			return nil, fmt.Errorf("failed to create request: %w", err)
 		}
@@ -273,9 +342,9 @@ func (s *Service) TestCustomLLMService(configData string) (map[string]interface{
 	defer resp.Body.Close()
 
 	// Read response
-	body, err := io.ReadAll(resp.Body)
+	body, err := s.readLLMResponse(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response: %w", err)
+		return nil, err
 	}
 
 	// Check status code
@@ -289,12 +358,12 @@ func (s *Service) TestCustomLLMService(configData string) (map[string]interface{
 	}
 
 	// Parse response
-	var response map[string]interface{}
-	if err := json.Unmarshal(body, &response); err != nil {
+	response, err := decodeLLMResponse(body, resp.Header.Get("Content-Type"), resp.StatusCode)
+	if err != nil {
 		return map[string]interface{}{
 			"success": false,
 			"status":  resp.StatusCode,
-			"error":   "Invalid JSON response",
+			"error":   err.Error(),
 			"message": "Service test failed",
 		}, nil
 	}
@@ -325,7 +394,7 @@ func (s *Service) SendCustomLLMMessageWithModel(ctx context.Context, sessionID s
 }
 
 func (s *Service) getCustomLLMServiceConfig(serviceID string) (CustomLLMService, error) {
-	customServices, ok := s.config["customServices"].([]interface{})
+	customServices, ok := s.configValue("customServices").([]interface{})
 	if !ok {
 		return CustomLLMService{}, fmt.Errorf("custom services not configured")
 	}
@@ -351,40 +420,45 @@ func (s *Service) getCustomLLMServiceConfig(serviceID string) (CustomLLMService,
 	return CustomLLMService{}, fmt.Errorf("custom service not found: %s", serviceID)
 }
 
-// sendLLMMessageInternal handles the common logic for sending messages via LLM
-func (s *Service) sendLLMMessageInternal(ctx context.Context, sessionID string, message string, serviceConfig CustomLLMService, modelID string) (map[string]interface{}, error) {
-	targetModel := modelID
-	if targetModel == "" {
-		targetModel = serviceConfig.DefaultModel
-	}
-
-	// Get session
-	session, err := s.GetSession(sessionID)
-	if err != nil {
-		return nil, err
-	}
-
+// buildLLMMessages assembles the request messages for a new user turn: the
+// system prompt, the session history and the message itself. It also
+// returns the agent mode requested by the message.
+func (s *Service) buildLLMMessages(session *Session, message string, attached messageAttachments, serviceConfig CustomLLMService, model string, agent AgentConfig) ([]map[string]interface{}, agentMode) {
 	// Prepare messages for API
 	messages := []map[string]interface{}{}
-	for _, msg := range session.Messages {
-		role, content, ok := normalizeStoredMessage(msg)
+	for _, msg := range s.sessionMessages(session) {
+		role, content, imageParts, ok := normalizeStoredMessageParts(msg)
 		if !ok {
 			continue
 		}
 		if strings.TrimSpace(role) == "" {
 			continue
 		}
-		messages = append(messages, map[string]interface{}{
+		if role == "user" {
+			content = withAttachedFiles(content, s.historyFiles(msg))
+		}
+		llmMsg := map[string]interface{}{
 			"role":    role,
 			"content": content,
-		})
+		}
+		if role == "user" && len(imageParts) > 0 {
+			if history := s.historyAttachments(imageParts); len(history) > 0 {
+				llmMsg["images"] = history
+			}
+		}
+		messages = append(messages, llmMsg)
 	}
 
-	// Add current message
-	messages = append(messages, map[string]interface{}{
+	// Add current message, with any @-mentioned or attached files and
+	// images
+	current := map[string]interface{}{
 		"role":    "user",
-		"content": message,
-	})
+		"content": withAttachedFiles(s.expandFileMentions(message), attached.files),
+	}
+	if len(attached.images) > 0 {
+		current["images"] = attached.images
+	}
+	messages = append(messages, current)
 
 	// Add system prompt for tools
 	// Try to load custom prompt from .openspace/prompt.md
@@ -396,16 +470,44 @@ func (s *Service) sendLLMMessageInternal(ctx context.Context, sessionID string,
 		}
 	}
 
-	// Check for Plan Mode in user message
-	planMode := false
-	if strings.HasPrefix(message, "[MODE: PLAN]") {
-		planMode = true
-		// Remove the mode tag for the actual message content if needed,
-		// but keeping it helps the model know the context too.
-	}
+	// Check for Plan/Review Mode in user message, else use the agent's
+	// default. The mode tag is kept in the message content since it helps
+	// the model know the context too.
+	mode := agent.modeFor(message)
 
 	toolMode := resolveToolCallingMode(serviceConfig)
 
+	var systemPromptContent string
+	if s.useCompactSystemPrompt(serviceConfig, model) {
+		systemPromptContent = compactSystemPrompt(toolMode, mode, newToolRegistry().restrictedTo(agent.Tools))
+	} else {
+		systemPromptContent = fullSystemPrompt(toolMode, mode)
+		if len(agent.Tools) > 0 {
+			allowed := newToolRegistry().restrictedTo(agent.Tools).Names()
+			systemPromptContent += "\n====\nAVAILABLE TOOLS\n====\nOnly these tools are enabled for this agent: " + strings.Join(allowed, ", ") + ".\nCalls to any other tool listed above will be rejected.\n"
+		}
+	}
+	if strings.TrimSpace(agent.SystemPrompt) != "" {
+		systemPromptContent += "\n====\nAGENT: " + agent.Name + "\n====\n" + strings.TrimSpace(agent.SystemPrompt) + "\n"
+	}
+	if s.configBool("injectTodos", true) {
+		if todos, err := s.sessionTodos(session.ID); err == nil {
+			systemPromptContent += todoPromptSection(todos)
+		}
+	}
+
+	systemPrompt := map[string]interface{}{
+		"role":    "system",
+		"content": systemPromptContent + userPrompt,
+	}
+	// Prepend system prompt
+	messages = append([]map[string]interface{}{systemPrompt}, messages...)
+
+	return messages, mode
+}
+
+// fullSystemPrompt is the built-in system prompt for toolMode and mode.
+func fullSystemPrompt(toolMode string, mode agentMode) string {
 	systemPromptContent := `You are OpenSpace, a highly skilled software engineer with extensive knowledge in many programming languages, frameworks, best practices, and performance optimization.
 
 ====
@@ -425,7 +527,8 @@ If tool calling is not available for this provider, you must use the XML tool ca
 Available Tools:
 
 1. search_files: Search for files by name.
-   Args: <query>filename</query>
+   Args: <query>filename</query> <include_hidden>true|false</include_hidden> (optional, default false)
+   - Dotfiles and dot-directories (e.g. .github, .env.example) are only searched with include_hidden.
 
 2. read_file: Read the content of a file.
    Args: <path>path/to/file</path>
@@ -434,10 +537,11 @@ Available Tools:
    Args: <path>directory_path</path>
 
 4. run_command: Execute a shell command.
-   Args: <command>shell_command</command>
+   Args: <command>shell_command</command> <background>true|false</background> (optional)
    - Only use this when necessary. Prefer specialized tools.
-   - Commands have timeouts; keep them short and non-interactive.
-   - Always use explicit, safe commands (no interactive prompts).
+   - Commands time out after 60 seconds; keep them short.
+   - Commands run without a terminal and with empty stdin. Interactive programs (editors, REPLs, "npm init", "git commit" without -m) are refused; pass flags such as -y or -m instead.
+   - Start dev servers and watchers with background set to true; it returns a handle for command_output instead of waiting.
 
 5. save_file: Save content to a file.
    Args: <path>path/to/file</path> <content>file_content</content>
@@ -450,8 +554,43 @@ Available Tools:
    Args: <staged>true|false</staged> (optional, default false)
 
 8. manage_todo: Manage session todo list.
-   Args: <action>add|update|delete|list</action> <content>task_description</content> <id>task_id</id> <status>pending|in_progress|completed</status>
+   Args: <action>add|update|delete|list|reorder|clear_completed</action> <content>task_description</content> <id>task_id</id> <status>pending|in_progress|completed</status> <priority>low|medium|high</priority> <ids>id1, id2, id3</ids>
    - Use this to keep track of your progress on complex tasks.
+   - update changes status and/or priority; reorder takes the todo IDs in their new order; clear_completed removes the completed ones.
+   - list reports how many are done.
+
+9. move_file: Move or rename a file or directory within the workspace.
+   Args: <source>old/path</source> <destination>new/path</destination> <overwrite>true|false</overwrite> (optional, default false)
+
+10. make_dir: Create a directory (and missing parents) within the workspace.
+   Args: <path>path/to/dir</path>
+
+11. find_definition: Find where a symbol is defined (single best file:line).
+   Args: <symbol>SymbolName</symbol>
+
+12. find_references: Find where a symbol is used (whole identifiers, definitions first).
+   Args: <symbol>SymbolName</symbol> <limit>100</limit> (optional)
+
+13. file_stat: Get a file's line count, size, last-modified time and language without reading it.
+   Args: <path>path/to/file</path>
+
+14. tree: Show the directory tree, skipping ignored directories. Cheaper than many list_files calls.
+   Args: <path>directory_path</path> (optional, default workspace root) <depth>3</depth> (optional)
+
+15. run_tests: Detect the project type and run its tests (go test, npm test, cargo test, pytest, ...). Returns pass/fail and the failing output.
+   Args: (none)
+
+16. lint: Run the project's formatter/linter (gofmt/goimports, eslint, prettier, ruff, cargo fmt) and return the diff or issues.
+   Args: <fix>true|false</fix> (optional, default false; true rewrites the files)
+   - Run it after editing code to catch formatting and lint problems.
+
+17. build: Detect the project type and build it (go build, npm run build, cargo build, ...). On failure returns the compiler errors as a list of {file, line, column, message}.
+   Args: (none)
+   - Run it after editing code to check that it compiles.
+
+18. command_output: Read the new output of a command started with run_command background=true, given its handle. Set input to answer a prompt such as a y/n question (a newline is added); full-screen programs and password prompts are not supported. Set stop to true to stop the command and everything it started.
+   Args: <handle>bg_123</handle> <input>y</input> (optional) <stop>true|false</stop> (optional)
+   - Stop background commands once you no longer need them.
 
 Example:
 <tool_call>
@@ -492,14 +631,24 @@ Tool execution MUST follow this step-by-step loop:
 
 Available Tools:
 
-1. search_files: Search for files by name. Args: query
+1. search_files: Search for files by name. Args: query, include_hidden (optional)
 2. read_file: Read the content of a file. Args: path
 3. list_files: List files in a directory. Args: path
-4. run_command: Execute a shell command. Args: command
+4. run_command: Execute a shell command without a terminal; interactive programs (editors, REPLs, prompts) are refused. Args: command, background (optional, true keeps it running and returns a handle)
 5. save_file: Save content to a file. Args: path, content
 6. git_status: Check git status. Args: none
 7. git_diff: Check git diff. Args: staged (optional)
-8. manage_todo: Manage session todo list. Args: action, content/id/status (depending on action)
+8. manage_todo: Manage session todo list. Args: action (add|update|delete|list|reorder|clear_completed), content/id/status/priority/ids (depending on action)
+9. move_file: Move or rename a file or directory within the workspace. Args: source, destination, overwrite (optional)
+10. make_dir: Create a directory (and missing parents) within the workspace. Args: path
+11. find_definition: Find where a symbol is defined (single best file:line). Args: symbol
+12. find_references: Find where a symbol is used (whole identifiers, definitions first). Args: symbol, limit (optional)
+13. file_stat: Get a file's line count, size, last-modified time and language without reading it. Args: path
+14. tree: Show the directory tree, skipping ignored directories. Cheaper than many list_files calls. Args: path (optional), depth (optional, default 3)
+15. run_tests: Detect the project type and run its tests (go test, npm test, cargo test, pytest, ...). Returns pass/fail and the failing output. Args: none
+16. lint: Run the project's formatter/linter (gofmt/goimports, eslint, prettier, ruff, cargo fmt) and return the diff or issues. Args: fix (optional, true rewrites the files)
+17. build: Detect the project type and build it (go build, npm run build, cargo build, ...). On failure returns the compiler errors as a list of {file, line, column, message}. Args: none
+18. command_output: Read the new output of a background command, send it a line of input, or stop it. Args: handle, input (optional), stop (optional)
 
 ====
 RULES
@@ -514,7 +663,18 @@ RULES
 `
 	}
 
-	if planMode {
+	switch mode {
+	case agentModeReview:
+		systemPromptContent += `
+====
+REVIEW MODE
+====
+You are currently in REVIEW MODE, which is strictly read-only.
+- Analyze and review the code; do not change anything.
+- Only read, search, list and git status/diff tools will run. Saving files, running commands and changing todos are refused.
+- Report findings and suggested changes in your reply instead of applying them.
+`
+	case agentModePlan:
 		systemPromptContent += `
 ====
 PLAN MODE
@@ -522,10 +682,11 @@ PLAN MODE
 You are currently in PLAN MODE.
 - Focus on information gathering, asking questions, and architecting a solution.
 - DO NOT execute tools that modify files or run side-effect commands yet.
-- Use 'read_file', 'search_files', 'list_files' to explore.
+- Use 'read_file', 'search_files', 'list_files' and 'tree' to explore.
+- 'run_command' only accepts simple read-only commands such as ls, cat, grep or git log.
 - When you have a solid plan, ask the user to switch to ACT MODE.
 `
-	} else {
+	default:
 		systemPromptContent += `
 ====
 ACT MODE
@@ -537,22 +698,42 @@ You are currently in ACT MODE.
 `
 	}
 
-	systemPrompt := map[string]interface{}{
-		"role":    "system",
-		"content": systemPromptContent + userPrompt,
+	return systemPromptContent
+}
+
+// sendLLMMessageInternal handles the common logic for sending messages via LLM
+func (s *Service) sendLLMMessageInternal(ctx context.Context, sessionID string, message string, serviceConfig CustomLLMService, modelID string) (map[string]interface{}, error) {
+	return s.sendAgentMessage(ctx, sessionID, message, messageAttachments{}, serviceConfig, modelID, s.agentByID(defaultAgentID))
+}
+
+// sendAgentMessage sends a message and its attachments via LLM on behalf of
+// agent
+func (s *Service) sendAgentMessage(ctx context.Context, sessionID string, message string, attached messageAttachments, serviceConfig CustomLLMService, modelID string, agent AgentConfig) (map[string]interface{}, error) {
+	targetModel := modelID
+	if targetModel == "" {
+		targetModel = serviceConfig.DefaultModel
 	}
-	// Prepend system prompt
-	messages = append([]map[string]interface{}{systemPrompt}, messages...)
 
-	// Make request
-	responseText, rawTurns, err := s.callLLMService(ctx, sessionID, serviceConfig, messages, targetModel, planMode)
+	// Get session
+	session, err := s.GetSession(sessionID)
 	if err != nil {
 		return nil, err
 	}
 
-	// Update session with new messages
-	s.sessionMux.Lock()
-	defer s.sessionMux.Unlock()
+	messages, mode := s.buildLLMMessages(session, message, attached, serviceConfig, targetModel, agent)
+
+	// Make request, failing over along the configured chain on outages
+	registry := newToolRegistry().restrictedTo(agent.Tools)
+	release, err := s.acquireLLMSlot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	responseText, rawTurns, answeredBy, answeredModel, err := s.callLLMServiceWithFallbacks(ctx, sessionID, serviceConfig, messages, targetModel, mode, registry)
+	release()
+	if err != nil {
+		s.saveToolStats(sessionID)
+		return nil, err
+	}
 
 	now := time.Now().UnixMilli()
 	messageID := fmt.Sprintf("msg_%d", now)
@@ -570,54 +751,124 @@ You are currently in ACT MODE.
 		userInfo["rawTurns"] = rawTurns
 	}
 	userMsg := map[string]interface{}{
-		"info": userInfo,
-		"parts": []map[string]interface{}{
-			{
-				"type": "text",
-				"text": message,
-			},
-		},
+		"info":  userInfo,
+		"parts": userMessageParts(message, attached),
 	}
-	session.Messages = append(session.Messages, userMsg)
 
 	// Add assistant response
 	assistantInfo := map[string]interface{}{
 		"role":      "assistant",
 		"createdAt": now + 100,
 		"id":        fmt.Sprintf("msg_%d", now+100),
-		"model":     targetModel,
-		"service":   serviceConfig.ID,
+		"model":     answeredModel,
+		"service":   answeredBy.ID,
+		"agent":     agent.ID,
+	}
+	if s.sessionDeterministic(sessionID) {
+		assistantInfo["deterministic"] = true
+	}
+	if answeredBy.ID != serviceConfig.ID || answeredModel != targetModel {
+		assistantInfo["fallbackFrom"] = serviceConfig.ID + "::" + targetModel
 	}
 	if len(rawTurns) > 0 {
-		if resp, ok := rawTurns[len(rawTurns)-1]["response"].(string); ok {
+		last := rawTurns[len(rawTurns)-1]
+		if resp, ok := last["response"].(string); ok {
 			assistantInfo["rawResponse"] = resp
 		}
+		if reason, ok := last["finishReason"].(string); ok {
+			assistantInfo["finishReason"] = reason
+		}
+		if refusal, ok := last["refusal"].(string); ok {
+			assistantInfo["refusal"] = refusal
+		}
 		assistantInfo["rawTurns"] = rawTurns
 	}
-	assistantMsg := map[string]interface{}{
-		"info": assistantInfo,
-		"parts": []map[string]interface{}{
-			{
-				"type":       "text",
-				"text":       responseText,
-				"tokenCount": 0,
-			},
+	assistantParts := []map[string]interface{}{
+		{
+			"type":       "text",
+			"text":       responseText,
+			"tokenCount": 0,
 		},
 	}
-	session.Messages = append(session.Messages, assistantMsg)
-	session.UpdatedAt = now + 100
+	// The reasoning is a separate part after the text, so it is shown on
+	// request and never sent back to the model with the history.
+	if reasoning := turnsReasoning(rawTurns); reasoning != "" {
+		assistantParts = append(assistantParts, map[string]interface{}{
+			"type": "reasoning",
+			"text": reasoning,
+		})
+	}
+	assistantMsg := map[string]interface{}{
+		"info":  assistantInfo,
+		"parts": assistantParts,
+	}
 
-	// Save session
-	if err := s.saveSessionsLocked(); err != nil {
-		fmt.Printf("Warning: Failed to save session: %v\n", err)
+	// Update session with new messages
+	if _, err := s.updateSession(sessionID, func(session *Session) error {
+		session.Messages = append(session.Messages, userMsg, assistantMsg)
+		session.UpdatedAt = now + 100
+		s.mergeToolStats(session)
+		return nil
+	}); err != nil {
+		return nil, err
 	}
 
 	return assistantMsg, nil
 }
 
+// RequestEstimate describes the request a message would produce.
+type RequestEstimate struct {
+	Service         string `json:"service,omitempty"`
+	Model           string `json:"model"`
+	ContextLimit    int    `json:"contextLimit"`
+	Messages        int    `json:"messages"`
+	OriginalTokens  int    `json:"originalTokens"`
+	EstimatedTokens int    `json:"estimatedTokens"`
+	Truncated       bool   `json:"truncated"`
+}
+
+// EstimateRequest assembles the messages SendMessage would send for message
+// and reports their estimated size, without contacting the provider.
+func (s *Service) EstimateRequest(sessionID string, message string, model string) (RequestEstimate, error) {
+	session, err := s.GetSession(sessionID)
+	if err != nil {
+		return RequestEstimate{}, err
+	}
+
+	route, err := s.resolveModelRoute(model)
+	if err != nil {
+		return RequestEstimate{}, err
+	}
+	serviceConfig := CustomLLMService{DefaultModel: route.Model}
+	if route.Source != routeMock {
+		if serviceConfig, err = s.serviceForRoute(route); err != nil {
+			return RequestEstimate{}, err
+		}
+	}
+	targetModel := route.Model
+	if targetModel == "" {
+		targetModel = serviceConfig.DefaultModel
+	}
+
+	messages, _ := s.buildLLMMessages(session, message, messageAttachments{}, serviceConfig, targetModel, s.agentByID(defaultAgentID))
+	limit := effectiveContextLimit(serviceConfig, targetModel)
+	originalTokens := estimateTokens(messages)
+	prepared := s.prepareMessages(messages, limit)
+
+	return RequestEstimate{
+		Service:         serviceConfig.ID,
+		Model:           targetModel,
+		ContextLimit:    limit,
+		Messages:        len(prepared),
+		OriginalTokens:  originalTokens,
+		EstimatedTokens: estimateTokens(prepared),
+		Truncated:       originalTokens > limit && len(messages) > 3,
+	}, nil
+}
+
 // GetCustomLLMServices returns all custom LLM services
 func (s *Service) GetCustomLLMServices() ([]CustomLLMService, error) {
-	customServices, ok := s.config["customServices"].([]interface{})
+	customServices, ok := s.configValue("customServices").([]interface{})
 	if !ok {
 		return []CustomLLMService{}, nil
 	}
@@ -648,39 +899,47 @@ func (s *Service) AddCustomLLMService(configData string) (CustomLLMService, erro
 	if service.Name == "" {
 		return service, fmt.Errorf("service name is required")
 	}
-	if service.BaseURL == "" {
-		return service, fmt.Errorf("base URL is required")
+	if service.Provider == "" {
+		service.Provider = inferProviderKind(service.ID, service.BaseURL)
 	}
-	if service.DefaultModel == "" {
-		return service, fmt.Errorf("default model is required")
+	kind, err := parseProviderKind(string(service.Provider))
+	if err != nil {
+		return service, err
 	}
-
-	// Get existing custom services
-	customServices, ok := s.config["customServices"].([]interface{})
-	if !ok {
-		customServices = []interface{}{}
+	service.Provider = kind
+	baseURL, err := normalizeBaseURL(service.Provider, service.BaseURL)
+	if err != nil {
+		return service, err
 	}
-
-	// Check for duplicate ID
-	for _, svc := range customServices {
-		svcMap := svc.(map[string]interface{})
-		if svcMap["id"] == service.ID {
-			return service, fmt.Errorf("service with ID '%s' already exists", service.ID)
-		}
+	service.BaseURL = baseURL
+	if service.DefaultModel == "" {
+		return service, fmt.Errorf("default model is required")
 	}
 
-	// Add new service
 	serviceJSON, _ := json.Marshal(service)
 	var serviceMap map[string]interface{}
 	json.Unmarshal(serviceJSON, &serviceMap)
-	customServices = append(customServices, serviceMap)
 
-	// Update config
-	s.config["customServices"] = customServices
+	err = s.updateConfig(func(config map[string]interface{}) error {
+		// Get existing custom services
+		customServices, ok := config["customServices"].([]interface{})
+		if !ok {
+			customServices = []interface{}{}
+		}
 
-	// Save config
-	if err := s.saveConfig(s.config); err != nil {
-		return service, fmt.Errorf("failed to save config: %w", err)
+		// Check for duplicate ID
+		for _, svc := range customServices {
+			svcMap := svc.(map[string]interface{})
+			if svcMap["id"] == service.ID {
+				return fmt.Errorf("service with ID '%s' already exists", service.ID)
+			}
+		}
+
+		config["customServices"] = append(customServices, serviceMap)
+		return nil
+	})
+	if err != nil {
+		return service, err
 	}
 
 	return service, nil
@@ -700,101 +959,283 @@ func (s *Service) UpdateCustomLLMService(serviceID string, configData string) (C
 	if service.Name == "" {
 		return service, fmt.Errorf("service name is required")
 	}
-	if service.BaseURL == "" {
-		return service, fmt.Errorf("base URL is required")
+	if service.Provider == "" {
+		service.Provider = inferProviderKind(service.ID, service.BaseURL)
+	}
+	kind, err := parseProviderKind(string(service.Provider))
+	if err != nil {
+		return service, err
+	}
+	service.Provider = kind
+	baseURL, err := normalizeBaseURL(service.Provider, service.BaseURL)
+	if err != nil {
+		return service, err
 	}
+	service.BaseURL = baseURL
 	if service.DefaultModel == "" {
 		return service, fmt.Errorf("default model is required")
 	}
 
-	// Get existing custom services
-	customServices, ok := s.config["customServices"].([]interface{})
-	if !ok {
-		return service, fmt.Errorf("no custom services configured")
-	}
+	err = s.updateConfig(func(config map[string]interface{}) error {
+		// Get existing custom services
+		customServices, ok := config["customServices"].([]interface{})
+		if !ok {
+			return fmt.Errorf("no custom services configured")
+		}
 
-	// Find and update service
-	found := false
-	for i, svc := range customServices {
-		svcMap := svc.(map[string]interface{})
-		if svcMap["id"] == serviceID {
-			serviceJSON, _ := json.Marshal(service)
-			var serviceMap map[string]interface{}
-			json.Unmarshal(serviceJSON, &serviceMap)
-			customServices[i] = serviceMap
-			found = true
-			break
+		// Find and update service
+		for i, svc := range customServices {
+			svcMap := svc.(map[string]interface{})
+			if svcMap["id"] == serviceID {
+				serviceJSON, _ := json.Marshal(service)
+				var serviceMap map[string]interface{}
+				json.Unmarshal(serviceJSON, &serviceMap)
+				customServices[i] = serviceMap
+				return nil
+			}
 		}
+		return fmt.Errorf("service not found: %s", serviceID)
+	})
+	if err != nil {
+		return service, err
 	}
 
-	if !found {
-		return service, fmt.Errorf("service not found: %s", serviceID)
+	return service, nil
+}
+
+// DeleteCustomLLMService deletes a custom LLM service
+func (s *Service) DeleteCustomLLMService(serviceID string) error {
+	return s.updateConfig(func(config map[string]interface{}) error {
+		// Get existing custom services
+		customServices, ok := config["customServices"].([]interface{})
+		if !ok {
+			return fmt.Errorf("no custom services configured")
+		}
+
+		// Find and remove service
+		for i, svc := range customServices {
+			svcMap := svc.(map[string]interface{})
+			if svcMap["id"] == serviceID {
+				config["customServices"] = append(customServices[:i], customServices[i+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("service not found: %s", serviceID)
+	})
+}
+
+// SetCustomLLMServiceEnabled switches a custom service on or off without
+// touching the rest of its config.
+func (s *Service) SetCustomLLMServiceEnabled(serviceID string, enabled bool) (CustomLLMService, error) {
+	err := s.updateConfig(func(config map[string]interface{}) error {
+		customServices, _ := config["customServices"].([]interface{})
+		for _, svc := range customServices {
+			if m, ok := svc.(map[string]interface{}); ok && m["id"] == serviceID {
+				m["enabled"] = enabled
+				return nil
+			}
+		}
+		return fmt.Errorf("service not found: %s", serviceID)
+	})
+	if err != nil {
+		return CustomLLMService{}, err
 	}
 
-	// Update config
-	s.config["customServices"] = customServices
+	return s.getCustomLLMServiceConfig(serviceID)
+}
+
+// ReorderCustomLLMServices stores the custom services in the order of ids,
+// which must name every custom service exactly once. The order is also
+// written to "servicePriority", ahead of any legacy providers listed there,
+// so model routing follows it.
+func (s *Service) ReorderCustomLLMServices(ids []string) ([]CustomLLMService, error) {
+	err := s.updateConfig(func(config map[string]interface{}) error {
+		customServices, _ := config["customServices"].([]interface{})
+		byID := make(map[string]interface{}, len(customServices))
+		for _, svc := range customServices {
+			if m, ok := svc.(map[string]interface{}); ok {
+				if id, _ := m["id"].(string); id != "" {
+					byID[id] = svc
+				}
+			}
+		}
+		if len(ids) != len(byID) {
+			return fmt.Errorf("%w: got %d service IDs, want all %d", ErrInvalidArgument, len(ids), len(byID))
+		}
+		reordered := make([]interface{}, 0, len(ids))
+		seen := map[string]bool{}
+		for _, id := range ids {
+			svc, ok := byID[id]
+			if !ok || seen[id] {
+				return fmt.Errorf("%w: unknown or repeated service %q", ErrInvalidArgument, id)
+			}
+			seen[id] = true
+			reordered = append(reordered, svc)
+		}
+
+		priority := make([]interface{}, 0, len(ids))
+		for _, id := range ids {
+			priority = append(priority, id)
+		}
+		previous, _ := config["servicePriority"].([]interface{})
+		for _, id := range previous {
+			if str, ok := id.(string); ok && !seen[str] {
+				priority = append(priority, str)
+			}
+		}
 
-	// Save config
-	if err := s.saveConfig(s.config); err != nil {
-		return service, fmt.Errorf("failed to save config: %w", err)
+		config["customServices"] = reordered
+		config["servicePriority"] = priority
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return service, nil
+	return s.GetCustomLLMServices()
 }
 
-// DeleteCustomLLMService deletes a custom LLM service
-func (s *Service) DeleteCustomLLMService(serviceID string) error {
-	// Get existing custom services
-	customServices, ok := s.config["customServices"].([]interface{})
-	if !ok {
-		return fmt.Errorf("no custom services configured")
+// defaultMaxResponseBytes is how much of an LLM response is read unless
+// "maxResponseBytes" is configured.
+const defaultMaxResponseBytes = 4 << 20
+
+// readLLMResponse reads an LLM response body, refusing bodies over the
+// configured size so a misbehaving endpoint cannot exhaust memory.
+func (s *Service) readLLMResponse(body io.Reader) ([]byte, error) {
+	limit := s.configInt("maxResponseBytes", defaultMaxResponseBytes)
+	if limit <= 0 {
+		limit = defaultMaxResponseBytes
 	}
+	data, err := io.ReadAll(io.LimitReader(body, int64(limit)+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if len(data) > limit {
+		return nil, fmt.Errorf("response too large: more than %d bytes (raise maxResponseBytes if this is expected)", limit)
+	}
+	return data, nil
+}
 
-	// Find and remove service
-	found := false
-	for i, svc := range customServices {
-		svcMap := svc.(map[string]interface{})
-		if svcMap["id"] == serviceID {
-			customServices = append(customServices[:i], customServices[i+1:]...)
-			found = true
-			break
+// openAIMessageText returns the text of an OpenAI message content, which is
+// a string or, from some servers, a list of typed parts.
+func openAIMessageText(content interface{}) string {
+	switch c := content.(type) {
+	case string:
+		return c
+	case []interface{}:
+		var texts []string
+		for _, part := range c {
+			p, ok := part.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if t, _ := p["type"].(string); t != "text" && t != "output_text" {
+				continue
+			}
+			if text, ok := p["text"].(string); ok {
+				texts = append(texts, text)
+			}
 		}
+		return strings.Join(texts, "")
 	}
+	return ""
+}
 
-	if !found {
-		return fmt.Errorf("service not found: %s", serviceID)
+// splitThinking separates a leading <think> or <thinking> block, which
+// models served without a reasoning field put in front of the answer, from
+// the rest of text. Text without one is returned unchanged.
+func splitThinking(text string) (answer string, reasoning string) {
+	trimmed := strings.TrimLeft(text, " \t\r\n")
+	for _, tag := range []string{"think", "thinking"} {
+		openTag, closeTag := "<"+tag+">", "</"+tag+">"
+		if !strings.HasPrefix(trimmed, openTag) {
+			continue
+		}
+		end := strings.Index(trimmed, closeTag)
+		if end < 0 {
+			return text, ""
+		}
+		return strings.TrimLeft(trimmed[end+len(closeTag):], " \t\r\n"), strings.TrimSpace(trimmed[len(openTag):end])
 	}
+	return text, ""
+}
 
-	// Update config
-	s.config["customServices"] = customServices
-
-	// Save config
-	if err := s.saveConfig(s.config); err != nil {
-		return fmt.Errorf("failed to save config: %w", err)
+// turnsReasoning joins the reasoning recorded on each turn of a reply.
+func turnsReasoning(rawTurns []map[string]interface{}) string {
+	var parts []string
+	for _, turn := range rawTurns {
+		if r, ok := turn["reasoning"].(string); ok && r != "" {
+			parts = append(parts, r)
+		}
 	}
+	return strings.Join(parts, "\n\n")
+}
+
+// Notes appended to a reply that the provider stopped early.
+const (
+	truncatedOutputNote = "[The response was cut off because it reached the model's output limit. Ask the model to continue to get the rest.]"
+	contentFilterNote   = "[The response was stopped by the provider's content filter.]"
+)
+
+// responseSnippetBytes is how much of a non-JSON response is quoted in
+// the error.
+const responseSnippetBytes = 200
 
-	return nil
+// decodeLLMResponse parses a JSON response body. Wrong base URLs tend to
+// produce HTML pages or plain text with a 200 status, so instead of the
+// bare unmarshal error the result names what came back, quotes its start
+// and points at the likely cause.
+func decodeLLMResponse(body []byte, contentType string, statusCode int) (map[string]interface{}, error) {
+	var response map[string]interface{}
+	err := json.Unmarshal(body, &response)
+	if err == nil && response != nil {
+		return response, nil
+	}
+	kind := "a non-JSON response"
+	if mediaType, _, _ := strings.Cut(contentType, ";"); strings.TrimSpace(mediaType) != "" {
+		kind = fmt.Sprintf("a non-JSON response (%s)", strings.TrimSpace(mediaType))
+	}
+	snippet := strings.Join(strings.Fields(truncateUTF8(string(body), responseSnippetBytes)), " ")
+	if len(body) > responseSnippetBytes {
+		snippet += " ..."
+	}
+	return nil, fmt.Errorf("the endpoint returned %s with status %d: %q; check that the service's base URL points at the API (for example https://api.openai.com/v1) and not at a web page", kind, statusCode, snippet)
 }
 
 // callLLMService calls the LLM service API with tool loop
-func (s *Service) callLLMService(ctx context.Context, sessionID string, config CustomLLMService, initialMessages []map[string]interface{}, model string, planMode bool) (string, []map[string]interface{}, error) {
+func (s *Service) callLLMService(ctx context.Context, sessionID string, config CustomLLMService, initialMessages []map[string]interface{}, model string, mode agentMode, registry *ToolRegistry) (string, []map[string]interface{}, error) {
+	text, rawTurns, _, err := s.runToolLoop(ctx, sessionID, config, initialMessages, model, mode, registry)
+	return text, rawTurns, err
+}
+
+// runToolLoop is callLLMService, also reporting whether any tool was
+// executed. A run that executed tools must not be retried on another
+// service, or the tools would run twice.
+func (s *Service) runToolLoop(ctx context.Context, sessionID string, config CustomLLMService, initialMessages []map[string]interface{}, model string, mode agentMode, registry *ToolRegistry) (string, []map[string]interface{}, bool, error) {
 	currentMessages := make([]map[string]interface{}, len(initialMessages))
 	copy(currentMessages, initialMessages)
 
 	// Apply context compression first
-	currentMessages = s.prepareMessages(currentMessages, config.ContextLimit)
+	contextLimit := effectiveContextLimit(config, model)
+	currentMessages = s.prepareMessages(currentMessages, contextLimit)
 
 	maxTurns := 10
 	var fullResponseBuilder strings.Builder
 	rawTurns := make([]map[string]interface{}, 0)
-	registry := newToolRegistry()
+	toolsRun := false
 	toolMode := resolveToolCallingMode(config)
+	budget := newToolResultBudget(contextLimit)
+	deterministic := s.sessionDeterministic(sessionID)
+	generation := s.generationParams(sessionID, config)
+	// A malformed XML tool call is sent back for repair once; after that
+	// the response is taken as it is.
+	repairedToolCall := false
 
 	for i := 0; i < maxTurns; i++ {
 		// Check context cancellation
 		select {
 		case <-ctx.Done():
-			return "", rawTurns, ctx.Err()
+			return "", rawTurns, toolsRun, ctx.Err()
 		default:
 		}
 
@@ -803,7 +1244,7 @@ func (s *Service) callLLMService(ctx context.Context, sessionID string, config C
 		var rawRequestJSON []byte
 		var requestData map[string]interface{}
 
-		if config.Provider == "anthropic" {
+		if config.Provider.isAnthropic() {
 			var systemPrompt string
 			var anthropicMessages []map[string]interface{}
 			for _, msg := range currentMessages {
@@ -818,14 +1259,14 @@ func (s *Service) callLLMService(ctx context.Context, sessionID string, config C
 			}
 			requestData = map[string]interface{}{
 				"model":      model,
-				"messages":   anthropicMessages,
+				"messages":   withImageContent(anthropicMessages, true),
 				"max_tokens": 4096,
 				"system":     strings.TrimSpace(systemPrompt),
 			}
 		} else {
 			requestData = map[string]interface{}{
 				"model":       model,
-				"messages":    currentMessages,
+				"messages":    withImageContent(currentMessages, false),
 				"temperature": 1,
 				"top_p":       0.95,
 				"max_tokens":  2048,
@@ -834,19 +1275,34 @@ func (s *Service) callLLMService(ctx context.Context, sessionID string, config C
 				requestData["tools"] = registry.OpenAITools()
 				requestData["tool_choice"] = "auto"
 			}
+			if config.Provider == ProviderOllama {
+				keepAlive := strings.TrimSpace(config.KeepAlive)
+				if keepAlive == "" {
+					keepAlive = defaultOllamaKeepAlive
+				}
+				requestData["keep_alive"] = keepAlive
+			}
+		}
+
+		generation.apply(requestData)
+		if deterministic {
+			applyDeterministic(requestData, config.Provider)
+		}
+		if isReasoningModel(config, model) {
+			adaptForReasoningModel(requestData)
 		}
 
 		rawRequestJSON, err = json.MarshalIndent(requestData, "", "  ")
 		if err != nil {
-			return "", rawTurns, fmt.Errorf("failed to marshal request: %w", err)
+			return "", rawTurns, toolsRun, fmt.Errorf("failed to marshal request: %w", err)
 		}
-		req, err = http.NewRequestWithContext(ctx, "POST", config.BaseURL, strings.NewReader(string(rawRequestJSON)))
+		req, err = http.NewRequestWithContext(ctx, "POST", resolveEndpoint(config.Provider, config.BaseURL), strings.NewReader(string(rawRequestJSON)))
 		if err != nil {
-			return "", rawTurns, fmt.Errorf("failed to create request: %w", err)
+			return "", rawTurns, toolsRun, fmt.Errorf("failed to create request: %w", err)
 		}
 		req.Header.Set("Content-Type", "application/json")
 
-		if config.Provider == "anthropic" {
+		if config.Provider.isAnthropic() {
 			req.Header.Set("x-api-key", config.APIKey)
 			req.Header.Set("anthropic-version", "2023-06-01")
 		} else {
@@ -867,70 +1323,118 @@ func (s *Service) callLLMService(ctx context.Context, sessionID string, config C
 			req.Header.Set(key, value)
 		}
 
-		client := &http.Client{Timeout: 120 * time.Second}
-		resp, err := client.Do(req)
-		if err != nil {
-			return "", rawTurns, fmt.Errorf("request failed: %w", err)
+		// An identical request answered before is served from the cache.
+		cacheKey := ""
+		if s.responseCacheable(requestData) {
+			cacheKey = responseCacheKey(req.URL.String(), rawRequestJSON)
+		}
+		var body []byte
+		cached := false
+		statusCode := http.StatusOK
+		contentType := "application/json"
+		if cacheKey != "" {
+			body, cached = s.cachedLLMResponse(cacheKey)
 		}
+		if !cached {
+			client := &http.Client{Timeout: 120 * time.Second}
+			resp, err := client.Do(req)
+			if err != nil {
+				return "", rawTurns, toolsRun, &llmRequestError{Err: err}
+			}
 
-		body, readErr := io.ReadAll(resp.Body)
-		_ = resp.Body.Close()
-		if readErr != nil {
-			return "", rawTurns, fmt.Errorf("failed to read response: %w", readErr)
+			var readErr error
+			body, readErr = s.readLLMResponse(resp.Body)
+			_ = resp.Body.Close()
+			if readErr != nil {
+				return "", rawTurns, toolsRun, readErr
+			}
+			statusCode = resp.StatusCode
+			contentType = resp.Header.Get("Content-Type")
 		}
 
 		sanitizedHeaders := sanitizeRequestHeaders(req.Header)
 		requestHeadersJSON, _ := json.MarshalIndent(sanitizedHeaders, "", "  ")
 
+		loggedRequest := redactImageData(rawRequestJSON)
 		rawTurns = append(rawTurns, map[string]interface{}{
 			"provider": config.Provider,
 			"model":    model,
-			"url":      config.BaseURL,
+			"url":      req.URL.String(),
 			"method":   req.Method,
-			"status":   resp.StatusCode,
+			"status":   statusCode,
+			"cached":   cached,
 			"requestHeaders": func() string {
 				if len(requestHeadersJSON) == 0 {
 					return ""
 				}
 				return string(requestHeadersJSON)
 			}(),
-			"request":  string(rawRequestJSON),
+			"request":  loggedRequest,
 			"response": string(body),
 		})
 
-		rawDebugInfo := fmt.Sprintf("\n\n<debug_info>\n<headers>\n%s\n</headers>\n<request>\n%s\n</request>\n<response>\n%s\n</response>\n</debug_info>", string(requestHeadersJSON), string(rawRequestJSON), string(body))
-		if resp.StatusCode >= 400 {
-			return "", rawTurns, fmt.Errorf("API request failed with status %d: %s%s", resp.StatusCode, string(body), rawDebugInfo)
+		rawDebugInfo := fmt.Sprintf("\n\n<debug_info>\n<headers>\n%s\n</headers>\n<request>\n%s\n</request>\n<response>\n%s\n</response>\n</debug_info>", string(requestHeadersJSON), loggedRequest, string(body))
+		if statusCode >= 400 {
+			return "", rawTurns, toolsRun, &llmStatusError{StatusCode: statusCode, Body: string(body) + rawDebugInfo}
 		}
 
-		var response map[string]interface{}
-		if err := json.Unmarshal(body, &response); err != nil {
-			return "", rawTurns, fmt.Errorf("failed to parse response: %w", err)
+		response, err := decodeLLMResponse(body, contentType, statusCode)
+		if err != nil {
+			return "", rawTurns, toolsRun, err
 		}
 
 		var responseText string
 		var nativeToolCalls []ToolCall
 		var nativeToolCallsRaw []map[string]any
-
-		if config.Provider == "anthropic" {
-			if contentArray, ok := response["content"].([]interface{}); ok && len(contentArray) > 0 {
-				if firstBlock, ok := contentArray[0].(map[string]interface{}); ok {
-					if text, ok := firstBlock["text"].(string); ok {
-						responseText = text
+		// finishReason uses the OpenAI names; Anthropic's max_tokens is
+		// reported as "length".
+		var finishReason, refusal, reasoning string
+
+		if config.Provider.isAnthropic() {
+			// With extended thinking the text follows "thinking" blocks.
+			if contentArray, ok := response["content"].([]interface{}); ok {
+				for _, b := range contentArray {
+					block, ok := b.(map[string]interface{})
+					if !ok {
+						continue
+					}
+					switch block["type"] {
+					case "thinking":
+						if thinking, ok := block["thinking"].(string); ok {
+							reasoning += thinking
+						}
+					case "text", nil:
+						if text, ok := block["text"].(string); ok {
+							responseText += text
+						}
 					}
 				}
 			}
+			finishReason, _ = response["stop_reason"].(string)
+			if finishReason == "max_tokens" {
+				finishReason = "length"
+			}
 		} else {
 			if choices, ok := response["choices"].([]interface{}); ok && len(choices) > 0 {
 				if choice, ok := choices[0].(map[string]interface{}); ok {
+					finishReason, _ = choice["finish_reason"].(string)
 					if message, ok := choice["message"].(map[string]interface{}); ok {
-						if content, ok := message["content"].(string); ok {
-							responseText = content
+						responseText = openAIMessageText(message["content"])
+						// Reasoning models may return their reasoning next to
+						// the answer; it is kept out of the reply text.
+						for _, key := range []string{"reasoning_content", "reasoning"} {
+							if r, ok := message[key].(string); ok && r != "" {
+								reasoning = r
+								break
+							}
 						}
-						if toolMode == "native" {
+						refusal, _ = message["refusal"].(string)
+						// A cut-off response may hold half a tool call;
+						// it is reported as truncated instead.
+						if toolMode == "native" && finishReason != "length" {
 							nCalls, nRaw, err := parseOpenAIToolCalls(anyMap(message))
 							if err != nil {
-								return "", rawTurns, err
+								return "", rawTurns, toolsRun, err
 							}
 							nativeToolCalls = nCalls
 							nativeToolCallsRaw = nRaw
@@ -940,8 +1444,31 @@ func (s *Service) callLLMService(ctx context.Context, sessionID string, config C
 			}
 		}
 
-		if responseText == "" && len(nativeToolCalls) == 0 {
-			return "", rawTurns, fmt.Errorf("empty response from service (provider: %s)%s", config.Provider, rawDebugInfo)
+		if reasoning == "" {
+			responseText, reasoning = splitThinking(responseText)
+		}
+
+		turn := rawTurns[len(rawTurns)-1]
+		if finishReason != "" {
+			turn["finishReason"] = finishReason
+		}
+		if reasoning != "" {
+			turn["reasoning"] = reasoning
+		}
+		if refusal != "" {
+			turn["refusal"] = refusal
+			if fullResponseBuilder.Len() > 0 {
+				fullResponseBuilder.WriteString("\n\n")
+			}
+			fullResponseBuilder.WriteString("The model declined to answer: " + refusal)
+			return fullResponseBuilder.String(), rawTurns, toolsRun, nil
+		}
+
+		if responseText == "" && len(nativeToolCalls) == 0 && finishReason != "length" {
+			return "", rawTurns, toolsRun, fmt.Errorf("empty response from service (provider: %s)%s", config.Provider, rawDebugInfo)
+		}
+		if cacheKey != "" && !cached {
+			s.storeLLMResponse(cacheKey, model, body)
 		}
 
 		if fullResponseBuilder.Len() > 0 {
@@ -951,6 +1478,15 @@ func (s *Service) callLLMService(ctx context.Context, sessionID string, config C
 			fullResponseBuilder.WriteString(responseText)
 		}
 
+		switch finishReason {
+		case "length":
+			fullResponseBuilder.WriteString("\n\n" + truncatedOutputNote)
+			return fullResponseBuilder.String(), rawTurns, toolsRun, nil
+		case "content_filter":
+			fullResponseBuilder.WriteString("\n\n" + contentFilterNote)
+			return fullResponseBuilder.String(), rawTurns, toolsRun, nil
+		}
+
 		if len(nativeToolCalls) > 0 {
 			transcript := buildToolCallTranscriptXML(nativeToolCalls)
 			if responseText != "" {
@@ -966,8 +1502,11 @@ func (s *Service) callLLMService(ctx context.Context, sessionID string, config C
 
 			var results []ToolResult
 			for _, call := range nativeToolCalls {
-				res := executeToolCall(ctx, s, registry, sessionID, call, planMode)
-				results = append(results, res)
+				results = append(results, executeToolCall(ctx, s, registry, sessionID, call, mode))
+			}
+			toolsRun = true
+			budget.fit(results)
+			for _, res := range results {
 				currentMessages = append(currentMessages, map[string]interface{}{
 					"role":         "tool",
 					"tool_call_id": res.ToolCallID,
@@ -985,11 +1524,19 @@ func (s *Service) callLLMService(ctx context.Context, sessionID string, config C
 		}
 
 		xmlCalls, err := parseXMLToolCallsFromText(responseText)
+		if reason, malformed := malformedToolCall(responseText, xmlCalls, err); malformed && !repairedToolCall {
+			repairedToolCall = true
+			currentMessages = append(currentMessages,
+				map[string]interface{}{"role": "assistant", "content": responseText},
+				map[string]interface{}{"role": "user", "content": toolCallRepairPrompt(reason)},
+			)
+			continue
+		}
 		if err != nil {
-			return "", rawTurns, err
+			return "", rawTurns, toolsRun, err
 		}
 		if len(xmlCalls) == 0 {
-			return fullResponseBuilder.String(), rawTurns, nil
+			return fullResponseBuilder.String(), rawTurns, toolsRun, nil
 		}
 
 		currentMessages = append(currentMessages, map[string]interface{}{
@@ -997,11 +1544,17 @@ func (s *Service) callLLMService(ctx context.Context, sessionID string, config C
 			"content": responseText,
 		})
 
-		var toolResults []string
+		var xmlResults []ToolResult
 		for _, call := range xmlCalls {
-			res := executeToolCall(ctx, s, registry, sessionID, call, planMode)
+			xmlResults = append(xmlResults, executeToolCall(ctx, s, registry, sessionID, call, mode))
+		}
+		toolsRun = true
+		budget.fit(xmlResults)
+
+		var toolResults []string
+		for i, call := range xmlCalls {
 			argsJSON, _ := json.MarshalIndent(call.Args, "", "  ")
-			toolResults = append(toolResults, fmt.Sprintf("STEP: execute_tool\nname: %s\nargs: %s\nresult:\n%s", call.Name, string(argsJSON), res.Content))
+			toolResults = append(toolResults, fmt.Sprintf("STEP: execute_tool\nname: %s\nargs: %s\nresult:\n%s", call.Name, string(argsJSON), xmlResults[i].Content))
 		}
 
 		if len(toolResults) > 0 {
@@ -1017,11 +1570,11 @@ func (s *Service) callLLMService(ctx context.Context, sessionID string, config C
 			continue
 		}
 
-		return fullResponseBuilder.String(), rawTurns, nil
+		return fullResponseBuilder.String(), rawTurns, toolsRun, nil
 
 	}
 	// If we exit the loop normally (e.g. context done), return what we have
-	return fullResponseBuilder.String(), rawTurns, nil
+	return fullResponseBuilder.String(), rawTurns, toolsRun, nil
 }
 
 func anyMap(m map[string]interface{}) map[string]any {
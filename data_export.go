@@ -0,0 +1,403 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// An export is a zip holding manifest.json, config.json and, per session,
+// sessions/<id>.json plus its message archive when it has one. Sessions in
+// the trash are included.
+
+const exportVersion = 1
+
+// maxExportEntryBytes caps how much of one archive entry is read on import.
+const maxExportEntryBytes = 512 * 1024 * 1024
+
+// Conflict strategies for ImportAll, applied when a session ID exists.
+const (
+	importSkip      = "skip"
+	importOverwrite = "overwrite"
+	importRename    = "rename"
+)
+
+type exportManifest struct {
+	Version    int   `json:"version"`
+	CreatedAt  int64 `json:"createdAt"`
+	Sessions   int   `json:"sessions"`
+	KeysMasked bool  `json:"keysMasked"`
+}
+
+// ImportResult reports what ImportAll restored.
+type ImportResult struct {
+	Imported       []string          `json:"imported"`
+	Skipped        []string          `json:"skipped,omitempty"`
+	Overwritten    []string          `json:"overwritten,omitempty"`
+	Renamed        map[string]string `json:"renamed,omitempty"` // exported ID -> new ID
+	ConfigRestored bool              `json:"configRestored"`
+}
+
+// maskedConfig returns a copy of config with every API key blanked.
+func maskedConfig(config map[string]interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	var masked map[string]interface{}
+	if err := json.Unmarshal(data, &masked); err != nil {
+		return nil, err
+	}
+	if services, ok := masked["customServices"].([]interface{}); ok {
+		for _, svc := range services {
+			if svcMap, ok := svc.(map[string]interface{}); ok {
+				if _, has := svcMap["apiKey"]; has {
+					svcMap["apiKey"] = ""
+				}
+			}
+		}
+	}
+	if providers, ok := masked["providers"].(map[string]interface{}); ok {
+		for _, p := range providers {
+			if pData, ok := p.(map[string]interface{}); ok {
+				if _, has := pData["api_key"]; has {
+					pData["api_key"] = ""
+				}
+			}
+		}
+	}
+	return masked, nil
+}
+
+// exportedConfigJSON returns the config as written to an export, with API
+// keys left out when maskKeys is set.
+func (s *Service) exportedConfigJSON(maskKeys bool) ([]byte, error) {
+	s.configMux.RLock()
+	defer s.configMux.RUnlock()
+	config := s.config
+	if maskKeys {
+		masked, err := maskedConfig(config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to mask config: %w", err)
+		}
+		config = masked
+	}
+	configJSON, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal config: %w", err)
+	}
+	return configJSON, nil
+}
+
+// ExportAll writes an export of the config and every session to a zip in
+// the temp directory and returns its path. With maskKeys set, API keys are
+// left out of the config.
+func (s *Service) ExportAll(maskKeys bool) (string, error) {
+	configJSON, err := s.exportedConfigJSON(maskKeys)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.CreateTemp("", fmt.Sprintf("openspace-export-%s-*.zip", time.Now().Format("20060102-150405")))
+	if err != nil {
+		return "", fmt.Errorf("failed to create export file: %w", err)
+	}
+	zw := zip.NewWriter(f)
+	fail := func(err error) (string, error) {
+		_ = zw.Close()
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return "", err
+	}
+	writeEntry := func(name string, data []byte) error {
+		w, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	}
+
+	if err := writeEntry("config.json", configJSON); err != nil {
+		return fail(fmt.Errorf("failed to write config: %w", err))
+	}
+
+	s.sessionMux.RLock()
+	var sessions []*Session
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	for _, session := range s.trash {
+		sessions = append(sessions, session)
+	}
+	for _, session := range sessions {
+		if err := s.loadSessionMessages(session); err != nil {
+			s.sessionMux.RUnlock()
+			return fail(err)
+		}
+	}
+	s.sessionMux.RUnlock()
+
+	for _, session := range sessions {
+		unlock := s.lockSession(session.ID)
+		data, err := json.MarshalIndent(session, "", "  ")
+		var archive []byte
+		if err == nil {
+			archive, err = os.ReadFile(s.sessionArchivePath(session.ID))
+			if os.IsNotExist(err) {
+				err = nil
+			}
+		}
+		unlock()
+		if err != nil {
+			return fail(fmt.Errorf("failed to export session %s: %w", session.ID, err))
+		}
+		if err := writeEntry("sessions/"+session.ID+".json", data); err != nil {
+			return fail(fmt.Errorf("failed to write session %s: %w", session.ID, err))
+		}
+		if len(archive) > 0 {
+			if err := writeEntry("sessions/"+session.ID+sessionArchiveSuffix, archive); err != nil {
+				return fail(fmt.Errorf("failed to write session %s: %w", session.ID, err))
+			}
+		}
+	}
+
+	manifest, _ := json.MarshalIndent(exportManifest{
+		Version:    exportVersion,
+		CreatedAt:  time.Now().UnixMilli(),
+		Sessions:   len(sessions),
+		KeysMasked: maskKeys,
+	}, "", "  ")
+	if err := writeEntry("manifest.json", manifest); err != nil {
+		return fail(fmt.Errorf("failed to write manifest: %w", err))
+	}
+	if err := zw.Close(); err != nil {
+		return fail(fmt.Errorf("failed to finish export: %w", err))
+	}
+	if err := f.Close(); err != nil {
+		return "", fmt.Errorf("failed to finish export: %w", err)
+	}
+	return f.Name(), nil
+}
+
+func readZipEntry(file *zip.File) ([]byte, error) {
+	rc, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(io.LimitReader(rc, maxExportEntryBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxExportEntryBytes {
+		return nil, fmt.Errorf("%s is too large", file.Name)
+	}
+	return data, nil
+}
+
+// restoreConfig replaces the config with an imported one, keeping the
+// current API keys where the import had them masked.
+func (s *Service) restoreConfig(config map[string]interface{}) error {
+	s.configMux.Lock()
+	defer s.configMux.Unlock()
+	restoreMaskedKeys(config, s.config)
+	if err := s.writeConfigLocked(config); err != nil {
+		return fmt.Errorf("failed to save config: %w", err)
+	}
+	s.config = config
+	return nil
+}
+
+// restoreMaskedKeys fills API keys blanked by a masked export from the
+// current config, matching services by ID.
+func restoreMaskedKeys(imported, current map[string]interface{}) {
+	currentKeys := map[string]string{}
+	if services, ok := current["customServices"].([]interface{}); ok {
+		for _, svc := range services {
+			if svcMap, ok := svc.(map[string]interface{}); ok {
+				id, _ := svcMap["id"].(string)
+				key, _ := svcMap["apiKey"].(string)
+				currentKeys[id] = key
+			}
+		}
+	}
+	if services, ok := imported["customServices"].([]interface{}); ok {
+		for _, svc := range services {
+			if svcMap, ok := svc.(map[string]interface{}); ok {
+				id, _ := svcMap["id"].(string)
+				if key, _ := svcMap["apiKey"].(string); key == "" && currentKeys[id] != "" {
+					svcMap["apiKey"] = currentKeys[id]
+				}
+			}
+		}
+	}
+
+	currentProviders, _ := current["providers"].(map[string]interface{})
+	if providers, ok := imported["providers"].(map[string]interface{}); ok {
+		for id, p := range providers {
+			pData, ok := p.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			old, _ := currentProviders[id].(map[string]interface{})
+			if key, _ := pData["api_key"].(string); key == "" {
+				if oldKey, _ := old["api_key"].(string); oldKey != "" {
+					pData["api_key"] = oldKey
+				}
+			}
+		}
+	}
+}
+
+// ImportAll restores an export made by ExportAll. The config replaces the
+// current one, keeping current API keys where the export's were masked.
+// A session whose ID already exists is handled by strategy: "skip" (the
+// default) keeps the existing one, "overwrite" replaces it and "rename"
+// imports the exported copy under a new ID.
+func (s *Service) ImportAll(archivePath string, strategy string) (ImportResult, error) {
+	result := ImportResult{Imported: []string{}}
+	switch strategy {
+	case "":
+		strategy = importSkip
+	case importSkip, importOverwrite, importRename:
+	default:
+		return result, fmt.Errorf("%w: unknown conflict strategy %q (want skip, overwrite or rename)", ErrInvalidArgument, strategy)
+	}
+
+	zr, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return result, fmt.Errorf("%w: not a export archive: %v", ErrInvalidArgument, err)
+	}
+	defer zr.Close()
+
+	var manifest *exportManifest
+	var config map[string]interface{}
+	var imported []*Session
+	archives := map[string][]byte{}
+	for _, file := range zr.File {
+		name := path.Clean(file.Name)
+		data, err := readZipEntry(file)
+		if err != nil {
+			return result, fmt.Errorf("failed to read %s: %w", file.Name, err)
+		}
+		switch {
+		case name == "manifest.json":
+			manifest = &exportManifest{}
+			if err := json.Unmarshal(data, manifest); err != nil {
+				return result, fmt.Errorf("%w: invalid manifest: %v", ErrInvalidArgument, err)
+			}
+		case name == "config.json":
+			if err := json.Unmarshal(data, &config); err != nil {
+				return result, fmt.Errorf("%w: invalid config: %v", ErrInvalidArgument, err)
+			}
+		case path.Dir(name) == "sessions" && strings.HasSuffix(name, sessionArchiveSuffix):
+			archives[strings.TrimSuffix(path.Base(name), sessionArchiveSuffix)] = data
+		case path.Dir(name) == "sessions" && strings.HasSuffix(name, ".json"):
+			var session Session
+			if err := json.Unmarshal(data, &session); err != nil {
+				return result, fmt.Errorf("%w: invalid session %s: %v", ErrInvalidArgument, name, err)
+			}
+			if _, err := s.sessionFilePath(session.ID); err != nil {
+				return result, fmt.Errorf("%w: %v", ErrInvalidArgument, err)
+			}
+			imported = append(imported, &session)
+		}
+	}
+	if manifest == nil {
+		return result, fmt.Errorf("%w: archive has no manifest.json", ErrInvalidArgument)
+	}
+	if manifest.Version > exportVersion {
+		return result, fmt.Errorf("%w: export version %d is newer than this app supports", ErrInvalidArgument, manifest.Version)
+	}
+
+	if config != nil {
+		migrateConfig(config)
+		if err := s.restoreConfig(config); err != nil {
+			return result, err
+		}
+		result.ConfigRestored = true
+	}
+
+	s.sessionMux.Lock()
+	defer s.sessionMux.Unlock()
+	if s.trash == nil {
+		s.trash = map[string]*Session{}
+	}
+
+	// Settle IDs first so children follow a renamed parent.
+	renamed := map[string]string{}
+	var toWrite []*Session
+	for _, session := range imported {
+		_, live := s.sessions[session.ID]
+		_, trashed := s.trash[session.ID]
+		if !live && !trashed {
+			toWrite = append(toWrite, session)
+			continue
+		}
+		switch strategy {
+		case importSkip:
+			result.Skipped = append(result.Skipped, session.ID)
+		case importOverwrite:
+			result.Overwritten = append(result.Overwritten, session.ID)
+			toWrite = append(toWrite, session)
+		case importRename:
+			newID := fmt.Sprintf("%s-imported-%d", session.ID, time.Now().UnixNano())
+			renamed[session.ID] = newID
+			toWrite = append(toWrite, session)
+		}
+	}
+	if len(renamed) > 0 {
+		result.Renamed = renamed
+	}
+
+	for _, session := range toWrite {
+		archive := archives[session.ID]
+		if newID, ok := renamed[session.ID]; ok {
+			session.ID = newID
+		}
+		if newParent, ok := renamed[session.ParentID]; ok {
+			session.ParentID = newParent
+		}
+		if session.Messages == nil {
+			session.Messages = []map[string]interface{}{}
+		}
+
+		delete(s.sessions, session.ID)
+		delete(s.trash, session.ID)
+		if session.DeletedAt != 0 {
+			s.trash[session.ID] = session
+		} else {
+			s.sessions[session.ID] = session
+		}
+
+		unlock := s.lockSession(session.ID)
+		err := os.MkdirAll(s.getSessionsDir(), 0755)
+		if err == nil {
+			archivePath := s.sessionArchivePath(session.ID)
+			if len(archive) > 0 {
+				err = writeFileAtomic(archivePath, archive, 0644)
+			} else if rmErr := os.Remove(archivePath); rmErr != nil && !os.IsNotExist(rmErr) {
+				err = rmErr
+			}
+		}
+		if err == nil {
+			err = s.writeSessionLocked(session)
+		}
+		unlock()
+		if err != nil {
+			return result, fmt.Errorf("failed to import session %s: %w", session.ID, err)
+		}
+		result.Imported = append(result.Imported, session.ID)
+	}
+
+	if err := s.saveSessionIndexLocked(); err != nil {
+		return result, err
+	}
+	return result, nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxDiffCells bounds the LCS table used for the changed middle section of
+// a diff. Larger inputs are shown as a full replacement instead.
+const maxDiffCells = 4_000_000
+
+const diffContextLines = 3
+
+type diffLine struct {
+	kind byte // ' ', '-', '+'
+	text string
+	aPos int // lines of the old text consumed before this line
+	bPos int // lines of the new text consumed before this line
+}
+
+// unifiedDiff returns a unified diff between oldText and newText, or "" when
+// they are equal.
+func unifiedDiff(oldName string, newName string, oldText string, newText string) string {
+	if oldText == newText {
+		return ""
+	}
+	lines := diffLines(splitDiffLines(oldText), splitDiffLines(newText))
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "--- %s\n+++ %s\n", oldName, newName)
+
+	i := 0
+	for i < len(lines) {
+		for i < len(lines) && lines[i].kind == ' ' {
+			i++
+		}
+		if i >= len(lines) {
+			break
+		}
+
+		start := i - diffContextLines
+		if start < 0 {
+			start = 0
+		}
+		last := i
+		for j := i; j < len(lines); j++ {
+			if lines[j].kind != ' ' {
+				if j-last > 2*diffContextLines {
+					break
+				}
+				last = j
+			}
+		}
+		end := last + diffContextLines + 1
+		if end > len(lines) {
+			end = len(lines)
+		}
+
+		aCount, bCount := 0, 0
+		for _, l := range lines[start:end] {
+			if l.kind != '+' {
+				aCount++
+			}
+			if l.kind != '-' {
+				bCount++
+			}
+		}
+		aStart, bStart := lines[start].aPos, lines[start].bPos
+		if aCount > 0 {
+			aStart++
+		}
+		if bCount > 0 {
+			bStart++
+		}
+		fmt.Fprintf(&b, "@@ -%d,%d +%d,%d @@\n", aStart, aCount, bStart, bCount)
+		for _, l := range lines[start:end] {
+			b.WriteByte(l.kind)
+			b.WriteString(strings.TrimSuffix(l.text, "\n"))
+			b.WriteByte('\n')
+		}
+		i = end
+	}
+	return b.String()
+}
+
+func splitDiffLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines aligns a and b, trimming the common prefix and suffix before
+// running an LCS over the remaining lines.
+func diffLines(a []string, b []string) []diffLine {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	kinds := make([]byte, 0, len(a)+len(b))
+	for i := 0; i < prefix; i++ {
+		kinds = append(kinds, ' ')
+	}
+	kinds = append(kinds, lcsKinds(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for i := 0; i < suffix; i++ {
+		kinds = append(kinds, ' ')
+	}
+
+	out := make([]diffLine, 0, len(kinds))
+	ai, bi := 0, 0
+	for _, k := range kinds {
+		l := diffLine{kind: k, aPos: ai, bPos: bi}
+		switch k {
+		case ' ':
+			l.text = a[ai]
+			ai++
+			bi++
+		case '-':
+			l.text = a[ai]
+			ai++
+		case '+':
+			l.text = b[bi]
+			bi++
+		}
+		out = append(out, l)
+	}
+	return out
+}
+
+func lcsKinds(a []string, b []string) []byte {
+	n, m := len(a), len(b)
+	kinds := make([]byte, 0, n+m)
+	if n*m > maxDiffCells {
+		for i := 0; i < n; i++ {
+			kinds = append(kinds, '-')
+		}
+		for j := 0; j < m; j++ {
+			kinds = append(kinds, '+')
+		}
+		return kinds
+	}
+
+	// dp[i*(m+1)+j] is the LCS length of a[i:] and b[j:].
+	dp := make([]int32, (n+1)*(m+1))
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				dp[i*(m+1)+j] = dp[(i+1)*(m+1)+j+1] + 1
+			} else if dp[(i+1)*(m+1)+j] >= dp[i*(m+1)+j+1] {
+				dp[i*(m+1)+j] = dp[(i+1)*(m+1)+j]
+			} else {
+				dp[i*(m+1)+j] = dp[i*(m+1)+j+1]
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < n && j < m {
+		switch {
+		case a[i] == b[j]:
+			kinds = append(kinds, ' ')
+			i++
+			j++
+		case dp[(i+1)*(m+1)+j] >= dp[i*(m+1)+j+1]:
+			kinds = append(kinds, '-')
+			i++
+		default:
+			kinds = append(kinds, '+')
+			j++
+		}
+	}
+	for ; i < n; i++ {
+		kinds = append(kinds, '-')
+	}
+	for ; j < m; j++ {
+		kinds = append(kinds, '+')
+	}
+	return kinds
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// dirListingTTL is how long a GetFiles result may be served from memory.
+const dirListingTTL = 5 * time.Second
+
+type dirListing struct {
+	files        []map[string]interface{}
+	modTime      time.Time
+	gitignoreMod time.Time
+	cachedAt     time.Time
+}
+
+// dirListingCache holds recent GetFiles results. An entry is only reused
+// while the directory and its .gitignore keep the mtimes they had when it
+// was stored; the file watcher also drops entries for directories it sees
+// change.
+type dirListingCache struct {
+	mu      sync.Mutex
+	entries map[string]dirListing
+}
+
+func dirListingStamps(path string) (time.Time, time.Time, bool) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, time.Time{}, false
+	}
+	var gitignoreMod time.Time
+	if gi, err := os.Stat(filepath.Join(path, ".gitignore")); err == nil {
+		gitignoreMod = gi.ModTime()
+	}
+	return info.ModTime(), gitignoreMod, true
+}
+
+func (c *dirListingCache) get(path string) ([]map[string]interface{}, bool) {
+	modTime, gitignoreMod, ok := dirListingStamps(path)
+	if !ok {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[path]
+	if !ok {
+		return nil, false
+	}
+	if time.Since(entry.cachedAt) > dirListingTTL || !entry.modTime.Equal(modTime) || !entry.gitignoreMod.Equal(gitignoreMod) {
+		delete(c.entries, path)
+		return nil, false
+	}
+	return append([]map[string]interface{}(nil), entry.files...), true
+}
+
+func (c *dirListingCache) put(path string, files []map[string]interface{}) {
+	modTime, gitignoreMod, ok := dirListingStamps(path)
+	if !ok {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[string]dirListing)
+	}
+	now := time.Now()
+	for p, entry := range c.entries {
+		if now.Sub(entry.cachedAt) > dirListingTTL {
+			delete(c.entries, p)
+		}
+	}
+	c.entries[path] = dirListing{
+		files:        append([]map[string]interface{}(nil), files...),
+		modTime:      modTime,
+		gitignoreMod: gitignoreMod,
+		cachedAt:     now,
+	}
+}
+
+// invalidate drops the listings affected by changes to the given paths.
+func (c *dirListingCache) invalidate(events []FileChangeEvent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, ev := range events {
+		delete(c.entries, filepath.Dir(ev.Path))
+		delete(c.entries, ev.Path)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Errors the frontend can tell apart. Wrap them with %w so the code survives
+// the "failed to ..." context added on the way up.
+var (
+	ErrSessionNotFound = errors.New("session not found")
+	ErrProviderAuth    = errors.New("provider authentication failed")
+	ErrContextCanceled = context.Canceled
+	ErrInvalidArgument = errors.New("invalid argument")
+	ErrModelNotFound   = errors.New("model not found")
+)
+
+// Error codes sent to the frontend.
+const (
+	errCodeSessionNotFound = "session_not_found"
+	errCodeProviderAuth    = "provider_auth"
+	errCodeCanceled        = "canceled"
+	errCodeInvalidArgument = "invalid_argument"
+	errCodeModelNotFound   = "model_not_found"
+	errCodeInternal        = "internal"
+)
+
+// AppError describes an App binding's error to the frontend, so the UI can
+// branch on Code instead of parsing Message.
+type AppError struct {
+	Code    string                 `json:"code"`
+	Message string                 `json:"message"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// appErrorEnvelope is what the frontend's promise is rejected with:
+// {"error": {"code", "message", "details"}}.
+type appErrorEnvelope struct {
+	Error AppError `json:"error"`
+}
+
+// detailedError attaches details for the frontend to an error without
+// changing its message.
+type detailedError struct {
+	err     error
+	details map[string]interface{}
+}
+
+func (e *detailedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *detailedError) Unwrap() error {
+	return e.err
+}
+
+// withErrorDetails attaches details to err; nil stays nil.
+func withErrorDetails(err error, details map[string]interface{}) error {
+	if err == nil {
+		return nil
+	}
+	return &detailedError{err: err, details: details}
+}
+
+// invalidArgument reports a bad binding argument with the given message.
+func invalidArgument(message string) error {
+	return fmt.Errorf("%w: %s", ErrInvalidArgument, message)
+}
+
+// errorCode maps err to the code of the first known error it wraps.
+func errorCode(err error) string {
+	switch {
+	case errors.Is(err, ErrInvalidArgument):
+		return errCodeInvalidArgument
+	case errors.Is(err, ErrSessionNotFound):
+		return errCodeSessionNotFound
+	case errors.Is(err, ErrModelNotFound):
+		return errCodeModelNotFound
+	case errors.Is(err, ErrProviderAuth):
+		return errCodeProviderAuth
+	case errors.Is(err, ErrContextCanceled):
+		return errCodeCanceled
+	default:
+		return errCodeInternal
+	}
+}
+
+// errorDetails merges the details attached along err's chain, outermost
+// first, plus the status code of a failed LLM request.
+func errorDetails(err error) map[string]interface{} {
+	details := map[string]interface{}{}
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		if de, ok := e.(*detailedError); ok {
+			for k, v := range de.details {
+				if _, exists := details[k]; !exists {
+					details[k] = v
+				}
+			}
+		}
+	}
+	var statusErr *llmStatusError
+	if errors.As(err, &statusErr) {
+		details["status"] = statusErr.StatusCode
+	}
+	if len(details) == 0 {
+		return nil
+	}
+	return details
+}
+
+// newAppError describes err for the frontend.
+func newAppError(err error) AppError {
+	return AppError{Code: errorCode(err), Message: err.Error(), Details: errorDetails(err)}
+}
+
+// formatAppError is the Wails ErrorFormatter: every error returned by an App
+// binding rejects the frontend's promise with an appErrorEnvelope.
+func formatAppError(err error) any {
+	return appErrorEnvelope{Error: newAppError(err)}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Event names emitted to the frontend.
+const (
+	fileMutationEventName   = "tool:file-change"
+	messageUpdatedEventName = "message:updated"
+	toolProgressEventName   = "tool:progress"
+)
+
+const (
+	maxSnapshotFileSize   = 1024 * 1024
+	maxEventDiffSize      = 64 * 1024
+	maxProgressArgSize    = 200
+	maxProgressResultSize = 2000
+)
+
+// SetEventEmitter registers the callback used to push events to the
+// frontend. It is wired to the Wails runtime at startup; without it events
+// are dropped.
+func (s *Service) SetEventEmitter(emit func(name string, data ...interface{})) {
+	s.eventMux.Lock()
+	s.eventEmitter = emit
+	s.eventMux.Unlock()
+}
+
+func (s *Service) hasEventEmitter() bool {
+	s.eventMux.RLock()
+	defer s.eventMux.RUnlock()
+	return s.eventEmitter != nil
+}
+
+func (s *Service) emitEvent(name string, data ...interface{}) {
+	s.eventMux.RLock()
+	emit := s.eventEmitter
+	s.eventMux.RUnlock()
+	if emit != nil {
+		emit(name, data...)
+	}
+}
+
+// fileMutator is implemented by tools that modify files, so their changes
+// can be reported to the frontend.
+type fileMutator interface {
+	MutatedPaths(args map[string]any) []string
+}
+
+type fileSnapshot struct {
+	path    string
+	exists  bool
+	content string
+	// skipped is set for files too large or binary to diff.
+	skipped bool
+}
+
+func (s *Service) snapshotFile(path string) fileSnapshot {
+	snap := fileSnapshot{path: s.resolveWorkspacePath(path)}
+	info, err := os.Stat(snap.path)
+	if err != nil {
+		return snap
+	}
+	snap.exists = true
+	if info.IsDir() || info.Size() > maxSnapshotFileSize {
+		snap.skipped = true
+		return snap
+	}
+	data, err := os.ReadFile(snap.path)
+	if err != nil || looksBinary(data) {
+		snap.skipped = true
+		return snap
+	}
+	snap.content = string(data)
+	return snap
+}
+
+// emitFileMutations reports the effect of a file-mutating tool call by
+// diffing the snapshots taken before it ran against the files on disk now.
+func (s *Service) emitFileMutations(sessionID string, call ToolCall, before []fileSnapshot, result ToolResult) {
+	for _, prev := range before {
+		after := s.snapshotFile(prev.path)
+
+		change := "modify"
+		switch {
+		case !prev.exists && after.exists:
+			change = "create"
+		case prev.exists && !after.exists:
+			change = "delete"
+		case !prev.exists && !after.exists:
+			change = "none"
+		}
+
+		diff := ""
+		if !prev.skipped && !after.skipped {
+			oldName, newName := prev.path, prev.path
+			if rel, err := filepath.Rel(s.GetWorkspaceDirectory(), prev.path); err == nil && !strings.HasPrefix(rel, "..") {
+				oldName, newName = "a/"+filepath.ToSlash(rel), "b/"+filepath.ToSlash(rel)
+			}
+			diff = unifiedDiff(oldName, newName, prev.content, after.content)
+			if len(diff) > maxEventDiffSize {
+				cut := strings.LastIndex(diff[:maxEventDiffSize], "\n")
+				diff = diff[:cut+1] + "... (diff truncated)\n"
+			}
+		}
+
+		s.emitEvent(fileMutationEventName, map[string]interface{}{
+			"sessionId": sessionID,
+			"callId":    result.ToolCallID,
+			"tool":      call.Name,
+			"path":      prev.path,
+			"change":    change,
+			"diff":      diff,
+			"isError":   result.IsError,
+			"timestamp": time.Now().UnixMilli(),
+		})
+	}
+}
+
+// toolProgressEnabled reports whether tool progress events should be sent.
+// They are opt-in through the "toolProgressEvents" config.
+func (s *Service) toolProgressEnabled() bool {
+	return s.hasEventEmitter() && s.configBool("toolProgressEvents", false)
+}
+
+// emitToolProgress reports that a tool call started (res is nil) or
+// finished. Args and results are shortened; the full result still goes to
+// the model.
+func (s *Service) emitToolProgress(sessionID string, call ToolCall, res *ToolResult, started time.Time) {
+	args := make(map[string]string, len(call.Args))
+	for k, v := range call.Args {
+		text := fmt.Sprint(v)
+		if kept := truncateRunes(text, maxProgressArgSize); len(kept) < len(text) {
+			text = kept + "..."
+		}
+		args[k] = text
+	}
+
+	payload := map[string]interface{}{
+		"sessionId": sessionID,
+		"callId":    call.ID,
+		"tool":      call.Name,
+		"args":      args,
+		"phase":     "start",
+		"timestamp": time.Now().UnixMilli(),
+	}
+	if res != nil {
+		result := res.Content
+		if kept := truncateUTF8(result, maxProgressResultSize); len(kept) < len(result) {
+			result = kept + "\n... (truncated)"
+		}
+		payload["phase"] = "end"
+		payload["result"] = result
+		payload["isError"] = res.IsError
+		payload["durationMs"] = time.Since(started).Milliseconds()
+	}
+	s.emitEvent(toolProgressEventName, payload)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// maxAttachedFileSize caps how much of an attached file is sent.
+const maxAttachedFileSize = 64 * 1024
+
+// FileAttachment is a workspace file attached to the next message of a
+// session. The file is read again when the message is sent; Hash tells
+// whether it changed in between.
+type FileAttachment struct {
+	Path       string `json:"path"`
+	Size       int64  `json:"size"`
+	Hash       string `json:"hash"`
+	Language   string `json:"language,omitempty"`
+	AttachedAt int64  `json:"attachedAt"`
+}
+
+// sentFile is an attached file as read at send time: the block added to
+// the request and the part stored in the session.
+type sentFile struct {
+	block string
+	part  map[string]interface{}
+}
+
+// messageAttachments is what a user message carries besides its text.
+type messageAttachments struct {
+	images []imageAttachment
+	files  []sentFile
+}
+
+// fileLanguages maps extensions to the language label of attached files.
+var fileLanguages = map[string]string{
+	".go": "go", ".py": "python", ".js": "javascript", ".jsx": "jsx",
+	".ts": "typescript", ".tsx": "tsx", ".rs": "rust", ".java": "java",
+	".c": "c", ".h": "c", ".cpp": "cpp", ".cc": "cpp", ".hpp": "cpp",
+	".cs": "csharp", ".rb": "ruby", ".php": "php", ".swift": "swift",
+	".kt": "kotlin", ".sh": "bash", ".sql": "sql", ".html": "html",
+	".css": "css", ".json": "json", ".yaml": "yaml", ".yml": "yaml",
+	".toml": "toml", ".md": "markdown", ".xml": "xml",
+}
+
+// fileLanguage returns the language label for path, or "" if unknown.
+func fileLanguage(path string) string {
+	return fileLanguages[strings.ToLower(filepath.Ext(path))]
+}
+
+// readAttachedFile reads an attached workspace file.
+func (s *Service) readAttachedFile(path string) ([]byte, error) {
+	resolved, err := s.workspaceFilePath(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidArgument, err)
+	}
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("%w: %s is a directory, not a file", ErrInvalidArgument, path)
+	}
+	return os.ReadFile(resolved)
+}
+
+func hashFileContent(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// AttachFileToMessage attaches a workspace file to the next message sent
+// in the session. Attaching the same path again refreshes it.
+func (s *Service) AttachFileToMessage(sessionID, path string) (FileAttachment, error) {
+	if _, err := s.GetSession(sessionID); err != nil {
+		return FileAttachment{}, err
+	}
+	path = filepath.ToSlash(filepath.Clean(strings.TrimSpace(path)))
+	data, err := s.readAttachedFile(path)
+	if err != nil {
+		return FileAttachment{}, fmt.Errorf("failed to attach %s: %w", path, err)
+	}
+	if bytes.IndexByte(data, 0) >= 0 {
+		return FileAttachment{}, fmt.Errorf("%w: %s is a binary file", ErrInvalidArgument, path)
+	}
+
+	attachment := FileAttachment{
+		Path:       path,
+		Size:       int64(len(data)),
+		Hash:       hashFileContent(data),
+		Language:   fileLanguage(path),
+		AttachedAt: time.Now().UnixMilli(),
+	}
+
+	s.pendingFilesMux.Lock()
+	defer s.pendingFilesMux.Unlock()
+	if s.pendingFiles == nil {
+		s.pendingFiles = map[string][]FileAttachment{}
+	}
+	files := s.pendingFiles[sessionID]
+	for i, f := range files {
+		if f.Path == path {
+			files[i] = attachment
+			return attachment, nil
+		}
+	}
+	s.pendingFiles[sessionID] = append(files, attachment)
+	return attachment, nil
+}
+
+// GetPendingAttachments returns the files attached to the session's next
+// message.
+func (s *Service) GetPendingAttachments(sessionID string) []FileAttachment {
+	s.pendingFilesMux.Lock()
+	defer s.pendingFilesMux.Unlock()
+	return append([]FileAttachment{}, s.pendingFiles[sessionID]...)
+}
+
+// RemoveFileAttachment detaches a file from the session's next message.
+func (s *Service) RemoveFileAttachment(sessionID, path string) {
+	path = filepath.ToSlash(filepath.Clean(strings.TrimSpace(path)))
+	s.pendingFilesMux.Lock()
+	defer s.pendingFilesMux.Unlock()
+	files := s.pendingFiles[sessionID]
+	for i, f := range files {
+		if f.Path == path {
+			s.pendingFiles[sessionID] = append(files[:i:i], files[i+1:]...)
+			break
+		}
+	}
+	if len(s.pendingFiles[sessionID]) == 0 {
+		delete(s.pendingFiles, sessionID)
+	}
+}
+
+// clearPendingAttachments drops the attachments that were sent, keeping any
+// attached while the message was in flight.
+func (s *Service) clearPendingAttachments(sessionID string, sent []FileAttachment) {
+	s.pendingFilesMux.Lock()
+	defer s.pendingFilesMux.Unlock()
+	var kept []FileAttachment
+	for _, f := range s.pendingFiles[sessionID] {
+		wasSent := false
+		for _, done := range sent {
+			if done == f {
+				wasSent = true
+				break
+			}
+		}
+		if !wasSent {
+			kept = append(kept, f)
+		}
+	}
+	if len(kept) == 0 {
+		delete(s.pendingFiles, sessionID)
+		return
+	}
+	s.pendingFiles[sessionID] = kept
+}
+
+// readPendingFile reads an attachment at send time. A file that changed
+// since it was attached is sent as it is now, with a note; one that is gone
+// is sent as a note.
+func (s *Service) readPendingFile(attachment FileAttachment) sentFile {
+	part := map[string]interface{}{
+		"type":     "file",
+		"path":     attachment.Path,
+		"language": attachment.Language,
+	}
+	note := func(msg string) sentFile {
+		part["error"] = msg
+		return sentFile{
+			block: fmt.Sprintf("<file path=%q>\n[%s]\n</file>", attachment.Path, msg),
+			part:  part,
+		}
+	}
+
+	data, err := s.readAttachedFile(attachment.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return note("file was removed after it was attached")
+		}
+		return note(fmt.Sprintf("could not read file: %v", err))
+	}
+	hash := hashFileContent(data)
+	part["size"] = len(data)
+	part["hash"] = hash
+
+	var header strings.Builder
+	fmt.Fprintf(&header, "<file path=%q", attachment.Path)
+	if attachment.Language != "" {
+		fmt.Fprintf(&header, " language=%q", attachment.Language)
+	}
+	header.WriteString(">\n")
+	if hash != attachment.Hash {
+		part["changed"] = true
+		header.WriteString("[changed since it was attached; current content below]\n")
+	}
+
+	text := truncateUTF8(string(data), maxAttachedFileSize)
+	if len(text) < len(data) {
+		part["truncated"] = true
+		text += fmt.Sprintf("\n... (truncated, %d of %d bytes shown)", len(text), len(data))
+	}
+	return sentFile{block: header.String() + text + "\n</file>", part: part}
+}
+
+// storedFileAttachments returns the files attached to a stored user
+// message.
+func storedFileAttachments(msg map[string]interface{}) []FileAttachment {
+	parts, _ := storedParts(msg)
+	var files []FileAttachment
+	for _, part := range parts {
+		if partType, _ := part["type"].(string); partType != "file" {
+			continue
+		}
+		path, _ := part["path"].(string)
+		hash, _ := part["hash"].(string)
+		language, _ := part["language"].(string)
+		files = append(files, FileAttachment{Path: path, Hash: hash, Language: language})
+	}
+	return files
+}
+
+// historyFiles reads the files attached to a stored user message again, so
+// a replayed message carries them like its images. A file that changed since
+// the message was sent is replayed as it is now, with a note.
+func (s *Service) historyFiles(msg map[string]interface{}) []sentFile {
+	var files []sentFile
+	for _, f := range storedFileAttachments(msg) {
+		files = append(files, s.readPendingFile(f))
+	}
+	return files
+}
+
+// withAttachedFiles appends the attached files to a message's content.
+func withAttachedFiles(content string, files []sentFile) string {
+	if len(files) == 0 {
+		return content
+	}
+	blocks := make([]string, len(files))
+	for i, f := range files {
+		blocks[i] = f.block
+	}
+	return content + "\n\nAttached files:\n\n" + strings.Join(blocks, "\n\n")
+}
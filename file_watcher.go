@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// FileChangeEvent is the payload emitted for each changed path.
+type FileChangeEvent struct {
+	Path string `json:"path"`
+	Op   string `json:"op"` // create, modify, delete
+}
+
+const (
+	fileChangeEventName   = "fs:change"
+	fileWatchDebounceTime = 300 * time.Millisecond
+)
+
+// fileWatcher recursively watches a directory tree and reports debounced
+// change batches. fsnotify only watches single directories, so every
+// non-ignored subdirectory is added individually and new ones are picked up
+// as they are created.
+type fileWatcher struct {
+	watcher *fsnotify.Watcher
+	root    string
+	ignored map[string]bool
+	emit    func(events []FileChangeEvent)
+	done    chan struct{}
+	stopped sync.WaitGroup
+}
+
+func newFileWatcher(root string, emit func(events []FileChangeEvent)) (*fileWatcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create watcher: %w", err)
+	}
+	fw := &fileWatcher{
+		watcher: w,
+		root:    root,
+		ignored: loadIgnoredDirs(root),
+		emit:    emit,
+		done:    make(chan struct{}),
+	}
+	if err := fw.addRecursive(root); err != nil {
+		_ = w.Close()
+		return nil, err
+	}
+	fw.stopped.Add(1)
+	go fw.run()
+	return fw, nil
+}
+
+func (fw *fileWatcher) addRecursive(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			if path == dir {
+				return err
+			}
+			return nil
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if path != dir && fw.ignored[d.Name()] {
+			return filepath.SkipDir
+		}
+		if err := fw.watcher.Add(path); err != nil {
+			fmt.Printf("Warning: Failed to watch %s: %v\n", path, err)
+		}
+		return nil
+	})
+}
+
+// isIgnored reports whether any component of path below the root is on the
+// ignore list.
+func (fw *fileWatcher) isIgnored(path string) bool {
+	rel, err := filepath.Rel(fw.root, path)
+	if err != nil {
+		return false
+	}
+	for _, part := range strings.Split(filepath.ToSlash(rel), "/") {
+		if fw.ignored[part] {
+			return true
+		}
+	}
+	return false
+}
+
+func (fw *fileWatcher) run() {
+	defer fw.stopped.Done()
+
+	pending := map[string]string{}
+	order := []string{}
+	var timer *time.Timer
+	var timerC <-chan time.Time
+
+	flush := func() {
+		if len(order) == 0 {
+			return
+		}
+		events := make([]FileChangeEvent, 0, len(order))
+		for _, path := range order {
+			events = append(events, FileChangeEvent{Path: path, Op: pending[path]})
+		}
+		pending = map[string]string{}
+		order = order[:0]
+		fw.emit(events)
+	}
+
+	for {
+		select {
+		case <-fw.done:
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		case ev, ok := <-fw.watcher.Events:
+			if !ok {
+				return
+			}
+			op := fileChangeOp(ev.Op)
+			if op == "" || fw.isIgnored(ev.Name) {
+				continue
+			}
+			if op == "create" {
+				if info, err := os.Stat(ev.Name); err == nil && info.IsDir() {
+					_ = fw.addRecursive(ev.Name)
+				}
+			}
+			prev, seen := pending[ev.Name]
+			if !seen {
+				order = append(order, ev.Name)
+			}
+			// A file created and then written within one window is still a create.
+			if !(prev == "create" && op == "modify") {
+				pending[ev.Name] = op
+			}
+			if timer == nil {
+				timer = time.NewTimer(fileWatchDebounceTime)
+				timerC = timer.C
+			} else {
+				timer.Reset(fileWatchDebounceTime)
+			}
+		case <-timerC:
+			timer = nil
+			timerC = nil
+			flush()
+		case err, ok := <-fw.watcher.Errors:
+			if !ok {
+				return
+			}
+			fmt.Printf("Warning: File watcher error: %v\n", err)
+		}
+	}
+}
+
+func (fw *fileWatcher) close() error {
+	close(fw.done)
+	err := fw.watcher.Close()
+	fw.stopped.Wait()
+	return err
+}
+
+func fileChangeOp(op fsnotify.Op) string {
+	switch {
+	case op.Has(fsnotify.Create):
+		return "create"
+	case op.Has(fsnotify.Remove), op.Has(fsnotify.Rename):
+		return "delete"
+	case op.Has(fsnotify.Write):
+		return "modify"
+	default:
+		return ""
+	}
+}
+
+// WatchDirectory starts watching path (the workspace when empty) and calls
+// emit with batches of changes. Any previous watch is stopped first.
+func (s *Service) WatchDirectory(path string, emit func(events []FileChangeEvent)) error {
+	if path == "" {
+		path = s.GetWorkspaceDirectory()
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(s.GetWorkspaceDirectory(), path)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("path is not a directory")
+	}
+
+	s.watcherMux.Lock()
+	defer s.watcherMux.Unlock()
+
+	if s.watcher != nil {
+		_ = s.watcher.close()
+		s.watcher = nil
+	}
+
+	fw, err := newFileWatcher(path, func(events []FileChangeEvent) {
+		s.dirCache.invalidate(events)
+		emit(events)
+	})
+	if err != nil {
+		return err
+	}
+	s.watcher = fw
+	return nil
+}
+
+// StopWatch stops the active directory watch, if any.
+func (s *Service) StopWatch() error {
+	s.watcherMux.Lock()
+	defer s.watcherMux.Unlock()
+
+	if s.watcher == nil {
+		return nil
+	}
+	err := s.watcher.close()
+	s.watcher = nil
+	return err
+}
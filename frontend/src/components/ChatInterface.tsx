@@ -13,9 +13,11 @@ import {
     Terminal as TerminalIcon,
     Architecture as PlanIcon,
     Build as ActIcon,
+    RateReview as ReviewIcon,
     BugReport as DebugIcon
 } from '@mui/icons-material';
 import { GetSessionMessages, SendMessage, AbortSession, SummarizeSession, GetProviders, GetAgents, FindFilesByName, RunCommandDetailed } from '../../wailsjs/go/main/App';
+import { errorMessage, toAppError } from '../errors';
 
 // --- Interfaces ---
 
@@ -35,12 +37,24 @@ interface Message {
     rawRequest?: string;
     rawResponse?: string;
     rawTurns?: any[];
+    mock?: boolean;
+    reasoning?: string;
 }
 
+// reasoningText returns the model's reasoning stored as "reasoning" parts.
+const reasoningText = (parts: any[] | undefined): string | undefined => {
+    const text = (parts || [])
+        .filter((p: any) => p?.type === 'reasoning' && p?.text)
+        .map((p: any) => p.text)
+        .join('\n\n');
+    return text || undefined;
+};
+
 interface Model {
     id: string;
     name: string;
     provider: string;
+    capabilities?: string[];
 }
 
 // --- Helper Components ---
@@ -417,6 +431,7 @@ const ChatInterface: React.FC<ChatInterfaceProps> = ({ sessionId, onOpenFile, on
     const [messages, setMessages] = useState<Message[]>([]);
     const [loading, setLoading] = useState(false);
     const [rawOpenById, setRawOpenById] = useState<Record<string, boolean>>({});
+    const [reasoningOpenById, setReasoningOpenById] = useState<Record<string, boolean>>({});
     const [showRawEnabled, setShowRawEnabled] = useState<boolean>(() => {
         try {
             const savedV3 = localStorage.getItem('openspace.showRaw.v3');
@@ -433,7 +448,7 @@ const ChatInterface: React.FC<ChatInterfaceProps> = ({ sessionId, onOpenFile, on
     
     const [, setAgents] = useState<any[]>([]);
     const [selectedAgent, setSelectedAgent] = useState('');
-    const [mode, setMode] = useState<'plan' | 'act'>('act');
+    const [mode, setMode] = useState<'plan' | 'review' | 'act'>('act');
     
     // Model menu
     const [modelAnchorEl, setModelAnchorEl] = useState<null | HTMLElement>(null);
@@ -451,10 +466,7 @@ const ChatInterface: React.FC<ChatInterfaceProps> = ({ sessionId, onOpenFile, on
             const [providerId, modelId] = value.split('::', 2);
             return { providerId: providerId || '', modelId: modelId || '' };
         }
-        if (value.includes(':')) {
-            const [providerId, modelId] = value.split(':', 2);
-            return { providerId: providerId || '', modelId: modelId || '' };
-        }
+        // A single ':' is part of the model name (e.g. Ollama's "llama3:8b").
         return { providerId: '', modelId: value };
     };
 
@@ -479,6 +491,11 @@ const ChatInterface: React.FC<ChatInterfaceProps> = ({ sessionId, onOpenFile, on
         }
     };
 
+    // Act mode runs the tool loop, so offer only models known to support
+    // tools there, unless none are known.
+    const toolModels = models.filter(m => m.capabilities?.includes('tools') || m.id === selectedModel);
+    const menuModels = mode === 'act' && toolModels.some(m => m.id !== selectedModel) ? toolModels : models;
+
     const loadConfig = async () => {
         try {
             const modelsData = await GetProviders();
@@ -494,13 +511,21 @@ const ChatInterface: React.FC<ChatInterfaceProps> = ({ sessionId, onOpenFile, on
                              const modelId = m.id || '';
                              const compositeId = providerId && modelId ? `${providerId}::${modelId}` : (modelId || providerId);
                              const displayName = `${pName}: ${m.name || modelId || compositeId}`;
-                             modelsList.push({ id: compositeId, name: displayName, provider: pName });
+                             modelsList.push({ id: compositeId, name: displayName, provider: pName, capabilities: Array.isArray(m.capabilities) ? m.capabilities : undefined });
                          });
                      }
                  });
             }
             setModels(modelsList);
-            if (modelsList.length > 0) setSelectedModel(modelsList[0].id);
+            // Keep an explicit choice; only fall back to the configured default.
+            const defaults = parsedModels.default || {};
+            const defaultEntry = Object.entries(defaults)[0] as [string, string] | undefined;
+            const defaultId = defaultEntry ? `${defaultEntry[0]}::${defaultEntry[1]}` : '';
+            setSelectedModel(prev => {
+                if (prev && modelsList.some(m => m.id === prev)) return prev;
+                if (defaultId && modelsList.some(m => m.id === defaultId)) return defaultId;
+                return modelsList.length > 0 ? modelsList[0].id : '';
+            });
 
             const agentsData = await GetAgents();
             const parsedAgents = JSON.parse(agentsData);
@@ -525,7 +550,9 @@ const ChatInterface: React.FC<ChatInterfaceProps> = ({ sessionId, onOpenFile, on
                 model: item.info?.model,
                 rawRequest: item.info?.rawRequest,
                 rawResponse: item.info?.rawResponse,
-                rawTurns: item.info?.rawTurns
+                rawTurns: item.info?.rawTurns,
+                mock: item.info?.mock === true,
+                reasoning: reasoningText(item.parts)
             }));
             setMessages(history);
         } catch (e) {
@@ -584,7 +611,7 @@ const ChatInterface: React.FC<ChatInterfaceProps> = ({ sessionId, onOpenFile, on
                 console.error(e);
                 const errorMsg: Message = {
                     role: 'system',
-                    text: `Error executing command "${args}":\n${e}`,
+                    text: `Error executing command "${args}":\n${errorMessage(e)}`,
                     timestamp: new Date()
                 };
                 setMessages(prev => [...prev, errorMsg]);
@@ -636,7 +663,9 @@ const ChatInterface: React.FC<ChatInterfaceProps> = ({ sessionId, onOpenFile, on
             // Or use a slash command convention for now since we haven't updated the backend signature yet
             // Actually, let's prepend it as a system instruction in the user message for now
             // "[MODE: PLAN] user message"
-            const messageToSend = mode === 'plan' ? `[MODE: PLAN] ${userMsg.text}` : userMsg.text;
+            const messageToSend = mode === 'plan'
+                ? `[MODE: PLAN] ${userMsg.text}`
+                : mode === 'review' ? `[MODE: REVIEW] ${userMsg.text}` : userMsg.text;
             
             const res = await SendMessage(sessionId, messageToSend, selectedModel, selectedAgent);
             const parsed = JSON.parse(res);
@@ -649,7 +678,9 @@ const ChatInterface: React.FC<ChatInterfaceProps> = ({ sessionId, onOpenFile, on
                 timestamp: new Date(),
                 model: parsed.info?.model,
                 rawResponse: parsed.info?.rawResponse,
-                rawTurns: parsed.info?.rawTurns
+                rawTurns: parsed.info?.rawTurns,
+                mock: parsed.info?.mock === true,
+                reasoning: reasoningText(parsed.parts)
             };
             setMessages(prev => {
                 const updated = prev.map(m => {
@@ -665,7 +696,10 @@ const ChatInterface: React.FC<ChatInterfaceProps> = ({ sessionId, onOpenFile, on
             setModelStatus('idle');
         } catch (e) {
             console.error(e);
-            const errText = String(e);
+            const err = toAppError(e);
+            const errText = err.code === 'provider_auth'
+                ? `${err.message}\n\n请在设置中检查该 Provider 的 API Key。`
+                : err.message;
             setMessages(prev => [...prev, { role: 'system', text: `发送失败：${errText}`, timestamp: new Date() }]);
             setModelStatus('error');
         } finally {
@@ -687,7 +721,7 @@ const ChatInterface: React.FC<ChatInterfaceProps> = ({ sessionId, onOpenFile, on
             setMessages(prev => [...prev, { role: 'system', text: `Session Summary:\n\n${summaryText}`, timestamp: new Date() }]);
         } catch (e) {
             console.error(e);
-            setMessages(prev => [...prev, { role: 'system', text: `总结失败：${e}`, timestamp: new Date() }]);
+            setMessages(prev => [...prev, { role: 'system', text: `总结失败：${errorMessage(e)}`, timestamp: new Date() }]);
         }
     };
 
@@ -713,6 +747,16 @@ const ChatInterface: React.FC<ChatInterfaceProps> = ({ sessionId, onOpenFile, on
         return Boolean(rawOpenById[key]);
     };
 
+    const toggleReasoning = (msg: Message, fallbackIndex: number) => {
+        const key = msg.id || `idx_${fallbackIndex}`;
+        setReasoningOpenById(prev => ({ ...prev, [key]: !prev[key] }));
+    };
+
+    const isReasoningOpen = (msg: Message, fallbackIndex: number) => {
+        const key = msg.id || `idx_${fallbackIndex}`;
+        return Boolean(reasoningOpenById[key]);
+    };
+
     const renderRawTurns = (msg: Message) => {
         const turns = Array.isArray(msg.rawTurns) ? msg.rawTurns : [];
         if (!msg.rawRequest && !msg.rawResponse && turns.length === 0) {
@@ -824,6 +868,24 @@ const ChatInterface: React.FC<ChatInterfaceProps> = ({ sessionId, onOpenFile, on
                             <Typography variant="caption" sx={{ ml: 0.5, fontWeight: mode === 'plan' ? 'bold' : 'normal' }}>Plan</Typography>
                         </Button>
                     </Tooltip>
+                    <Tooltip title="Review Mode: Read-only analysis, no files, commands or todos are changed">
+                        <Button 
+                            size="small" 
+                            onClick={() => setMode('review')}
+                            sx={{ 
+                                minWidth: 0, 
+                                px: 1,
+                                py: 0.5,
+                                color: mode === 'review' ? 'var(--warning, #ff9800)' : 'var(--text-secondary)',
+                                bgcolor: mode === 'review' ? 'rgba(255, 152, 0, 0.1)' : 'transparent',
+                                borderRadius: 0,
+                                borderRight: '1px solid var(--border-color)'
+                            }}
+                        >
+                            <ReviewIcon fontSize="small" />
+                            <Typography variant="caption" sx={{ ml: 0.5, fontWeight: mode === 'review' ? 'bold' : 'normal' }}>Review</Typography>
+                        </Button>
+                    </Tooltip>
                     <Tooltip title="Act Mode: Execute changes and run commands">
                         <Button 
                             size="small" 
@@ -867,7 +929,7 @@ const ChatInterface: React.FC<ChatInterfaceProps> = ({ sessionId, onOpenFile, on
                     open={Boolean(modelAnchorEl)}
                     onClose={() => setModelAnchorEl(null)}
                 >
-                    {models.map((m) => (
+                    {menuModels.map((m) => (
                         <MenuItem 
                             key={m.id} 
                             selected={m.id === selectedModel}
@@ -921,6 +983,21 @@ const ChatInterface: React.FC<ChatInterfaceProps> = ({ sessionId, onOpenFile, on
                             <Typography variant="caption" sx={{ color: 'var(--text-secondary)' }}>
                                 {msg.role.toUpperCase()} • {msg.timestamp.toLocaleTimeString()}
                             </Typography>
+                            {msg.mock && (
+                                <Typography variant="caption" sx={{ color: 'var(--warning, #ff9800)' }}>
+                                    MOCK
+                                </Typography>
+                            )}
+                            {msg.reasoning && (
+                                <Button
+                                    size="small"
+                                    variant="text"
+                                    onClick={() => toggleReasoning(msg, i)}
+                                    sx={{ ml: 1, textTransform: 'none', color: 'var(--text-secondary)', fontSize: '0.7rem' }}
+                                >
+                                    {isReasoningOpen(msg, i) ? 'Hide Thinking' : 'Show Thinking'}
+                                </Button>
+                            )}
                             {showRawEnabled && msg.role !== 'system' && (
                                 <Button
                                     size="small"
@@ -945,8 +1022,15 @@ const ChatInterface: React.FC<ChatInterfaceProps> = ({ sessionId, onOpenFile, on
                             color: 'var(--text-primary)',
                             borderTopRightRadius: msg.role === 'user' ? 0 : 2,
                             borderTopLeftRadius: msg.role === 'assistant' ? 0 : 2,
-                            border: '1px solid var(--border-color)'
+                            border: msg.mock ? '1px solid var(--warning, #ff9800)' : '1px solid var(--border-color)'
                         }}>
+                            {msg.reasoning && isReasoningOpen(msg, i) && (
+                                <Box sx={{ mb: 1.5, pl: 1.5, borderLeft: '2px solid var(--border-color)', color: 'var(--text-secondary)' }}>
+                                    <Typography variant="body2" sx={{ whiteSpace: 'pre-wrap', color: 'inherit' }}>
+                                        {msg.reasoning}
+                                    </Typography>
+                                </Box>
+                            )}
                             {msg.searchResults ? (
                                 <Box sx={{ color: 'inherit' }}>
                                     <Typography variant="subtitle2" sx={{ mb: 1, color: 'inherit' }}>{msg.text}</Typography>
@@ -6,6 +6,7 @@ import {
     DeleteCustomLLMService,
     TestCustomLLMService
 } from '../../wailsjs/go/main/App';
+import { errorMessage } from '../errors';
 
 interface CustomLLMService {
     id: string;
@@ -19,6 +20,7 @@ interface CustomLLMService {
     provider: string;
     enabled: boolean;
     contextLimit?: number;
+    keepAlive?: string;
 }
 
 interface CustomLLMConfigProps {
@@ -66,7 +68,7 @@ const CustomLLMConfig: React.FC<CustomLLMConfigProps> = ({ onClose }) => {
             setIsAddingNew(false);
         } catch (e) {
             console.error('Failed to save service:', e);
-            alert('Failed to save service: ' + e);
+            alert('Failed to save service: ' + errorMessage(e));
         }
     };
 
@@ -77,7 +79,7 @@ const CustomLLMConfig: React.FC<CustomLLMConfigProps> = ({ onClose }) => {
             await loadServices();
         } catch (e) {
             console.error('Failed to delete service:', e);
-            alert('Failed to delete service: ' + e);
+            alert('Failed to delete service: ' + errorMessage(e));
         }
     };
 
@@ -92,7 +94,7 @@ const CustomLLMConfig: React.FC<CustomLLMConfigProps> = ({ onClose }) => {
             console.error('Failed to test service:', e);
             setTestResult({
                 success: false,
-                error: 'Failed to test service: ' + e
+                error: 'Failed to test service: ' + errorMessage(e)
             });
         } finally {
             setTesting(false);
@@ -213,9 +215,11 @@ const CustomLLMConfig: React.FC<CustomLLMConfigProps> = ({ onClose }) => {
                         value={formData.provider || 'openai'}
                         onChange={(e) => setFormData({ ...formData, provider: e.target.value })}
                     >
-                        <option value="openai">OpenAI Compatible</option>
+                        <option value="openai">OpenAI</option>
                         <option value="anthropic">Anthropic</option>
+                        <option value="gemini">Gemini</option>
                         <option value="ollama">Ollama</option>
+                        <option value="custom">Other OpenAI Compatible</option>
                     </select>
                 </div>
 
@@ -327,6 +331,18 @@ const CustomLLMConfig: React.FC<CustomLLMConfigProps> = ({ onClose }) => {
                     />
                 </div>
 
+                {formData.provider === 'ollama' && (
+                    <div className="form-group">
+                        <label>Keep Alive</label>
+                        <input
+                            type="text"
+                            value={formData.keepAlive || ''}
+                            onChange={(e) => setFormData({ ...formData, keepAlive: e.target.value })}
+                            placeholder="30m (-1 keeps the model loaded)"
+                        />
+                    </div>
+                )}
+
                 <div className="form-group">
                     <label style={{ display: 'flex', alignItems: 'center', gap: '8px' }}>
                         <input
@@ -1,8 +1,11 @@
 import React, { useState, useEffect } from 'react';
-import { GetFileContent, SaveFileContent } from '../../wailsjs/go/main/App';
+import { GetFileContentRange, SaveFileContent } from '../../wailsjs/go/main/App';
 import Editor from '@monaco-editor/react';
 import { useTheme } from '../ThemeContext';
 
+// Large files are loaded in chunks; the editor stays read-only until the whole file is loaded.
+const CHUNK_SIZE = 512 * 1024;
+
 interface FileEditorProps {
     path: string;
     onClose: () => void;
@@ -14,6 +17,10 @@ const FileEditor: React.FC<FileEditorProps> = ({ path, onClose }) => {
     const [loading, setLoading] = useState(true);
     const [saving, setSaving] = useState(false);
     const [error, setError] = useState<string | null>(null);
+    const [isBinary, setIsBinary] = useState(false);
+    const [nextOffset, setNextOffset] = useState<number | null>(null);
+    const [totalSize, setTotalSize] = useState(0);
+    const [loadingMore, setLoadingMore] = useState(false);
 
     // Determine language from file extension
     const getLanguageFromPath = (filePath: string) => {
@@ -65,11 +72,20 @@ const FileEditor: React.FC<FileEditorProps> = ({ path, onClose }) => {
         const loadContent = async () => {
             setLoading(true);
             setError(null);
+            setIsBinary(false);
+            setNextOffset(null);
             try {
-                const data = await GetFileContent(path);
+                const data = await GetFileContentRange(path, 0, CHUNK_SIZE);
                 if (data) {
                     const parsed = JSON.parse(data);
-                    setContent(parsed.content || '');
+                    setTotalSize(parsed.totalSize || 0);
+                    if (parsed.isBinary) {
+                        setIsBinary(true);
+                        setContent('');
+                    } else {
+                        setContent(parsed.content || '');
+                        setNextOffset(parsed.eof ? null : parsed.offset + parsed.length);
+                    }
                 }
             } catch (e: any) {
                 console.error('Failed to load file content:', e);
@@ -81,6 +97,26 @@ const FileEditor: React.FC<FileEditorProps> = ({ path, onClose }) => {
         loadContent();
     }, [path]);
 
+    const loadMore = async () => {
+        if (nextOffset === null) return;
+        setLoadingMore(true);
+        try {
+            const data = await GetFileContentRange(path, nextOffset, CHUNK_SIZE);
+            if (data) {
+                const parsed = JSON.parse(data);
+                setContent(prev => prev + (parsed.content || ''));
+                setNextOffset(parsed.eof ? null : parsed.offset + parsed.length);
+            }
+        } catch (e: any) {
+            console.error('Failed to load file content:', e);
+            setError('Failed to load file content');
+        } finally {
+            setLoadingMore(false);
+        }
+    };
+
+    const isPartial = nextOffset !== null;
+
     const handleSave = async () => {
         setSaving(true);
         setError(null);
@@ -118,7 +154,7 @@ const FileEditor: React.FC<FileEditorProps> = ({ path, onClose }) => {
                 <div style={{ display: 'flex', gap: '8px' }}>
                     <button
                         onClick={handleSave}
-                        disabled={saving}
+                        disabled={saving || isBinary || isPartial}
                         style={{
                             padding: '4px 12px',
                             backgroundColor: 'var(--accent-color)',
@@ -153,23 +189,48 @@ const FileEditor: React.FC<FileEditorProps> = ({ path, onClose }) => {
                     {error}
                 </div>
             )}
-            <div style={{ flex: 1, overflow: 'hidden' }}>
-                <Editor
-                    height="100%"
-                    language={getLanguageFromPath(path)}
-                    value={content}
-                    theme={theme === 'dark' ? 'vs-dark' : 'light'}
-                    onChange={(value) => setContent(value || '')}
-                    options={{
-                        minimap: { enabled: true },
-                        fontSize: 14,
-                        wordWrap: 'on',
-                        automaticLayout: true,
-                        scrollBeyondLastLine: false,
-                        padding: { top: 16, bottom: 16 }
-                    }}
-                />
-            </div>
+            {isPartial && (
+                <div style={{ padding: '8px 16px', display: 'flex', alignItems: 'center', gap: '8px', fontSize: '12px', color: 'var(--text-secondary)', borderBottom: '1px solid var(--border-color)' }}>
+                    <span>Showing {nextOffset} of {totalSize} bytes (read-only until fully loaded)</span>
+                    <button
+                        onClick={loadMore}
+                        disabled={loadingMore}
+                        style={{
+                            padding: '2px 10px',
+                            backgroundColor: 'transparent',
+                            color: 'var(--accent-color)',
+                            border: '1px solid var(--border-color)',
+                            borderRadius: '4px',
+                            cursor: 'pointer',
+                            fontSize: '12px'
+                        }}
+                    >
+                        {loadingMore ? 'Loading...' : 'Load more'}
+                    </button>
+                </div>
+            )}
+            {isBinary ? (
+                <div style={{ padding: '20px', color: 'var(--text-secondary)' }}>Binary file ({totalSize} bytes) cannot be displayed.</div>
+            ) : (
+                <div style={{ flex: 1, overflow: 'hidden' }}>
+                    <Editor
+                        height="100%"
+                        language={getLanguageFromPath(path)}
+                        value={content}
+                        theme={theme === 'dark' ? 'vs-dark' : 'light'}
+                        onChange={(value) => setContent(value || '')}
+                        options={{
+                            readOnly: isPartial,
+                            minimap: { enabled: true },
+                            fontSize: 14,
+                            wordWrap: 'on',
+                            automaticLayout: true,
+                            scrollBeyondLastLine: false,
+                            padding: { top: 16, bottom: 16 }
+                        }}
+                    />
+                </div>
+            )}
         </div>
     );
 };
@@ -1,4 +1,4 @@
-import React, { useEffect, useMemo, useState } from 'react';
+import React, { useEffect, useMemo, useRef, useState } from 'react';
 import {
     Box,
     Button,
@@ -41,7 +41,9 @@ import {
     OpenInNew as OpenInNewIcon,
     Refresh as RefreshIcon
 } from '@mui/icons-material';
-import { CreateFile, CreateFolder, DeletePath, FindFilesByName, FindText, GetFiles, OpenCurrentDirectory, PickDirectory, RenamePath, RevealInExplorer, SetWorkspaceDirectory } from '../../wailsjs/go/main/App';
+import { CreateFile, CreateFolder, DeletePath, FindFilesByName, FindText, GetFiles, OpenCurrentDirectory, PickDirectory, RenamePath, RevealInExplorer, SetWorkspaceDirectory, StopWatch, WatchDirectory } from '../../wailsjs/go/main/App';
+import { EventsOn } from '../../wailsjs/runtime/runtime';
+import { errorMessage } from '../errors';
 
 interface FileNode {
     name: string;
@@ -171,7 +173,7 @@ const FileExplorer: React.FC<FileExplorerProps> = ({ onFileClick }) => {
             setSelectedPath(dir);
             await loadChildren(dir, true);
         } catch (e: any) {
-            showToast(e?.message || '选择文件夹失败');
+            showToast(errorMessage(e) || '选择文件夹失败');
         }
     };
 
@@ -238,6 +240,32 @@ const FileExplorer: React.FC<FileExplorerProps> = ({ onFileClick }) => {
         }
     }, []);
 
+    const expandedRef = useRef(expanded);
+    expandedRef.current = expanded;
+
+    useEffect(() => {
+        if (!rootPath) return;
+        WatchDirectory(rootPath).catch(() => {});
+        const off = EventsOn('fs:change', (events: { path: string; op: string }[]) => {
+            const dirs = new Set<string>();
+            for (const ev of events || []) {
+                dirs.add(dirname(ev.path));
+            }
+            setChildrenByPath(prev => {
+                const next = { ...prev };
+                for (const d of dirs) delete next[d];
+                return next;
+            });
+            for (const d of dirs) {
+                if (d === rootPath || expandedRef.current.has(d)) loadChildren(d, true);
+            }
+        });
+        return () => {
+            off();
+            StopWatch().catch(() => {});
+        };
+    }, [rootPath]);
+
     const treeRootNode: FileNode | null = useMemo(() => {
         if (!rootPath) return null;
         return { name: basename(rootPath), path: rootPath, isDir: true };
@@ -268,7 +296,7 @@ const FileExplorer: React.FC<FileExplorerProps> = ({ onFileClick }) => {
         try {
             await RevealInExplorer(path);
         } catch (e: any) {
-            showToast(e?.message || '打开文件管理器失败');
+            showToast(errorMessage(e) || '打开文件管理器失败');
         }
     };
 
@@ -367,7 +395,7 @@ const FileExplorer: React.FC<FileExplorerProps> = ({ onFileClick }) => {
             showToast('已重命名');
             setRenameDialog(null);
         } catch (e: any) {
-            showToast(e?.message || '重命名失败');
+            showToast(errorMessage(e) || '重命名失败');
         }
     };
 
@@ -392,7 +420,7 @@ const FileExplorer: React.FC<FileExplorerProps> = ({ onFileClick }) => {
             showToast(createDialog.kind === 'folder' ? '已创建文件夹' : '已创建文件');
             setCreateDialog(null);
         } catch (e: any) {
-            showToast(e?.message || '创建失败');
+            showToast(errorMessage(e) || '创建失败');
         }
     };
 
@@ -417,7 +445,7 @@ const FileExplorer: React.FC<FileExplorerProps> = ({ onFileClick }) => {
             showToast('已删除');
             setDeleteDialog(null);
         } catch (e: any) {
-            showToast(e?.message || '删除失败');
+            showToast(errorMessage(e) || '删除失败');
         }
     };
 
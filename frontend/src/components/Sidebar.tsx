@@ -1,5 +1,5 @@
 import React, { useState, useEffect } from 'react';
-import { GetSessions, GetSessionStatus, CreateSession, DeleteSession } from '../../wailsjs/go/main/App';
+import { CompactStorage, GetSessions, GetSessionStatus, GetTrash, CreateSession, DeleteSession, PurgeTrash, RestoreSession } from '../../wailsjs/go/main/App';
 import { useTheme } from '../ThemeContext';
 
 interface SidebarProps {
@@ -13,6 +13,8 @@ const Sidebar: React.FC<SidebarProps> = ({ onSelectSession, onShowConfig }) => {
     const [activeSession, setActiveSession] = useState<string | null>(null);
 
     const [sessionStatuses, setSessionStatuses] = useState<{ [key: string]: any }>({});
+    const [trash, setTrash] = useState<any[]>([]);
+    const [showTrash, setShowTrash] = useState(false);
 
     const loadSessions = async () => {
         try {
@@ -60,10 +62,11 @@ const Sidebar: React.FC<SidebarProps> = ({ onSelectSession, onShowConfig }) => {
 
     const handleDeleteSession = async (e: React.MouseEvent, id: string) => {
         e.stopPropagation();
-        if (!window.confirm('Are you sure you want to delete this session?')) return;
+        if (!window.confirm('Move this session to the trash?')) return;
         try {
             await DeleteSession(id);
             setSessions(prev => prev.filter(s => (s.id || s.ID) !== id));
+            if (showTrash) loadTrash();
             if (activeSession === id) {
                 setActiveSession(null);
                 onSelectSession('');
@@ -74,6 +77,55 @@ const Sidebar: React.FC<SidebarProps> = ({ onSelectSession, onShowConfig }) => {
         }
     };
 
+    const handleCompactStorage = async () => {
+        try {
+            const data = await CompactStorage();
+            const result = JSON.parse(data);
+            const kb = ((result.bytesReclaimed || 0) / 1024).toFixed(1);
+            alert(`Storage compacted: ${kb} KB reclaimed, ${result.removedFiles || 0} stale files removed.`);
+            loadSessions();
+        } catch (e) {
+            console.error('Compact storage failed:', e);
+            alert('Failed to compact storage');
+        }
+    };
+
+    const loadTrash = async () => {
+        try {
+            const data = await GetTrash();
+            setTrash(data ? JSON.parse(data) || [] : []);
+        } catch (e) {
+            console.error('Failed to load trash:', e);
+        }
+    };
+
+    const handleToggleTrash = () => {
+        if (!showTrash) loadTrash();
+        setShowTrash(!showTrash);
+    };
+
+    const handleRestoreSession = async (id: string) => {
+        try {
+            await RestoreSession(id);
+            setTrash(prev => prev.filter(s => s.id !== id));
+            loadSessions();
+        } catch (e) {
+            console.error('Restore session failed:', e);
+            alert('Failed to restore session');
+        }
+    };
+
+    const handlePurgeTrash = async () => {
+        if (!window.confirm('Permanently delete all sessions in the trash?')) return;
+        try {
+            await PurgeTrash();
+            setTrash([]);
+        } catch (e) {
+            console.error('Purge trash failed:', e);
+            alert('Failed to empty trash');
+        }
+    };
+
     const handleSelect = (id: string) => {
         setActiveSession(id);
         onSelectSession(id);
@@ -103,6 +155,13 @@ const Sidebar: React.FC<SidebarProps> = ({ onSelectSession, onShowConfig }) => {
                 >
                     {theme === 'light' ? '🌙 Dark Mode' : '☀️ Light Mode'}
                 </button>
+                <button
+                    className="Button"
+                    style={{ width: '100%', backgroundColor: 'var(--text-secondary)', marginTop: '8px' }}
+                    onClick={handleCompactStorage}
+                >
+                    🧹 Compact Storage
+                </button>
             </div>
             <div style={{ overflowY: 'auto', flex: 1 }}>
                 <div style={{ padding: '12px 16px', fontSize: '12px', color: 'var(--text-secondary)', fontWeight: 'bold' }}>
@@ -157,6 +216,42 @@ const Sidebar: React.FC<SidebarProps> = ({ onSelectSession, onShowConfig }) => {
                         </div>
                     );
                 })}
+                <div
+                    style={{ padding: '12px 16px', fontSize: '12px', color: 'var(--text-secondary)', fontWeight: 'bold', cursor: 'pointer' }}
+                    onClick={handleToggleTrash}
+                >
+                    {showTrash ? '▾' : '▸'} TRASH
+                </div>
+                {showTrash && (
+                    <>
+                        {trash.length === 0 && (
+                            <div style={{ padding: '4px 16px', fontSize: '12px', color: 'var(--text-secondary)' }}>
+                                Trash is empty
+                            </div>
+                        )}
+                        {trash.map((s) => (
+                            <div key={s.id} className="ChatItem" style={{ display: 'flex', justifyContent: 'space-between', alignItems: 'center', opacity: 0.7 }}>
+                                <div style={{ fontSize: '14px', whiteSpace: 'nowrap', overflow: 'hidden', textOverflow: 'ellipsis', flex: 1 }}>
+                                    {s.title || 'Untitled Session'}
+                                </div>
+                                <button
+                                    onClick={() => handleRestoreSession(s.id)}
+                                    style={{ background: 'transparent', border: 'none', color: 'var(--text-secondary)', cursor: 'pointer', fontSize: '12px', padding: '4px' }}
+                                    title="Restore Session"
+                                >
+                                    ↩️
+                                </button>
+                            </div>
+                        ))}
+                        {trash.length > 0 && (
+                            <div style={{ padding: '8px 16px' }}>
+                                <button className="Button" style={{ width: '100%', backgroundColor: 'var(--text-secondary)' }} onClick={handlePurgeTrash}>
+                                    Empty Trash
+                                </button>
+                            </div>
+                        )}
+                    </>
+                )}
             </div>
         </div>
     );
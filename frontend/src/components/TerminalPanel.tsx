@@ -2,6 +2,7 @@ import React, { useEffect, useMemo, useRef, useState } from 'react';
 import { Box, IconButton, Paper, Tooltip, Typography } from '@mui/material';
 import { Close as CloseIcon, DeleteOutline as ClearIcon, Terminal as TerminalIcon } from '@mui/icons-material';
 import { GetFiles, GetPath, RunCommandDetailedWithCwd } from '../../wailsjs/go/main/App';
+import { errorMessage } from '../errors';
 
 type TerminalEntry = {
     id: string;
@@ -134,7 +135,7 @@ const TerminalPanel: React.FC<TerminalPanelProps> = ({ open, onClose, height })
             if (typeof parsed?.shell === 'string' && parsed.shell) setShell(parsed.shell);
             if (typeof parsed?.branch === 'string') setBranch(parsed.branch);
         } catch (e) {
-            const message = e instanceof Error ? e.message : String(e);
+            const message = errorMessage(e);
             updateEntry(id, { output: message, status: 'error', finishedAt: Date.now() });
         } finally {
             setRunning(false);
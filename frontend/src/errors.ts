@@ -0,0 +1,24 @@
+// Errors from the Go bindings reject with {"error": {code, message, details}}
+// (see appErrorEnvelope in errors.go). These helpers also accept plain
+// strings and Error objects.
+
+export type AppErrorCode = 'session_not_found' | 'provider_auth' | 'canceled' | 'invalid_argument' | 'model_not_found' | 'internal';
+
+export interface AppError {
+    code: AppErrorCode;
+    message: string;
+    details?: Record<string, unknown>;
+}
+
+export function toAppError(e: unknown): AppError {
+    const inner = e && typeof e === 'object' && (e as any).error ? (e as any).error : e;
+    if (inner && typeof inner === 'object' && typeof (inner as any).message === 'string') {
+        const code = typeof (inner as any).code === 'string' ? (inner as any).code : 'internal';
+        return { code, message: (inner as any).message, details: (inner as any).details };
+    }
+    return { code: 'internal', message: String(e) };
+}
+
+export function errorMessage(e: unknown): string {
+    return toAppError(e).message;
+}
@@ -5,8 +5,18 @@ export function AbortSession(arg1:string):Promise<string>;
 
 export function AddCustomLLMService(arg1:string):Promise<string>;
 
+export function AttachFileToMessage(arg1:string,arg2:string):Promise<string>;
+
+export function CancelSearch():Promise<void>;
+
+export function ClearCache():Promise<number>;
+
 export function ClearPrompt():Promise<string>;
 
+export function CompactStorage():Promise<string>;
+
+export function ContinueSession(arg1:string):Promise<string>;
+
 export function CreateFile(arg1:string):Promise<void>;
 
 export function CreateFolder(arg1:string):Promise<void>;
@@ -19,6 +29,10 @@ export function DeletePath(arg1:string):Promise<void>;
 
 export function DeleteSession(arg1:string):Promise<string>;
 
+export function EstimateRequest(arg1:string,arg2:string,arg3:string):Promise<string>;
+
+export function ExportAll(arg1:boolean):Promise<string>;
+
 export function FindFilesByName(arg1:string,arg2:string,arg3:number):Promise<string>;
 
 export function FindSymbol(arg1:string):Promise<string>;
@@ -27,6 +41,14 @@ export function FindText(arg1:string):Promise<string>;
 
 export function GetAgents():Promise<string>;
 
+export function GetAllTodos(arg1:boolean):Promise<string>;
+
+export function GetArchivedMessages(arg1:string):Promise<string>;
+
+export function GetAsyncResult(arg1:string):Promise<string>;
+
+export function GetBackgroundCommandOutput(arg1:string):Promise<string>;
+
 export function GetCommands():Promise<string>;
 
 export function GetConfig():Promise<string>;
@@ -35,14 +57,24 @@ export function GetCurrentProject():Promise<string>;
 
 export function GetCustomLLMServices():Promise<string>;
 
+export function GetDefaultModel():Promise<string>;
+
 export function GetFileContent(arg1:string):Promise<string>;
 
+export function GetFileContentRange(arg1:string,arg2:number,arg3:number):Promise<string>;
+
 export function GetFileStatus():Promise<string>;
 
 export function GetFiles(arg1:string):Promise<string>;
 
+export function GetModelRouting(arg1:string):Promise<string>;
+
+export function GetModels(arg1:string):Promise<string>;
+
 export function GetPath():Promise<string>;
 
+export function GetPendingAttachments(arg1:string):Promise<string>;
+
 export function GetProjects():Promise<string>;
 
 export function GetProviderAuth():Promise<string>;
@@ -63,22 +95,48 @@ export function GetSessionStatus():Promise<string>;
 
 export function GetSessionTodo(arg1:string):Promise<string>;
 
+export function GetSessionToolStats(arg1:string):Promise<string>;
+
 export function GetSessions():Promise<string>;
 
+export function GetSystemStatus():Promise<string>;
+
+export function GetToolSpecs():Promise<string>;
+
+export function GetTrash():Promise<string>;
+
 export function GetVCSInfo():Promise<string>;
 
 export function Greet(arg1:string):Promise<string>;
 
+export function ImportAll(arg1:string,arg2:string):Promise<string>;
+
+export function ListBackups(arg1:string):Promise<string>;
+
 export function ListProviders():Promise<string>;
 
 export function OpenCurrentDirectory():Promise<void>;
 
+export function PatchConfig(arg1:string):Promise<string>;
+
 export function PickDirectory():Promise<string>;
 
+export function PurgeTrash():Promise<string>;
+
+export function RegenerateWithModel(arg1:string,arg2:string):Promise<string>;
+
+export function RemoveFileAttachment(arg1:string,arg2:string):Promise<void>;
+
 export function RenamePath(arg1:string,arg2:string):Promise<void>;
 
+export function ReorderCustomLLMServices(arg1:Array<string>):Promise<string>;
+
 export function RestartServer():Promise<void>;
 
+export function RestoreBackup(arg1:string,arg2:string):Promise<string>;
+
+export function RestoreSession(arg1:string):Promise<string>;
+
 export function RevealInExplorer(arg1:string):Promise<void>;
 
 export function RunCommand(arg1:string):Promise<string>;
@@ -89,18 +147,38 @@ export function RunCommandDetailedWithCwd(arg1:string,arg2:string):Promise<strin
 
 export function SaveFileContent(arg1:string,arg2:string):Promise<void>;
 
+export function SelectVariant(arg1:string,arg2:string,arg3:number):Promise<string>;
+
+export function SendCommandInput(arg1:string,arg2:string):Promise<void>;
+
 export function SendCustomLLMMessage(arg1:string,arg2:string,arg3:string):Promise<string>;
 
 export function SendMessage(arg1:string,arg2:string,arg3:string,arg4:string):Promise<string>;
 
 export function SendMessageAsync(arg1:string,arg2:string,arg3:string,arg4:string):Promise<string>;
 
+export function SendMessageWithAttachments(arg1:string,arg2:string,arg3:string,arg4:string,arg5:Array<string>):Promise<string>;
+
+export function SetCustomLLMServiceEnabled(arg1:string,arg2:boolean):Promise<string>;
+
+export function SetDefaultModel(arg1:string):Promise<string>;
+
+export function SetSessionDeterministic(arg1:string,arg2:boolean):Promise<string>;
+
+export function SetSessionGenerationParams(arg1:string,arg2:string):Promise<string>;
+
 export function SetWorkspaceDirectory(arg1:string):Promise<void>;
 
+export function StartBackgroundCommand(arg1:string,arg2:string):Promise<string>;
+
 export function StartOpenSpaceServer():Promise<void>;
 
+export function StopBackgroundCommand(arg1:string):Promise<string>;
+
 export function StopOpenSpaceServer():Promise<void>;
 
+export function StopWatch():Promise<void>;
+
 export function SubmitPrompt():Promise<string>;
 
 export function SummarizeSession(arg1:string,arg2:string,arg3:string):Promise<string>;
@@ -112,3 +190,5 @@ export function UpdateConfig(arg1:string):Promise<string>;
 export function UpdateCustomLLMService(arg1:string,arg2:string):Promise<string>;
 
 export function UpdateSession(arg1:string,arg2:string):Promise<string>;
+
+export function WatchDirectory(arg1:string):Promise<void>;
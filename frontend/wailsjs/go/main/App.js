@@ -10,10 +10,30 @@ export function AddCustomLLMService(arg1) {
   return window['go']['main']['App']['AddCustomLLMService'](arg1);
 }
 
+export function AttachFileToMessage(arg1, arg2) {
+  return window['go']['main']['App']['AttachFileToMessage'](arg1, arg2);
+}
+
+export function CancelSearch() {
+  return window['go']['main']['App']['CancelSearch']();
+}
+
+export function ClearCache() {
+  return window['go']['main']['App']['ClearCache']();
+}
+
 export function ClearPrompt() {
   return window['go']['main']['App']['ClearPrompt']();
 }
 
+export function CompactStorage() {
+  return window['go']['main']['App']['CompactStorage']();
+}
+
+export function ContinueSession(arg1) {
+  return window['go']['main']['App']['ContinueSession'](arg1);
+}
+
 export function CreateFile(arg1) {
   return window['go']['main']['App']['CreateFile'](arg1);
 }
@@ -38,6 +58,14 @@ export function DeleteSession(arg1) {
   return window['go']['main']['App']['DeleteSession'](arg1);
 }
 
+export function EstimateRequest(arg1, arg2, arg3) {
+  return window['go']['main']['App']['EstimateRequest'](arg1, arg2, arg3);
+}
+
+export function ExportAll(arg1) {
+  return window['go']['main']['App']['ExportAll'](arg1);
+}
+
 export function FindFilesByName(arg1, arg2, arg3) {
   return window['go']['main']['App']['FindFilesByName'](arg1, arg2, arg3);
 }
@@ -54,6 +82,22 @@ export function GetAgents() {
   return window['go']['main']['App']['GetAgents']();
 }
 
+export function GetAllTodos(arg1) {
+  return window['go']['main']['App']['GetAllTodos'](arg1);
+}
+
+export function GetArchivedMessages(arg1) {
+  return window['go']['main']['App']['GetArchivedMessages'](arg1);
+}
+
+export function GetAsyncResult(arg1) {
+  return window['go']['main']['App']['GetAsyncResult'](arg1);
+}
+
+export function GetBackgroundCommandOutput(arg1) {
+  return window['go']['main']['App']['GetBackgroundCommandOutput'](arg1);
+}
+
 export function GetCommands() {
   return window['go']['main']['App']['GetCommands']();
 }
@@ -70,10 +114,18 @@ export function GetCustomLLMServices() {
   return window['go']['main']['App']['GetCustomLLMServices']();
 }
 
+export function GetDefaultModel() {
+  return window['go']['main']['App']['GetDefaultModel']();
+}
+
 export function GetFileContent(arg1) {
   return window['go']['main']['App']['GetFileContent'](arg1);
 }
 
+export function GetFileContentRange(arg1, arg2, arg3) {
+  return window['go']['main']['App']['GetFileContentRange'](arg1, arg2, arg3);
+}
+
 export function GetFileStatus() {
   return window['go']['main']['App']['GetFileStatus']();
 }
@@ -82,10 +134,22 @@ export function GetFiles(arg1) {
   return window['go']['main']['App']['GetFiles'](arg1);
 }
 
+export function GetModelRouting(arg1) {
+  return window['go']['main']['App']['GetModelRouting'](arg1);
+}
+
+export function GetModels(arg1) {
+  return window['go']['main']['App']['GetModels'](arg1);
+}
+
 export function GetPath() {
   return window['go']['main']['App']['GetPath']();
 }
 
+export function GetPendingAttachments(arg1) {
+  return window['go']['main']['App']['GetPendingAttachments'](arg1);
+}
+
 export function GetProjects() {
   return window['go']['main']['App']['GetProjects']();
 }
@@ -126,10 +190,26 @@ export function GetSessionTodo(arg1) {
   return window['go']['main']['App']['GetSessionTodo'](arg1);
 }
 
+export function GetSessionToolStats(arg1) {
+  return window['go']['main']['App']['GetSessionToolStats'](arg1);
+}
+
 export function GetSessions() {
   return window['go']['main']['App']['GetSessions']();
 }
 
+export function GetSystemStatus() {
+  return window['go']['main']['App']['GetSystemStatus']();
+}
+
+export function GetToolSpecs() {
+  return window['go']['main']['App']['GetToolSpecs']();
+}
+
+export function GetTrash() {
+  return window['go']['main']['App']['GetTrash']();
+}
+
 export function GetVCSInfo() {
   return window['go']['main']['App']['GetVCSInfo']();
 }
@@ -138,6 +218,14 @@ export function Greet(arg1) {
   return window['go']['main']['App']['Greet'](arg1);
 }
 
+export function ImportAll(arg1, arg2) {
+  return window['go']['main']['App']['ImportAll'](arg1, arg2);
+}
+
+export function ListBackups(arg1) {
+  return window['go']['main']['App']['ListBackups'](arg1);
+}
+
 export function ListProviders() {
   return window['go']['main']['App']['ListProviders']();
 }
@@ -146,18 +234,46 @@ export function OpenCurrentDirectory() {
   return window['go']['main']['App']['OpenCurrentDirectory']();
 }
 
+export function PatchConfig(arg1) {
+  return window['go']['main']['App']['PatchConfig'](arg1);
+}
+
 export function PickDirectory() {
   return window['go']['main']['App']['PickDirectory']();
 }
 
+export function PurgeTrash() {
+  return window['go']['main']['App']['PurgeTrash']();
+}
+
+export function RegenerateWithModel(arg1, arg2) {
+  return window['go']['main']['App']['RegenerateWithModel'](arg1, arg2);
+}
+
+export function RemoveFileAttachment(arg1, arg2) {
+  return window['go']['main']['App']['RemoveFileAttachment'](arg1, arg2);
+}
+
 export function RenamePath(arg1, arg2) {
   return window['go']['main']['App']['RenamePath'](arg1, arg2);
 }
 
+export function ReorderCustomLLMServices(arg1) {
+  return window['go']['main']['App']['ReorderCustomLLMServices'](arg1);
+}
+
 export function RestartServer() {
   return window['go']['main']['App']['RestartServer']();
 }
 
+export function RestoreBackup(arg1, arg2) {
+  return window['go']['main']['App']['RestoreBackup'](arg1, arg2);
+}
+
+export function RestoreSession(arg1) {
+  return window['go']['main']['App']['RestoreSession'](arg1);
+}
+
 export function RevealInExplorer(arg1) {
   return window['go']['main']['App']['RevealInExplorer'](arg1);
 }
@@ -178,6 +294,14 @@ export function SaveFileContent(arg1, arg2) {
   return window['go']['main']['App']['SaveFileContent'](arg1, arg2);
 }
 
+export function SelectVariant(arg1, arg2, arg3) {
+  return window['go']['main']['App']['SelectVariant'](arg1, arg2, arg3);
+}
+
+export function SendCommandInput(arg1, arg2) {
+  return window['go']['main']['App']['SendCommandInput'](arg1, arg2);
+}
+
 export function SendCustomLLMMessage(arg1, arg2, arg3) {
   return window['go']['main']['App']['SendCustomLLMMessage'](arg1, arg2, arg3);
 }
@@ -190,18 +314,50 @@ export function SendMessageAsync(arg1, arg2, arg3, arg4) {
   return window['go']['main']['App']['SendMessageAsync'](arg1, arg2, arg3, arg4);
 }
 
+export function SendMessageWithAttachments(arg1, arg2, arg3, arg4, arg5) {
+  return window['go']['main']['App']['SendMessageWithAttachments'](arg1, arg2, arg3, arg4, arg5);
+}
+
+export function SetCustomLLMServiceEnabled(arg1, arg2) {
+  return window['go']['main']['App']['SetCustomLLMServiceEnabled'](arg1, arg2);
+}
+
+export function SetDefaultModel(arg1) {
+  return window['go']['main']['App']['SetDefaultModel'](arg1);
+}
+
+export function SetSessionDeterministic(arg1, arg2) {
+  return window['go']['main']['App']['SetSessionDeterministic'](arg1, arg2);
+}
+
+export function SetSessionGenerationParams(arg1, arg2) {
+  return window['go']['main']['App']['SetSessionGenerationParams'](arg1, arg2);
+}
+
 export function SetWorkspaceDirectory(arg1) {
   return window['go']['main']['App']['SetWorkspaceDirectory'](arg1);
 }
 
+export function StartBackgroundCommand(arg1, arg2) {
+  return window['go']['main']['App']['StartBackgroundCommand'](arg1, arg2);
+}
+
 export function StartOpenSpaceServer() {
   return window['go']['main']['App']['StartOpenSpaceServer']();
 }
 
+export function StopBackgroundCommand(arg1) {
+  return window['go']['main']['App']['StopBackgroundCommand'](arg1);
+}
+
 export function StopOpenSpaceServer() {
   return window['go']['main']['App']['StopOpenSpaceServer']();
 }
 
+export function StopWatch() {
+  return window['go']['main']['App']['StopWatch']();
+}
+
 export function SubmitPrompt() {
   return window['go']['main']['App']['SubmitPrompt']();
 }
@@ -225,3 +381,7 @@ export function UpdateCustomLLMService(arg1, arg2) {
 export function UpdateSession(arg1, arg2) {
   return window['go']['main']['App']['UpdateSession'](arg1, arg2);
 }
+
+export function WatchDirectory(arg1) {
+  return window['go']['main']['App']['WatchDirectory'](arg1);
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// deterministicSeed is the seed sent by deterministic sessions.
+const deterministicSeed = 42
+
+// GenerationParams are sampling parameters for LLM requests. Unset fields
+// fall through in the order session > service > built-in default, where
+// the built-in defaults are the ones callLLMService puts in every request
+// (temperature 1, top_p 0.95 and 2048 max tokens, 4096 for Anthropic).
+// Deterministic sessions still force temperature 0 and top_p 1.
+type GenerationParams struct {
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"topP,omitempty"`
+	MaxTokens   int      `json:"maxTokens,omitempty"`
+}
+
+func (p GenerationParams) isZero() bool {
+	return p.Temperature == nil && p.TopP == nil && p.MaxTokens == 0
+}
+
+// validate checks the ranges the providers accept.
+func (p GenerationParams) validate() error {
+	if p.Temperature != nil && (*p.Temperature < 0 || *p.Temperature > 2) {
+		return fmt.Errorf("%w: temperature must be between 0 and 2", ErrInvalidArgument)
+	}
+	if p.TopP != nil && (*p.TopP <= 0 || *p.TopP > 1) {
+		return fmt.Errorf("%w: topP must be greater than 0 and at most 1", ErrInvalidArgument)
+	}
+	if p.MaxTokens < 0 {
+		return fmt.Errorf("%w: maxTokens cannot be negative", ErrInvalidArgument)
+	}
+	return nil
+}
+
+// over returns p with its unset fields taken from base.
+func (p GenerationParams) over(base GenerationParams) GenerationParams {
+	if p.Temperature == nil {
+		p.Temperature = base.Temperature
+	}
+	if p.TopP == nil {
+		p.TopP = base.TopP
+	}
+	if p.MaxTokens == 0 {
+		p.MaxTokens = base.MaxTokens
+	}
+	return p
+}
+
+// apply sets the parameters that are set on a request body.
+func (p GenerationParams) apply(requestData map[string]interface{}) {
+	if p.Temperature != nil {
+		requestData["temperature"] = *p.Temperature
+	}
+	if p.TopP != nil {
+		requestData["top_p"] = *p.TopP
+	}
+	if p.MaxTokens > 0 {
+		requestData["max_tokens"] = p.MaxTokens
+	}
+}
+
+// SetSessionGenerationParams sets the session's sampling parameters. They
+// override the service's for every request of the session; params with no
+// field set clears the override.
+func (s *Service) SetSessionGenerationParams(sessionID string, params GenerationParams) (*Session, error) {
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+	return s.updateSession(sessionID, func(session *Session) error {
+		if params.isZero() {
+			session.Generation = nil
+		} else {
+			session.Generation = &params
+		}
+		session.UpdatedAt = time.Now().UnixMilli()
+		return nil
+	})
+}
+
+// generationParams returns the sampling parameters for a session's requests
+// to service, the session's overriding the service's.
+func (s *Service) generationParams(sessionID string, service CustomLLMService) GenerationParams {
+	s.sessionMux.RLock()
+	session, ok := s.sessions[sessionID]
+	s.sessionMux.RUnlock()
+	if !ok {
+		return service.GenerationParams
+	}
+	unlock := s.lockSession(sessionID)
+	defer unlock()
+	if session.Generation == nil {
+		return service.GenerationParams
+	}
+	return session.Generation.over(service.GenerationParams)
+}
+
+// SetSessionDeterministic switches reproducible requests on or off for a
+// session: temperature 0, top_p 1 and a fixed seed where the provider
+// accepts one, overriding the service defaults.
+func (s *Service) SetSessionDeterministic(sessionID string, enabled bool) (*Session, error) {
+	return s.updateSession(sessionID, func(session *Session) error {
+		session.Deterministic = enabled
+		session.UpdatedAt = time.Now().UnixMilli()
+		return nil
+	})
+}
+
+// sessionDeterministic reports whether a session asked for reproducible
+// requests.
+func (s *Service) sessionDeterministic(sessionID string) bool {
+	s.sessionMux.RLock()
+	session, ok := s.sessions[sessionID]
+	s.sessionMux.RUnlock()
+	if !ok {
+		return false
+	}
+	unlock := s.lockSession(sessionID)
+	defer unlock()
+	return session.Deterministic
+}
+
+// applyDeterministic sets the sampling parameters of a reproducible request.
+// Anthropic has no seed and should not get top_p alongside temperature; the
+// seed is only sent to OpenAI-style servers known to honour it.
+func applyDeterministic(requestData map[string]interface{}, provider ProviderKind) {
+	requestData["temperature"] = 0
+	if provider.isAnthropic() {
+		delete(requestData, "top_p")
+		return
+	}
+	requestData["top_p"] = 1
+	if provider != ProviderGemini {
+		requestData["seed"] = deterministicSeed
+	}
+}
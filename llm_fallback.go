@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// llmRequestError reports that an LLM request never got an HTTP response.
+type llmRequestError struct {
+	Err error
+}
+
+func (e *llmRequestError) Error() string {
+	return fmt.Sprintf("request failed: %v", e.Err)
+}
+
+func (e *llmRequestError) Unwrap() error {
+	return e.Err
+}
+
+// llmStatusError reports an HTTP error status from an LLM API.
+type llmStatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *llmStatusError) Error() string {
+	return fmt.Sprintf("API request failed with status %d: %s", e.StatusCode, e.Body)
+}
+
+// Is makes 401 and 403 responses match ErrProviderAuth.
+func (e *llmStatusError) Is(target error) bool {
+	return target == ErrProviderAuth && (e.StatusCode == 401 || e.StatusCode == 403)
+}
+
+// isProviderOutage reports whether err means the provider itself is
+// unavailable (connection failure or 5xx), as opposed to a bad request.
+func isProviderOutage(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var statusErr *llmStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500
+	}
+	var reqErr *llmRequestError
+	return errors.As(err, &reqErr)
+}
+
+// llmTarget is a service and the model to request from it.
+type llmTarget struct {
+	service CustomLLMService
+	model   string
+}
+
+// fallbackChain returns the services to try after primary, read from the
+// "fallbacks" config. Entries are "serviceID" or "serviceID::model"; the
+// service's default model is used when no model is given.
+func (s *Service) fallbackChain(primary CustomLLMService, model string) []llmTarget {
+	chain := []llmTarget{{primary, model}}
+
+	entries, _ := s.configValue("fallbacks").([]interface{})
+	for _, entry := range entries {
+		ref, ok := entry.(string)
+		if !ok || strings.TrimSpace(ref) == "" {
+			continue
+		}
+		serviceID, fallbackModel := ref, ""
+		if parts := strings.SplitN(ref, "::", 2); len(parts) == 2 {
+			serviceID, fallbackModel = parts[0], parts[1]
+		}
+		svc, err := s.getCustomLLMServiceConfig(serviceID)
+		if err != nil {
+			fmt.Printf("Warning: Skipping fallback %s: %v\n", ref, err)
+			continue
+		}
+		if !svc.Enabled {
+			continue
+		}
+		if fallbackModel == "" {
+			fallbackModel = svc.DefaultModel
+		}
+		if svc.ID == primary.ID && fallbackModel == model {
+			continue
+		}
+		chain = append(chain, llmTarget{svc, fallbackModel})
+	}
+	return chain
+}
+
+// callLLMServiceWithFallbacks runs callLLMService against the primary
+// service and, if it is unreachable or returns a 5xx, against each entry of
+// the fallback chain in turn. Failover only happens while no tool has been
+// executed, so tool calls are never executed twice. It returns the service
+// and model that produced the answer.
+func (s *Service) callLLMServiceWithFallbacks(ctx context.Context, sessionID string, config CustomLLMService, messages []map[string]interface{}, model string, mode agentMode, registry *ToolRegistry) (string, []map[string]interface{}, CustomLLMService, string, error) {
+	var allTurns []map[string]interface{}
+	var lastErr error
+	chain := s.fallbackChain(config, model)
+	for i, target := range chain {
+		if i > 0 {
+			prev := chain[i-1]
+			fmt.Printf("Warning: %s::%s failed (%v), falling back to %s::%s\n", prev.service.ID, prev.model, lastErr, target.service.ID, target.model)
+		}
+		text, rawTurns, toolsRun, err := s.runToolLoop(ctx, sessionID, target.service, messages, target.model, mode, registry)
+		allTurns = append(allTurns, rawTurns...)
+		if err == nil {
+			return text, allTurns, target.service, target.model, nil
+		}
+		lastErr = err
+		if !isProviderOutage(err) || toolsRun {
+			break
+		}
+	}
+	return "", allTurns, config, model, lastErr
+}
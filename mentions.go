@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// maxMentionFileSize caps how much of an @-mentioned file is attached.
+const maxMentionFileSize = 64 * 1024
+
+// fileMentionPattern matches "@path" tokens at the start of the message or
+// after whitespace. Only tokens that look like paths (containing "/" or "."
+// once trailing punctuation is removed) are treated as file mentions, so
+// "@someone" and "@someone." are left alone.
+var fileMentionPattern = regexp.MustCompile(`(^|\s)@([^\s@]*[./][^\s@]*)`)
+
+// expandFileMentions replaces "@path" mentions in message with a reference
+// and appends the mentioned files' contents. Files must be inside the
+// workspace; missing or unreadable files get a note instead.
+func (s *Service) expandFileMentions(message string) string {
+	var attachments []string
+	seen := map[string]bool{}
+
+	expanded := fileMentionPattern.ReplaceAllStringFunc(message, func(match string) string {
+		sub := fileMentionPattern.FindStringSubmatch(match)
+		lead, path := sub[1], sub[2]
+		trimmed := strings.TrimRight(path, ",.;:!?)]}'\"")
+		trailing := path[len(trimmed):]
+		if !strings.ContainsAny(trimmed, "./") {
+			return match
+		}
+
+		if !seen[trimmed] {
+			seen[trimmed] = true
+			attachments = append(attachments, s.mentionAttachment(trimmed))
+		}
+		return lead + "`" + trimmed + "` (attached below)" + trailing
+	})
+
+	if len(attachments) == 0 {
+		return message
+	}
+	return expanded + "\n\nReferenced files:\n\n" + strings.Join(attachments, "\n\n")
+}
+
+// mentionAttachment renders the contents of one mentioned file.
+func (s *Service) mentionAttachment(path string) string {
+	note := func(msg string) string {
+		return fmt.Sprintf("<file path=%q>\n[%s]\n</file>", path, msg)
+	}
+
+	resolved, err := s.workspaceFilePath(path)
+	if err != nil {
+		return note(err.Error())
+	}
+	info, err := os.Stat(resolved)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return note("file not found")
+		}
+		return note(fmt.Sprintf("could not read file: %v", err))
+	}
+	if info.IsDir() {
+		return note("is a directory, not a file")
+	}
+
+	f, err := os.Open(resolved)
+	if err != nil {
+		return note(fmt.Sprintf("could not read file: %v", err))
+	}
+	defer f.Close()
+	// Read one extra byte so truncation can back off to a rune boundary.
+	buf := make([]byte, maxMentionFileSize+1)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return note(fmt.Sprintf("could not read file: %v", err))
+	}
+	content := buf[:n]
+	if bytes.IndexByte(content, 0) >= 0 {
+		return note("binary file not attached")
+	}
+
+	text := truncateUTF8(string(content), maxMentionFileSize)
+	if len(text) < int(info.Size()) {
+		text += fmt.Sprintf("\n... (truncated, %d of %d bytes shown)", len(text), info.Size())
+	}
+	return fmt.Sprintf("<file path=%q>\n%s\n</file>", path, text)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// Model capabilities reported to the UI.
+const (
+	capabilityTools  = "tools"  // native function calling
+	capabilityVision = "vision" // image input
+	capabilityJSON   = "json"   // structured JSON output mode
+	// capabilityReasoning marks OpenAI-style reasoning models, which take
+	// the "developer" role instead of "system" and no sampling parameters.
+	capabilityReasoning = "reasoning"
+)
+
+// modelCapabilityTable maps model name prefixes to their capabilities, with
+// the same longest-prefix lookup as modelContextWindows. A service can
+// override an entry through its "modelCapabilities" config.
+var modelCapabilityTable = map[string][]string{
+	// OpenAI
+	"gpt-3.5-turbo": {capabilityTools, capabilityJSON},
+	"gpt-4":         {capabilityTools, capabilityJSON},
+	"gpt-4-turbo":   {capabilityTools, capabilityVision, capabilityJSON},
+	"gpt-4o":        {capabilityTools, capabilityVision, capabilityJSON},
+	"gpt-4.1":       {capabilityTools, capabilityVision, capabilityJSON},
+	"gpt-5":         {capabilityTools, capabilityVision, capabilityJSON, capabilityReasoning},
+	"gpt-5-chat":    {capabilityTools, capabilityVision, capabilityJSON},
+	"o1":            {capabilityTools, capabilityVision, capabilityJSON, capabilityReasoning},
+	"o1-mini":       {capabilityReasoning},
+	"o3":            {capabilityTools, capabilityVision, capabilityJSON, capabilityReasoning},
+	"o4-mini":       {capabilityTools, capabilityVision, capabilityJSON, capabilityReasoning},
+
+	// Anthropic
+	"claude-2":        {},
+	"claude-3":        {capabilityTools, capabilityVision},
+	"claude-sonnet-4": {capabilityTools, capabilityVision},
+	"claude-opus-4":   {capabilityTools, capabilityVision},
+
+	// Google
+	"gemini-pro": {capabilityTools, capabilityJSON},
+	"gemini-1.5": {capabilityTools, capabilityVision, capabilityJSON},
+	"gemini-2":   {capabilityTools, capabilityVision, capabilityJSON},
+
+	// Common Ollama / open models
+	"llama3.1":        {capabilityTools},
+	"llama3.2":        {capabilityTools},
+	"llama3.2-vision": {capabilityVision},
+	"llama3.3":        {capabilityTools},
+	"llava":           {capabilityVision},
+	"mistral":         {capabilityTools},
+	"mixtral":         {capabilityTools},
+	"qwen2.5":         {capabilityTools},
+	"qwen3":           {capabilityTools},
+	"deepseek-chat":   {capabilityTools, capabilityJSON},
+	"gemma3":          {capabilityVision},
+}
+
+// ModelInfo is a selectable model with its capabilities.
+type ModelInfo struct {
+	ID           string   `json:"id"` // "service::model", as SendMessage takes it
+	Service      string   `json:"service"`
+	Model        string   `json:"model"`
+	Capabilities []string `json:"capabilities"`
+}
+
+// builtinModelCapabilities returns the table entry for model, or nil when
+// the model is unknown.
+func builtinModelCapabilities(model string) []string {
+	name := modelBaseName(model)
+	best := ""
+	var caps []string
+	for prefix, c := range modelCapabilityTable {
+		if strings.HasPrefix(name, prefix) && len(prefix) > len(best) {
+			best, caps = prefix, c
+		}
+	}
+	return caps
+}
+
+// modelCapabilities returns the capabilities of model on a service: the
+// service's "modelCapabilities" entry for it if configured, else the
+// built-in table. Unknown models have none.
+func modelCapabilities(svcMap map[string]interface{}, model string) []string {
+	if configured, ok := svcMap["modelCapabilities"].(map[string]interface{}); ok {
+		if list, ok := configured[model].([]interface{}); ok {
+			caps := []string{}
+			for _, c := range list {
+				if str, ok := c.(string); ok {
+					caps = append(caps, strings.ToLower(strings.TrimSpace(str)))
+				}
+			}
+			return caps
+		}
+	}
+	caps := builtinModelCapabilities(model)
+	if caps == nil {
+		return []string{}
+	}
+	return append([]string{}, caps...)
+}
+
+// serviceModelCapabilities is modelCapabilities for a parsed service.
+func serviceModelCapabilities(config CustomLLMService, model string) []string {
+	if caps, ok := config.ModelCapabilities[model]; ok {
+		return caps
+	}
+	return builtinModelCapabilities(model)
+}
+
+// isReasoningModel reports whether requests for model on config must use
+// the reasoning-model format. Services can change the answer per model
+// through "modelCapabilities".
+func isReasoningModel(config CustomLLMService, model string) bool {
+	if config.Provider.isAnthropic() {
+		return false
+	}
+	return hasCapabilities(serviceModelCapabilities(config, model), []string{capabilityReasoning})
+}
+
+// adaptForReasoningModel rewrites an OpenAI-style request for a reasoning
+// model: system messages become developer messages, max_tokens becomes
+// max_completion_tokens and temperature and top_p are dropped.
+func adaptForReasoningModel(requestData map[string]interface{}) {
+	if messages, ok := requestData["messages"].([]map[string]interface{}); ok {
+		adapted := make([]map[string]interface{}, len(messages))
+		for i, msg := range messages {
+			if msg["role"] == "system" {
+				copied := make(map[string]interface{}, len(msg))
+				for k, v := range msg {
+					copied[k] = v
+				}
+				copied["role"] = "developer"
+				msg = copied
+			}
+			adapted[i] = msg
+		}
+		requestData["messages"] = adapted
+	}
+	if maxTokens, ok := requestData["max_tokens"]; ok {
+		requestData["max_completion_tokens"] = maxTokens
+		delete(requestData, "max_tokens")
+	}
+	delete(requestData, "temperature")
+	delete(requestData, "top_p")
+}
+
+// hasCapabilities reports whether caps includes every required capability.
+func hasCapabilities(caps, required []string) bool {
+	for _, r := range required {
+		found := false
+		for _, c := range caps {
+			if c == r {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// serviceModels lists a service entry's models, default model included.
+func serviceModels(svcMap map[string]interface{}, modelsKey, defaultKey string) []string {
+	var models []string
+	seen := map[string]bool{}
+	add := func(m string) {
+		if m != "" && !seen[m] {
+			seen[m] = true
+			models = append(models, m)
+		}
+	}
+	if list, ok := svcMap[modelsKey].([]interface{}); ok {
+		for _, m := range list {
+			if str, ok := m.(string); ok {
+				add(str)
+			}
+		}
+	}
+	if m, ok := svcMap[defaultKey].(string); ok {
+		add(m)
+	}
+	return models
+}
+
+// GetModels returns the models of enabled services and legacy providers that
+// have all the required capabilities, sorted by ID. No requirement returns
+// every model.
+func (s *Service) GetModels(required []string) []ModelInfo {
+	models := []ModelInfo{}
+	add := func(serviceID string, svcMap map[string]interface{}, names []string) {
+		for _, model := range names {
+			caps := modelCapabilities(svcMap, model)
+			if !hasCapabilities(caps, required) {
+				continue
+			}
+			models = append(models, ModelInfo{
+				ID:           serviceID + "::" + model,
+				Service:      serviceID,
+				Model:        model,
+				Capabilities: caps,
+			})
+		}
+	}
+	for _, svcMap := range s.enabledCustomServices() {
+		id, _ := svcMap["id"].(string)
+		add(id, svcMap, serviceModels(svcMap, "models", "defaultModel"))
+	}
+	for id, pData := range s.legacyProviders() {
+		add(id, pData, serviceModels(pData, "", "model"))
+	}
+	sort.Slice(models, func(i, j int) bool { return models[i].ID < models[j].ID })
+	return models
+}
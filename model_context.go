@@ -0,0 +1,93 @@
+package main
+
+import "strings"
+
+// modelContextWindows maps model name prefixes to their context window in
+// tokens. Lookups use the longest matching prefix, so more specific entries
+// (gpt-4o) win over general ones (gpt-4).
+var modelContextWindows = map[string]int{
+	// OpenAI
+	"gpt-3.5-turbo": 16385,
+	"gpt-4":         8192,
+	"gpt-4-32k":     32768,
+	"gpt-4-turbo":   128000,
+	"gpt-4o":        128000,
+	"gpt-4.1":       1047576,
+	"gpt-5":         400000,
+	"o1":            200000,
+	"o1-mini":       128000,
+	"o3":            200000,
+	"o4-mini":       200000,
+
+	// Anthropic
+	"claude-2":        100000,
+	"claude-3":        200000,
+	"claude-sonnet-4": 200000,
+	"claude-opus-4":   200000,
+
+	// Google
+	"gemini-pro":       32760,
+	"gemini-1.5-flash": 1048576,
+	"gemini-1.5-pro":   2097152,
+	"gemini-2.0-flash": 1048576,
+	"gemini-2.5":       1048576,
+
+	// Common Ollama / open models
+	"llama2":         4096,
+	"llama3":         8192,
+	"llama3.1":       131072,
+	"llama3.2":       131072,
+	"llama3.3":       131072,
+	"codellama":      16384,
+	"mistral":        32768,
+	"mixtral":        32768,
+	"qwen2.5":        32768,
+	"qwen2.5-coder":  32768,
+	"qwen3":          40960,
+	"deepseek-chat":  64000,
+	"deepseek-coder": 16384,
+	"deepseek-r1":    131072,
+	"gemma2":         8192,
+	"gemma3":         131072,
+	"phi3":           4096,
+}
+
+// modelBaseName lowercases model and drops provider prefixes
+// ("openai/gpt-4o") and Ollama tags ("llama3.1:8b") for table lookups.
+func modelBaseName(model string) string {
+	name := strings.ToLower(strings.TrimSpace(model))
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	if i := strings.Index(name, ":"); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+// contextWindowForModel returns the known context window of model, or 0 if
+// it is not in the table. Provider prefixes and Ollama tags are ignored.
+func contextWindowForModel(model string) int {
+	name := modelBaseName(model)
+
+	best, window := "", 0
+	for prefix, size := range modelContextWindows {
+		if strings.HasPrefix(name, prefix) && len(prefix) > len(best) {
+			best, window = prefix, size
+		}
+	}
+	return window
+}
+
+// effectiveContextLimit is the context limit to use for a request: the
+// service's explicit ContextLimit, else the model's known window, else
+// defaultContextLimit.
+func effectiveContextLimit(config CustomLLMService, model string) int {
+	if config.ContextLimit > 0 {
+		return config.ContextLimit
+	}
+	if window := contextWindowForModel(model); window > 0 {
+		return window
+	}
+	return defaultContextLimit
+}
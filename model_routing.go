@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Model routing decides which service answers a model string. An empty
+// model stands for the "defaultModel" config, see SetDefaultModel.
+// Precedence:
+//
+//  1. An explicit "service::model" prefix ("service:model" also works when
+//     service is configured, see splitProviderModel) scopes resolution to that service
+//     alone: an enabled custom service (which accepts any model), else a
+//     legacy "providers" entry configured for that model. Anything else is
+//     an ErrModelNotFound error rather than a match elsewhere.
+//  2. Otherwise every enabled custom service listing the model (in "models"
+//     or as its default model) is a candidate, and so is every legacy
+//     provider whose "model" matches. Custom services come first.
+//  3. Within each group candidates are ordered by the "servicePriority"
+//     config, a list of service IDs where earlier wins (kept in step with
+//     ReorderCustomLLMServices), then alphabetically by ID, so the same
+//     request always routes the same way.
+//
+// With no match the built-in mock provider answers.
+
+// Route sources.
+const (
+	routeCustom   = "custom"
+	routeProvider = "provider"
+	routeMock     = "mock"
+)
+
+// ModelRoute reports which service handles a model and why.
+type ModelRoute struct {
+	Model      string   `json:"model"`
+	Service    string   `json:"service,omitempty"`
+	Source     string   `json:"source"`               // "custom", "provider" or "mock"
+	Reason     string   `json:"reason"`               // "explicit", "only", "priority", "alphabetical" or "none"
+	Candidates []string `json:"candidates,omitempty"` // in precedence order
+}
+
+// legacyProviders returns the entries of the legacy "providers" config.
+func (s *Service) legacyProviders() map[string]map[string]interface{} {
+	providers := map[string]map[string]interface{}{}
+	providersMap, ok := s.configValue("providers").(map[string]interface{})
+	if !ok {
+		return providers
+	}
+	for id, pConfig := range providersMap {
+		if pData, ok := pConfig.(map[string]interface{}); ok {
+			providers[id] = pData
+		}
+	}
+	return providers
+}
+
+// enabledCustomServices returns the custom service entries not switched off.
+func (s *Service) enabledCustomServices() []map[string]interface{} {
+	var services []map[string]interface{}
+	customServices, _ := s.configValue("customServices").([]interface{})
+	for _, svc := range customServices {
+		svcMap, ok := svc.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if enabled, ok := svcMap["enabled"].(bool); ok && !enabled {
+			continue
+		}
+		services = append(services, svcMap)
+	}
+	return services
+}
+
+// isConfiguredService reports whether id names a custom service, enabled or
+// not, or a legacy provider.
+func (s *Service) isConfiguredService(id string) bool {
+	if _, ok := s.legacyProviders()[id]; ok {
+		return true
+	}
+	_, err := s.getCustomLLMServiceConfig(id)
+	return err == nil
+}
+
+// servicePriority returns the rank of each service ID in the
+// "servicePriority" config.
+func (s *Service) servicePriority() map[string]int {
+	rank := map[string]int{}
+	ids, _ := s.configValue("servicePriority").([]interface{})
+	for i, id := range ids {
+		if str, ok := id.(string); ok {
+			if _, seen := rank[str]; !seen {
+				rank[str] = i
+			}
+		}
+	}
+	return rank
+}
+
+// sortByPriority orders service IDs by rank, unranked last, then by ID.
+func sortByPriority(ids []string, rank map[string]int) {
+	sort.SliceStable(ids, func(i, j int) bool {
+		ri, iRanked := rank[ids[i]]
+		rj, jRanked := rank[ids[j]]
+		if iRanked != jRanked {
+			return iRanked
+		}
+		if iRanked && ri != rj {
+			return ri < rj
+		}
+		return ids[i] < ids[j]
+	})
+}
+
+// resolveModelRoute applies the routing precedence to model, which may
+// carry a "service::" prefix.
+func (s *Service) resolveModelRoute(model string) (ModelRoute, error) {
+	if strings.TrimSpace(model) == "" {
+		model = s.configString("defaultModel", "")
+	}
+	customs := s.enabledCustomServices()
+	legacy := s.legacyProviders()
+	providerID, modelID := splitProviderModel(model, s.isConfiguredService)
+	route := ModelRoute{Model: modelID, Source: routeMock, Reason: "none"}
+
+	if providerID != "" {
+		return s.explicitModelRoute(route, providerID, customs, legacy)
+	}
+	if modelID == "" {
+		return route, nil
+	}
+
+	var customIDs, legacyIDs []string
+	for _, svcMap := range customs {
+		id, _ := svcMap["id"].(string)
+		if id == "" {
+			continue
+		}
+		listed := false
+		if models, ok := svcMap["models"].([]interface{}); ok {
+			for _, m := range models {
+				if str, ok := m.(string); ok && str == modelID {
+					listed = true
+					break
+				}
+			}
+		}
+		if defaultModel, _ := svcMap["defaultModel"].(string); listed || defaultModel == modelID {
+			customIDs = append(customIDs, id)
+		}
+	}
+	for id, pData := range legacy {
+		if pModel, _ := pData["model"].(string); pModel == modelID {
+			legacyIDs = append(legacyIDs, id)
+		}
+	}
+
+	rank := s.servicePriority()
+	sortByPriority(customIDs, rank)
+	sortByPriority(legacyIDs, rank)
+	route.Candidates = append(customIDs, legacyIDs...)
+	if len(route.Candidates) == 0 {
+		return route, nil
+	}
+
+	route.Service = route.Candidates[0]
+	route.Source = routeCustom
+	if len(customIDs) == 0 {
+		route.Source = routeProvider
+	}
+	_, ranked := rank[route.Service]
+	switch {
+	case len(route.Candidates) == 1:
+		route.Reason = "only"
+	case ranked:
+		route.Reason = "priority"
+	default:
+		route.Reason = "alphabetical"
+	}
+	return route, nil
+}
+
+// explicitModelRoute resolves a model named with a service prefix, looking
+// at that service only.
+func (s *Service) explicitModelRoute(route ModelRoute, providerID string, customs []map[string]interface{}, legacy map[string]map[string]interface{}) (ModelRoute, error) {
+	route.Reason = "explicit"
+	for _, svcMap := range customs {
+		if id, _ := svcMap["id"].(string); id == providerID {
+			route.Service, route.Source = id, routeCustom
+			return route, nil
+		}
+	}
+	if pData, ok := legacy[providerID]; ok {
+		pModel, _ := pData["model"].(string)
+		if pModel != route.Model {
+			return route, fmt.Errorf("%w: provider %q serves %q, not %q", ErrModelNotFound, providerID, pModel, route.Model)
+		}
+		route.Service, route.Source = providerID, routeProvider
+		return route, nil
+	}
+	if _, err := s.getCustomLLMServiceConfig(providerID); err == nil {
+		return route, fmt.Errorf("%w: service %q is disabled", ErrModelNotFound, providerID)
+	}
+	return route, fmt.Errorf("%w: unknown service %q", ErrModelNotFound, providerID)
+}
+
+// serviceForRoute returns the service configuration a route points at.
+func (s *Service) serviceForRoute(route ModelRoute) (CustomLLMService, error) {
+	switch route.Source {
+	case routeCustom:
+		return s.getCustomLLMServiceConfig(route.Service)
+	case routeProvider:
+		pData, ok := s.legacyProviders()[route.Service]
+		if !ok {
+			return CustomLLMService{}, fmt.Errorf("provider not found: %s", route.Service)
+		}
+		return legacyProviderService(route.Service, pData), nil
+	default:
+		return CustomLLMService{}, fmt.Errorf("no service handles model %q", route.Model)
+	}
+}
+
+// GetModelRouting reports which service SendMessage would use for model.
+func (s *Service) GetModelRouting(model string) (ModelRoute, error) {
+	return s.resolveModelRoute(model)
+}
+
+// GetDefaultModel returns the model used when none is given, or "".
+func (s *Service) GetDefaultModel() string {
+	return s.configString("defaultModel", "")
+}
+
+// SetDefaultModel sets the model used when none is given. It must route to
+// a configured service and is stored as "service::model"; an empty model
+// clears the setting.
+func (s *Service) SetDefaultModel(model string) (ModelRoute, error) {
+	model = strings.TrimSpace(model)
+	route := ModelRoute{Source: routeMock, Reason: "none"}
+	value := ""
+	if model != "" {
+		var err error
+		route, err = s.resolveModelRoute(model)
+		if err != nil {
+			return route, err
+		}
+		if route.Source == routeMock || route.Model == "" {
+			return route, fmt.Errorf("%w: no configured service serves %q", ErrModelNotFound, model)
+		}
+		value = route.Service + "::" + route.Model
+	}
+
+	err := s.updateConfig(func(config map[string]interface{}) error {
+		if value == "" {
+			delete(config, "defaultModel")
+		} else {
+			config["defaultModel"] = value
+		}
+		return nil
+	})
+	return route, err
+}
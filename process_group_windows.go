@@ -0,0 +1,36 @@
+//go:build windows
+
+package main
+
+import (
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// startProcessGroup starts cmd in a new process group, so it can be stopped
+// together with the processes it starts.
+func startProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.CreationFlags |= syscall.CREATE_NEW_PROCESS_GROUP
+}
+
+// interruptProcessGroup stops cmd's process tree. Windows has no signal a
+// console-less process group reliably handles, so this kills it.
+func interruptProcessGroup(cmd *exec.Cmd) {
+	killProcessGroup(cmd)
+}
+
+// killProcessGroup kills cmd and every process it started.
+func killProcessGroup(cmd *exec.Cmd) {
+	if cmd.Process == nil {
+		return
+	}
+	kill := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid))
+	hideCommandWindow(kill)
+	if err := kill.Run(); err != nil {
+		_ = cmd.Process.Kill()
+	}
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// projectCommand runs Command for projects whose root holds Marker. An
+// entry with Script instead of Command runs that package.json script with
+// the package manager the lockfile points to, and only matches when the
+// script is defined. Fix is the variant that changes files, for the
+// formatters and linters that have one.
+type projectCommand struct {
+	Marker  string `json:"marker"`
+	Command string `json:"command,omitempty"`
+	Script  string `json:"script,omitempty"`
+	Fix     string `json:"fix,omitempty"`
+}
+
+// defaultTestCommands are checked in order after any "testCommands" from
+// the config.
+var defaultTestCommands = []projectCommand{
+	{Marker: "go.mod", Command: "go test ./..."},
+	{Marker: "Cargo.toml", Command: "cargo test"},
+	{Marker: "package.json", Script: "test"},
+	{Marker: "pyproject.toml", Command: "python -m pytest"},
+	{Marker: "setup.py", Command: "python -m pytest"},
+	{Marker: "pom.xml", Command: "mvn -q test"},
+	{Marker: "build.gradle", Command: "gradle test"},
+	{Marker: "build.gradle.kts", Command: "gradle test"},
+	{Marker: "Makefile", Command: "make test"},
+}
+
+// npmDefaultTestScript is the placeholder npm init writes.
+const npmDefaultTestScript = `echo "Error: no test specified" && exit 1`
+
+const (
+	defaultTestTimeout = 5 * time.Minute
+	// testSummaryLines bounds the failure lines and the output tail in a
+	// test summary.
+	testSummaryLines = 40
+)
+
+// configProjectCommands reads a list of projectCommand from config key.
+// Malformed entries are skipped.
+func (s *Service) configProjectCommands(key string) []projectCommand {
+	raw, ok := s.configValue(key).([]interface{})
+	if !ok {
+		return nil
+	}
+	var commands []projectCommand
+	for _, item := range raw {
+		entry, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		marker, _ := entry["marker"].(string)
+		command, _ := entry["command"].(string)
+		script, _ := entry["script"].(string)
+		fix, _ := entry["fix"].(string)
+		if strings.TrimSpace(marker) == "" || (strings.TrimSpace(command) == "" && strings.TrimSpace(script) == "") {
+			continue
+		}
+		commands = append(commands, projectCommand{Marker: marker, Command: command, Script: script, Fix: fix})
+	}
+	return commands
+}
+
+// detectProjectCommands returns the entries whose marker exists in root,
+// in order, with Command resolved.
+func detectProjectCommands(root string, commands []projectCommand) []projectCommand {
+	var matched []projectCommand
+	for _, c := range commands {
+		if _, err := os.Stat(filepath.Join(root, c.Marker)); err != nil {
+			continue
+		}
+		if c.Command == "" {
+			script, ok := npmScriptCommand(root, c.Script)
+			if !ok {
+				continue
+			}
+			c.Command = script
+		}
+		matched = append(matched, c)
+	}
+	return matched
+}
+
+// detectProjectCommand returns the command of the first entry whose marker
+// exists in root, with the marker it matched.
+func detectProjectCommand(root string, commands []projectCommand) (command string, marker string, ok bool) {
+	matched := detectProjectCommands(root, commands)
+	if len(matched) == 0 {
+		return "", "", false
+	}
+	return matched[0].Command, matched[0].Marker, true
+}
+
+// npmScriptCommand returns the command running a package.json script with
+// the project's package manager, if the script is defined.
+func npmScriptCommand(root string, script string) (string, bool) {
+	data, err := os.ReadFile(filepath.Join(root, "package.json"))
+	if err != nil {
+		return "", false
+	}
+	var pkg struct {
+		Scripts map[string]string `json:"scripts"`
+	}
+	if err := json.Unmarshal(data, &pkg); err != nil {
+		return "", false
+	}
+	body := strings.TrimSpace(pkg.Scripts[script])
+	if body == "" || body == npmDefaultTestScript {
+		return "", false
+	}
+	manager := "npm"
+	for _, lock := range []struct{ file, manager string }{
+		{"pnpm-lock.yaml", "pnpm"}, {"yarn.lock", "yarn"}, {"bun.lockb", "bun"},
+	} {
+		if _, err := os.Stat(filepath.Join(root, lock.file)); err == nil {
+			manager = lock.manager
+			break
+		}
+	}
+	// "bun test" runs bun's own test runner rather than the script.
+	if script == "test" && manager != "bun" {
+		return manager + " test", true
+	}
+	return manager + " run " + script, true
+}
+
+// projectCommandResult is the outcome of a detected project command.
+type projectCommandResult struct {
+	Command  string
+	Output   string
+	ExitCode int
+	Duration time.Duration
+	TimedOut bool
+}
+
+// runProjectCommand runs command in the workspace with timeout.
+func (s *Service) runProjectCommand(ctx context.Context, command string, timeout time.Duration) projectCommandResult {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	result, err := s.RunCommandWithCwdContext(ctx, command, "")
+	res := projectCommandResult{
+		Command:  command,
+		Output:   result.Output,
+		ExitCode: result.ExitCode,
+		Duration: time.Since(start).Round(100 * time.Millisecond),
+		TimedOut: errors.Is(ctx.Err(), context.DeadlineExceeded),
+	}
+	if err != nil && res.ExitCode == 0 {
+		res.ExitCode = 1
+	}
+	return res
+}
+
+// testFailureLine matches the lines test runners use to report failures.
+var testFailureLine = regexp.MustCompile(`(?i)(\bFAIL\b|\bFAILED\b|\bpanic:|\berror\b|✗|✕|^\s*at .+:\d+)`)
+
+// summarizeTestRun reports whether the tests passed and, when they did
+// not, the lines reporting failures followed by the end of the output.
+func summarizeTestRun(res projectCommandResult) string {
+	var b strings.Builder
+	switch {
+	case res.TimedOut:
+		fmt.Fprintf(&b, "TIMED OUT: `%s` did not finish within %s.\n", res.Command, res.Duration)
+	case res.ExitCode == 0:
+		fmt.Fprintf(&b, "PASS: `%s` succeeded in %s.\n", res.Command, res.Duration)
+	default:
+		fmt.Fprintf(&b, "FAIL: `%s` exited with code %d after %s.\n", res.Command, res.ExitCode, res.Duration)
+	}
+
+	lines := strings.Split(strings.TrimRight(res.Output, "\n"), "\n")
+	if res.ExitCode != 0 || res.TimedOut {
+		var failures []string
+		for _, line := range lines {
+			if testFailureLine.MatchString(line) {
+				failures = append(failures, line)
+			}
+		}
+		if len(failures) > 0 {
+			if len(failures) > testSummaryLines {
+				failures = append(failures[:testSummaryLines], fmt.Sprintf("... %d more", len(failures)-testSummaryLines))
+			}
+			b.WriteString("\nFailures:\n" + strings.Join(failures, "\n") + "\n")
+		}
+	}
+	tail := lines
+	if len(tail) > testSummaryLines {
+		tail = tail[len(tail)-testSummaryLines:]
+	}
+	if text := strings.TrimSpace(strings.Join(tail, "\n")); text != "" {
+		b.WriteString("\nLast output:\n" + text + "\n")
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
+
+type runTestsTool struct{}
+
+func (t *runTestsTool) Spec() ToolSpec {
+	return ToolSpec{
+		Name:        "run_tests",
+		Description: "Detect the project type (go.mod, package.json, Cargo.toml, pyproject.toml, ...) and run its tests. Returns pass/fail and the failing output.",
+		Parameters: map[string]any{
+			"type":                 "object",
+			"properties":           map[string]any{},
+			"additionalProperties": false,
+		},
+	}
+}
+
+func (t *runTestsTool) AllowedInPlanMode() bool { return false }
+
+func (t *runTestsTool) ReadOnly(args map[string]any) bool { return false }
+
+func (t *runTestsTool) Execute(ctx context.Context, svc *Service, sessionID string, args map[string]any) (string, error) {
+	commands := append(svc.configProjectCommands("testCommands"), defaultTestCommands...)
+	command, _, ok := detectProjectCommand(svc.GetWorkspaceDirectory(), commands)
+	if !ok {
+		return "", errors.New("no test command found for this project; add one to \"testCommands\" in the config, or use run_command")
+	}
+	timeout := time.Duration(svc.configInt("testTimeoutSeconds", int(defaultTestTimeout/time.Second))) * time.Second
+	res := svc.runProjectCommand(ctx, command, timeout)
+	return summarizeTestRun(res), nil
+}
+
+// defaultLintCommands are checked in order after any "lintCommands" from
+// the config; the first whose program is installed runs.
+var defaultLintCommands = []projectCommand{
+	{Marker: "go.mod", Command: "goimports -l -d .", Fix: "goimports -l -w ."},
+	{Marker: "go.mod", Command: "gofmt -l -d .", Fix: "gofmt -l -w ."},
+	{Marker: "package.json", Script: "lint"},
+	{Marker: "eslint.config.js", Command: "npx --no-install eslint .", Fix: "npx --no-install eslint --fix ."},
+	{Marker: "eslint.config.mjs", Command: "npx --no-install eslint .", Fix: "npx --no-install eslint --fix ."},
+	{Marker: ".eslintrc.json", Command: "npx --no-install eslint .", Fix: "npx --no-install eslint --fix ."},
+	{Marker: ".eslintrc.js", Command: "npx --no-install eslint .", Fix: "npx --no-install eslint --fix ."},
+	{Marker: ".prettierrc", Command: "npx --no-install prettier --check .", Fix: "npx --no-install prettier --write ."},
+	{Marker: ".prettierrc.json", Command: "npx --no-install prettier --check .", Fix: "npx --no-install prettier --write ."},
+	{Marker: "prettier.config.js", Command: "npx --no-install prettier --check .", Fix: "npx --no-install prettier --write ."},
+	{Marker: "ruff.toml", Command: "ruff format --diff .; ruff check .", Fix: "ruff format . && ruff check --fix ."},
+	{Marker: "pyproject.toml", Command: "ruff format --diff .; ruff check .", Fix: "ruff format . && ruff check --fix ."},
+	{Marker: "Cargo.toml", Command: "cargo fmt --check", Fix: "cargo fmt"},
+}
+
+// exitCommandNotFound is the shell's exit code for a missing program.
+const exitCommandNotFound = 127
+
+// commandInstalled reports whether the program command starts with is on
+// the PATH.
+func commandInstalled(command string) bool {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return false
+	}
+	_, err := exec.LookPath(fields[0])
+	return err == nil
+}
+
+const defaultLintTimeout = 2 * time.Minute
+
+type lintTool struct{}
+
+func (t *lintTool) Spec() ToolSpec {
+	return ToolSpec{
+		Name:        "lint",
+		Description: "Run the project's formatter or linter (gofmt/goimports, eslint, prettier, ruff, cargo fmt) and return the diff or issues. With fix it rewrites the files instead.",
+		Parameters: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"fix": map[string]any{"type": "boolean"},
+			},
+			"additionalProperties": false,
+		},
+	}
+}
+
+func (t *lintTool) AllowedInPlanMode() bool { return false }
+
+func (t *lintTool) ReadOnly(args map[string]any) bool { return false }
+
+func (t *lintTool) Execute(ctx context.Context, svc *Service, sessionID string, args map[string]any) (string, error) {
+	fix, err := optionalBoolArg(args, "fix", false)
+	if err != nil {
+		return "", err
+	}
+	commands := append(svc.configProjectCommands("lintCommands"), defaultLintCommands...)
+	matched := detectProjectCommands(svc.GetWorkspaceDirectory(), commands)
+	if len(matched) == 0 {
+		return "", errors.New("no formatter or linter found for this project; add one to \"lintCommands\" in the config, or use run_command")
+	}
+
+	timeout := time.Duration(svc.configInt("lintTimeoutSeconds", int(defaultLintTimeout/time.Second))) * time.Second
+	var missing []string
+	for _, c := range matched {
+		command := c.Command
+		if fix && c.Fix != "" {
+			command = c.Fix
+		}
+		if !commandInstalled(command) {
+			missing = append(missing, strings.Fields(command)[0])
+			continue
+		}
+		res := svc.runProjectCommand(ctx, command, timeout)
+		return summarizeLintRun(res, fix && c.Fix != ""), nil
+	}
+	return fmt.Sprintf("No formatter or linter is installed for this project (looked for %s). Skipping lint.", strings.Join(uniqueStrings(missing), ", ")), nil
+}
+
+// summarizeLintRun reports a lint or format run: clean, the issues or diff
+// it printed, or that its tools are missing.
+func summarizeLintRun(res projectCommandResult, fixed bool) string {
+	output := strings.TrimSpace(res.Output)
+	switch {
+	case res.TimedOut:
+		return fmt.Sprintf("TIMED OUT: `%s` did not finish within %s.", res.Command, res.Duration)
+	case res.ExitCode == exitCommandNotFound:
+		return fmt.Sprintf("`%s` is not installed or could not be started; skipping lint.\n%s", res.Command, truncateUTF8(output, 500))
+	case res.ExitCode == 0 && output == "":
+		if fixed {
+			return fmt.Sprintf("`%s` ran; nothing left to fix.", res.Command)
+		}
+		return fmt.Sprintf("CLEAN: `%s` reported no issues.", res.Command)
+	}
+	status := "ISSUES"
+	if fixed {
+		status = "FIXED"
+	} else if res.ExitCode == 0 {
+		status = "OUTPUT"
+	}
+	lines := strings.Split(output, "\n")
+	if len(lines) > maxLintLines {
+		lines = append(lines[:maxLintLines], fmt.Sprintf("... %d more lines", len(lines)-maxLintLines))
+	}
+	return fmt.Sprintf("%s: `%s` exited with code %d:\n%s", status, res.Command, res.ExitCode, strings.Join(lines, "\n"))
+}
+
+// maxLintLines bounds the diff or issue lines returned by lint.
+const maxLintLines = 200
+
+// uniqueStrings returns list without repeats, keeping the first of each.
+func uniqueStrings(list []string) []string {
+	seen := make(map[string]bool, len(list))
+	var out []string
+	for _, s := range list {
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// defaultBuildCommands are checked in order after any "buildCommands" from
+// the config.
+var defaultBuildCommands = []projectCommand{
+	{Marker: "go.mod", Command: "go build ./..."},
+	{Marker: "Cargo.toml", Command: "cargo build"},
+	{Marker: "package.json", Script: "build"},
+	{Marker: "tsconfig.json", Command: "npx --no-install tsc --noEmit"},
+	{Marker: "pom.xml", Command: "mvn -q compile"},
+	{Marker: "build.gradle", Command: "gradle assemble"},
+	{Marker: "build.gradle.kts", Command: "gradle assemble"},
+	{Marker: "Makefile", Command: "make"},
+}
+
+const (
+	defaultBuildTimeout = 5 * time.Minute
+	// maxBuildErrors bounds the errors returned by the build tool.
+	maxBuildErrors = 50
+)
+
+// BuildError is one compiler error located in a file.
+type BuildError struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column,omitempty"`
+	Message string `json:"message"`
+}
+
+var (
+	// file:line[:col]: message, as printed by go, gcc, clang and most
+	// linters.
+	fileLineError = regexp.MustCompile(`^\s*([^\s:()][^:()]*\.[A-Za-z0-9]+):(\d+)(?::(\d+))?:\s*(.+)$`)
+	// file(line,col): message, as printed by tsc and MSBuild.
+	parenLineError = regexp.MustCompile(`^\s*([^\s(][^(]*\.[A-Za-z0-9]+)\((\d+),(\d+)\):\s*(.+)$`)
+	// [ERROR] file:[line,col] message, as printed by Maven.
+	mavenError = regexp.MustCompile(`^\[ERROR\]\s+(.+?):\[(\d+),(\d+)\]\s*(.+)$`)
+	// Rust reports the message first and the location on a later
+	// "--> file:line:col" line.
+	rustErrorHeader   = regexp.MustCompile(`^(error(?:\[\w+\])?):\s*(.+)$`)
+	rustErrorLocation = regexp.MustCompile(`^\s*-->\s*(.+?):(\d+):(\d+)$`)
+)
+
+// parseBuildErrors extracts the located errors from compiler output.
+// Warnings are skipped when the line says so.
+func parseBuildErrors(output string) []BuildError {
+	var errs []BuildError
+	seen := map[BuildError]bool{}
+	add := func(file, line, col, message string) {
+		message = strings.TrimSpace(message)
+		if strings.HasPrefix(strings.ToLower(message), "warning") {
+			return
+		}
+		e := BuildError{File: strings.TrimPrefix(file, "./"), Message: message}
+		e.Line, _ = strconv.Atoi(line)
+		e.Column, _ = strconv.Atoi(col)
+		if !seen[e] {
+			seen[e] = true
+			errs = append(errs, e)
+		}
+	}
+
+	pendingRust := ""
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if m := rustErrorHeader.FindStringSubmatch(line); m != nil {
+			pendingRust = m[2]
+			continue
+		}
+		if m := rustErrorLocation.FindStringSubmatch(line); m != nil {
+			if pendingRust != "" {
+				add(m[1], m[2], m[3], pendingRust)
+				pendingRust = ""
+			}
+			continue
+		}
+		if m := mavenError.FindStringSubmatch(line); m != nil {
+			add(m[1], m[2], m[3], m[4])
+		} else if m := parenLineError.FindStringSubmatch(line); m != nil {
+			add(m[1], m[2], m[3], m[4])
+		} else if m := fileLineError.FindStringSubmatch(line); m != nil {
+			add(m[1], m[2], m[3], m[4])
+		}
+	}
+	return errs
+}
+
+// summarizeBuildRun reports a build: success, or the parsed errors as JSON
+// and, when none could be parsed, the end of the output. Error paths are
+// shown relative to root.
+func summarizeBuildRun(res projectCommandResult, root string) string {
+	switch {
+	case res.TimedOut:
+		return fmt.Sprintf("TIMED OUT: `%s` did not finish within %s.", res.Command, res.Duration)
+	case res.ExitCode == 0:
+		return fmt.Sprintf("BUILD OK: `%s` succeeded in %s.", res.Command, res.Duration)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "BUILD FAILED: `%s` exited with code %d after %s.\n", res.Command, res.ExitCode, res.Duration)
+	errs := parseBuildErrors(res.Output)
+	for i := range errs {
+		errs[i].File = toWorkspaceRel(root, errs[i].File)
+	}
+	if len(errs) > 0 {
+		total := len(errs)
+		if total > maxBuildErrors {
+			errs = errs[:maxBuildErrors]
+		}
+		data, _ := json.MarshalIndent(errs, "", "  ")
+		fmt.Fprintf(&b, "\nErrors (%d):\n%s\n", total, data)
+		if total > maxBuildErrors {
+			fmt.Fprintf(&b, "... %d more errors not shown\n", total-maxBuildErrors)
+		}
+		return strings.TrimRight(b.String(), "\n")
+	}
+	lines := strings.Split(strings.TrimRight(res.Output, "\n"), "\n")
+	if len(lines) > testSummaryLines {
+		lines = lines[len(lines)-testSummaryLines:]
+	}
+	b.WriteString("\nNo file locations found in the output. Last output:\n" + strings.Join(lines, "\n"))
+	return b.String()
+}
+
+type buildTool struct{}
+
+func (t *buildTool) Spec() ToolSpec {
+	return ToolSpec{
+		Name:        "build",
+		Description: "Detect the project type and build it (go build, npm run build, cargo build, ...). On failure returns the compiler errors as a list of {file, line, column, message}.",
+		Parameters: map[string]any{
+			"type":                 "object",
+			"properties":           map[string]any{},
+			"additionalProperties": false,
+		},
+	}
+}
+
+func (t *buildTool) AllowedInPlanMode() bool { return false }
+
+func (t *buildTool) ReadOnly(args map[string]any) bool { return false }
+
+func (t *buildTool) Execute(ctx context.Context, svc *Service, sessionID string, args map[string]any) (string, error) {
+	commands := append(svc.configProjectCommands("buildCommands"), defaultBuildCommands...)
+	command, _, ok := detectProjectCommand(svc.GetWorkspaceDirectory(), commands)
+	if !ok {
+		return "", errors.New("no build command found for this project; add one to \"buildCommands\" in the config, or use run_command")
+	}
+	timeout := time.Duration(svc.configInt("buildTimeoutSeconds", int(defaultBuildTimeout/time.Second))) * time.Second
+	res := svc.runProjectCommand(ctx, command, timeout)
+	return summarizeBuildRun(res, svc.GetWorkspaceDirectory()), nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// ProviderKind is the API a service speaks. It decides the request shape,
+// the endpoint path and the default tool-calling protocol.
+type ProviderKind string
+
+const (
+	ProviderOpenAI    ProviderKind = "openai"
+	ProviderAnthropic ProviderKind = "anthropic"
+	ProviderGemini    ProviderKind = "gemini" // via its OpenAI-compatible endpoint
+	ProviderOllama    ProviderKind = "ollama"
+	ProviderCustom    ProviderKind = "custom" // any other OpenAI-compatible server
+)
+
+// parseProviderKind validates a provider kind from a service config.
+func parseProviderKind(value string) (ProviderKind, error) {
+	kind := ProviderKind(strings.ToLower(strings.TrimSpace(value)))
+	switch kind {
+	case ProviderOpenAI, ProviderAnthropic, ProviderGemini, ProviderOllama, ProviderCustom:
+		return kind, nil
+	}
+	return "", fmt.Errorf("%w: unknown provider %q (want openai, anthropic, gemini, ollama or custom)", ErrInvalidArgument, value)
+}
+
+// isAnthropic reports whether the kind uses Anthropic's Messages API; every
+// other kind uses OpenAI-style chat completions.
+func (k ProviderKind) isAnthropic() bool {
+	return k == ProviderAnthropic
+}
+
+// inferProviderKind guesses the kind of a service saved before kinds
+// existed, from its base URL and, failing that, its ID. It is only used to
+// migrate old configs.
+func inferProviderKind(id, baseURL string) ProviderKind {
+	host := ""
+	port := ""
+	if u, err := url.Parse(strings.TrimSpace(baseURL)); err == nil {
+		host = strings.ToLower(u.Hostname())
+		port = u.Port()
+	}
+	lowerID := strings.ToLower(id)
+	switch {
+	case strings.HasSuffix(host, "anthropic.com"):
+		return ProviderAnthropic
+	case strings.HasSuffix(host, "openai.com"):
+		return ProviderOpenAI
+	case host == "generativelanguage.googleapis.com":
+		return ProviderGemini
+	case port == "11434":
+		return ProviderOllama
+	case strings.Contains(lowerID, "anthropic"):
+		return ProviderAnthropic
+	case strings.Contains(lowerID, "openai"):
+		return ProviderOpenAI
+	case strings.Contains(lowerID, "ollama"):
+		return ProviderOllama
+	}
+	return ProviderCustom
+}
+
+// migrateProviderKinds sets a valid "provider" on every custom service that
+// lacks one and saves the config if anything changed.
+func (s *Service) migrateProviderKinds() {
+	s.configMux.Lock()
+	defer s.configMux.Unlock()
+	config, err := copyConfig(s.config)
+	if err != nil {
+		fmt.Printf("Warning: Failed to migrate provider kinds: %v\n", err)
+		return
+	}
+	customServices, ok := config["customServices"].([]interface{})
+	if !ok {
+		return
+	}
+	changed := false
+	for _, svc := range customServices {
+		svcMap, ok := svc.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		current, _ := svcMap["provider"].(string)
+		if kind, err := parseProviderKind(current); err == nil {
+			if string(kind) != current {
+				svcMap["provider"] = string(kind)
+				changed = true
+			}
+			continue
+		}
+		id, _ := svcMap["id"].(string)
+		baseURL, _ := svcMap["baseUrl"].(string)
+		svcMap["provider"] = string(inferProviderKind(id, baseURL))
+		changed = true
+	}
+	if !changed {
+		return
+	}
+	if err := s.writeConfigLocked(config); err != nil {
+		fmt.Printf("Warning: Failed to save migrated provider kinds: %v\n", err)
+	}
+	s.config = config
+}
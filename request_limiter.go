@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// defaultMaxConcurrentRequests is used when "maxConcurrentRequests" is not
+// configured.
+const defaultMaxConcurrentRequests = 4
+
+// requestLimiter caps how many LLM requests run at once. Callers beyond the
+// limit queue until a slot frees up or their context is cancelled.
+type requestLimiter struct {
+	mu    sync.Mutex
+	slots chan struct{}
+}
+
+// acquire waits for a slot among size. If size changed since the last call a
+// new set of slots is used; requests holding old slots release them there.
+func (l *requestLimiter) acquire(ctx context.Context, size int) (func(), error) {
+	if size <= 0 {
+		size = defaultMaxConcurrentRequests
+	}
+	l.mu.Lock()
+	if l.slots == nil || cap(l.slots) != size {
+		l.slots = make(chan struct{}, size)
+	}
+	slots := l.slots
+	l.mu.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// acquireLLMSlot blocks until an LLM request may start.
+func (s *Service) acquireLLMSlot(ctx context.Context) (func(), error) {
+	return s.llmLimiter.acquire(ctx, s.configInt("maxConcurrentRequests", defaultMaxConcurrentRequests))
+}
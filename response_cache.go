@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The response cache stores successful LLM responses on disk, keyed by the
+// endpoint and the exact request body (model, messages, temperature and the
+// rest), so re-sending an identical prompt costs nothing. It is off unless
+// config "cacheResponses" is true, and only requests with temperature 0 are
+// cached unless "cacheNonDeterministic" is also true. Entries expire after
+// "cacheTTLSeconds" and at most "cacheMaxEntries" are kept, oldest evicted
+// first. Error responses are never cached.
+
+const (
+	defaultCacheTTL        = 24 * time.Hour
+	defaultCacheMaxEntries = 500
+)
+
+// cachedResponse is one cache file.
+type cachedResponse struct {
+	Model     string `json:"model"`
+	CreatedAt int64  `json:"createdAt"`
+	Body      string `json:"body"`
+}
+
+func (s *Service) responseCacheDir() string {
+	return filepath.Join(s.dataDir, "cache")
+}
+
+// responseCacheKey hashes a request body for endpoint.
+func responseCacheKey(endpoint string, body []byte) string {
+	sum := sha256.Sum256([]byte(endpoint + "\n" + string(body)))
+	return hex.EncodeToString(sum[:])
+}
+
+// requestTemperature returns the temperature a request asks for; providers
+// default to 1 when it is not set.
+func requestTemperature(requestData map[string]interface{}) float64 {
+	switch v := requestData["temperature"].(type) {
+	case float64:
+		return v
+	case int:
+		return float64(v)
+	}
+	return 1
+}
+
+// responseCacheable reports whether a request may use the cache.
+func (s *Service) responseCacheable(requestData map[string]interface{}) bool {
+	if !s.configBool("cacheResponses", false) {
+		return false
+	}
+	return requestTemperature(requestData) == 0 || s.configBool("cacheNonDeterministic", false)
+}
+
+// cachedLLMResponse returns the cached body for key if it has not expired.
+func (s *Service) cachedLLMResponse(key string) ([]byte, bool) {
+	s.cacheMux.Lock()
+	defer s.cacheMux.Unlock()
+
+	path := filepath.Join(s.responseCacheDir(), key+".json")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	var entry cachedResponse
+	if err := json.Unmarshal(data, &entry); err != nil {
+		_ = os.Remove(path)
+		return nil, false
+	}
+	ttl := time.Duration(s.configInt("cacheTTLSeconds", int(defaultCacheTTL/time.Second))) * time.Second
+	if time.Since(time.UnixMilli(entry.CreatedAt)) > ttl {
+		_ = os.Remove(path)
+		return nil, false
+	}
+	return []byte(entry.Body), true
+}
+
+// storeLLMResponse caches a successful response body and evicts the oldest
+// entries past the size limit.
+func (s *Service) storeLLMResponse(key string, model string, body []byte) {
+	s.cacheMux.Lock()
+	defer s.cacheMux.Unlock()
+
+	dir := s.responseCacheDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		fmt.Printf("Warning: Failed to create response cache: %v\n", err)
+		return
+	}
+	data, err := json.Marshal(cachedResponse{Model: model, CreatedAt: time.Now().UnixMilli(), Body: string(body)})
+	if err != nil {
+		return
+	}
+	if err := os.WriteFile(filepath.Join(dir, key+".json"), data, 0644); err != nil {
+		fmt.Printf("Warning: Failed to write response cache: %v\n", err)
+		return
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	type cacheFile struct {
+		name    string
+		modTime time.Time
+	}
+	var files []cacheFile
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		if info, err := e.Info(); err == nil {
+			files = append(files, cacheFile{name: e.Name(), modTime: info.ModTime()})
+		}
+	}
+	limit := s.configInt("cacheMaxEntries", defaultCacheMaxEntries)
+	if len(files) <= limit {
+		return
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	for _, f := range files[:len(files)-limit] {
+		_ = os.Remove(filepath.Join(dir, f.name))
+	}
+}
+
+// ClearCache removes every cached response and returns how many there were.
+func (s *Service) ClearCache() (int, error) {
+	s.cacheMux.Lock()
+	defer s.cacheMux.Unlock()
+
+	entries, err := os.ReadDir(s.responseCacheDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	removed := 0
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.responseCacheDir(), e.Name())); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
@@ -1,17 +1,24 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
-	"runtime"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 )
 
 // TodoItem represents a task
@@ -32,27 +39,98 @@ type Session struct {
 	Messages  []map[string]interface{} `json:"messages"`
 	ParentID  string                   `json:"parentId,omitempty"`
 	Todos     []TodoItem               `json:"todos,omitempty"` // Session-specific todos
+	// ArchivedCount is the number of older messages moved to the archive
+	// sidecar by the maxMessagesPerSession limit.
+	ArchivedCount int `json:"archivedCount,omitempty"`
+	// DeletedAt is set while the session is in the trash.
+	DeletedAt int64 `json:"deletedAt,omitempty"`
+	// Deterministic makes requests use temperature 0 and a fixed seed, see
+	// SetSessionDeterministic.
+	Deterministic bool `json:"deterministic,omitempty"`
+	// Generation overrides the service's sampling parameters, see
+	// SetSessionGenerationParams.
+	Generation *GenerationParams `json:"generation,omitempty"`
+	// ToolStats counts the agent's tool calls by tool name.
+	ToolStats map[string]ToolStat `json:"toolStats,omitempty"`
+
+	// lazy is set while Messages have not been read from disk yet;
+	// messageCount then holds the count recorded in the index.
+	lazy         bool
+	messageCount int
 }
 
 // Service provides business logic for OpenSpace
 type Service struct {
 	sessions     map[string]*Session
-	sessionMux   sync.RWMutex
+	trash        map[string]*Session // soft-deleted sessions, guarded by sessionMux
+	sessionMux   sync.RWMutex        // guards the sessions and trash maps
+	sessionLocks sync.Map            // session ID -> *sync.Mutex, see lockSession
+	sessionLoad  sync.Mutex          // guards lazy message loading
+	indexMux     sync.Mutex          // serializes session index writes
 	dataDir      string
 	configFile   string
-	sessionsFile string
+	sessionsFile string // legacy monolithic store, migrated on load
+	sessionsDir  string
+	storeVersion int // session index format read on load, see sessionIndexVersion
+	backupsDir   string
 	configMux    sync.RWMutex
 	config       map[string]interface{}
 
 	// Cancellation support
 	cancelFuncs    map[string]context.CancelFunc
 	cancelFuncsMux sync.Mutex
+	searchCancel   context.CancelFunc
+	searchSeq      uint64
 
 	workspaceDir    string
 	workspaceDirMux sync.RWMutex
+
+	watcher    *fileWatcher
+	watcherMux sync.Mutex
+	dirCache   dirListingCache
+	customCmds customCommandCache
+
+	eventEmitter func(name string, data ...interface{})
+	eventMux     sync.RWMutex
+
+	asyncResults    map[string]*AsyncResult
+	asyncWG         sync.WaitGroup
+	asyncInFlight   atomic.Int64
+	sendsInFlight   atomic.Int64
+	llmLimiter      requestLimiter
+	asyncResultsMux sync.Mutex
+
+	pendingFiles    map[string][]FileAttachment // session ID -> files for the next message
+	pendingFilesMux sync.Mutex
+	cacheMux        sync.Mutex // guards the response cache directory
+
+	background    map[string]*backgroundCommand // handle -> command, see StartBackgroundCommand
+	backgroundMux sync.Mutex
+
+	toolStats    map[string]map[string]ToolStat // session ID -> stats not yet saved
+	toolStatsMux sync.Mutex
 }
 
-func splitProviderModel(model string) (string, string) {
+// AsyncResult is the outcome of a SendMessageAsync call.
+type AsyncResult struct {
+	ProcessingID string                 `json:"processingId"`
+	SessionID    string                 `json:"sessionId"`
+	Status       string                 `json:"status"` // processing, completed, error
+	MessageID    string                 `json:"messageId,omitempty"`
+	Message      map[string]interface{} `json:"message,omitempty"`
+	Error        string                 `json:"error,omitempty"`
+	StartedAt    int64                  `json:"startedAt"`
+	FinishedAt   int64                  `json:"finishedAt,omitempty"`
+}
+
+// asyncResultTTL is how long finished async results are kept for polling.
+const asyncResultTTL = time.Hour
+
+// splitProviderModel splits "service::model" into its parts. A single ":"
+// separates a service only when isService knows the left side, since model
+// names such as Ollama's "llama3:8b" contain colons themselves; "::" is the
+// unambiguous form.
+func splitProviderModel(model string, isService func(id string) bool) (string, string) {
 	if strings.Contains(model, "::") {
 		parts := strings.SplitN(model, "::", 2)
 		if len(parts) == 2 && strings.TrimSpace(parts[0]) != "" && strings.TrimSpace(parts[1]) != "" {
@@ -61,7 +139,7 @@ func splitProviderModel(model string) (string, string) {
 	}
 	if strings.Contains(model, ":") {
 		parts := strings.SplitN(model, ":", 2)
-		if len(parts) == 2 && strings.TrimSpace(parts[0]) != "" && strings.TrimSpace(parts[1]) != "" {
+		if len(parts) == 2 && strings.TrimSpace(parts[0]) != "" && strings.TrimSpace(parts[1]) != "" && isService(parts[0]) {
 			return parts[0], parts[1]
 		}
 	}
@@ -69,7 +147,10 @@ func splitProviderModel(model string) (string, string) {
 }
 
 type CommandRunResult struct {
-	Output   string
+	// Output is stdout and stderr interleaved as they were written.
+	Output string
+	// Stderr is what the command wrote to stderr alone.
+	Stderr   string
 	Cwd      string
 	Shell    string
 	Branch   string
@@ -93,13 +174,18 @@ func NewService() *Service {
 		dataDir:      dataDir,
 		configFile:   configFile,
 		sessionsFile: sessionsFile,
+		sessionsDir:  filepath.Join(dataDir, "sessions"),
+		backupsDir:   filepath.Join(home, ".openspace", "backups"),
 		config:       make(map[string]interface{}),
 		cancelFuncs:  make(map[string]context.CancelFunc),
+		asyncResults: make(map[string]*AsyncResult),
 	}
 
 	// Load persisted data
 	service.loadSessions()
 	service.loadConfig()
+	service.migrateProviderKinds()
+	service.purgeExpiredTrash()
 
 	return service
 }
@@ -115,6 +201,54 @@ func (s *Service) GetWorkspaceDirectory() string {
 	return dir
 }
 
+func (s *Service) resolveWorkspacePath(path string) string {
+	path = fromToolPath(path)
+	if !filepath.IsAbs(path) {
+		return filepath.Join(s.GetWorkspaceDirectory(), path)
+	}
+	return path
+}
+
+// workspaceFilePath resolves path against the workspace and refuses paths
+// that end up outside of it.
+func (s *Service) workspaceFilePath(path string) (string, error) {
+	root := filepath.Clean(s.GetWorkspaceDirectory())
+	resolved := filepath.Clean(s.resolveWorkspacePath(path))
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path is outside the workspace: %s", path)
+	}
+	return resolved, nil
+}
+
+// toWorkspaceRel returns path as the tools should show it: relative to root
+// with forward slashes on every OS, so the model can pass it back to
+// read_file or edit_file unchanged. Relative paths are taken as relative to
+// root; paths outside root stay absolute, also with forward slashes.
+func toWorkspaceRel(root, path string) string {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(root, path)
+	}
+	path = filepath.Clean(path)
+	rel, err := filepath.Rel(filepath.Clean(root), path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return filepath.ToSlash(path)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// fromToolPath converts a path from a tool call to the OS form. Both "/"
+// and "\" are accepted as separators, so a path written for another OS, or
+// copied from Windows output, still resolves.
+func fromToolPath(path string) string {
+	return filepath.FromSlash(strings.ReplaceAll(path, `\`, "/"))
+}
+
+// workspaceRel is toWorkspaceRel against the current workspace.
+func (s *Service) workspaceRel(path string) string {
+	return toWorkspaceRel(s.GetWorkspaceDirectory(), path)
+}
+
 func (s *Service) SetWorkspaceDirectory(dir string) error {
 	dir = strings.TrimSpace(dir)
 	if dir == "" {
@@ -137,54 +271,11 @@ func (s *Service) SetWorkspaceDirectory(dir string) error {
 	return nil
 }
 
-// loadSessions loads sessions from file
-func (s *Service) loadSessions() {
-	s.sessionMux.Lock()
-	defer s.sessionMux.Unlock()
-
-	if _, err := os.Stat(s.sessionsFile); err != nil {
-		return // File doesn't exist, start with empty sessions
-	}
-
-	data, err := os.ReadFile(s.sessionsFile)
-	if err != nil {
-		fmt.Printf("Warning: Failed to load sessions: %v\n", err)
-		return
-	}
-
-	var sessionsData map[string]*Session
-	if err := json.Unmarshal(data, &sessionsData); err != nil {
-		fmt.Printf("Warning: Failed to parse sessions file: %v\n", err)
-		return
-	}
-
-	s.sessions = sessionsData
-}
-
-// saveSessions saves sessions to file
-func (s *Service) saveSessions() error {
-	s.sessionMux.RLock()
-	defer s.sessionMux.RUnlock()
-	return s.saveSessionsLocked()
-}
-
-func (s *Service) saveSessionsLocked() error {
-	data, err := json.MarshalIndent(s.sessions, "", "  ")
-	if err != nil {
-		return fmt.Errorf("failed to marshal sessions: %w", err)
-	}
-
-	if err := os.WriteFile(s.sessionsFile, data, 0644); err != nil {
-		return fmt.Errorf("failed to save sessions: %w", err)
-	}
-
-	return nil
-}
-
 // loadConfig loads configuration from file
 func (s *Service) loadConfig() {
 	if _, err := os.Stat(s.configFile); err != nil {
 		// Create default config
+		s.configMux.Lock()
 		s.config = map[string]interface{}{
 			"providers": map[string]interface{}{
 				"openspace": map[string]interface{}{
@@ -192,6 +283,7 @@ func (s *Service) loadConfig() {
 				},
 			},
 		}
+		s.configMux.Unlock()
 		return
 	}
 
@@ -201,16 +293,31 @@ func (s *Service) loadConfig() {
 		return
 	}
 
-	if err := json.Unmarshal(data, &s.config); err != nil {
+	var config map[string]interface{}
+	if err := json.Unmarshal(data, &config); err != nil {
 		fmt.Printf("Warning: Failed to parse config file: %v\n", err)
+		return
 	}
+	s.configMux.Lock()
+	defer s.configMux.Unlock()
+	if config != nil && migrateConfig(config) {
+		if err := s.writeConfigLocked(config); err != nil {
+			fmt.Printf("Warning: Failed to save migrated config: %v\n", err)
+		}
+	}
+	s.config = config
 }
 
 // saveConfig saves configuration to file
 func (s *Service) saveConfig(config map[string]interface{}) error {
 	s.configMux.Lock()
 	defer s.configMux.Unlock()
+	return s.writeConfigLocked(config)
+}
 
+// writeConfigLocked writes config to disk. The caller holds configMux.
+func (s *Service) writeConfigLocked(config map[string]interface{}) error {
+	stampConfigVersion(config)
 	data, err := json.MarshalIndent(config, "", "  ")
 	if err != nil {
 		return fmt.Errorf("failed to marshal config: %w", err)
@@ -223,14 +330,14 @@ func (s *Service) saveConfig(config map[string]interface{}) error {
 	return nil
 }
 
-// GetSessions returns all sessions
-func (s *Service) GetSessions() ([]*Session, error) {
+// GetSessions returns the metadata of all sessions, without messages
+func (s *Service) GetSessions() ([]SessionMeta, error) {
 	s.sessionMux.RLock()
 	defer s.sessionMux.RUnlock()
 
-	sessions := make([]*Session, 0, len(s.sessions))
+	sessions := make([]SessionMeta, 0, len(s.sessions))
 	for _, session := range s.sessions {
-		sessions = append(sessions, session)
+		sessions = append(sessions, s.sessionMeta(session))
 	}
 
 	// Sort by updated time (most recent first)
@@ -267,12 +374,11 @@ func (s *Service) CreateSession(title string, parentID string) (*Session, error)
 
 	s.sessionMux.Lock()
 	s.sessions[sessionID] = session
-	s.sessionMux.Unlock()
-
-	// Save sessions after creating
-	if err := s.saveSessions(); err != nil {
+	// Save session after creating
+	if err := s.saveSessionLocked(session); err != nil {
 		fmt.Printf("Warning: Failed to save session: %v\n", err)
 	}
+	s.sessionMux.Unlock()
 
 	return session, nil
 }
@@ -284,7 +390,10 @@ func (s *Service) GetSession(sessionID string) (*Session, error) {
 
 	session, exists := s.sessions[sessionID]
 	if !exists {
-		return nil, fmt.Errorf("session not found: %s", sessionID)
+		return nil, fmt.Errorf("%w: %s", ErrSessionNotFound, sessionID)
+	}
+	if err := s.loadSessionMessages(session); err != nil {
+		return nil, err
 	}
 
 	return session, nil
@@ -292,41 +401,60 @@ func (s *Service) GetSession(sessionID string) (*Session, error) {
 
 // UpdateSession updates a session
 func (s *Service) UpdateSession(sessionID string, title string) (*Session, error) {
+	return s.updateSession(sessionID, func(session *Session) error {
+		if title != "" {
+			session.Title = title
+			session.UpdatedAt = time.Now().UnixMilli()
+		}
+		return nil
+	})
+}
+
+// DeleteSession moves a session to the trash, from where it can be brought
+// back with RestoreSession until the trash is purged. Its children are
+// handled according to the "orphanedChildPolicy" config: "reparent" (the
+// default) moves them to the deleted session's parent, "detach" makes them
+// top-level sessions.
+func (s *Service) DeleteSession(sessionID string) error {
 	s.sessionMux.Lock()
 	defer s.sessionMux.Unlock()
 
-	session, exists := s.sessions[sessionID]
+	deleted, exists := s.sessions[sessionID]
 	if !exists {
-		return nil, fmt.Errorf("session not found: %s", sessionID)
-	}
-
-	if title != "" {
-		session.Title = title
-		session.UpdatedAt = time.Now().UnixMilli()
+		return fmt.Errorf("%w: %s", ErrSessionNotFound, sessionID)
 	}
 
-	// Save after update
-	if err := s.saveSessionsLocked(); err != nil {
+	delete(s.sessions, sessionID)
+	if s.trash == nil {
+		s.trash = make(map[string]*Session)
+	}
+	unlock := s.lockSession(sessionID)
+	deleted.DeletedAt = time.Now().UnixMilli()
+	unlock()
+	s.trash[sessionID] = deleted
+	if err := s.rewriteSessionFileLocked(deleted); err != nil {
 		fmt.Printf("Warning: Failed to save session: %v\n", err)
 	}
 
-	return session, nil
-}
-
-// DeleteSession deletes a session
-func (s *Service) DeleteSession(sessionID string) error {
-	s.sessionMux.Lock()
-	_, exists := s.sessions[sessionID]
-	if !exists {
-		s.sessionMux.Unlock()
-		return fmt.Errorf("session not found: %s", sessionID)
+	newParent := deleted.ParentID
+	if s.configString("orphanedChildPolicy", "reparent") == "detach" {
+		newParent = ""
+	}
+	for _, child := range s.sessions {
+		unlock := s.lockSession(child.ID)
+		if child.ParentID != sessionID {
+			unlock()
+			continue
+		}
+		child.ParentID = newParent
+		unlock()
+		if err := s.rewriteSessionFileLocked(child); err != nil {
+			fmt.Printf("Warning: Failed to save session: %v\n", err)
+		}
 	}
-
-	delete(s.sessions, sessionID)
-	s.sessionMux.Unlock()
 
 	// Save after deletion
-	if err := s.saveSessions(); err != nil {
+	if err := s.saveSessionIndexLocked(); err != nil {
 		fmt.Printf("Warning: Failed to save session: %v\n", err)
 	}
 
@@ -340,10 +468,13 @@ func (s *Service) GetSessionMessages(sessionID string, limit int) ([]map[string]
 
 	session, exists := s.sessions[sessionID]
 	if !exists {
-		return nil, fmt.Errorf("session not found: %s", sessionID)
+		return nil, fmt.Errorf("%w: %s", ErrSessionNotFound, sessionID)
+	}
+	if err := s.loadSessionMessages(session); err != nil {
+		return nil, err
 	}
 
-	messages := session.Messages
+	messages := s.sessionMessages(session)
 	if limit > 0 && len(messages) > limit {
 		messages = messages[len(messages)-limit:]
 	}
@@ -363,8 +494,130 @@ func (s *Service) CancelSession(sessionID string) {
 	}
 }
 
+// beginSearch returns a context for a workspace search started from the UI.
+// Starting a new search cancels the previous one, as does CancelSearch. The
+// returned func must be called when the search finishes.
+func (s *Service) beginSearch() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s.cancelFuncsMux.Lock()
+	if s.searchCancel != nil {
+		s.searchCancel()
+	}
+	s.searchSeq++
+	seq := s.searchSeq
+	s.searchCancel = cancel
+	s.cancelFuncsMux.Unlock()
+
+	return ctx, func() {
+		s.cancelFuncsMux.Lock()
+		if s.searchSeq == seq {
+			s.searchCancel = nil
+		}
+		s.cancelFuncsMux.Unlock()
+		cancel()
+	}
+}
+
+// shutdownTimeout bounds how long Shutdown waits for background commands and
+// async sends to finish.
+const shutdownTimeout = 5 * time.Second
+
+// Shutdown stops background commands, cancels in-flight requests and
+// searches, waits up to timeout for both to wind down, then writes loaded
+// sessions, the session index and the config to disk.
+func (s *Service) Shutdown(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	s.stopBackgroundCommands(timeout)
+
+	s.cancelFuncsMux.Lock()
+	for sessionID, cancel := range s.cancelFuncs {
+		cancel()
+		delete(s.cancelFuncs, sessionID)
+	}
+	if s.searchCancel != nil {
+		s.searchCancel()
+		s.searchCancel = nil
+	}
+	s.cancelFuncsMux.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.asyncWG.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Until(deadline)):
+		fmt.Printf("Warning: Timed out after %s with %d async messages still running\n", timeout, s.asyncInFlight.Load())
+	}
+
+	var errs []error
+	s.sessionMux.Lock()
+	for _, session := range s.sessions {
+		unlock := s.lockSession(session.ID)
+		if !session.lazy {
+			if err := s.writeSessionFile(session); err != nil {
+				errs = append(errs, fmt.Errorf("failed to save session %s: %w", session.ID, err))
+			}
+		}
+		unlock()
+	}
+	if err := s.saveSessionIndexLocked(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to save session index: %w", err))
+	}
+	s.sessionMux.Unlock()
+
+	// The snapshot is saved rather than the live config, which readers may
+	// still hold and saving stamps with the config version.
+	var config map[string]interface{}
+	var err error
+	s.configMux.RLock()
+	if s.config != nil {
+		config, err = copyConfig(s.config)
+	}
+	s.configMux.RUnlock()
+	if err == nil && config != nil {
+		err = s.saveConfig(config)
+	}
+	if err != nil {
+		errs = append(errs, fmt.Errorf("failed to save config: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// CancelSearch aborts the running workspace search, if any
+func (s *Service) CancelSearch() {
+	s.cancelFuncsMux.Lock()
+	defer s.cancelFuncsMux.Unlock()
+
+	if s.searchCancel != nil {
+		s.searchCancel()
+		s.searchCancel = nil
+	}
+}
+
 // SendMessage sends a message to a session
 func (s *Service) SendMessage(sessionID string, message string, model string, agent string) (map[string]interface{}, error) {
+	return s.SendMessageWithAttachments(sessionID, message, model, agent, nil)
+}
+
+// SendMessageWithAttachments sends a message with images attached, each
+// given as a data URL or a workspace path.
+func (s *Service) SendMessageWithAttachments(sessionID string, message string, model string, agent string, attachments []string) (map[string]interface{}, error) {
+	images, err := s.loadAttachments(attachments)
+	if err != nil {
+		return nil, err
+	}
+	return s.sendMessage(sessionID, message, model, agent, images, s.GetPendingAttachments(sessionID))
+}
+
+// sendMessage sends a message with its images and the attached files, which
+// are read at send time and no longer pending once the reply is saved.
+func (s *Service) sendMessage(sessionID string, message string, model string, agent string, images []imageAttachment, files []FileAttachment) (map[string]interface{}, error) {
+	s.sendsInFlight.Add(1)
+	defer s.sendsInFlight.Add(-1)
+
 	// Create cancellation context
 	ctx, cancel := context.WithCancel(context.Background())
 
@@ -390,127 +643,59 @@ func (s *Service) SendMessage(sessionID string, message string, model string, ag
 		s.cancelFuncsMux.Unlock()
 	}()
 
-	providerID, modelID := splitProviderModel(model)
-	if modelID != "" && modelID != model {
-		model = modelID
+	// Built-in slash commands are answered locally; custom ones expand to a
+	// prompt for the model.
+	if reply, handled, err := s.runSlashCommand(ctx, sessionID, message); handled {
+		return reply, err
 	}
-
-	// Check if this model belongs to a custom service
-	if customServicesConfig, exists := s.config["customServices"]; exists {
-		if customServices, ok := customServicesConfig.([]interface{}); ok {
-			for _, svc := range customServices {
-				if svcMap, ok := svc.(map[string]interface{}); ok {
-					// Check if service is enabled
-					if enabled, ok := svcMap["enabled"].(bool); ok && !enabled {
-						continue
-					}
-
-					serviceID, _ := svcMap["id"].(string)
-					if providerID != "" && serviceID != providerID {
-						continue
-					}
-
-					// Check if model exists in this service
-					if modelsList, ok := svcMap["models"].([]interface{}); ok {
-						for _, m := range modelsList {
-							if modelStr, ok := m.(string); ok && modelStr == model {
-								// Found the service for this model
-								return s.SendCustomLLMMessageWithModel(ctx, sessionID, message, serviceID, model)
-							}
-						}
-					}
-
-					if providerID != "" {
-						if defaultModel, ok := svcMap["defaultModel"].(string); ok && defaultModel == model {
-							return s.SendCustomLLMMessageWithModel(ctx, sessionID, message, serviceID, model)
-						}
-					}
-				}
-			}
-		}
+	if expanded, ok := s.expandCustomCommand(message); ok {
+		message = expanded
 	}
 
-	// Check "providers" config (Legacy/Standard)
-	if providersConfig, exists := s.config["providers"]; exists {
-		if providersMap, ok := providersConfig.(map[string]interface{}); ok {
-			if providerID != "" {
-				if pConfig, exists := providersMap[providerID]; exists {
-					if pData, ok := pConfig.(map[string]interface{}); ok {
-						providerModel, _ := pData["model"].(string)
-						if providerModel == model {
-							baseURL, _ := pData["base_url"].(string)
-							if baseURL == "" {
-								if strings.Contains(strings.ToLower(providerID), "openai") {
-									baseURL = "https://api.openai.com/v1/chat/completions"
-								} else if strings.Contains(strings.ToLower(providerID), "anthropic") {
-									baseURL = "https://api.anthropic.com/v1/messages"
-								}
-							}
-
-							apiKey, _ := pData["api_key"].(string)
-							name, _ := pData["name"].(string)
-							if name == "" {
-								name = providerID
-							}
-
-							customService := CustomLLMService{
-								ID:           providerID,
-								Name:         name,
-								BaseURL:      baseURL,
-								APIKey:       apiKey,
-								DefaultModel: providerModel,
-								AuthType:     "bearer",
-								Enabled:      true,
-							}
-
-							return s.sendLLMMessageInternal(ctx, sessionID, message, customService, model)
-						}
-					}
-				}
-			} else {
-				for id, pConfig := range providersMap {
-					if pData, ok := pConfig.(map[string]interface{}); ok {
-						providerModel, _ := pData["model"].(string)
-						if providerModel == model {
-							baseURL, _ := pData["base_url"].(string)
-							if baseURL == "" {
-								if strings.Contains(strings.ToLower(id), "openai") {
-									baseURL = "https://api.openai.com/v1/chat/completions"
-								} else if strings.Contains(strings.ToLower(id), "anthropic") {
-									baseURL = "https://api.anthropic.com/v1/messages"
-								}
-							}
-
-							apiKey, _ := pData["api_key"].(string)
-							name, _ := pData["name"].(string)
-							if name == "" {
-								name = id
-							}
+	// Attached files are read now, so the model sees their current content.
+	attached := messageAttachments{images: images}
+	for _, f := range files {
+		attached.files = append(attached.files, s.readPendingFile(f))
+	}
 
-							customService := CustomLLMService{
-								ID:           id,
-								Name:         name,
-								BaseURL:      baseURL,
-								APIKey:       apiKey,
-								DefaultModel: providerModel,
-								AuthType:     "bearer",
-								Enabled:      true,
-							}
+	agentConfig := s.agentByID(agent)
+	if model == "" {
+		model = agentConfig.Model
+	}
 
-							return s.sendLLMMessageInternal(ctx, sessionID, message, customService, model)
-						}
-					}
-				}
-			}
+	// Route the model to a service; see model_routing.go for the
+	// precedence. The route is resolved per call, so a session can switch
+	// models between turns.
+	route, err := s.resolveModelRoute(model)
+	if err != nil {
+		return nil, err
+	}
+	if route.Model != "" {
+		model = route.Model
+	}
+	if route.Source != routeMock {
+		serviceConfig, err := s.serviceForRoute(route)
+		if err != nil {
+			return nil, err
+		}
+		reply, err := s.sendAgentMessage(ctx, sessionID, message, attached, serviceConfig, model, agentConfig)
+		if err == nil {
+			s.clearPendingAttachments(sessionID, files)
 		}
+		return reply, err
 	}
 
-	s.sessionMux.Lock()
-	defer s.sessionMux.Unlock()
-
-	session, exists := s.sessions[sessionID]
-	if !exists {
-		return nil, fmt.Errorf("session not found: %s", sessionID)
+	// Nothing can serve the model. The canned reply below is only for
+	// trying the app without a provider and must be switched on explicitly.
+	if !s.configBool("allowMockProvider", false) {
+		name := model
+		if name == "" {
+			name = "(default)"
+		}
+		return nil, withErrorDetails(
+			fmt.Errorf("%w: no provider configured for model %s", ErrModelNotFound, name),
+			map[string]interface{}{"model": model},
+		)
 	}
 
 	now := time.Now().UnixMilli()
@@ -544,14 +729,8 @@ func (s *Service) SendMessage(sessionID string, message string, model string, ag
 			}(),
 			"rawTurns": rawTurns,
 		},
-		"parts": []map[string]interface{}{
-			{
-				"type": "text",
-				"text": message,
-			},
-		},
+		"parts": userMessageParts(message, attached),
 	}
-	session.Messages = append(session.Messages, userMsg)
 
 	// Generate a simple response (mock AI response)
 	responseText := fmt.Sprintf("I received your message: %s\n\nThis is a mock response from the default provider. To use a real AI, please configure a custom provider in Settings.", message)
@@ -585,6 +764,7 @@ func (s *Service) SendMessage(sessionID string, message string, model string, ag
 			"createdAt": now + 100,
 			"id":        fmt.Sprintf("msg_%d", now+100),
 			"model":     model,
+			"mock":      true,
 			"rawResponse": func() string {
 				if len(rawResponseJSON) == 0 {
 					return ""
@@ -598,32 +778,133 @@ func (s *Service) SendMessage(sessionID string, message string, model string, ag
 				"type":       "text",
 				"text":       responseText,
 				"tokenCount": 0,
+				"mock":       true,
 			},
 		},
 	}
-	session.Messages = append(session.Messages, assistantMsg)
-	session.UpdatedAt = now + 100
-
 	// Save after sending message
-	if err := s.saveSessionsLocked(); err != nil {
-		fmt.Printf("Warning: Failed to save session: %v\n", err)
+	if _, err := s.updateSession(sessionID, func(session *Session) error {
+		session.Messages = append(session.Messages, userMsg, assistantMsg)
+		session.UpdatedAt = now + 100
+		return nil
+	}); err != nil {
+		return nil, err
 	}
 
+	s.clearPendingAttachments(sessionID, files)
 	return assistantMsg, nil
 }
 
-// SendMessageAsync sends a message asynchronously
+// continuePrompt is the synthetic user turn ContinueSession sends.
+const continuePrompt = "Please continue."
+
+// ContinueSession nudges a stopped agent run to keep going. It sends a
+// "Please continue." turn using the model, service and agent of the last
+// assistant message, so the existing history and tools are picked up as usual.
+// The mode tag of the last user message is kept, so a plan or review run
+// stays read-only.
+func (s *Service) ContinueSession(sessionID string) (map[string]interface{}, error) {
+	session, err := s.GetSession(sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := s.sessionMessages(session)
+	model, agent := "", ""
+	for i := len(messages) - 1; i >= 0; i-- {
+		info, ok := messages[i]["info"].(map[string]interface{})
+		if !ok || info["role"] != "assistant" {
+			continue
+		}
+		model, _ = info["model"].(string)
+		agent, _ = info["agent"].(string)
+		if serviceID, _ := info["service"].(string); serviceID != "" && model != "" {
+			model = serviceID + "::" + model
+		}
+		break
+	}
+
+	if model == "" {
+		return nil, fmt.Errorf("session has no assistant reply to continue")
+	}
+
+	prompt := continuePrompt
+	for i := len(messages) - 1; i >= 0; i-- {
+		role, text, _, ok := normalizeStoredMessageParts(messages[i])
+		if !ok || role != "user" {
+			continue
+		}
+		if tag, _ := splitModeTag(strings.TrimSpace(text)); tag != "" {
+			prompt = tag + " " + prompt
+		}
+		break
+	}
+	return s.SendMessage(sessionID, prompt, model, agent)
+}
+
+// SendMessageAsync sends a message asynchronously. The outcome can be polled
+// with GetAsyncResult, and a message updated event carrying the same result
+// is emitted once the reply is saved or fails.
 func (s *Service) SendMessageAsync(sessionID string, message string, model string, agent string) (string, error) {
-	// Use goroutine for async processing
+	now := time.Now()
+	processingID := fmt.Sprintf("processing_%d", now.UnixNano())
+	result := &AsyncResult{
+		ProcessingID: processingID,
+		SessionID:    sessionID,
+		Status:       "processing",
+		StartedAt:    now.UnixMilli(),
+	}
+
+	s.asyncResultsMux.Lock()
+	for id, r := range s.asyncResults {
+		if r.FinishedAt != 0 && now.Sub(time.UnixMilli(r.FinishedAt)) > asyncResultTTL {
+			delete(s.asyncResults, id)
+		}
+	}
+	s.asyncResults[processingID] = result
+	s.asyncResultsMux.Unlock()
+
+	// Use goroutine for async processing; Shutdown waits for it
+	s.asyncWG.Add(1)
+	s.asyncInFlight.Add(1)
 	go func() {
-		_, err := s.SendMessage(sessionID, message, model, agent)
+		defer s.asyncWG.Done()
+		defer s.asyncInFlight.Add(-1)
+		response, err := s.SendMessage(sessionID, message, model, agent)
+
+		s.asyncResultsMux.Lock()
 		if err != nil {
 			fmt.Printf("Error in async message processing: %v\n", err)
+			result.Status = "error"
+			result.Error = err.Error()
+		} else {
+			result.Status = "completed"
+			result.Message = response
+			if info, ok := response["info"].(map[string]interface{}); ok {
+				result.MessageID, _ = info["id"].(string)
+			}
 		}
+		result.FinishedAt = time.Now().UnixMilli()
+		snapshot := *result
+		s.asyncResultsMux.Unlock()
+
+		s.emitEvent(messageUpdatedEventName, snapshot)
 	}()
 
 	// Return immediately with a processing ID
-	return fmt.Sprintf("processing_%d", time.Now().UnixMilli()), nil
+	return processingID, nil
+}
+
+// GetAsyncResult returns the state of a SendMessageAsync call.
+func (s *Service) GetAsyncResult(processingID string) (AsyncResult, error) {
+	s.asyncResultsMux.Lock()
+	defer s.asyncResultsMux.Unlock()
+
+	result, ok := s.asyncResults[processingID]
+	if !ok {
+		return AsyncResult{}, fmt.Errorf("unknown processing ID: %s", processingID)
+	}
+	return *result, nil
 }
 
 // GetSessionStatus returns status for all sessions
@@ -641,13 +922,33 @@ func (s *Service) GetSessionStatus() (map[string]interface{}, error) {
 	return status, nil
 }
 
+// GetSystemStatus reports in-flight work: messages being sent (sync and
+// async), async sends not yet finished, and the sessions they belong to.
+func (s *Service) GetSystemStatus() map[string]interface{} {
+	s.cancelFuncsMux.Lock()
+	busy := make([]string, 0, len(s.cancelFuncs))
+	for sessionID := range s.cancelFuncs {
+		busy = append(busy, sessionID)
+	}
+	searching := s.searchCancel != nil
+	s.cancelFuncsMux.Unlock()
+	sort.Strings(busy)
+
+	return map[string]interface{}{
+		"sendsInFlight": s.sendsInFlight.Load(),
+		"asyncInFlight": s.asyncInFlight.Load(),
+		"busySessions":  busy,
+		"searching":     searching,
+	}
+}
+
 // GetProviders returns providers configuration
 func (s *Service) GetProviders() (map[string]interface{}, error) {
 	providers := []map[string]interface{}{}
 	defaultMap := map[string]interface{}{}
 
 	// 1. Process "providers" (legacy/standard config)
-	if providersConfig, exists := s.config["providers"]; exists {
+	if providersConfig := s.configValue("providers"); providersConfig != nil {
 		if providersMap, ok := providersConfig.(map[string]interface{}); ok {
 			for providerID, providerConfig := range providersMap {
 				if providerData, ok := providerConfig.(map[string]interface{}); ok {
@@ -657,8 +958,9 @@ func (s *Service) GetProviders() (map[string]interface{}, error) {
 					if modelID, exists := providerData["model"]; exists {
 						if modelStr, ok := modelID.(string); ok && modelStr != "" {
 							models[modelStr] = map[string]interface{}{
-								"id":   modelStr,
-								"name": modelStr,
+								"id":           modelStr,
+								"name":         modelStr,
+								"capabilities": modelCapabilities(providerData, modelStr),
 							}
 							// Set as default for this provider
 							defaultMap[providerID] = modelStr
@@ -685,7 +987,7 @@ func (s *Service) GetProviders() (map[string]interface{}, error) {
 	}
 
 	// 2. Process "customServices"
-	if customServicesConfig, exists := s.config["customServices"]; exists {
+	if customServicesConfig := s.configValue("customServices"); customServicesConfig != nil {
 		if customServices, ok := customServicesConfig.([]interface{}); ok {
 			for _, svc := range customServices {
 				if svcMap, ok := svc.(map[string]interface{}); ok {
@@ -704,8 +1006,9 @@ func (s *Service) GetProviders() (map[string]interface{}, error) {
 						for _, m := range modelsList {
 							if modelStr, ok := m.(string); ok {
 								models[modelStr] = map[string]interface{}{
-									"id":   modelStr,
-									"name": modelStr,
+									"id":           modelStr,
+									"name":         modelStr,
+									"capabilities": modelCapabilities(svcMap, modelStr),
 								}
 							}
 						}
@@ -715,8 +1018,9 @@ func (s *Service) GetProviders() (map[string]interface{}, error) {
 					if defaultModel, ok := svcMap["defaultModel"].(string); ok && defaultModel != "" {
 						if _, exists := models[defaultModel]; !exists {
 							models[defaultModel] = map[string]interface{}{
-								"id":   defaultModel,
-								"name": defaultModel,
+								"id":           defaultModel,
+								"name":         defaultModel,
+								"capabilities": modelCapabilities(svcMap, defaultModel),
 							}
 						}
 					}
@@ -759,10 +1063,14 @@ func (s *Service) GetProviders() (map[string]interface{}, error) {
 		}, nil
 	}
 
-	return map[string]interface{}{
+	result := map[string]interface{}{
 		"providers": providers,
 		"default":   defaultMap,
-	}, nil
+	}
+	if defaultModel := s.GetDefaultModel(); defaultModel != "" {
+		result["defaultModel"] = defaultModel
+	}
+	return result, nil
 }
 
 // ListProviders returns list of providers
@@ -786,40 +1094,67 @@ func (s *Service) GetProviderAuth() (map[string]interface{}, error) {
 
 // GetAgents returns list of agents
 func (s *Service) GetAgents() ([]map[string]interface{}, error) {
-	return []map[string]interface{}{
-		{
-			"id":   "default",
-			"name": "Default Agent",
-		},
-	}, nil
+	agents := []map[string]interface{}{}
+	for _, agent := range s.configuredAgents() {
+		entry := map[string]interface{}{
+			"id":   agent.ID,
+			"name": agent.Name,
+		}
+		if agent.Description != "" {
+			entry["description"] = agent.Description
+		}
+		if agent.Model != "" {
+			entry["model"] = agent.Model
+		}
+		if agent.Mode != "" {
+			entry["mode"] = agent.Mode
+		}
+		if len(agent.Tools) > 0 {
+			entry["tools"] = agent.Tools
+		}
+		agents = append(agents, entry)
+	}
+	return agents, nil
 }
 
 // GetCommands returns list of commands
 func (s *Service) GetCommands() ([]map[string]interface{}, error) {
-	return []map[string]interface{}{
-		{
-			"id":          "help",
-			"name":        "help",
-			"description": "Show help information",
-			"category":    "general",
-		},
-		{
-			"id":          "file",
-			"name":        "file",
-			"description": "File operations",
-			"category":    "file",
-		},
-		{
-			"id":          "search",
-			"name":        "search",
-			"description": "Search in codebase",
-			"category":    "search",
-		},
-	}, nil
+	commands := []map[string]interface{}{}
+	specs := append(newCommandRegistry().Specs(), s.customCommandSpecs()...)
+	for _, spec := range specs {
+		commands = append(commands, map[string]interface{}{
+			"id":          spec.Name,
+			"name":        spec.Name,
+			"description": spec.Description,
+			"category":    spec.Category,
+			"usage":       spec.Usage,
+		})
+	}
+	return commands, nil
+}
+
+// GetToolSpecs returns the tools an agent can call, with the JSON schema of
+// their arguments, sorted by name.
+func (s *Service) GetToolSpecs() ([]map[string]interface{}, error) {
+	registry := newToolRegistry()
+	tools := []map[string]interface{}{}
+	for _, name := range registry.Names() {
+		h, _ := registry.get(name)
+		spec := h.Spec()
+		tools = append(tools, map[string]interface{}{
+			"name":              spec.Name,
+			"description":       spec.Description,
+			"parameters":        spec.Parameters,
+			"allowedInPlanMode": h.AllowedInPlanMode(),
+		})
+	}
+	return tools, nil
 }
 
 // GetConfig returns configuration
 func (s *Service) GetConfig() (map[string]interface{}, error) {
+	s.configMux.RLock()
+	defer s.configMux.RUnlock()
 	return s.config, nil
 }
 
@@ -829,9 +1164,19 @@ func (s *Service) UpdateConfig(configData string) (map[string]interface{}, error
 	if err := json.Unmarshal([]byte(configData), &config); err != nil {
 		return nil, fmt.Errorf("invalid JSON in config: %w", err)
 	}
+	warnings, err := validateConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range warnings {
+		fmt.Printf("Warning: Config: %s\n", w)
+	}
+
+	s.configMux.Lock()
+	defer s.configMux.Unlock()
 
 	// Save config to file
-	if err := s.saveConfig(config); err != nil {
+	if err := s.writeConfigLocked(config); err != nil {
 		return nil, fmt.Errorf("failed to save config: %w", err)
 	}
 
@@ -841,6 +1186,42 @@ func (s *Service) UpdateConfig(configData string) (map[string]interface{}, error
 	return config, nil
 }
 
+// configValue returns a top-level config value, or nil when unset. Config
+// changes replace s.config rather than modifying it, so the value can be
+// used after the lock is released.
+func (s *Service) configValue(key string) interface{} {
+	s.configMux.RLock()
+	defer s.configMux.RUnlock()
+	return s.config[key]
+}
+
+// configBool returns a boolean config value, or def when unset or mistyped.
+func (s *Service) configBool(key string, def bool) bool {
+	if v, ok := s.configValue(key).(bool); ok {
+		return v
+	}
+	return def
+}
+
+// configInt returns an integer config value, or def when unset or mistyped.
+func (s *Service) configInt(key string, def int) int {
+	switch v := s.configValue(key).(type) {
+	case float64:
+		return int(v)
+	case int:
+		return v
+	}
+	return def
+}
+
+// configString returns a string config value, or def when unset or empty.
+func (s *Service) configString(key string, def string) string {
+	if v, ok := s.configValue(key).(string); ok && strings.TrimSpace(v) != "" {
+		return v
+	}
+	return def
+}
+
 // GetCurrentProject returns current project info
 func (s *Service) GetCurrentProject() (map[string]interface{}, error) {
 	dir := s.GetWorkspaceDirectory()
@@ -860,21 +1241,81 @@ func (s *Service) GetProjects() ([]map[string]interface{}, error) {
 func (s *Service) GetVCSInfo() (map[string]interface{}, error) {
 	wd := s.GetWorkspaceDirectory()
 
-	// Try to get git branch
-	cmd := exec.Command("git", "rev-parse", "--abbrev-ref", "HEAD")
-	cmd.Dir = wd
-	output, err := cmd.Output()
-	branch := "main"
-	if err == nil {
-		branch = strings.TrimSpace(string(output))
-		if branch == "" {
-			branch = "main"
+	vcsType, root := detectVCS(wd)
+	info := map[string]interface{}{
+		"type":   vcsType,
+		"branch": "",
+	}
+	if vcsType == "none" {
+		return info, nil
+	}
+	info["root"] = root
+
+	switch vcsType {
+	case "git":
+		info["branch"] = runVCSCommand(wd, "git", "rev-parse", "--abbrev-ref", "HEAD")
+	case "hg":
+		info["branch"] = runVCSCommand(wd, "hg", "branch")
+		info["bookmark"] = runVCSCommand(wd, "hg", "log", "-r", ".", "--template", "{activebookmark}")
+	case "jj":
+		// jj has no current branch; report the nearest bookmark on the working-copy ancestry.
+		bookmark := runVCSCommand(wd, "jj", "log", "--no-graph", "--ignore-working-copy",
+			"-r", "latest(::@ & bookmarks())", "-T", `bookmarks.map(|b| b.name()).join(",")`)
+		if i := strings.Index(bookmark, ","); i >= 0 {
+			bookmark = bookmark[:i]
 		}
+		info["branch"] = bookmark
+		info["bookmark"] = bookmark
 	}
 
-	return map[string]interface{}{
-		"branch": branch,
-	}, nil
+	return info, nil
+}
+
+// vcsMarkers lists repository marker directories in detection order. jj is
+// checked before git because colocated jj repositories also contain .git.
+var vcsMarkers = []struct {
+	dir     string
+	vcsType string
+}{
+	{".jj", "jj"},
+	{".git", "git"},
+	{".hg", "hg"},
+}
+
+// detectVCS walks up from dir looking for a repository marker and returns
+// the VCS type ("git", "hg", "jj" or "none") and the repository root.
+func detectVCS(dir string) (string, string) {
+	if strings.TrimSpace(dir) == "" {
+		return "none", ""
+	}
+	current, err := filepath.Abs(dir)
+	if err != nil {
+		return "none", ""
+	}
+	for {
+		for _, marker := range vcsMarkers {
+			// .git may be a file for worktrees and submodules, so only check existence.
+			if _, err := os.Stat(filepath.Join(current, marker.dir)); err == nil {
+				return marker.vcsType, current
+			}
+		}
+		parent := filepath.Dir(current)
+		if parent == current {
+			return "none", ""
+		}
+		current = parent
+	}
+}
+
+func runVCSCommand(dir string, name string, args ...string) string {
+	cmd := exec.Command(name, args...)
+	cmd.Dir = dir
+	hideCommandWindow(cmd)
+	out, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
 }
 
 // GetPath returns path information
@@ -900,11 +1341,56 @@ func (s *Service) GetFiles(path string) ([]map[string]interface{}, error) {
 		path = s.GetWorkspaceDirectory()
 	}
 
-	// Ensure path is absolute
-	if !filepath.IsAbs(path) {
-		path = filepath.Join(s.GetWorkspaceDirectory(), path)
+	// Ensure path is absolute
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(s.GetWorkspaceDirectory(), path)
+	}
+
+	if files, ok := s.dirCache.get(path); ok {
+		return files, nil
+	}
+
+	ignoredDirs := loadIgnoredDirs(path)
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []map[string]interface{}{}
+	for _, entry := range entries {
+		// Check ignore list
+		if entry.IsDir() && ignoredDirs[entry.Name()] {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		filePath := filepath.Join(path, entry.Name())
+		files = append(files, map[string]interface{}{
+			"name": entry.Name(),
+			"path": filePath,
+			"type": func() string {
+				if entry.IsDir() {
+					return "directory"
+				}
+				return "file"
+			}(),
+			"size":  info.Size(),
+			"mtime": info.ModTime().Unix(),
+		})
 	}
 
+	s.dirCache.put(path, files)
+	return files, nil
+}
+
+// loadIgnoredDirs returns the directory names to hide when listing path: a
+// built-in list plus simple entries from path/.gitignore.
+func loadIgnoredDirs(path string) map[string]bool {
 	// Default ignore list (hardcoded for now, can be improved to read .gitignore)
 	ignoredDirs := map[string]bool{
 		"node_modules": true,
@@ -939,63 +1425,219 @@ func (s *Service) GetFiles(path string) ([]map[string]interface{}, error) {
 		}
 	}
 
-	entries, err := os.ReadDir(path)
+	return ignoredDirs
+}
+
+// GetFileContent returns file content
+func (s *Service) GetFileContent(path string) (map[string]interface{}, error) {
+	if path == "" {
+		return nil, fmt.Errorf("path parameter is required")
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(s.GetWorkspaceDirectory(), path)
+	}
+
+	content, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
 
-	files := []map[string]interface{}{}
-	for _, entry := range entries {
-		// Check ignore list
-		if entry.IsDir() && ignoredDirs[entry.Name()] {
-			continue
+	sniff := content
+	if len(sniff) > binarySniffSize {
+		sniff = sniff[:binarySniffSize]
+	}
+	if looksBinary(sniff) {
+		preview := content
+		if len(preview) > hexPreviewSize {
+			preview = preview[:hexPreviewSize]
 		}
+		return map[string]interface{}{
+			"path":       path,
+			"content":    "",
+			"size":       len(content),
+			"isBinary":   true,
+			"hexPreview": hex.Dump(preview),
+		}, nil
+	}
 
-		info, err := entry.Info()
-		if err != nil {
-			continue
-		}
+	return map[string]interface{}{
+		"path":       path,
+		"content":    string(content),
+		"size":       len(content),
+		"isBinary":   false,
+		"lineEnding": detectLineEnding(content),
+		"hasBOM":     bytes.HasPrefix(content, utf8BOM),
+	}, nil
+}
 
-		filePath := filepath.Join(path, entry.Name())
-		files = append(files, map[string]interface{}{
-			"name": entry.Name(),
-			"path": filePath,
-			"type": func() string {
-				if entry.IsDir() {
-					return "directory"
-				}
-				return "file"
-			}(),
-			"size":  info.Size(),
-			"mtime": info.ModTime().Unix(),
-		})
-	}
+const hexPreviewSize = 256
 
-	return files, nil
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// detectLineEnding returns the dominant line ending in data: "CRLF", "LF",
+// or "none" when the content has no line breaks.
+func detectLineEnding(data []byte) string {
+	crlf := bytes.Count(data, []byte("\r\n"))
+	lf := bytes.Count(data, []byte("\n")) - crlf
+	switch {
+	case crlf == 0 && lf == 0:
+		return "none"
+	case crlf > lf:
+		return "CRLF"
+	default:
+		return "LF"
+	}
 }
 
-// GetFileContent returns file content
-func (s *Service) GetFileContent(path string) (map[string]interface{}, error) {
+const (
+	defaultFileChunkSize = 256 * 1024
+	maxFileChunkSize     = 4 * 1024 * 1024
+	binarySniffSize      = 8000
+)
+
+// GetFileContentRange returns up to length bytes of a file starting at
+// offset, so large files can be paged instead of read whole. The returned
+// range is adjusted to UTF-8 rune boundaries; callers should continue from
+// offset+length. Binary files are reported but their content is not returned.
+func (s *Service) GetFileContentRange(path string, offset int64, length int64) (map[string]interface{}, error) {
 	if path == "" {
 		return nil, fmt.Errorf("path parameter is required")
 	}
 	if !filepath.IsAbs(path) {
 		path = filepath.Join(s.GetWorkspaceDirectory(), path)
 	}
+	if offset < 0 {
+		return nil, fmt.Errorf("offset must be non-negative")
+	}
+	if length <= 0 {
+		length = defaultFileChunkSize
+	}
+	if length > maxFileChunkSize {
+		length = maxFileChunkSize
+	}
 
-	content, err := os.ReadFile(path)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
 	if err != nil {
 		return nil, err
 	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("path is a directory")
+	}
+	totalSize := info.Size()
+
+	head := make([]byte, binarySniffSize)
+	n, err := f.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if looksBinary(head[:n]) {
+		return map[string]interface{}{
+			"path":      path,
+			"content":   "",
+			"offset":    offset,
+			"length":    0,
+			"totalSize": totalSize,
+			"isBinary":  true,
+			"eof":       true,
+		}, nil
+	}
+
+	if offset > totalSize {
+		offset = totalSize
+	}
+	// Read a few extra bytes so a rune split at either edge can be realigned.
+	buf := make([]byte, length+utf8.UTFMax)
+	n, err = f.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	buf = buf[:n]
+
+	start := 0
+	for start < len(buf) && start < utf8.UTFMax && !utf8.RuneStart(buf[start]) {
+		start++
+	}
+	end := start + int(length)
+	if end > len(buf) {
+		end = len(buf)
+	}
+	if offset+int64(end) < totalSize {
+		for i := end; i > start && i > end-utf8.UTFMax; i-- {
+			if utf8.RuneStart(buf[i-1]) {
+				if !utf8.FullRune(buf[i-1 : end]) {
+					end = i - 1
+				}
+				break
+			}
+		}
+	}
+	if end == start && start < len(buf) {
+		// Always make progress, even when length is smaller than one rune.
+		_, size := utf8.DecodeRune(buf[start:])
+		end = start + size
+	}
 
+	chunkOffset := offset + int64(start)
+	chunkLength := int64(end - start)
 	return map[string]interface{}{
-		"path":    path,
-		"content": string(content),
+		"path":      path,
+		"content":   string(buf[start:end]),
+		"offset":    chunkOffset,
+		"length":    chunkLength,
+		"totalSize": totalSize,
+		"isBinary":  false,
+		"eof":       chunkOffset+chunkLength >= totalSize,
 	}, nil
 }
 
-// SaveFileContent saves content to a file
+// looksBinary reports whether data appears to be binary rather than text:
+// it contains a NUL byte or a significant share of invalid UTF-8.
+func looksBinary(data []byte) bool {
+	if len(data) == 0 {
+		return false
+	}
+	if bytes.IndexByte(data, 0) >= 0 {
+		return true
+	}
+	invalid := 0
+	for i := 0; i < len(data); {
+		r, size := utf8.DecodeRune(data[i:])
+		if r == utf8.RuneError && size == 1 {
+			// A rune cut off by the sniff window is not evidence of binary data.
+			if !utf8.FullRune(data[i:]) {
+				break
+			}
+			invalid++
+		}
+		i += size
+	}
+	return invalid*10 > len(data)
+}
+
+// SaveFileContent saves content to a file, keeping the line endings of the
+// file it replaces.
 func (s *Service) SaveFileContent(path string, content string) error {
+	return s.saveFileContent("", path, content, "")
+}
+
+// SaveFileContentWithLineEnding saves content to a file atomically.
+// lineEnding selects how line breaks are written: "" matches the existing
+// file's dominant line ending (new files are written as given), "LF" or
+// "CRLF" force one style, and "asis" writes content unchanged.
+func (s *Service) SaveFileContentWithLineEnding(path string, content string, lineEnding string) error {
+	return s.saveFileContent("", path, content, lineEnding)
+}
+
+// saveFileContent implements SaveFileContentWithLineEnding. sessionID
+// identifies the session making the change for backups; it may be empty
+// for edits made directly from the UI.
+func (s *Service) saveFileContent(sessionID string, path string, content string, lineEnding string) error {
 	if path == "" {
 		return fmt.Errorf("path parameter is required")
 	}
@@ -1011,7 +1653,131 @@ func (s *Service) SaveFileContent(path string, content string) error {
 		return fmt.Errorf("failed to create directory: %w", err)
 	}
 
-	return os.WriteFile(path, []byte(content), 0644)
+	existing, readErr := os.ReadFile(path)
+
+	switch strings.ToUpper(strings.TrimSpace(lineEnding)) {
+	case "":
+		if readErr == nil {
+			if ending := detectLineEnding(existing); ending != "none" {
+				content = normalizeLineEndings(content, ending)
+			}
+		}
+	case "LF":
+		content = normalizeLineEndings(content, "LF")
+	case "CRLF":
+		content = normalizeLineEndings(content, "CRLF")
+	case "ASIS":
+	default:
+		return fmt.Errorf("invalid line ending: %s", lineEnding)
+	}
+
+	if readErr == nil && s.configBool("backupBeforeOverwrite", false) {
+		if err := s.backupFile(sessionID, path, existing); err != nil {
+			return err
+		}
+	}
+
+	return writeFileAtomic(path, []byte(content), 0644)
+}
+
+// moveFile renames source to destination, both confined to the workspace.
+// An existing destination file is only replaced when overwrite is set, and is
+// backed up first when backups are enabled.
+func (s *Service) moveFile(sessionID string, source string, destination string, overwrite bool) error {
+	src, err := s.workspaceFilePath(source)
+	if err != nil {
+		return err
+	}
+	dst, err := s.workspaceFilePath(destination)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(src); err != nil {
+		return fmt.Errorf("source does not exist: %s", source)
+	}
+	if info, err := os.Stat(dst); err == nil {
+		if !overwrite {
+			return fmt.Errorf("destination already exists: %s (set overwrite to replace it)", destination)
+		}
+		if info.IsDir() {
+			return fmt.Errorf("destination is a directory: %s", destination)
+		}
+		if s.configBool("backupBeforeOverwrite", false) {
+			if data, err := os.ReadFile(dst); err == nil {
+				if err := s.backupFile(sessionID, dst, data); err != nil {
+					return fmt.Errorf("failed to back up %s: %w", destination, err)
+				}
+			}
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("failed to create destination directory: %w", err)
+	}
+	if err := os.Rename(src, dst); err != nil {
+		return fmt.Errorf("failed to move file: %w", err)
+	}
+	return nil
+}
+
+// makeDir creates path and any missing parents inside the workspace.
+func (s *Service) makeDir(path string) error {
+	dir, err := s.workspaceFilePath(path)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(dir); err == nil && !info.IsDir() {
+		return fmt.Errorf("a file already exists at %s", path)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	return nil
+}
+
+// normalizeLineEndings rewrites every line break in content as ending
+// ("LF" or "CRLF").
+func normalizeLineEndings(content string, ending string) string {
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+	if ending == "CRLF" {
+		content = strings.ReplaceAll(content, "\n", "\r\n")
+	}
+	return content
+}
+
+// writeFileAtomic writes data to a temp file next to path and renames it into
+// place, so readers never observe a partially written file. An existing
+// file's permissions are kept.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if info, err := os.Stat(path); err == nil {
+		perm = info.Mode().Perm()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write temp file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync temp file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close temp file: %w", err)
+	}
+	if err := os.Chmod(tmpPath, perm); err != nil {
+		return fmt.Errorf("failed to set file mode: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to replace file: %w", err)
+	}
+	return nil
 }
 
 // RunCommand executes a shell command
@@ -1024,55 +1790,40 @@ func (s *Service) RunCommandWithCwd(command string, cwd string) (CommandRunResul
 	return s.RunCommandWithCwdContext(context.Background(), command, cwd)
 }
 
+// commandDir resolves the directory a command runs in: cwd relative to the
+// workspace, or the workspace itself when cwd is empty or not a directory.
+func (s *Service) commandDir(cwd string) string {
+	wd := s.GetWorkspaceDirectory()
+	if strings.TrimSpace(cwd) == "" {
+		return wd
+	}
+	dir := cwd
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(wd, dir)
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return wd
+	}
+	return dir
+}
+
 func (s *Service) RunCommandWithCwdContext(ctx context.Context, command string, cwd string) (CommandRunResult, error) {
 	if command == "" {
 		return CommandRunResult{}, fmt.Errorf("command parameter is required")
 	}
 
-	wd := s.GetWorkspaceDirectory()
-	baseDir := wd
-	if strings.TrimSpace(cwd) != "" {
-		baseDir = cwd
-		if !filepath.IsAbs(baseDir) {
-			baseDir = filepath.Join(wd, baseDir)
-		}
-		if info, err := os.Stat(baseDir); err != nil || !info.IsDir() {
-			baseDir = wd
-		}
-	}
-
-	var shell string
-	var args []string
-
-	if runtime.GOOS == "windows" {
-		if pwshPath, err := exec.LookPath("pwsh"); err == nil {
-			shell = pwshPath
-			args = []string{"-NoProfile", "-NonInteractive", "-ExecutionPolicy", "Bypass", "-Command", wrapPowerShellCommand(command, baseDir)}
-		} else if psPath, err := exec.LookPath("powershell"); err == nil {
-			shell = psPath
-			args = []string{"-NoProfile", "-NonInteractive", "-ExecutionPolicy", "Bypass", "-Command", wrapPowerShellCommand(command, baseDir)}
-		} else {
-			shell = "cmd"
-			args = []string{"/C", wrapCmdCommand(command, baseDir)}
-		}
-	} else {
-		if bashPath, err := exec.LookPath("bash"); err == nil {
-			shell = bashPath
-			args = []string{"-lc", wrapPosixShellCommand(command, baseDir)}
-		} else {
-			shell = "sh"
-			args = []string{"-lc", wrapPosixShellCommand(command, baseDir)}
-		}
-	}
+	baseDir := s.commandDir(cwd)
+	marker := newCwdMarker()
+	shell, args := s.commandShell(command, baseDir, marker)
 
 	cmd := exec.CommandContext(ctx, shell, args...)
 	hideCommandWindow(cmd)
 
 	cmd.Dir = baseDir
-	rawOut, err := cmd.CombinedOutput()
+	rawOut, rawErr, err := runCapturingStderr(cmd)
 	output := string(rawOut)
 
-	cleanOutput, finalCwd := stripOpenSpaceCwdMarker(output)
+	cleanOutput, finalCwd := stripOpenSpaceCwdMarker(output, marker)
 	if finalCwd == "" {
 		finalCwd = baseDir
 	}
@@ -1092,6 +1843,7 @@ func (s *Service) RunCommandWithCwdContext(ctx context.Context, command string,
 
 	result := CommandRunResult{
 		Output:   cleanOutput,
+		Stderr:   strings.TrimRight(string(rawErr), "\n"),
 		Cwd:      finalCwd,
 		Shell:    detectShellName(shell),
 		Branch:   branch,
@@ -1104,17 +1856,30 @@ func (s *Service) RunCommandWithCwdContext(ctx context.Context, command string,
 	return result, nil
 }
 
-const openSpaceCwdMarker = "__OPENSPACE_CWD__="
+const openSpaceCwdMarker = "__OPENSPACE_CWD_"
 
-func stripOpenSpaceCwdMarker(output string) (string, string) {
+// newCwdMarker returns the marker a command's wrapper prints before the
+// final working directory. It includes a random nonce, so output that
+// happens to contain a marker is never mistaken for it.
+func newCwdMarker() string {
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Sprintf("%s%d__=", openSpaceCwdMarker, time.Now().UnixNano())
+	}
+	return openSpaceCwdMarker + hex.EncodeToString(nonce) + "__="
+}
+
+// stripOpenSpaceCwdMarker removes the last line carrying marker from output
+// and returns the cleaned output and the directory it reported.
+func stripOpenSpaceCwdMarker(output string, marker string) (string, string) {
 	normalized := strings.ReplaceAll(output, "\r\n", "\n")
 	lines := strings.Split(normalized, "\n")
 
 	cwd := ""
 	for i := len(lines) - 1; i >= 0; i-- {
 		line := strings.TrimSpace(lines[i])
-		if strings.HasPrefix(line, openSpaceCwdMarker) {
-			cwd = strings.TrimSpace(strings.TrimPrefix(line, openSpaceCwdMarker))
+		if strings.HasPrefix(line, marker) {
+			cwd = strings.TrimSpace(strings.TrimPrefix(line, marker))
 			lines = append(lines[:i], lines[i+1:]...)
 			break
 		}
@@ -1125,14 +1890,14 @@ func stripOpenSpaceCwdMarker(output string) (string, string) {
 	return clean, cwd
 }
 
-func wrapPowerShellCommand(userCommand string, cwd string) string {
+func wrapPowerShellCommand(userCommand string, cwd string, marker string) string {
 	return strings.Join([]string{
 		"$__openspaceLastExit = 0",
 		"try { Set-Location -LiteralPath " + psSingleQuote(cwd) + " } catch {}",
 		userCommand,
 		"$__openspaceLastExit = $LASTEXITCODE",
 		"$__openspaceCwd = (Get-Location).Path",
-		"Write-Output (" + psSingleQuote(openSpaceCwdMarker) + " + $__openspaceCwd)",
+		"Write-Output (" + psSingleQuote(marker) + " + $__openspaceCwd)",
 		"exit $__openspaceLastExit",
 	}, "\n")
 }
@@ -1142,14 +1907,14 @@ func psSingleQuote(value string) string {
 	return "'" + escaped + "'"
 }
 
-func wrapPosixShellCommand(userCommand string, cwd string) string {
+func wrapPosixShellCommand(userCommand string, cwd string, marker string) string {
 	cwdLiteral := shSingleQuote(cwd)
 	return strings.Join([]string{
 		"cd " + cwdLiteral + " 2>/dev/null || true",
 		userCommand,
 		"__openspaceExit=$?",
 		"__openspaceCwd=\"$(pwd)\"",
-		"printf \"\\n" + openSpaceCwdMarker + "%s\\n\" \"$__openspaceCwd\"",
+		"printf \"\\n" + marker + "%s\\n\" \"$__openspaceCwd\"",
 		"exit $__openspaceExit",
 	}, "\n")
 }
@@ -1161,11 +1926,11 @@ func shSingleQuote(value string) string {
 	return "'" + strings.ReplaceAll(value, "'", "'\\''") + "'"
 }
 
-func wrapCmdCommand(userCommand string, cwd string) string {
+func wrapCmdCommand(userCommand string, cwd string, marker string) string {
 	return strings.Join([]string{
 		"cd /d " + cmdQuoteArg(cwd),
 		userCommand,
-		"for /f \"delims=\" %%i in ('cd') do @echo " + openSpaceCwdMarker + "%%i",
+		"for /f \"delims=\" %%i in ('cd') do @echo " + marker + "%%i",
 	}, " & ")
 }
 
@@ -1218,10 +1983,25 @@ func (s *Service) GetFileStatus() (map[string]interface{}, error) {
 
 // FindFilesByName searches for files by name
 func (s *Service) FindFilesByName(query string, fileType string, limit int) ([]string, error) {
-	return s.FindFilesByNameContext(context.Background(), query, fileType, limit)
+	return s.FindFilesByNameContext(context.Background(), query, fileType, limit, false)
+}
+
+// skipSearchEntry reports whether a workspace search should skip info, and
+// whether that means skipping a whole directory. .git and node_modules are
+// always skipped; other dotfiles and dot-directories only unless
+// includeHidden is set.
+func skipSearchEntry(info os.FileInfo, includeHidden bool) (skip bool, skipDir bool) {
+	name := info.Name()
+	if info.IsDir() && (name == ".git" || name == "node_modules") {
+		return true, true
+	}
+	if !includeHidden && len(name) > 1 && name[0] == '.' {
+		return true, info.IsDir()
+	}
+	return false, false
 }
 
-func (s *Service) FindFilesByNameContext(ctx context.Context, query string, fileType string, limit int) ([]string, error) {
+func (s *Service) FindFilesByNameContext(ctx context.Context, query string, fileType string, limit int, includeHidden bool) ([]string, error) {
 	if query == "" {
 		return nil, fmt.Errorf("query parameter is required")
 	}
@@ -1240,16 +2020,17 @@ func (s *Service) FindFilesByNameContext(ctx context.Context, query string, file
 		default:
 		}
 
-		// Skip hidden directories
-		name := info.Name()
-		if info.IsDir() && (len(name) > 0 && name[0] == '.' || name == "node_modules" || name == ".git") {
-			return filepath.SkipDir
+		if path != wd {
+			if skip, skipDir := skipSearchEntry(info, includeHidden); skipDir {
+				return filepath.SkipDir
+			} else if skip {
+				return nil
+			}
 		}
 
 		// Check if filename contains query
 		if !info.IsDir() && containsIgnoreCase(info.Name(), query) {
-			rel, _ := filepath.Rel(wd, path)
-			results = append(results, rel)
+			results = append(results, toWorkspaceRel(wd, path))
 		}
 
 		return nil
@@ -1269,6 +2050,10 @@ func (s *Service) FindFilesByNameContext(ctx context.Context, query string, file
 
 // FindText searches for text in files
 func (s *Service) FindText(pattern string) ([]map[string]interface{}, error) {
+	return s.FindTextContext(context.Background(), pattern, false)
+}
+
+func (s *Service) FindTextContext(ctx context.Context, pattern string, includeHidden bool) ([]map[string]interface{}, error) {
 	if pattern == "" {
 		return nil, fmt.Errorf("pattern parameter is required")
 	}
@@ -1287,12 +2072,20 @@ func (s *Service) FindText(pattern string) ([]map[string]interface{}, error) {
 		if err != nil {
 			return nil
 		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
 
-		// Skip directories and hidden files
-		if info.IsDir() || len(info.Name()) > 0 && info.Name()[0] == '.' {
-			if info.IsDir() && (info.Name() == "node_modules" || info.Name() == ".git") {
+		if path != wd {
+			if skip, skipDir := skipSearchEntry(info, includeHidden); skipDir {
 				return filepath.SkipDir
+			} else if skip {
+				return nil
 			}
+		}
+		if info.IsDir() {
 			return nil
 		}
 
@@ -1305,9 +2098,8 @@ func (s *Service) FindText(pattern string) ([]map[string]interface{}, error) {
 		// Search for pattern
 		matches := re.FindAllString(string(content), -1)
 		if len(matches) > 0 {
-			relPath, _ := filepath.Rel(wd, path)
 			results = append(results, map[string]interface{}{
-				"file":    relPath,
+				"file":    toWorkspaceRel(wd, path),
 				"matches": matches,
 				"count":   len(matches),
 			})
@@ -1325,6 +2117,10 @@ func (s *Service) FindText(pattern string) ([]map[string]interface{}, error) {
 
 // FindSymbol searches for symbols
 func (s *Service) FindSymbol(query string) ([]map[string]interface{}, error) {
+	return s.FindSymbolContext(context.Background(), query)
+}
+
+func (s *Service) FindSymbolContext(ctx context.Context, query string) ([]map[string]interface{}, error) {
 	if query == "" {
 		return nil, fmt.Errorf("query parameter is required")
 	}
@@ -1332,57 +2128,60 @@ func (s *Service) FindSymbol(query string) ([]map[string]interface{}, error) {
 	wd := s.GetWorkspaceDirectory()
 	results := []map[string]interface{}{}
 
-	// Simple symbol search - look for function definitions, variables, etc.
-	patterns := []string{
-		fmt.Sprintf("func\\s+%s\\s*\\(", regexp.QuoteMeta(query)),
-		fmt.Sprintf("var\\s+%s\\s*=", regexp.QuoteMeta(query)),
-		fmt.Sprintf("const\\s+%s\\s*=", regexp.QuoteMeta(query)),
-		fmt.Sprintf("type\\s+%s\\s", regexp.QuoteMeta(query)),
-	}
+	// Definition patterns are chosen per file by language
+	patterns := compileSymbolPatterns(query)
 
-	for _, pattern := range patterns {
-		re, err := regexp.Compile(pattern)
+	err := filepath.Walk(wd, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
-			continue
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
 		}
 
-		err = filepath.Walk(wd, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return nil
-			}
-
-			// Skip directories and non-source files
-			if info.IsDir() || !isSourceFile(info.Name()) {
-				if info.IsDir() && (info.Name() == "node_modules" || info.Name() == ".git") {
-					return filepath.SkipDir
-				}
+		if path != wd {
+			if skip, skipDir := skipSearchEntry(info, false); skipDir {
+				return filepath.SkipDir
+			} else if skip {
 				return nil
 			}
+		}
+		// Skip directories and non-source files
+		if info.IsDir() || !isSourceFile(info.Name()) {
+			return nil
+		}
 
-			// Read file content
-			content, err := os.ReadFile(path)
-			if err != nil {
-				return nil
-			}
+		// Read file content
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil
+		}
 
-			// Search for symbol
-			matches := re.FindAllString(string(content), -1)
-			if len(matches) > 0 {
-				relPath, _ := filepath.Rel(wd, path)
-				results = append(results, map[string]interface{}{
-					"file":    relPath,
-					"symbol":  query,
-					"matches": matches,
-					"count":   len(matches),
-				})
+		defs := findSymbolDefinitions(patterns, info.Name(), content)
+		if len(defs) > 0 {
+			relPath := toWorkspaceRel(wd, path)
+			matches := make([]string, 0, len(defs))
+			for _, def := range defs {
+				matches = append(matches, def.Text)
 			}
+			results = append(results, map[string]interface{}{
+				"file":        relPath,
+				"symbol":      query,
+				"kind":        defs[0].Kind,
+				"language":    symbolLanguage(info.Name()),
+				"matches":     matches,
+				"definitions": defs,
+				"count":       len(defs),
+			})
+		}
 
-			return nil
-		})
+		return nil
+	})
 
-		if err != nil {
-			continue
-		}
+	if err != nil {
+		return nil, err
 	}
 
 	return results, nil
@@ -1395,10 +2194,10 @@ func (s *Service) GetSessionChildren(sessionID string) ([]map[string]interface{}
 
 	children := []map[string]interface{}{}
 	for _, session := range s.sessions {
-		if session.ParentID == sessionID {
+		if meta := s.sessionMeta(session); meta.ParentID == sessionID {
 			children = append(children, map[string]interface{}{
-				"id":    session.ID,
-				"title": session.Title,
+				"id":    meta.ID,
+				"title": meta.Title,
 				"state": "idle",
 			})
 		}
@@ -1407,20 +2206,16 @@ func (s *Service) GetSessionChildren(sessionID string) ([]map[string]interface{}
 	return children, nil
 }
 
-// UpdateSessionTodos updates todo items for a session
-func (s *Service) UpdateSessionTodos(sessionID string, todos []TodoItem) error {
-	s.sessionMux.Lock()
-	defer s.sessionMux.Unlock()
-
-	session, exists := s.sessions[sessionID]
-	if !exists {
-		return fmt.Errorf("session not found: %s", sessionID)
+// UpdateSessionTodos replaces the todo items of a session and returns them
+// normalized, see normalizeTodos. Nothing is stored if any item is invalid.
+func (s *Service) UpdateSessionTodos(sessionID string, todos []TodoItem) ([]TodoItem, error) {
+	normalized, err := normalizeTodos(todos)
+	if err != nil {
+		return nil, err
 	}
-
-	session.Todos = todos
-	session.UpdatedAt = time.Now().UnixMilli()
-
-	return s.saveSessionsLocked()
+	return s.modifySessionTodos(sessionID, func([]TodoItem) ([]TodoItem, error) {
+		return normalized, nil
+	})
 }
 
 // GetGitStatus returns git status
@@ -1469,8 +2264,10 @@ func (s *Service) GetSessionTodo(sessionID string) ([]map[string]interface{}, er
 
 	session, exists := s.sessions[sessionID]
 	if !exists {
-		return nil, fmt.Errorf("session not found: %s", sessionID)
+		return nil, fmt.Errorf("%w: %s", ErrSessionNotFound, sessionID)
 	}
+	unlock := s.lockSession(sessionID)
+	defer unlock()
 
 	// Use stored todos if available
 	if len(session.Todos) > 0 {
@@ -1487,6 +2284,9 @@ func (s *Service) GetSessionTodo(sessionID string) ([]map[string]interface{}, er
 	}
 
 	todos := []map[string]interface{}{}
+	if err := s.loadSessionMessages(session); err != nil {
+		return nil, err
+	}
 
 	// Fallback: Scan all messages for todo items (legacy support)
 	for _, msg := range session.Messages {
@@ -1546,7 +2346,7 @@ func (s *Service) SummarizeSession(sessionID string, providerID string, modelID
 	}
 
 	// Try to use LLM for summary if custom services are configured
-	if customServicesConfig, exists := s.config["customServices"]; exists {
+	if customServicesConfig := s.configValue("customServices"); customServicesConfig != nil {
 		if customServices, ok := customServicesConfig.([]interface{}); ok && len(customServices) > 0 {
 			var serviceConfig CustomLLMService
 			found := false
@@ -1591,7 +2391,8 @@ func (s *Service) SummarizeSession(sessionID string, providerID string, modelID
 				messages := []map[string]interface{}{}
 
 				// Add session context (limit to last 50 messages to avoid token limits)
-				msgs := session.Messages
+				history := s.sessionMessages(session)
+				msgs := history
 				if len(msgs) > 50 {
 					msgs = msgs[len(msgs)-50:]
 				}
@@ -1617,17 +2418,23 @@ func (s *Service) SummarizeSession(sessionID string, providerID string, modelID
 				})
 
 				// Call LLM
-				summary, _, err := s.callLLMService(context.Background(), sessionID, serviceConfig, messages, model, true)
+				release, err := s.acquireLLMSlot(context.Background())
+				if err != nil {
+					return nil, err
+				}
+				summary, _, err := s.callLLMService(context.Background(), sessionID, serviceConfig, messages, model, agentModePlan, newToolRegistry())
+				release()
 				if err == nil {
 					// Save summary to session
-					s.sessionMux.Lock()
-					session.Summary = summary
-					_ = s.saveSessionsLocked()
-					s.sessionMux.Unlock()
+					_, _ = s.updateSession(sessionID, func(session *Session) error {
+						session.Summary = summary
+						s.mergeToolStats(session)
+						return nil
+					})
 
 					return map[string]interface{}{
 						"summary":      summary,
-						"messageCount": len(session.Messages),
+						"messageCount": len(history),
 						"provider":     serviceConfig.ID,
 						"model":        model,
 					}, nil
@@ -1639,7 +2446,7 @@ func (s *Service) SummarizeSession(sessionID string, providerID string, modelID
 	}
 
 	// Simple summarization based on message count (Fallback)
-	messageCount := len(session.Messages)
+	messageCount := len(s.sessionMessages(session))
 	summary := fmt.Sprintf("Session '%s' contains %d messages. (LLM summary unavailable)", session.Title, messageCount)
 
 	return map[string]interface{}{
@@ -2,12 +2,17 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"unicode/utf8"
 )
 
 func TestSendLLMMessageInternal_HandlesStoredPartsShape(t *testing.T) {
@@ -113,7 +118,7 @@ func TestCallLLMService_StoresSanitizedRequestHeaders(t *testing.T) {
 
 	_, rawTurns, err := s.callLLMService(context.Background(), "s1", cfg, []map[string]interface{}{
 		{"role": "user", "content": "hi"},
-	}, "gpt-test", true)
+	}, "gpt-test", agentModePlan, newToolRegistry())
 	if err != nil {
 		t.Fatalf("expected nil error, got %v", err)
 	}
@@ -129,3 +134,1319 @@ func TestCallLLMService_StoresSanitizedRequestHeaders(t *testing.T) {
 		t.Fatalf("expected secret token to be redacted, got %s", rh)
 	}
 }
+
+func newFallbackTestService(t *testing.T, primaryStatus int) (*Service, CustomLLMService, *int) {
+	t.Helper()
+	return newFallbackTestServiceWithPrimary(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "primary down", primaryStatus)
+	})
+}
+
+func newFallbackTestServiceWithPrimary(t *testing.T, handler http.HandlerFunc) (*Service, CustomLLMService, *int) {
+	t.Helper()
+	primary := httptest.NewServer(handler)
+	t.Cleanup(primary.Close)
+
+	backupCalls := 0
+	backup := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backupCalls++
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []map[string]interface{}{
+				{"message": map[string]interface{}{"content": "hello from backup"}},
+			},
+		})
+	}))
+	t.Cleanup(backup.Close)
+
+	tmp := t.TempDir()
+	s := &Service{
+		sessions:     map[string]*Session{"s1": {ID: "s1"}},
+		dataDir:      tmp,
+		sessionsFile: filepath.Join(tmp, "sessions.json"),
+		config: map[string]interface{}{
+			"customServices": []interface{}{
+				map[string]interface{}{
+					"id":           "backup",
+					"name":         "backup",
+					"baseUrl":      backup.URL,
+					"authType":     "none",
+					"enabled":      true,
+					"defaultModel": "backup-model",
+					"provider":     "openai",
+				},
+			},
+			"fallbacks": []interface{}{"backup"},
+		},
+		cancelFuncs: map[string]context.CancelFunc{},
+	}
+	cfg := CustomLLMService{
+		ID:           "primary",
+		Name:         "primary",
+		BaseURL:      primary.URL,
+		AuthType:     "none",
+		Enabled:      true,
+		DefaultModel: "primary-model",
+		Provider:     "openai",
+	}
+	return s, cfg, &backupCalls
+}
+
+func TestSendLLMMessageInternal_FailsOverOn5xx(t *testing.T) {
+	s, cfg, backupCalls := newFallbackTestService(t, http.StatusServiceUnavailable)
+
+	msg, err := s.sendLLMMessageInternal(context.Background(), "s1", "hi", cfg, "primary-model")
+	if err != nil {
+		t.Fatalf("expected failover to succeed, got %v", err)
+	}
+	if *backupCalls != 1 {
+		t.Fatalf("expected backup to be called once, got %d", *backupCalls)
+	}
+	info, _ := msg["info"].(map[string]interface{})
+	if info["service"] != "backup" || info["model"] != "backup-model" {
+		t.Fatalf("expected answer recorded from backup, got service=%v model=%v", info["service"], info["model"])
+	}
+	if info["fallbackFrom"] != "primary::primary-model" {
+		t.Fatalf("unexpected fallbackFrom: %v", info["fallbackFrom"])
+	}
+}
+
+func TestSendLLMMessageInternal_NoFailoverOn4xx(t *testing.T) {
+	s, cfg, backupCalls := newFallbackTestService(t, http.StatusBadRequest)
+
+	if _, err := s.sendLLMMessageInternal(context.Background(), "s1", "hi", cfg, "primary-model"); err == nil {
+		t.Fatalf("expected 4xx error to be returned")
+	}
+	if *backupCalls != 0 {
+		t.Fatalf("expected no failover on 4xx, got %d backup calls", *backupCalls)
+	}
+}
+
+func TestSendLLMMessageInternal_NoFailoverAfterToolsRan(t *testing.T) {
+	var primaryCalls atomic.Int32
+	s, cfg, backupCalls := newFallbackTestServiceWithPrimary(t, func(w http.ResponseWriter, r *http.Request) {
+		if primaryCalls.Add(1) > 1 {
+			// Drop the connection without a response.
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				_ = conn.Close()
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []map[string]interface{}{{"message": map[string]interface{}{
+				"content": "",
+				"tool_calls": []map[string]interface{}{{
+					"id":       "call_1",
+					"type":     "function",
+					"function": map[string]interface{}{"name": "list_files", "arguments": `{"path":"."}`},
+				}},
+			}}},
+		})
+	})
+	s.workspaceDir = t.TempDir()
+
+	_, err := s.sendLLMMessageInternal(context.Background(), "s1", "hi", cfg, "primary-model")
+	var reqErr *llmRequestError
+	if !errors.As(err, &reqErr) {
+		t.Fatalf("expected the dropped connection to be returned, got %v", err)
+	}
+	if n := primaryCalls.Load(); n != 2 {
+		t.Fatalf("expected the primary to be called twice, got %d", n)
+	}
+	if *backupCalls != 0 {
+		t.Fatalf("expected no failover once a tool has run, got %d backup calls", *backupCalls)
+	}
+}
+
+func TestPrepareMessages_CutsOversizedLatestMessageOnRuneBoundary(t *testing.T) {
+	s := &Service{}
+	messages := []map[string]interface{}{
+		{"role": "user", "content": "start"},
+		{"role": "assistant", "content": "ok"},
+		{"role": "user", "content": "middle"},
+		{"role": "user", "content": strings.Repeat("汉字😀", 200)},
+	}
+
+	prepared := s.prepareMessages(messages, 50)
+	last, _ := prepared[len(prepared)-1]["content"].(string)
+	if !strings.Contains(last, "truncated to fit the context limit") {
+		t.Fatalf("expected latest message to be kept and truncated, got %q", last)
+	}
+	if !utf8.ValidString(last) {
+		t.Fatalf("truncated message is not valid UTF-8: %q", last)
+	}
+}
+
+func TestNormalizeBaseURL_CommonMistypes(t *testing.T) {
+	cases := []struct {
+		provider ProviderKind
+		in       string
+		want     string
+	}{
+		{"openai", "https://api.openai.com/v1", "https://api.openai.com/v1/chat/completions"},
+		{"openai", "https://api.openai.com/v1/", "https://api.openai.com/v1/chat/completions"},
+		{"openai", "  https://api.openai.com  ", "https://api.openai.com/v1/chat/completions"},
+		{"", "https://api.deepseek.com/v1/chat", "https://api.deepseek.com/v1/chat/completions"},
+		{"openai", "https://api.openai.com/v1/chat/completions/", "https://api.openai.com/v1/chat/completions"},
+		{"openai", "https://generativelanguage.googleapis.com/v1beta/openai", "https://generativelanguage.googleapis.com/v1beta/openai"},
+		{"openai", "http://localhost:11434/v1", "http://localhost:11434/v1/chat/completions"},
+		{"anthropic", "https://api.anthropic.com/v1/messages/", "https://api.anthropic.com/v1/messages"},
+		{"anthropic", "https://api.anthropic.com/v1", "https://api.anthropic.com/v1/messages"},
+	}
+	for _, c := range cases {
+		got, err := normalizeBaseURL(c.provider, c.in)
+		if err != nil || got != c.want {
+			t.Errorf("normalizeBaseURL(%q, %q) = %q, %v; want %q", c.provider, c.in, got, err, c.want)
+		}
+	}
+
+	for _, bad := range []string{"", "api.openai.com/v1", "ftp://example.com/v1", "https://", "http://exa mple.com"} {
+		if _, err := normalizeBaseURL("openai", bad); !errors.Is(err, ErrInvalidArgument) {
+			t.Errorf("normalizeBaseURL(%q) error = %v, want invalid argument", bad, err)
+		}
+	}
+}
+
+func TestResolveEndpoint_BaseVsFullPerProvider(t *testing.T) {
+	cases := []struct {
+		provider ProviderKind
+		base     string
+		full     string
+	}{
+		{"openai", "https://x/v1", "https://x/v1/chat/completions"},
+		{"", "https://x/v1", "https://x/v1/chat/completions"},
+		{"ollama", "http://localhost:11434", "http://localhost:11434/v1/chat/completions"},
+		{"anthropic", "https://x/v1", "https://x/v1/messages"},
+		{"anthropic", "https://x", "https://x/v1/messages"},
+	}
+	for _, c := range cases {
+		if got := resolveEndpoint(c.provider, c.base); got != c.full {
+			t.Errorf("resolveEndpoint(%q, base %q) = %q, want %q", c.provider, c.base, got, c.full)
+		}
+		if got := resolveEndpoint(c.provider, c.full); got != c.full {
+			t.Errorf("resolveEndpoint(%q, full %q) = %q, want it unchanged", c.provider, c.full, got)
+		}
+	}
+}
+
+func TestLegacyProviderService_ResolvesLikeCustomServices(t *testing.T) {
+	openai := legacyProviderService("openai", map[string]interface{}{"model": "gpt-4o", "base_url": "https://x/v1/"})
+	if openai.BaseURL != "https://x/v1/chat/completions" || openai.Provider != "openai" {
+		t.Fatalf("unexpected openai service: %+v", openai)
+	}
+	anthropic := legacyProviderService("my-anthropic", map[string]interface{}{"model": "claude"})
+	if anthropic.BaseURL != defaultAnthropicEndpoint || anthropic.Provider != "anthropic" {
+		t.Fatalf("unexpected anthropic service: %+v", anthropic)
+	}
+}
+
+func TestAddCustomLLMService_StoresNormalizedBaseURL(t *testing.T) {
+	s := &Service{config: map[string]interface{}{}, configFile: filepath.Join(t.TempDir(), "config.json")}
+
+	svc, err := s.AddCustomLLMService(`{"id":"oa","name":"OpenAI","baseUrl":"https://api.openai.com/v1/","defaultModel":"gpt-4o","provider":"openai"}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if svc.BaseURL != "https://api.openai.com/v1/chat/completions" {
+		t.Fatalf("unexpected base URL %q", svc.BaseURL)
+	}
+
+	if _, err := s.AddCustomLLMService(`{"id":"bad","name":"Bad","baseUrl":"api.openai.com","defaultModel":"gpt-4o"}`); err == nil {
+		t.Fatalf("expected a URL without scheme to be rejected")
+	}
+}
+
+func TestResolveModelRoute_DeterministicPrecedence(t *testing.T) {
+	s := &Service{config: map[string]interface{}{
+		"customServices": []interface{}{
+			map[string]interface{}{"id": "zeta", "models": []interface{}{"gpt-4o"}, "defaultModel": "gpt-4o"},
+			map[string]interface{}{"id": "alpha", "models": []interface{}{"gpt-4o"}, "defaultModel": "x"},
+			map[string]interface{}{"id": "off", "models": []interface{}{"gpt-4o"}, "enabled": false},
+		},
+		"providers": map[string]interface{}{
+			"legacy-b": map[string]interface{}{"model": "gpt-4o"},
+			"legacy-a": map[string]interface{}{"model": "gpt-4o"},
+		},
+	}}
+
+	for i := 0; i < 20; i++ {
+		route, _ := s.resolveModelRoute("gpt-4o")
+		if route.Service != "alpha" || route.Source != routeCustom || route.Reason != "alphabetical" {
+			t.Fatalf("unexpected route: %+v", route)
+		}
+		if strings.Join(route.Candidates, ",") != "alpha,zeta,legacy-a,legacy-b" {
+			t.Fatalf("unexpected candidates: %v", route.Candidates)
+		}
+	}
+
+	s.config["servicePriority"] = []interface{}{"zeta"}
+	if route, _ := s.resolveModelRoute("gpt-4o"); route.Service != "zeta" || route.Reason != "priority" {
+		t.Fatalf("expected priority to win, got %+v", route)
+	}
+	if route, _ := s.resolveModelRoute("legacy-b::gpt-4o"); route.Service != "legacy-b" || route.Source != routeProvider || route.Reason != "explicit" {
+		t.Fatalf("expected explicit prefix to win, got %+v", route)
+	}
+	if route, _ := s.resolveModelRoute("unknown-model"); route.Source != routeMock {
+		t.Fatalf("expected mock route, got %+v", route)
+	}
+}
+
+func TestResolveModelRoute_ProviderPrefixIsStrict(t *testing.T) {
+	s := &Service{config: map[string]interface{}{
+		"customServices": []interface{}{
+			map[string]interface{}{"id": "a", "models": []interface{}{"shared"}, "defaultModel": "shared"},
+			map[string]interface{}{"id": "off", "models": []interface{}{"shared"}, "defaultModel": "shared", "enabled": false},
+		},
+		"providers": map[string]interface{}{
+			"b": map[string]interface{}{"model": "shared"},
+			"c": map[string]interface{}{"model": "other"},
+		},
+	}}
+
+	if route, err := s.resolveModelRoute("b::shared"); err != nil || route.Service != "b" {
+		t.Fatalf("expected b, got %+v, %v", route, err)
+	}
+	if route, err := s.resolveModelRoute("a::shared"); err != nil || route.Service != "a" {
+		t.Fatalf("expected a, got %+v, %v", route, err)
+	}
+	// c exists but does not serve "shared"; a and b do, but must not be used.
+	for _, model := range []string{"c::shared", "off::shared", "missing::shared"} {
+		route, err := s.resolveModelRoute(model)
+		if !errors.Is(err, ErrModelNotFound) {
+			t.Fatalf("%s: expected ErrModelNotFound, got %+v, %v", model, route, err)
+		}
+	}
+}
+
+func TestResolveModelRoute_OllamaTags(t *testing.T) {
+	s := &Service{config: map[string]interface{}{
+		"customServices": []interface{}{
+			map[string]interface{}{"id": "ollama", "provider": "ollama", "models": []interface{}{"llama3:8b", "qwen2.5-coder:14b"}, "defaultModel": "llama3:8b"},
+		},
+	}}
+
+	cases := []struct {
+		model       string
+		wantService string
+		wantModel   string
+	}{
+		{"llama3:8b", "ollama", "llama3:8b"},
+		{"qwen2.5-coder:14b", "ollama", "qwen2.5-coder:14b"},
+		{"ollama::qwen2.5-coder:14b", "ollama", "qwen2.5-coder:14b"},
+		{"ollama:llama3:8b", "ollama", "llama3:8b"},
+	}
+	for _, c := range cases {
+		route, err := s.resolveModelRoute(c.model)
+		if err != nil || route.Service != c.wantService || route.Model != c.wantModel {
+			t.Errorf("resolveModelRoute(%q) = %+v, %v; want %s serving %q", c.model, route, err, c.wantService, c.wantModel)
+		}
+	}
+
+	// An unknown left side keeps the whole name as the model.
+	if route, err := s.resolveModelRoute("mistral:7b"); err != nil || route.Model != "mistral:7b" || route.Source != routeMock {
+		t.Fatalf("expected mistral:7b to stay a model name, got %+v, %v", route, err)
+	}
+}
+
+func TestMigrateProviderKinds_InfersOnce(t *testing.T) {
+	s := &Service{
+		configFile: filepath.Join(t.TempDir(), "config.json"),
+		config: map[string]interface{}{
+			"customServices": []interface{}{
+				map[string]interface{}{"id": "a", "baseUrl": "https://api.anthropic.com/v1/messages"},
+				map[string]interface{}{"id": "local", "baseUrl": "http://localhost:11434/v1"},
+				map[string]interface{}{"id": "proxy", "baseUrl": "https://llm.example.com/v1"},
+				map[string]interface{}{"id": "g", "baseUrl": "https://x", "provider": "Gemini"},
+			},
+		},
+	}
+	s.migrateProviderKinds()
+
+	want := []string{"anthropic", "ollama", "custom", "gemini"}
+	for i, svc := range s.config["customServices"].([]interface{}) {
+		if got := svc.(map[string]interface{})["provider"]; got != want[i] {
+			t.Errorf("service %d: provider = %v, want %s", i, got, want[i])
+		}
+	}
+
+	if _, err := parseProviderKind("azure"); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("expected unknown kind to be rejected, got %v", err)
+	}
+}
+
+func TestGetModels_FiltersByCapability(t *testing.T) {
+	s := &Service{config: map[string]interface{}{
+		"customServices": []interface{}{
+			map[string]interface{}{
+				"id":                "svc",
+				"models":            []interface{}{"gpt-4o", "llama3:8b", "my-model"},
+				"defaultModel":      "gpt-4o",
+				"modelCapabilities": map[string]interface{}{"my-model": []interface{}{"tools"}},
+			},
+		},
+		"providers": map[string]interface{}{
+			"legacy": map[string]interface{}{"model": "claude-3-5-sonnet"},
+		},
+	}}
+
+	ids := func(models []ModelInfo) string {
+		var out []string
+		for _, m := range models {
+			out = append(out, m.ID)
+		}
+		return strings.Join(out, ",")
+	}
+	if got := ids(s.GetModels(nil)); got != "legacy::claude-3-5-sonnet,svc::gpt-4o,svc::llama3:8b,svc::my-model" {
+		t.Fatalf("unexpected models: %s", got)
+	}
+	if got := ids(s.GetModels([]string{"tools"})); got != "legacy::claude-3-5-sonnet,svc::gpt-4o,svc::my-model" {
+		t.Fatalf("unexpected tool models: %s", got)
+	}
+	if got := ids(s.GetModels([]string{"tools", "json"})); got != "svc::gpt-4o" {
+		t.Fatalf("unexpected tool+json models: %s", got)
+	}
+}
+
+func TestSendAgentMessage_SendsImageAttachments(t *testing.T) {
+	var body map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []map[string]interface{}{{"message": map[string]interface{}{"content": "a cat"}}},
+		})
+	}))
+	t.Cleanup(server.Close)
+
+	tmp := t.TempDir()
+	png := []byte("\x89PNG\r\n\x1a\n0000")
+	if err := os.WriteFile(filepath.Join(tmp, "old.png"), png, 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := &Service{
+		sessions:     map[string]*Session{},
+		dataDir:      tmp,
+		workspaceDir: tmp,
+		sessionsFile: filepath.Join(tmp, "sessions.json"),
+		config:       map[string]interface{}{},
+		cancelFuncs:  map[string]context.CancelFunc{},
+	}
+	s.sessions["s1"] = &Session{
+		ID: "s1",
+		Messages: []map[string]interface{}{{
+			"info": map[string]interface{}{"role": "user"},
+			"parts": []interface{}{
+				map[string]interface{}{"type": "text", "text": "earlier"},
+				map[string]interface{}{"type": "image", "mediaType": "image/png", "path": "old.png"},
+			},
+		}},
+	}
+
+	images, err := s.loadAttachments([]string{"data:image/png;base64," + base64.StdEncoding.EncodeToString(png)})
+	if err != nil {
+		t.Fatalf("loadAttachments: %v", err)
+	}
+	cfg := CustomLLMService{ID: "svc", BaseURL: server.URL, AuthType: "none", Provider: ProviderOpenAI}
+	if _, err := s.sendAgentMessage(context.Background(), "s1", "what is this?", messageAttachments{images: images}, cfg, "gpt-4o", s.agentByID(defaultAgentID)); err != nil {
+		t.Fatalf("sendAgentMessage: %v", err)
+	}
+
+	messages, _ := body["messages"].([]interface{})
+	imageURLs := 0
+	for _, m := range messages {
+		content, ok := m.(map[string]interface{})["content"].([]interface{})
+		if !ok {
+			continue
+		}
+		for _, c := range content {
+			if part := c.(map[string]interface{}); part["type"] == "image_url" {
+				imageURLs++
+			}
+		}
+	}
+	if imageURLs != 2 {
+		t.Fatalf("expected the history and new image in the request, got %d in %v", imageURLs, messages)
+	}
+
+	stored := s.sessions["s1"].Messages[1]
+	_, text, imageParts, ok := normalizeStoredMessageParts(stored)
+	if !ok || text != "what is this?" || len(imageParts) != 1 {
+		t.Fatalf("unexpected stored user message: %v", stored)
+	}
+	if url, _ := imageParts[0]["url"].(string); !strings.HasPrefix(url, "data:image/png;base64,") {
+		t.Fatalf("expected the data URL to be stored, got %v", imageParts[0])
+	}
+}
+
+func TestWithImageContent_AnthropicBlocks(t *testing.T) {
+	image := imageAttachment{MediaType: "image/png", Data: []byte("img")}
+	out := withImageContent([]map[string]interface{}{
+		{"role": "user", "content": "look", "images": []imageAttachment{image}},
+	}, true)
+	if _, has := out[0]["images"]; has {
+		t.Fatalf("images key must not be sent")
+	}
+	content := out[0]["content"].([]map[string]interface{})
+	if len(content) != 2 || content[0]["text"] != "look" || content[1]["type"] != "image" {
+		t.Fatalf("unexpected content: %v", content)
+	}
+	source := content[1]["source"].(map[string]interface{})
+	if source["type"] != "base64" || source["media_type"] != "image/png" || source["data"] != "aW1n" {
+		t.Fatalf("unexpected image source: %v", source)
+	}
+}
+
+func TestRedactImageData_OmitsPayloads(t *testing.T) {
+	payload := base64.StdEncoding.EncodeToString([]byte("secret image bytes"))
+	request, _ := json.Marshal(map[string]interface{}{
+		"messages": []interface{}{
+			map[string]interface{}{"role": "user", "content": []interface{}{
+				map[string]interface{}{"type": "text", "text": "look"},
+				map[string]interface{}{"type": "image_url", "image_url": map[string]interface{}{"url": "data:image/png;base64," + payload}},
+				map[string]interface{}{"type": "image", "source": map[string]interface{}{"type": "base64", "media_type": "image/png", "data": payload}},
+				map[string]interface{}{"type": "image_url", "image_url": map[string]interface{}{"url": "https://example.com/cat.png"}},
+			}},
+		},
+	})
+
+	logged := redactImageData(request)
+	if strings.Contains(logged, payload) {
+		t.Fatalf("image data was not redacted: %s", logged)
+	}
+	for _, want := range []string{"data:image/png;base64,[", "bytes of base64 image data omitted", "https://example.com/cat.png", `"look"`} {
+		if !strings.Contains(logged, want) {
+			t.Fatalf("expected %q in %s", want, logged)
+		}
+	}
+}
+
+func TestLoadAttachment_RejectsOversizedAndNonImages(t *testing.T) {
+	tmp := t.TempDir()
+	s := &Service{workspaceDir: tmp, config: map[string]interface{}{"maxAttachmentBytes": float64(8)}}
+	if err := os.WriteFile(filepath.Join(tmp, "big.png"), []byte("\x89PNG\r\n\x1a\n0000"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tmp, "notes.txt"), []byte("text"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ref := range []string{"big.png", "notes.txt", "../outside.png", "data:image/png,raw"} {
+		if _, err := s.loadAttachment(ref); !errors.Is(err, ErrInvalidArgument) {
+			t.Fatalf("%s: expected ErrInvalidArgument, got %v", ref, err)
+		}
+	}
+}
+
+func TestAttachFileToMessage_ReadsCurrentContentAtSend(t *testing.T) {
+	tmp := t.TempDir()
+	s := &Service{
+		sessions:     map[string]*Session{"s1": {ID: "s1"}},
+		workspaceDir: tmp,
+		config:       map[string]interface{}{},
+	}
+	file := filepath.Join(tmp, "main.go")
+	if err := os.WriteFile(file, []byte("package main\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	attachment, err := s.AttachFileToMessage("s1", "./main.go")
+	if err != nil {
+		t.Fatalf("AttachFileToMessage: %v", err)
+	}
+	if attachment.Path != "main.go" || attachment.Language != "go" {
+		t.Fatalf("unexpected attachment: %+v", attachment)
+	}
+	if _, err := s.AttachFileToMessage("s1", "../escape.go"); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("expected outside path to be rejected, got %v", err)
+	}
+
+	if err := os.WriteFile(file, []byte("package main\n\nfunc main() {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sent := s.readPendingFile(attachment)
+	if sent.part["changed"] != true || !strings.Contains(sent.block, "func main() {}") || !strings.Contains(sent.block, `language="go"`) {
+		t.Fatalf("expected the changed file to be sent as it is now, got %q %v", sent.block, sent.part)
+	}
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	if gone := s.readPendingFile(attachment); gone.part["error"] == nil {
+		t.Fatalf("expected a removed file to be noted, got %v", gone.part)
+	}
+
+	if pending := s.GetPendingAttachments("s1"); len(pending) != 1 {
+		t.Fatalf("expected one pending attachment, got %v", pending)
+	}
+	s.clearPendingAttachments("s1", []FileAttachment{attachment})
+	if pending := s.GetPendingAttachments("s1"); len(pending) != 0 {
+		t.Fatalf("expected sent attachments to be cleared, got %v", pending)
+	}
+}
+
+func TestBuildLLMMessages_ReplaysAttachedFiles(t *testing.T) {
+	tmp := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmp, "main.go"), []byte("package main\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := &Service{workspaceDir: tmp, config: map[string]interface{}{}}
+	sent := s.readPendingFile(FileAttachment{Path: "main.go", Language: "go", Hash: hashFileContent([]byte("package main\n"))})
+	session := &Session{
+		ID: "s1",
+		Messages: []map[string]interface{}{
+			{"info": map[string]interface{}{"role": "user"}, "parts": userMessageParts("review this", messageAttachments{files: []sentFile{sent}})},
+			{"info": map[string]interface{}{"role": "assistant"}, "parts": []interface{}{map[string]interface{}{"type": "text", "text": "looks fine"}}},
+		},
+	}
+
+	messages, _ := s.buildLLMMessages(session, "and now?", messageAttachments{}, CustomLLMService{ID: "svc"}, "m", s.agentByID(defaultAgentID))
+	if len(messages) != 4 {
+		t.Fatalf("expected system, history and current messages, got %v", messages)
+	}
+	content, _ := messages[1]["content"].(string)
+	if !strings.HasPrefix(content, "review this") || !strings.Contains(content, "Attached files:") || !strings.Contains(content, "package main") {
+		t.Fatalf("expected the attached file to be replayed, got %q", content)
+	}
+	if reply, _ := messages[2]["content"].(string); reply != "looks fine" {
+		t.Fatalf("unexpected reply content %q", reply)
+	}
+}
+
+func TestCallLLMService_CachesIdenticalRequests(t *testing.T) {
+	hits := 0
+	fail := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []map[string]interface{}{{"message": map[string]interface{}{"content": "cached answer"}}},
+		})
+	}))
+	t.Cleanup(server.Close)
+
+	s := &Service{dataDir: t.TempDir(), config: map[string]interface{}{"cacheResponses": true}}
+	cfg := CustomLLMService{ID: "svc", BaseURL: server.URL, AuthType: "none", Provider: ProviderOpenAI}
+	send := func(content string) (string, error) {
+		text, _, err := s.callLLMService(context.Background(), "s1", cfg, []map[string]interface{}{
+			{"role": "user", "content": content},
+		}, "gpt-test", agentModePlan, newToolRegistry())
+		return text, err
+	}
+
+	// Requests at the default temperature are not deterministic.
+	for i := 0; i < 2; i++ {
+		if _, err := send("hi"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if hits != 2 {
+		t.Fatalf("expected non-deterministic requests to bypass the cache, got %d hits", hits)
+	}
+
+	s.config["cacheNonDeterministic"] = true
+	hits = 0
+	for i := 0; i < 3; i++ {
+		if text, err := send("hi"); err != nil || text != "cached answer" {
+			t.Fatalf("send: %q %v", text, err)
+		}
+	}
+	if hits != 1 {
+		t.Fatalf("expected one request for identical prompts, got %d", hits)
+	}
+
+	fail = true
+	hits = 0
+	for i := 0; i < 2; i++ {
+		if _, err := send("other"); err == nil {
+			t.Fatalf("expected the error response")
+		}
+	}
+	if hits != 2 {
+		t.Fatalf("expected error responses not to be cached, got %d hits", hits)
+	}
+
+	if removed, err := s.ClearCache(); err != nil || removed != 1 {
+		t.Fatalf("ClearCache: %d %v", removed, err)
+	}
+}
+
+func TestSendAgentMessage_DeterministicSession(t *testing.T) {
+	var body map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []map[string]interface{}{{"message": map[string]interface{}{"content": "ok"}}},
+		})
+	}))
+	t.Cleanup(server.Close)
+
+	s, parent, _, _ := newSessionChain(t)
+	if _, err := s.SetSessionDeterministic(parent, true); err != nil {
+		t.Fatal(err)
+	}
+	cfg := CustomLLMService{ID: "svc", BaseURL: server.URL, AuthType: "none", Provider: ProviderOllama}
+	reply, err := s.sendLLMMessageInternal(context.Background(), parent, "hi", cfg, "llama3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body["temperature"] != float64(0) || body["top_p"] != float64(1) || body["seed"] != float64(deterministicSeed) {
+		t.Fatalf("unexpected sampling parameters: temperature=%v top_p=%v seed=%v", body["temperature"], body["top_p"], body["seed"])
+	}
+	if reply["info"].(map[string]interface{})["deterministic"] != true {
+		t.Fatalf("expected the reply to record the deterministic run")
+	}
+
+	reloaded := &Service{sessions: map[string]*Session{}, dataDir: s.dataDir}
+	reloaded.loadSessions()
+	if !reloaded.sessionDeterministic(parent) {
+		t.Fatalf("expected the flag to survive a reload")
+	}
+
+	anthropic := map[string]interface{}{"top_p": 0.95}
+	applyDeterministic(anthropic, ProviderAnthropic)
+	if _, hasSeed := anthropic["seed"]; hasSeed || anthropic["top_p"] != nil || anthropic["temperature"] != 0 {
+		t.Fatalf("unexpected anthropic parameters: %v", anthropic)
+	}
+}
+
+func TestSessionGenerationParams_Precedence(t *testing.T) {
+	var body map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body = nil
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []map[string]interface{}{{"message": map[string]interface{}{"content": "ok"}}},
+		})
+	}))
+	t.Cleanup(server.Close)
+
+	s, parent, child, _ := newSessionChain(t)
+	serviceTemp, serviceTopP := 0.7, 0.9
+	cfg := CustomLLMService{ID: "svc", BaseURL: server.URL, AuthType: "none", Provider: ProviderOpenAI, ToolCalling: "xml",
+		GenerationParams: GenerationParams{Temperature: &serviceTemp, TopP: &serviceTopP}}
+	messages := []map[string]interface{}{{"role": "user", "content": "hi"}}
+
+	sessionTemp := 1.3
+	if _, err := s.SetSessionGenerationParams(parent, GenerationParams{Temperature: &sessionTemp, MaxTokens: 512}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.callLLMService(context.Background(), parent, cfg, messages, "gpt-4o", agentModeAct, newToolRegistry()); err != nil {
+		t.Fatal(err)
+	}
+	if body["temperature"] != 1.3 || body["top_p"] != 0.9 || body["max_tokens"] != float64(512) {
+		t.Fatalf("session > service: temperature=%v top_p=%v max_tokens=%v", body["temperature"], body["top_p"], body["max_tokens"])
+	}
+
+	if _, _, err := s.callLLMService(context.Background(), child, cfg, messages, "gpt-4o", agentModeAct, newToolRegistry()); err != nil {
+		t.Fatal(err)
+	}
+	if body["temperature"] != 0.7 || body["top_p"] != 0.9 || body["max_tokens"] != float64(2048) {
+		t.Fatalf("service > default: temperature=%v top_p=%v max_tokens=%v", body["temperature"], body["top_p"], body["max_tokens"])
+	}
+
+	reloaded := &Service{sessions: map[string]*Session{}, dataDir: s.dataDir}
+	reloaded.loadSessions()
+	if got := reloaded.generationParams(parent, CustomLLMService{}); got.Temperature == nil || *got.Temperature != 1.3 || got.MaxTokens != 512 {
+		t.Fatalf("expected the session params to survive a reload, got %+v", got)
+	}
+
+	session, err := s.SetSessionGenerationParams(parent, GenerationParams{})
+	if err != nil || session.Generation != nil {
+		t.Fatalf("expected empty params to clear the override: %+v %v", session.Generation, err)
+	}
+	tooHot := 2.5
+	if _, err := s.SetSessionGenerationParams(parent, GenerationParams{Temperature: &tooHot}); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("expected ErrInvalidArgument for temperature 2.5, got %v", err)
+	}
+}
+
+func TestSetCustomLLMServiceEnabled_TogglesOnlyEnabled(t *testing.T) {
+	tmp := t.TempDir()
+	s := &Service{configFile: filepath.Join(tmp, "config.json"), config: map[string]interface{}{
+		"customServices": []interface{}{
+			map[string]interface{}{"id": "svc", "baseUrl": "http://x", "apiKey": "k", "models": []interface{}{"m"}, "enabled": true},
+		},
+	}}
+
+	svc, err := s.SetCustomLLMServiceEnabled("svc", false)
+	if err != nil {
+		t.Fatalf("SetCustomLLMServiceEnabled: %v", err)
+	}
+	if svc.Enabled || svc.APIKey != "k" || len(svc.Models) != 1 {
+		t.Fatalf("expected only enabled to change, got %+v", svc)
+	}
+	if len(s.enabledCustomServices()) != 0 {
+		t.Fatalf("expected the service to be disabled")
+	}
+	if saved, _ := os.ReadFile(s.configFile); !strings.Contains(string(saved), `"enabled": false`) {
+		t.Fatalf("expected the toggle to be saved, got %s", saved)
+	}
+
+	if _, err := s.SetCustomLLMServiceEnabled("missing", true); err == nil {
+		t.Fatalf("expected an unknown service to fail")
+	}
+}
+
+func TestDeleteCustomLLMService_LeavesReadersUntouched(t *testing.T) {
+	tmp := t.TempDir()
+	s := &Service{configFile: filepath.Join(tmp, "config.json"), config: map[string]interface{}{
+		"customServices": []interface{}{
+			map[string]interface{}{"id": "a", "name": "a", "baseUrl": "http://a", "defaultModel": "m"},
+			map[string]interface{}{"id": "b", "name": "b", "baseUrl": "http://b", "defaultModel": "m"},
+		},
+	}}
+	held := s.configValue("customServices").([]interface{})
+
+	if err := s.DeleteCustomLLMService("a"); err != nil {
+		t.Fatalf("DeleteCustomLLMService: %v", err)
+	}
+	if services, _ := s.GetCustomLLMServices(); len(services) != 1 || services[0].ID != "b" {
+		t.Fatalf("expected only b to remain, got %+v", services)
+	}
+	if len(held) != 2 || held[0].(map[string]interface{})["id"] != "a" {
+		t.Fatalf("expected a reader's services to stay as they were, got %v", held)
+	}
+	if err := s.DeleteCustomLLMService("a"); err == nil {
+		t.Fatalf("expected deleting a missing service to fail")
+	}
+}
+
+func TestReorderCustomLLMServices_DrivesRouting(t *testing.T) {
+	tmp := t.TempDir()
+	s := &Service{configFile: filepath.Join(tmp, "config.json"), config: map[string]interface{}{
+		"customServices": []interface{}{
+			map[string]interface{}{"id": "alpha", "baseUrl": "http://a", "models": []interface{}{"shared"}},
+			map[string]interface{}{"id": "beta", "baseUrl": "http://b", "models": []interface{}{"shared"}},
+		},
+		"servicePriority": []interface{}{"legacy", "alpha"},
+	}}
+
+	services, err := s.ReorderCustomLLMServices([]string{"beta", "alpha"})
+	if err != nil {
+		t.Fatalf("ReorderCustomLLMServices: %v", err)
+	}
+	if services[0].ID != "beta" || services[1].ID != "alpha" {
+		t.Fatalf("unexpected order: %+v", services)
+	}
+	priority, _ := json.Marshal(s.config["servicePriority"])
+	if string(priority) != `["beta","alpha","legacy"]` {
+		t.Fatalf("unexpected servicePriority: %s", priority)
+	}
+	if route, _ := s.resolveModelRoute("shared"); route.Service != "beta" {
+		t.Fatalf("expected routing to follow the new order, got %+v", route)
+	}
+
+	for _, ids := range [][]string{{"beta"}, {"beta", "beta"}, {"beta", "gamma"}} {
+		if _, err := s.ReorderCustomLLMServices(ids); !errors.Is(err, ErrInvalidArgument) {
+			t.Fatalf("%v: expected ErrInvalidArgument, got %v", ids, err)
+		}
+	}
+}
+
+func TestSetDefaultModel_UsedForEmptyModel(t *testing.T) {
+	tmp := t.TempDir()
+	s := &Service{configFile: filepath.Join(tmp, "config.json"), config: map[string]interface{}{
+		"customServices": []interface{}{
+			map[string]interface{}{"id": "svc", "baseUrl": "http://x", "models": []interface{}{"gpt-4o"}},
+		},
+	}}
+
+	if route, _ := s.resolveModelRoute(""); route.Source != routeMock {
+		t.Fatalf("expected the mock without a default, got %+v", route)
+	}
+	if _, err := s.SetDefaultModel("gpt-4o"); err != nil {
+		t.Fatalf("SetDefaultModel: %v", err)
+	}
+	if got := s.GetDefaultModel(); got != "svc::gpt-4o" {
+		t.Fatalf("expected the canonical form, got %q", got)
+	}
+	if route, _ := s.resolveModelRoute(""); route.Service != "svc" || route.Model != "gpt-4o" {
+		t.Fatalf("expected an empty model to use the default, got %+v", route)
+	}
+
+	if _, err := s.SetDefaultModel("nope"); !errors.Is(err, ErrModelNotFound) {
+		t.Fatalf("expected an unroutable model to be rejected, got %v", err)
+	}
+	if _, err := s.SetDefaultModel(""); err != nil || s.GetDefaultModel() != "" {
+		t.Fatalf("expected the default to be cleared, got %q %v", s.GetDefaultModel(), err)
+	}
+}
+
+func TestContinueSession_KeepsPlanMode(t *testing.T) {
+	var toolResults []string
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		var body map[string]interface{}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		messages, _ := body["messages"].([]interface{})
+		for _, m := range messages {
+			if msg := m.(map[string]interface{}); msg["role"] == "tool" {
+				content, _ := msg["content"].(string)
+				toolResults = append(toolResults, content)
+			}
+		}
+		message := map[string]interface{}{"content": "done"}
+		if calls == 1 {
+			message = map[string]interface{}{
+				"content": "",
+				"tool_calls": []map[string]interface{}{{
+					"id":       "call_1",
+					"type":     "function",
+					"function": map[string]interface{}{"name": "save_file", "arguments": `{"path":"out.txt","content":"x"}`},
+				}},
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"choices": []map[string]interface{}{{"message": message}}})
+	}))
+	t.Cleanup(server.Close)
+
+	tmp := t.TempDir()
+	s := &Service{
+		dataDir:      tmp,
+		workspaceDir: tmp,
+		sessionsFile: filepath.Join(tmp, "sessions.json"),
+		cancelFuncs:  map[string]context.CancelFunc{},
+		config: map[string]interface{}{
+			"customServices": []interface{}{
+				map[string]interface{}{"id": "svc", "baseUrl": server.URL, "authType": "none", "enabled": true, "provider": "openai", "models": []interface{}{"m"}},
+			},
+		},
+		sessions: map[string]*Session{"s1": {ID: "s1", Messages: []map[string]interface{}{
+			{"info": map[string]interface{}{"role": "user"}, "parts": []interface{}{map[string]interface{}{"type": "text", "text": planModeTag + " plan the change"}}},
+			{"info": map[string]interface{}{"role": "assistant", "service": "svc", "model": "m"}, "parts": []interface{}{map[string]interface{}{"type": "text", "text": "step 1"}}},
+		}}},
+	}
+
+	if _, err := s.ContinueSession("s1"); err != nil {
+		t.Fatalf("ContinueSession: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "out.txt")); !os.IsNotExist(err) {
+		t.Fatalf("expected save_file to be refused in plan mode, stat err %v", err)
+	}
+	if len(toolResults) != 1 || !strings.Contains(toolResults[0], "not allowed in PLAN mode") {
+		t.Fatalf("expected save_file to be rejected, got %q", toolResults)
+	}
+	_, text, _, _ := normalizeStoredMessageParts(s.sessions["s1"].Messages[2])
+	if text != planModeTag+" "+continuePrompt {
+		t.Fatalf("expected the continue turn to keep the mode tag, got %q", text)
+	}
+}
+
+func TestCallLLMService_RepromptsOnceForMalformedXMLToolCall(t *testing.T) {
+	replies := []string{
+		"Let me look.\n<tool_call><name>list_files</name><args><path>.</path></args>",
+		"<tool_call><name>list_files</name><args><path>.</path></args></tool_call>",
+		"done",
+	}
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]interface{}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		data, _ := json.Marshal(req["messages"])
+		bodies = append(bodies, string(data))
+		reply := replies[len(bodies)-1]
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []map[string]interface{}{{"message": map[string]interface{}{"content": reply}}},
+		})
+	}))
+	t.Cleanup(server.Close)
+
+	tmp := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmp, "a.txt"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := &Service{workspaceDir: tmp}
+	cfg := CustomLLMService{ID: "svc1", BaseURL: server.URL, AuthType: "none", Enabled: true, Provider: "custom", ToolCalling: "xml"}
+
+	text, _, err := s.callLLMService(context.Background(), "s1", cfg, []map[string]interface{}{
+		{"role": "user", "content": "list files"},
+	}, "m", agentModeAct, newToolRegistry())
+	if err != nil {
+		t.Fatalf("callLLMService: %v", err)
+	}
+	if len(bodies) != 3 {
+		t.Fatalf("expected a repair request and a follow-up, got %d requests", len(bodies))
+	}
+	if !strings.Contains(bodies[1], "could not be parsed") || !strings.Contains(bodies[1], "not closed with \\u003c/tool_call\\u003e") {
+		t.Fatalf("expected the repair hint in the second request, got %s", bodies[1])
+	}
+	if !strings.Contains(bodies[2], "a.txt (file)") {
+		t.Fatalf("expected the repaired call to run, got %s", bodies[2])
+	}
+	if !strings.HasSuffix(text, "done") {
+		t.Fatalf("unexpected final text: %q", text)
+	}
+}
+
+func TestCallLLMService_GivesUpAfterOneToolCallRepair(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []map[string]interface{}{{"message": map[string]interface{}{"content": "<tool_call><name>list_files</name>"}}},
+		})
+	}))
+	t.Cleanup(server.Close)
+
+	s := &Service{workspaceDir: t.TempDir()}
+	cfg := CustomLLMService{ID: "svc1", BaseURL: server.URL, AuthType: "none", Enabled: true, Provider: "custom", ToolCalling: "xml"}
+	if _, _, err := s.callLLMService(context.Background(), "s1", cfg, []map[string]interface{}{
+		{"role": "user", "content": "list files"},
+	}, "m", agentModeAct, newToolRegistry()); err != nil {
+		t.Fatalf("callLLMService: %v", err)
+	}
+	if requests != 2 {
+		t.Fatalf("expected exactly one repair attempt, got %d requests", requests)
+	}
+}
+
+func TestCallLLMService_RejectsOversizedResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("<html>" + strings.Repeat("x", 2048) + "</html>"))
+	}))
+	t.Cleanup(server.Close)
+
+	s := &Service{config: map[string]interface{}{"maxResponseBytes": float64(1024)}}
+	cfg := CustomLLMService{ID: "svc1", BaseURL: server.URL, AuthType: "none", Enabled: true, Provider: "openai", DefaultModel: "gpt-test"}
+
+	_, _, err := s.callLLMService(context.Background(), "s1", cfg, []map[string]interface{}{
+		{"role": "user", "content": "hi"},
+	}, "gpt-test", agentModePlan, newToolRegistry())
+	if err == nil || !strings.Contains(err.Error(), "response too large") {
+		t.Fatalf("expected a response too large error, got %v", err)
+	}
+
+	cfgJSON, _ := json.Marshal(cfg)
+	if _, err := s.TestCustomLLMService(string(cfgJSON)); err == nil || !strings.Contains(err.Error(), "response too large") {
+		t.Fatalf("expected TestCustomLLMService to apply the same cap, got %v", err)
+	}
+}
+
+func TestCallLLMService_ExplainsNonJSONResponses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte("<!DOCTYPE html>\n<html><body>Welcome to nginx!</body></html>"))
+	}))
+	t.Cleanup(server.Close)
+
+	s := &Service{}
+	cfg := CustomLLMService{ID: "svc1", BaseURL: server.URL, AuthType: "none", Enabled: true, Provider: "openai", DefaultModel: "gpt-test"}
+
+	_, _, err := s.callLLMService(context.Background(), "s1", cfg, []map[string]interface{}{
+		{"role": "user", "content": "hi"},
+	}, "gpt-test", agentModePlan, newToolRegistry())
+	if err == nil {
+		t.Fatalf("expected an error for an HTML response")
+	}
+	for _, want := range []string{"non-JSON response (text/html)", "status 200", "Welcome to nginx!", "base URL"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("expected %q in %v", want, err)
+		}
+	}
+
+	cfgJSON, _ := json.Marshal(cfg)
+	result, err := s.TestCustomLLMService(string(cfgJSON))
+	if err != nil {
+		t.Fatalf("TestCustomLLMService: %v", err)
+	}
+	if result["success"] != false || !strings.Contains(result["error"].(string), "Welcome to nginx!") {
+		t.Fatalf("expected the test to report the HTML page, got %v", result)
+	}
+}
+
+func TestSendAgentMessage_FinishReasonAndRefusal(t *testing.T) {
+	cases := []struct {
+		name       string
+		choice     map[string]interface{}
+		wantReason string
+		wantText   string
+		wantInfo   string
+	}{
+		{
+			name:       "stop",
+			choice:     map[string]interface{}{"finish_reason": "stop", "message": map[string]interface{}{"content": "all done"}},
+			wantReason: "stop",
+			wantText:   "all done",
+		},
+		{
+			name:       "length",
+			choice:     map[string]interface{}{"finish_reason": "length", "message": map[string]interface{}{"content": "the first half"}},
+			wantReason: "length",
+			wantText:   "the first half\n\n" + truncatedOutputNote,
+		},
+		{
+			name:       "refusal",
+			choice:     map[string]interface{}{"finish_reason": "stop", "message": map[string]interface{}{"content": nil, "refusal": "I can't help with that."}},
+			wantReason: "stop",
+			wantText:   "The model declined to answer: I can't help with that.",
+			wantInfo:   "I can't help with that.",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				_ = json.NewEncoder(w).Encode(map[string]interface{}{"choices": []map[string]interface{}{c.choice}})
+			}))
+			t.Cleanup(server.Close)
+
+			s, parent, _, _ := newSessionChain(t)
+			cfg := CustomLLMService{ID: "svc", BaseURL: server.URL, AuthType: "none", Provider: ProviderOpenAI, ToolCalling: "native"}
+			reply, err := s.sendLLMMessageInternal(context.Background(), parent, "hi", cfg, "gpt-test")
+			if err != nil {
+				t.Fatalf("sendLLMMessageInternal: %v", err)
+			}
+			info := reply["info"].(map[string]interface{})
+			if info["finishReason"] != c.wantReason {
+				t.Fatalf("finishReason = %v, want %q", info["finishReason"], c.wantReason)
+			}
+			if text := reply["parts"].([]map[string]interface{})[0]["text"]; text != c.wantText {
+				t.Fatalf("text = %q, want %q", text, c.wantText)
+			}
+			if refusal, _ := info["refusal"].(string); refusal != c.wantInfo {
+				t.Fatalf("refusal = %q, want %q", refusal, c.wantInfo)
+			}
+		})
+	}
+}
+
+func TestCallLLMService_ReasoningModelRequestFormat(t *testing.T) {
+	var body map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body = nil
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []map[string]interface{}{{"message": map[string]interface{}{
+				"content":           "the answer",
+				"reasoning_content": "thinking it over",
+			}}},
+		})
+	}))
+	t.Cleanup(server.Close)
+
+	s := &Service{}
+	messages := []map[string]interface{}{
+		{"role": "system", "content": "be brief"},
+		{"role": "user", "content": "hi"},
+	}
+	cases := []struct {
+		model     string
+		caps      map[string][]string
+		reasoning bool
+	}{
+		{model: "o3-mini", reasoning: true},
+		{model: "gpt-4o", reasoning: false},
+		{model: "my-reasoner", caps: map[string][]string{"my-reasoner": {"reasoning"}}, reasoning: true},
+		{model: "o1", caps: map[string][]string{"o1": {"tools"}}, reasoning: false},
+	}
+	for _, c := range cases {
+		cfg := CustomLLMService{ID: "svc", BaseURL: server.URL, AuthType: "none", Provider: ProviderOpenAI, ToolCalling: "xml", ModelCapabilities: c.caps}
+		text, rawTurns, err := s.callLLMService(context.Background(), "s1", cfg, messages, c.model, agentModeAct, newToolRegistry())
+		if err != nil {
+			t.Fatalf("%s: callLLMService: %v", c.model, err)
+		}
+		role := body["messages"].([]interface{})[0].(map[string]interface{})["role"]
+		_, hasTemperature := body["temperature"]
+		_, hasMaxCompletion := body["max_completion_tokens"]
+		if c.reasoning {
+			if role != "developer" || hasTemperature || body["top_p"] != nil || !hasMaxCompletion || body["max_tokens"] != nil {
+				t.Fatalf("%s: expected a reasoning request, got %v", c.model, body)
+			}
+		} else if role != "system" || !hasTemperature || hasMaxCompletion {
+			t.Fatalf("%s: expected a regular request, got %v", c.model, body)
+		}
+		if text != "the answer" || rawTurns[0]["reasoning"] != "thinking it over" {
+			t.Fatalf("%s: expected reasoning to be kept apart, got %q / %v", c.model, text, rawTurns[0]["reasoning"])
+		}
+	}
+	if messages[0]["role"] != "system" {
+		t.Fatalf("expected the caller's messages to be left alone")
+	}
+}
+
+func TestCallLLMService_SendsOllamaKeepAlive(t *testing.T) {
+	var body map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body = nil
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []map[string]interface{}{{"message": map[string]interface{}{"content": "ok"}}},
+		})
+	}))
+	t.Cleanup(server.Close)
+
+	s := &Service{}
+	messages := []map[string]interface{}{{"role": "user", "content": "hi"}}
+	cases := []struct {
+		provider  ProviderKind
+		keepAlive string
+		want      interface{}
+	}{
+		{ProviderOllama, "", defaultOllamaKeepAlive},
+		{ProviderOllama, "-1", "-1"},
+		{ProviderOpenAI, "10m", nil},
+	}
+	for _, c := range cases {
+		cfg := CustomLLMService{ID: "svc", BaseURL: server.URL, AuthType: "none", Provider: c.provider, ToolCalling: "xml", KeepAlive: c.keepAlive}
+		if _, _, err := s.callLLMService(context.Background(), "s1", cfg, messages, "llama3", agentModeAct, newToolRegistry()); err != nil {
+			t.Fatalf("%s: callLLMService: %v", c.provider, err)
+		}
+		if body["keep_alive"] != c.want {
+			t.Fatalf("%s %q: keep_alive = %v, want %v", c.provider, c.keepAlive, body["keep_alive"], c.want)
+		}
+	}
+}
+
+func TestBuildLLMMessages_CompactSystemPromptForSmallContext(t *testing.T) {
+	s := &Service{config: map[string]interface{}{}}
+	session := &Session{ID: "s1"}
+	systemPrompt := func(cfg CustomLLMService, model string) string {
+		messages, _ := s.buildLLMMessages(session, "hi", messageAttachments{}, cfg, model, s.agentByID(defaultAgentID))
+		content, _ := messages[0]["content"].(string)
+		return content
+	}
+
+	small := CustomLLMService{ID: "small", ContextLimit: 8000}
+	compact := systemPrompt(small, "tiny-model")
+	for _, name := range newToolRegistry().Names() {
+		if !strings.Contains(compact, "- "+name+"(") {
+			t.Errorf("compact prompt is missing tool %s:\n%s", name, compact)
+		}
+	}
+	if !strings.Contains(compact, "<tool_call>") || !strings.Contains(compact, "save_file(path, content)") {
+		t.Fatalf("compact prompt lost the call format or tool args:\n%s", compact)
+	}
+
+	full := systemPrompt(CustomLLMService{ID: "big", ContextLimit: 128000}, "big-model")
+	if len(compact) >= len(full)/2 {
+		t.Fatalf("compact prompt is %d bytes, full prompt %d", len(compact), len(full))
+	}
+
+	s.config["systemPromptStyle"] = "full"
+	if got := systemPrompt(small, "tiny-model"); got != full {
+		t.Fatalf("systemPromptStyle full should keep the full prompt for small models")
+	}
+	s.config["systemPromptStyle"] = "compact"
+	if got := systemPrompt(CustomLLMService{ID: "big", ContextLimit: 128000}, "big-model"); got != compact {
+		t.Fatalf("systemPromptStyle compact should use the compact prompt for large models")
+	}
+}
+
+func TestPrepareMessages_CountsSystemPromptAgainstLimit(t *testing.T) {
+	s := &Service{}
+	messages := []map[string]interface{}{
+		{"role": "system", "content": strings.Repeat("s", 160)},
+		{"role": "user", "content": "first task"},
+		{"role": "assistant", "content": strings.Repeat("a", 240)},
+		{"role": "user", "content": strings.Repeat("b", 80)},
+		{"role": "user", "content": "latest"},
+	}
+
+	// Without the 40 token system prompt everything would fit in 100.
+	prepared := s.prepareMessages(messages, 100)
+	if prepared[0]["role"] != "system" || prepared[0]["content"] != messages[0]["content"] {
+		t.Fatalf("system prompt was not kept first: %v", prepared[0])
+	}
+	if prepared[1]["content"] != "first task" {
+		t.Fatalf("expected the task definition after the system prompt, got %v", prepared[1]["content"])
+	}
+	for _, msg := range prepared {
+		if msg["content"] == messages[2]["content"] {
+			t.Fatalf("expected the system prompt to crowd out the oldest reply, got %d messages", len(prepared))
+		}
+	}
+	if last := prepared[len(prepared)-1]["content"]; last != "latest" {
+		t.Fatalf("latest message was not kept: %v", last)
+	}
+}
+
+func TestSendAgentMessage_StoresReasoningAsSeparatePart(t *testing.T) {
+	var requests []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		requests = append(requests, body)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []map[string]interface{}{{"message": map[string]interface{}{
+				"content":           "the answer",
+				"reasoning_content": "secret chain of thought",
+			}}},
+		})
+	}))
+	t.Cleanup(server.Close)
+
+	s, parent, _, _ := newSessionChain(t)
+	cfg := CustomLLMService{ID: "svc", BaseURL: server.URL, AuthType: "none", Provider: ProviderOpenAI, ToolCalling: "xml"}
+	reply, err := s.sendLLMMessageInternal(context.Background(), parent, "hi", cfg, "deepseek-reasoner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := reply["parts"].([]map[string]interface{})
+	if len(parts) != 2 || parts[0]["text"] != "the answer" || parts[1]["type"] != "reasoning" || parts[1]["text"] != "secret chain of thought" {
+		t.Fatalf("unexpected parts: %v", parts)
+	}
+
+	if _, err := s.sendLLMMessageInternal(context.Background(), parent, "again", cfg, "deepseek-reasoner"); err != nil {
+		t.Fatal(err)
+	}
+	history, _ := json.Marshal(requests[len(requests)-1]["messages"])
+	if !strings.Contains(string(history), "the answer") || strings.Contains(string(history), "secret chain of thought") {
+		t.Fatalf("expected the answer but not the reasoning in the next request: %s", history)
+	}
+}
+
+func TestCallLLMService_AnthropicThinkingBlocks(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"content": []map[string]interface{}{
+				{"type": "thinking", "thinking": "let me think", "signature": "sig"},
+				{"type": "text", "text": "done"},
+			},
+			"stop_reason": "end_turn",
+		})
+	}))
+	t.Cleanup(server.Close)
+
+	s := &Service{}
+	cfg := CustomLLMService{ID: "svc", BaseURL: server.URL, AuthType: "none", Provider: ProviderAnthropic, ToolCalling: "xml"}
+	text, turns, err := s.callLLMService(context.Background(), "s1", cfg, []map[string]interface{}{{"role": "user", "content": "hi"}}, "claude-test", agentModeAct, newToolRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != "done" || turnsReasoning(turns) != "let me think" {
+		t.Fatalf("text = %q, reasoning = %q", text, turnsReasoning(turns))
+	}
+}
+
+func TestSplitThinking(t *testing.T) {
+	cases := []struct {
+		in, answer, reasoning string
+	}{
+		{"<think>\nhmm\n</think>\n\nhello", "hello", "hmm"},
+		{"  <thinking>plan</thinking>answer", "answer", "plan"},
+		{"no thinking here", "no thinking here", ""},
+		{"answer <think>late</think>", "answer <think>late</think>", ""},
+		{"<think>never closed", "<think>never closed", ""},
+	}
+	for _, c := range cases {
+		answer, reasoning := splitThinking(c.in)
+		if answer != c.answer || reasoning != c.reasoning {
+			t.Errorf("splitThinking(%q) = %q, %q; want %q, %q", c.in, answer, reasoning, c.answer, c.reasoning)
+		}
+	}
+}
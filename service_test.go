@@ -0,0 +1,1075 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSaveFileContent_PreservesCRLF(t *testing.T) {
+	tmp := t.TempDir()
+	path := filepath.Join(tmp, "crlf.txt")
+	if err := os.WriteFile(path, []byte("line1\r\nline2\r\n"), 0644); err != nil {
+		t.Fatalf("failed to write fixture: %v", err)
+	}
+
+	s := &Service{workspaceDir: tmp}
+	if err := s.SaveFileContent(path, "line1\nline2 edited\nline3\n"); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+	if string(got) != "line1\r\nline2 edited\r\nline3\r\n" {
+		t.Fatalf("expected CRLF line endings, got %q", got)
+	}
+
+	entries, _ := os.ReadDir(tmp)
+	if len(entries) != 1 {
+		t.Fatalf("expected temp file to be cleaned up, got %d entries", len(entries))
+	}
+}
+
+func TestSaveFileContent_NewFileKeepsContent(t *testing.T) {
+	tmp := t.TempDir()
+	s := &Service{workspaceDir: tmp}
+	if err := s.SaveFileContent("nested/new.txt", "a\nb\r\n"); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	got, err := os.ReadFile(filepath.Join(tmp, "nested", "new.txt"))
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+	if string(got) != "a\nb\r\n" {
+		t.Fatalf("expected content unchanged for new file, got %q", got)
+	}
+}
+
+func TestSaveFileContentWithLineEnding_Override(t *testing.T) {
+	tmp := t.TempDir()
+	path := filepath.Join(tmp, "crlf.txt")
+	if err := os.WriteFile(path, []byte("a\r\nb\r\n"), 0644); err != nil {
+		t.Fatalf("failed to write fixture: %v", err)
+	}
+
+	s := &Service{workspaceDir: tmp}
+	if err := s.SaveFileContentWithLineEnding(path, "a\r\nb\nc\n", "LF"); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	got, _ := os.ReadFile(path)
+	if string(got) != "a\nb\nc\n" {
+		t.Fatalf("expected LF line endings, got %q", got)
+	}
+}
+
+func newSessionChain(t *testing.T) (*Service, string, string, string) {
+	t.Helper()
+	s := &Service{sessions: map[string]*Session{}, dataDir: t.TempDir(), config: map[string]interface{}{}}
+	for _, sess := range []*Session{
+		{ID: "parent"},
+		{ID: "child", ParentID: "parent"},
+		{ID: "grandchild", ParentID: "child"},
+	} {
+		s.sessions[sess.ID] = sess
+		if err := s.saveSessionLocked(sess); err != nil {
+			t.Fatalf("failed to save session %s: %v", sess.ID, err)
+		}
+	}
+	return s, "parent", "child", "grandchild"
+}
+
+func TestDeleteSession_ReparentsChildrenByDefault(t *testing.T) {
+	s, parent, child, grandchild := newSessionChain(t)
+
+	if err := s.DeleteSession(child); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if got := s.sessions[grandchild].ParentID; got != parent {
+		t.Fatalf("expected grandchild to be reparented to %q, got %q", parent, got)
+	}
+
+	reloaded := &Service{sessions: map[string]*Session{}, dataDir: s.dataDir}
+	reloaded.loadSessions()
+	if got := reloaded.sessions[grandchild].ParentID; got != parent {
+		t.Fatalf("expected reparenting to be persisted, got %q", got)
+	}
+	children, _ := reloaded.GetSessionChildren(parent)
+	if len(children) != 1 || children[0]["id"] != grandchild {
+		t.Fatalf("expected %s to be the only child of %s, got %v", grandchild, parent, children)
+	}
+}
+
+func TestDeleteSession_DetachPolicy(t *testing.T) {
+	s, parent, child, grandchild := newSessionChain(t)
+	s.config["orphanedChildPolicy"] = "detach"
+
+	if err := s.DeleteSession(parent); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if got := s.sessions[child].ParentID; got != "" {
+		t.Fatalf("expected child to be detached, got parent %q", got)
+	}
+	if got := s.sessions[grandchild].ParentID; got != child {
+		t.Fatalf("expected grandchild to keep its parent, got %q", got)
+	}
+}
+
+func TestUpdateSession_ConcurrentSessions(t *testing.T) {
+	s, parent, child, _ := newSessionChain(t)
+
+	var wg sync.WaitGroup
+	for _, id := range []string{parent, child} {
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(id string, i int) {
+				defer wg.Done()
+				_, err := s.updateSession(id, func(session *Session) error {
+					session.Messages = append(session.Messages, map[string]interface{}{"n": i})
+					return nil
+				})
+				if err != nil {
+					t.Errorf("update %s: %v", id, err)
+				}
+			}(id, i)
+		}
+	}
+	wg.Wait()
+
+	reloaded := &Service{sessions: map[string]*Session{}, dataDir: s.dataDir}
+	reloaded.loadSessions()
+	for _, id := range []string{parent, child} {
+		msgs, err := reloaded.GetSessionMessages(id, 0)
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", id, err)
+		}
+		if len(msgs) != 10 {
+			t.Fatalf("expected 10 messages in %s, got %d", id, len(msgs))
+		}
+	}
+	meta, _ := reloaded.GetSessions()
+	for _, m := range meta {
+		if (m.ID == parent || m.ID == child) && m.MessageCount != 10 {
+			t.Fatalf("expected index to record 10 messages for %s, got %d", m.ID, m.MessageCount)
+		}
+	}
+}
+
+func TestFindSymbolDefinitions_PerLanguage(t *testing.T) {
+	cases := []struct {
+		file    string
+		content string
+		want    []string // kinds in line order
+	}{
+		{"a.go", "func (s *Service) Load() {}\ntype Load struct{}\nx := Load()\n", []string{"function", "type"}},
+		{"a.py", "class Load:\n    async def Load(self):\n        return Load()\nLoad = 1\n", []string{"class", "function", "variable"}},
+		{"a.ts", "export const Load = async (x: number) => x\nexport class Load {}\nLoad()\ninterface Load {}\nfunction Load() {}\n", []string{"function", "class", "interface", "function"}},
+	}
+	patterns := compileSymbolPatterns("Load")
+	for _, c := range cases {
+		defs := findSymbolDefinitions(patterns, c.file, []byte(c.content))
+		var got []string
+		for _, d := range defs {
+			got = append(got, d.Kind)
+		}
+		if strings.Join(got, ",") != strings.Join(c.want, ",") {
+			t.Errorf("%s: kinds = %v, want %v (defs %+v)", c.file, got, c.want, defs)
+		}
+	}
+}
+
+func TestFindDefinition_PrefersRealDefinitionOverTestCopy(t *testing.T) {
+	tmp := t.TempDir()
+	files := map[string]string{
+		// Walked first, so it only loses on its score.
+		"parse_test.go":   "package main\n\nfunc Parse(s string) string { return s }\n",
+		"parser/parse.go": "package parser\n\nimport \"strings\"\n\nfunc Parse(s string) string {\n\treturn strings.TrimSpace(s)\n}\n",
+		"main.go":         "package main\n\nfunc main() { _ = Parse(\"x\") }\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(tmp, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := &Service{workspaceDir: tmp}
+	def, candidates, err := s.FindDefinition(context.Background(), "Parse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if def.File != "parser/parse.go" || def.Line != 5 || candidates != 2 {
+		t.Fatalf("got %s:%d of %d candidates, want parser/parse.go:5 of 2", def.File, def.Line, candidates)
+	}
+}
+
+func TestIdentifierColumns_WholeWordsOnly(t *testing.T) {
+	got := identifierColumns("id idle x.id id_ (id)", "id")
+	want := []int{1, 11, 19}
+	if len(got) != len(want) {
+		t.Fatalf("columns = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("columns = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestErrorCode_SurvivesWrapping(t *testing.T) {
+	s := &Service{sessions: map[string]*Session{}}
+	_, err := s.GetSession("missing")
+	cases := []struct {
+		err  error
+		want string
+	}{
+		{fmt.Errorf("failed to get session: %w", err), errCodeSessionNotFound},
+		{fmt.Errorf("failed to send message: %w", &llmStatusError{StatusCode: 401}), errCodeProviderAuth},
+		{fmt.Errorf("failed to send message: %w", &llmStatusError{StatusCode: 500}), errCodeInternal},
+		{fmt.Errorf("failed to send message: %w", &llmRequestError{Err: context.Canceled}), errCodeCanceled},
+	}
+	for _, c := range cases {
+		env, ok := formatAppError(c.err).(appErrorEnvelope)
+		if !ok || env.Error.Code != c.want || env.Error.Message != c.err.Error() {
+			t.Errorf("formatAppError(%v) = %+v, want code %q", c.err, env, c.want)
+		}
+	}
+}
+
+func TestFormatAppError_Details(t *testing.T) {
+	err := withErrorDetails(fmt.Errorf("failed to send message: %w", &llmStatusError{StatusCode: 403}), map[string]interface{}{"sessionId": "s1"})
+	data, _ := json.Marshal(formatAppError(err))
+	want := `{"error":{"code":"provider_auth","message":"failed to send message: API request failed with status 403: ","details":{"sessionId":"s1","status":403}}}`
+	if string(data) != want {
+		t.Fatalf("envelope = %s, want %s", data, want)
+	}
+
+	data, _ = json.Marshal(formatAppError(invalidArgument("session ID cannot be empty")))
+	if !strings.Contains(string(data), `"code":"invalid_argument"`) || strings.Contains(string(data), "details") {
+		t.Fatalf("unexpected envelope: %s", data)
+	}
+}
+
+func TestSendMessage_MockProviderIsOptIn(t *testing.T) {
+	s, parent, _, _ := newSessionChain(t)
+	s.cancelFuncs = map[string]context.CancelFunc{}
+
+	_, err := s.SendMessage(parent, "hello", "some-model", "")
+	if !errors.Is(err, ErrModelNotFound) || !strings.Contains(err.Error(), "no provider configured for model some-model") {
+		t.Fatalf("expected a missing provider error, got %v", err)
+	}
+	if msgs, _ := s.GetSessionMessages(parent, 0); len(msgs) != 0 {
+		t.Fatalf("nothing should be saved on error, got %v", msgs)
+	}
+
+	s.config["allowMockProvider"] = true
+	reply, err := s.SendMessage(parent, "hello", "some-model", "")
+	if err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+	info := reply["info"].(map[string]interface{})
+	part := reply["parts"].([]map[string]interface{})[0]
+	if info["mock"] != true || part["mock"] != true {
+		t.Fatalf("mock reply should be flagged, got info=%v part=%v", info, part)
+	}
+}
+
+func TestRegenerateWithModel_KeepsReplacedRepliesAsVariants(t *testing.T) {
+	s, parent, _, _ := newSessionChain(t)
+	s.cancelFuncs = map[string]context.CancelFunc{}
+	s.config["allowMockProvider"] = true
+
+	if _, err := s.RegenerateWithModel(parent, "other-model"); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("expected an empty session to be rejected, got %v", err)
+	}
+	if _, err := s.SendMessage(parent, "hello", "first-model", ""); err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+	for _, model := range []string{"second-model", "third-model"} {
+		if _, err := s.RegenerateWithModel(parent, model); err != nil {
+			t.Fatalf("RegenerateWithModel(%s): %v", model, err)
+		}
+	}
+
+	msgs, err := s.GetSessionMessages(parent, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("expected the turn to be replaced, got %d messages", len(msgs))
+	}
+	if _, text, _, _ := normalizeStoredMessageParts(msgs[0]); text != "hello" {
+		t.Fatalf("expected the same prompt, got %q", text)
+	}
+	reply := msgs[1]
+	if model := reply["info"].(map[string]interface{})["model"]; model != "third-model" {
+		t.Fatalf("expected the reply from third-model, got %v", model)
+	}
+	var models []string
+	for _, v := range messageVariants(reply) {
+		model, _ := v["info"].(map[string]interface{})["model"].(string)
+		models = append(models, model)
+		if _, nested := v["info"].(map[string]interface{})["variants"]; nested {
+			t.Fatalf("variants must not nest: %v", v)
+		}
+	}
+	if strings.Join(models, ",") != "first-model,second-model" {
+		t.Fatalf("unexpected variants: %v", models)
+	}
+}
+
+func TestSelectVariant_ChoosesContextContent(t *testing.T) {
+	s, parent, _, _ := newSessionChain(t)
+	reply := map[string]interface{}{
+		"info":  map[string]interface{}{"id": "a1", "role": "assistant"},
+		"parts": []map[string]interface{}{{"type": "text", "text": "latest"}},
+		// Saved by the first RegenerateWithModel, before variants moved
+		// into info.
+		"variants": []interface{}{
+			map[string]interface{}{
+				"info":  map[string]interface{}{"id": "a0", "role": "assistant", "model": "old"},
+				"parts": []interface{}{map[string]interface{}{"type": "text", "text": "original"}},
+			},
+		},
+	}
+	if _, err := s.updateSession(parent, func(session *Session) error {
+		session.Messages = append(session.Messages, reply)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := &Service{sessions: map[string]*Session{}, dataDir: s.dataDir}
+	reloaded.loadSessions()
+	if _, err := reloaded.SelectVariant(parent, "a1", 0); err != nil {
+		t.Fatalf("SelectVariant: %v", err)
+	}
+	msgs, _ := reloaded.GetSessionMessages(parent, 0)
+	if _, legacy := msgs[0]["variants"]; legacy {
+		t.Fatalf("expected top-level variants to be migrated into info")
+	}
+	if _, text, ok := normalizeStoredMessage(msgs[0]); !ok || text != "original" {
+		t.Fatalf("expected the selected variant as context, got %q", text)
+	}
+
+	if _, err := reloaded.SelectVariant(parent, "a1", 1); err != nil {
+		t.Fatalf("SelectVariant(own): %v", err)
+	}
+	if _, text, _ := normalizeStoredMessage(msgs[0]); text != "original" {
+		t.Fatalf("expected earlier messages not to change, got %q", text)
+	}
+	msgs, _ = reloaded.GetSessionMessages(parent, 0)
+	if _, text, _ := normalizeStoredMessage(msgs[0]); text != "latest" {
+		t.Fatalf("expected the reply's own content, got %q", text)
+	}
+	if _, err := reloaded.SelectVariant(parent, "a1", 2); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("expected out-of-range index to fail, got %v", err)
+	}
+}
+
+func TestExportAll_ImportAllRoundTrip(t *testing.T) {
+	s, parent, child, _ := newSessionChain(t)
+	s.config = map[string]interface{}{
+		"customServices": []interface{}{map[string]interface{}{"id": "svc", "apiKey": "secret"}},
+	}
+	if _, err := s.updateSession(parent, func(session *Session) error {
+		session.Messages = append(session.Messages, map[string]interface{}{"info": map[string]interface{}{"role": "user"}})
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := s.ExportAll(true)
+	if err != nil {
+		t.Fatalf("ExportAll: %v", err)
+	}
+	t.Cleanup(func() { os.Remove(archive) })
+
+	// A fresh install restores everything but the masked key.
+	fresh := &Service{sessions: map[string]*Session{}, dataDir: t.TempDir(), config: map[string]interface{}{}}
+	fresh.configFile = filepath.Join(fresh.dataDir, "config.json")
+	result, err := fresh.ImportAll(archive, "")
+	if err != nil {
+		t.Fatalf("ImportAll: %v", err)
+	}
+	if len(result.Imported) != 3 || !result.ConfigRestored {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	svc := fresh.config["customServices"].([]interface{})[0].(map[string]interface{})
+	if svc["apiKey"] != "" {
+		t.Fatalf("expected the key to stay masked, got %v", svc["apiKey"])
+	}
+	msgs, err := fresh.GetSessionMessages(parent, 0)
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("expected the messages to be restored, got %v %v", msgs, err)
+	}
+
+	// Importing into the original keeps its key and renames on conflict.
+	s.configFile = filepath.Join(s.dataDir, "config.json")
+	result, err = s.ImportAll(archive, importRename)
+	if err != nil {
+		t.Fatalf("ImportAll(rename): %v", err)
+	}
+	if len(result.Renamed) != 3 {
+		t.Fatalf("expected every session to be renamed, got %+v", result)
+	}
+	svc = s.config["customServices"].([]interface{})[0].(map[string]interface{})
+	if svc["apiKey"] != "secret" {
+		t.Fatalf("expected the current key to be kept, got %v", svc["apiKey"])
+	}
+	renamedChild, err := s.GetSession(result.Renamed[child])
+	if err != nil || renamedChild.ParentID != result.Renamed[parent] {
+		t.Fatalf("expected the renamed child to follow its parent, got %+v %v", renamedChild, err)
+	}
+
+	if _, err := s.ImportAll(archive, "merge"); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("expected unknown strategy to be rejected, got %v", err)
+	}
+}
+
+func TestUpdateConfig_ValidatesKnownKeys(t *testing.T) {
+	tmp := t.TempDir()
+	s := &Service{configFile: filepath.Join(tmp, "config.json"), config: map[string]interface{}{}}
+
+	_, err := s.UpdateConfig(`{"customServices": {"id": "svc"}}`)
+	if !errors.Is(err, ErrInvalidArgument) || !strings.Contains(err.Error(), "customServices: want array, got object") {
+		t.Fatalf("expected customServices shape to be rejected, got %v", err)
+	}
+	if _, statErr := os.Stat(s.configFile); !os.IsNotExist(statErr) {
+		t.Fatalf("expected an invalid config not to be saved")
+	}
+
+	_, err = s.UpdateConfig(`{"customServices": [{"id": "a", "baseUrl": "http://x", "provider": "azure"}, {"id": "a"}], "providers": []}`)
+	problems, _ := errorDetails(err)["problems"].([]string)
+	want := []string{
+		`customServices[0].provider "azure" is not one of openai, anthropic, gemini, ollama or custom`,
+		`customServices[1].baseUrl is required`,
+		`customServices[1].id "a" is used more than once`,
+		`providers: want object, got array`,
+	}
+	if strings.Join(problems, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected problems:\n%s", strings.Join(problems, "\n"))
+	}
+
+	// Unknown keys are kept and mistyped settings only warn.
+	config, err := s.UpdateConfig(`{"myPlugin": {"x": 1}, "cacheResponses": "yes"}`)
+	if err != nil {
+		t.Fatalf("expected warnings only, got %v", err)
+	}
+	if _, ok := config["myPlugin"]; !ok || config["cacheResponses"] != "yes" {
+		t.Fatalf("expected the config to be stored as given, got %v", config)
+	}
+	warnings, _ := validateConfig(config)
+	if len(warnings) != 1 || !strings.HasPrefix(warnings[0], "cacheResponses: want boolean") {
+		t.Fatalf("unexpected warnings: %v", warnings)
+	}
+}
+
+func TestPatchConfig_SetsNestedPaths(t *testing.T) {
+	tmp := t.TempDir()
+	s := &Service{configFile: filepath.Join(tmp, "config.json"), config: map[string]interface{}{
+		"customServices": []interface{}{
+			map[string]interface{}{"id": "a", "baseUrl": "http://a", "enabled": true},
+			map[string]interface{}{"id": "b", "baseUrl": "http://b", "enabled": true},
+		},
+		"theme": "dark",
+	}}
+
+	config, err := s.PatchConfig(`{"customServices[1].enabled": false, "providers.local.model": "llama3", "theme": null}`)
+	if err != nil {
+		t.Fatalf("PatchConfig: %v", err)
+	}
+	services := config["customServices"].([]interface{})
+	if services[0].(map[string]interface{})["enabled"] != true || services[1].(map[string]interface{})["enabled"] != false {
+		t.Fatalf("expected only the second service to change, got %v", services)
+	}
+	if model := config["providers"].(map[string]interface{})["local"].(map[string]interface{})["model"]; model != "llama3" {
+		t.Fatalf("expected missing objects to be created, got %v", config["providers"])
+	}
+	if _, ok := config["theme"]; ok {
+		t.Fatalf("expected null to delete the key")
+	}
+	saved, err := os.ReadFile(s.configFile)
+	if err != nil || !strings.Contains(string(saved), `"llama3"`) {
+		t.Fatalf("expected the patch to be saved, got %s %v", saved, err)
+	}
+
+	for _, patch := range []string{
+		`{"customServices[5].enabled": true}`,
+		`{"customServices.enabled": true}`,
+		`{"customServices[0].baseUrl": ""}`,
+		`{"a..b": 1}`,
+	} {
+		if _, err := s.PatchConfig(patch); !errors.Is(err, ErrInvalidArgument) {
+			t.Fatalf("%s: expected ErrInvalidArgument, got %v", patch, err)
+		}
+	}
+	if s.config["customServices"].([]interface{})[0].(map[string]interface{})["baseUrl"] != "http://a" {
+		t.Fatalf("expected a rejected patch to leave the config untouched")
+	}
+}
+
+func TestExecuteToolCall_RecordsSessionToolStats(t *testing.T) {
+	s, parent, _, _ := newSessionChain(t)
+	s.workspaceDir = t.TempDir()
+	if err := os.WriteFile(filepath.Join(s.workspaceDir, "a.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	registry := newToolRegistry()
+	for _, call := range []ToolCall{
+		{Name: "read_file", Args: map[string]any{"path": "a.txt"}},
+		{Name: "read_file", Args: map[string]any{"path": "missing.txt"}},
+		{Name: "list_files", Args: map[string]any{"path": "."}},
+	} {
+		executeToolCall(context.Background(), s, registry, parent, call, agentModeAct)
+	}
+
+	stats, err := s.GetSessionToolStats(parent)
+	if err != nil {
+		t.Fatalf("GetSessionToolStats: %v", err)
+	}
+	if got := stats["read_file"]; got.Calls != 2 || got.Errors != 1 {
+		t.Fatalf("unexpected read_file stats: %+v", got)
+	}
+	if got := stats["list_files"]; got.Calls != 1 || got.Errors != 0 {
+		t.Fatalf("unexpected list_files stats: %+v", got)
+	}
+
+	reload := func() map[string]ToolStat {
+		reloaded := &Service{sessions: map[string]*Session{}, dataDir: s.dataDir}
+		reloaded.loadSessions()
+		stats, _ := reloaded.GetSessionToolStats(parent)
+		return stats
+	}
+	if stats := reload(); len(stats) != 0 {
+		t.Fatalf("expected the stats to be saved with the reply, not per call, got %v", stats)
+	}
+	s.saveToolStats(parent)
+	if stats := reload(); stats["read_file"].Calls != 2 || stats["list_files"].Calls != 1 {
+		t.Fatalf("expected the stats to survive a reload, got %v", stats)
+	}
+	if stats, _ := s.GetSessionToolStats(parent); stats["read_file"].Calls != 2 {
+		t.Fatalf("expected saved stats not to be counted twice, got %v", stats)
+	}
+	if _, err := s.GetSessionToolStats("missing"); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected ErrSessionNotFound, got %v", err)
+	}
+}
+
+func TestLoadSessions_LegacyFileShapes(t *testing.T) {
+	message := map[string]interface{}{
+		"info":  map[string]interface{}{"role": "user"},
+		"parts": []interface{}{map[string]interface{}{"type": "text", "text": "hello"}},
+	}
+	shapes := map[string]interface{}{
+		"map": map[string]interface{}{
+			"a": map[string]interface{}{"id": "a", "title": "A", "messages": []interface{}{message}},
+			"b": map[string]interface{}{"title": "B"},
+		},
+		"array": []interface{}{
+			map[string]interface{}{"id": "a", "title": "A", "messages": []interface{}{message}},
+			map[string]interface{}{"id": "b", "title": "B"},
+		},
+	}
+	for name, shape := range shapes {
+		t.Run(name, func(t *testing.T) {
+			tmp := t.TempDir()
+			sessionsFile := filepath.Join(tmp, "sessions.json")
+			data, _ := json.Marshal(shape)
+			if err := os.WriteFile(sessionsFile, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			s := &Service{sessions: map[string]*Session{}, dataDir: tmp, sessionsFile: sessionsFile}
+			s.loadSessions()
+			if len(s.sessions) != 2 || s.sessions["a"].Title != "A" || s.sessions["b"].Title != "B" {
+				t.Fatalf("expected sessions a and b, got %v", s.sessions)
+			}
+			session, err := s.GetSession("a")
+			if err != nil || len(session.Messages) != 1 {
+				t.Fatalf("expected the messages of a to be migrated: %v %v", session, err)
+			}
+			if _, err := os.Stat(sessionsFile + ".migrated"); err != nil {
+				t.Fatalf("expected the legacy file to be retired: %v", err)
+			}
+		})
+	}
+}
+
+func TestLoadSessions_RewritesIndexWrittenAsArray(t *testing.T) {
+	s, parent, child, grandchild := newSessionChain(t)
+	indexPath := filepath.Join(s.getSessionsDir(), sessionIndexFile)
+	list := []SessionMeta{}
+	for _, session := range s.sessions {
+		list = append(list, newSessionMeta(session))
+	}
+	data, _ := json.Marshal(map[string]interface{}{"sessions": list})
+	if err := os.WriteFile(indexPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := &Service{sessions: map[string]*Session{}, dataDir: s.dataDir}
+	reloaded.loadSessions()
+	for _, id := range []string{parent, child, grandchild} {
+		if _, ok := reloaded.sessions[id]; !ok {
+			t.Fatalf("expected session %s to be loaded from the array index", id)
+		}
+	}
+	if reloaded.sessions[child].ParentID != parent {
+		t.Fatalf("expected the parent link to survive, got %q", reloaded.sessions[child].ParentID)
+	}
+	rewritten, _ := os.ReadFile(indexPath)
+	var index struct {
+		Sessions map[string]SessionMeta `json:"sessions"`
+	}
+	if err := json.Unmarshal(rewritten, &index); err != nil || len(index.Sessions) != 3 {
+		t.Fatalf("expected the index to be rewritten keyed by ID: %v\n%s", err, rewritten)
+	}
+}
+
+func TestLoadConfig_UpgradesUnversionedAndKeepsNewerVersion(t *testing.T) {
+	tmp := t.TempDir()
+	configFile := filepath.Join(tmp, "config.json")
+	readVersion := func() interface{} {
+		data, _ := os.ReadFile(configFile)
+		var config map[string]interface{}
+		_ = json.Unmarshal(data, &config)
+		return config[storageVersionKey]
+	}
+
+	if err := os.WriteFile(configFile, []byte(`{"defaultModel": "m"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := &Service{configFile: configFile}
+	s.loadConfig()
+	if got := readVersion(); got != float64(configVersion) {
+		t.Fatalf("expected the config to be saved as version %d, got %v", configVersion, got)
+	}
+	if s.configString("defaultModel", "") != "m" {
+		t.Fatalf("migration lost settings: %v", s.config)
+	}
+
+	newer := configVersion + 1
+	if err := os.WriteFile(configFile, []byte(fmt.Sprintf(`{"_version": %d, "defaultModel": "m", "futureSetting": true}`, newer)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s = &Service{configFile: configFile}
+	s.loadConfig()
+	if err := s.saveConfig(s.config); err != nil {
+		t.Fatal(err)
+	}
+	if got := readVersion(); got != float64(newer) {
+		t.Fatalf("expected a newer config to keep version %d, got %v", newer, got)
+	}
+	if s.config["futureSetting"] != true {
+		t.Fatalf("expected unknown settings of a newer config to be kept")
+	}
+}
+
+func TestLoadSessions_StampsIndexVersion(t *testing.T) {
+	s, parent, _, _ := newSessionChain(t)
+	indexPath := filepath.Join(s.getSessionsDir(), sessionIndexFile)
+	readVersion := func() int {
+		data, _ := os.ReadFile(indexPath)
+		var index sessionIndex
+		_ = json.Unmarshal(data, &index)
+		return index.Version
+	}
+	if got := readVersion(); got != sessionIndexVersion {
+		t.Fatalf("expected new indexes to be written as version %d, got %d", sessionIndexVersion, got)
+	}
+
+	newer := sessionIndexVersion + 1
+	data, _ := os.ReadFile(indexPath)
+	var raw map[string]interface{}
+	_ = json.Unmarshal(data, &raw)
+	raw[storageVersionKey] = newer
+	data, _ = json.Marshal(raw)
+	if err := os.WriteFile(indexPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := &Service{sessions: map[string]*Session{}, dataDir: s.dataDir}
+	reloaded.loadSessions()
+	if _, ok := reloaded.sessions[parent]; !ok {
+		t.Fatalf("expected a newer index to stay readable")
+	}
+	if _, err := reloaded.UpdateSession(parent, "renamed"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readVersion(); got != newer {
+		t.Fatalf("expected a newer index to keep version %d, got %d", newer, got)
+	}
+}
+
+func TestUpdateSessionTodos_ValidatesAndNormalizes(t *testing.T) {
+	s, parent, _, _ := newSessionChain(t)
+	if _, err := s.UpdateSessionTodos(parent, []TodoItem{{ID: "keep", Content: "old"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	todos, err := s.UpdateSessionTodos(parent, []TodoItem{
+		{Content: "  write tests  "},
+		{ID: "b", Content: "ship", Status: "In_Progress ", Priority: "HIGH"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(todos) != 2 || todos[0].ID == "" || todos[0].Content != "write tests" || todos[0].Status != "pending" || todos[0].Priority != "medium" {
+		t.Fatalf("unexpected first todo: %+v", todos)
+	}
+	if todos[1].Status != "in_progress" || todos[1].Priority != "high" {
+		t.Fatalf("unexpected second todo: %+v", todos[1])
+	}
+
+	_, err = s.UpdateSessionTodos(parent, []TodoItem{
+		{Content: "fine"},
+		{Content: " "},
+		{Content: "x", Status: "done"},
+		{ID: "dup", Content: "y", Priority: "urgent"},
+		{ID: "dup", Content: "z"},
+	})
+	if !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("expected ErrInvalidArgument, got %v", err)
+	}
+	for _, want := range []string{"todos[1]: content", "todos[2]: status", "todos[3]: priority", "todos[4]: id"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("expected %q in %v", want, err)
+		}
+	}
+	stored, _ := s.sessionTodos(parent)
+	if len(stored) != 2 || stored[1].ID != "b" {
+		t.Fatalf("a rejected update changed the todos: %+v", stored)
+	}
+}
+
+func TestGetAllTodos_GroupsOpenTodosBySession(t *testing.T) {
+	s, parent, child, _ := newSessionChain(t)
+	if _, err := s.UpdateSessionTodos(parent, []TodoItem{{Content: "a"}, {Content: "b", Status: "completed"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.UpdateSessionTodos(child, []TodoItem{{Content: "c", Status: "completed"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.UpdateSession(parent, "Parent"); err != nil {
+		t.Fatal(err)
+	}
+	s.sessions[parent].UpdatedAt = s.sessions[child].UpdatedAt + 1
+
+	open, err := s.GetAllTodos(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(open) != 1 || open[0].SessionID != parent || open[0].Title != "Parent" || len(open[0].Todos) != 1 || open[0].Todos[0].Content != "a" {
+		t.Fatalf("unexpected open todos: %+v", open)
+	}
+
+	all, err := s.GetAllTodos(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 || all[0].SessionID != parent || len(all[0].Todos) != 2 || all[1].SessionID != child {
+		t.Fatalf("unexpected todos with completed: %+v", all)
+	}
+}
+
+func TestRunCommand_ConfiguredShell(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a POSIX shell")
+	}
+	tmp := t.TempDir()
+	s := &Service{workspaceDir: tmp, config: map[string]interface{}{
+		"shell": map[string]interface{}{"path": "sh"},
+	}}
+	result, err := s.RunCommandWithCwd("mkdir sub && cd sub && echo hi", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Shell != "sh" || !strings.Contains(result.Output, "hi") || result.Cwd != filepath.Join(tmp, "sub") {
+		t.Fatalf("unexpected result with configured shell: %+v", result)
+	}
+
+	s.config["shell"] = map[string]interface{}{"path": "no-such-shell-openspace"}
+	result, err = s.RunCommandWithCwd("echo fallback", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := defaultCommandShell("true", tmp, newCwdMarker())
+	if result.Shell != detectShellName(want) || !strings.Contains(result.Output, "fallback") {
+		t.Fatalf("expected fallback to the default shell, got %+v", result)
+	}
+
+	s.config["shell"] = map[string]interface{}{"path": "sh", "style": "tcsh"}
+	if _, _, ok := s.configuredShell(); ok {
+		t.Fatal("expected an unknown shell style to be rejected")
+	}
+	if got := fishSingleQuote(`it's a\b`); got != `'it\'s a\\b'` {
+		t.Fatalf("fishSingleQuote = %s", got)
+	}
+}
+
+func TestRunCommand_SeparatesStderr(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a POSIX shell")
+	}
+	s := &Service{workspaceDir: t.TempDir()}
+	result, err := s.RunCommandWithCwd("echo to-stdout; echo to-stderr 1>&2", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(result.Output, "to-stdout") || !strings.Contains(result.Output, "to-stderr") {
+		t.Fatalf("combined output is missing a stream: %q", result.Output)
+	}
+	if !strings.Contains(result.Stderr, "to-stderr") || strings.Contains(result.Stderr, "to-stdout") {
+		t.Fatalf("unexpected stderr: %q", result.Stderr)
+	}
+}
+
+func TestRunCommand_IgnoresFakeCwdMarker(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a POSIX shell")
+	}
+	tmp := t.TempDir()
+	s := &Service{workspaceDir: tmp}
+	result, err := s.RunCommandWithCwd("echo __OPENSPACE_CWD__=/fake; echo __OPENSPACE_CWD_0000__=/fake", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Cwd != tmp {
+		t.Fatalf("cwd = %q, want %q", result.Cwd, tmp)
+	}
+	if !strings.Contains(result.Output, "__OPENSPACE_CWD__=/fake") || !strings.Contains(result.Output, "__OPENSPACE_CWD_0000__=/fake") {
+		t.Fatalf("user output was stripped: %q", result.Output)
+	}
+
+	marker := newCwdMarker()
+	if marker == newCwdMarker() {
+		t.Fatal("expected a new marker per invocation")
+	}
+	clean, cwd := stripOpenSpaceCwdMarker("a\n"+marker+"/real\n__OPENSPACE_CWD__=/fake", marker)
+	if cwd != "/real" || clean != "a\n__OPENSPACE_CWD__=/fake" {
+		t.Fatalf("stripOpenSpaceCwdMarker = %q, %q", clean, cwd)
+	}
+}
+
+func TestBackgroundCommand_IncrementalOutputAndStop(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a POSIX shell")
+	}
+	s := &Service{workspaceDir: t.TempDir()}
+	handle, err := s.StartBackgroundCommand("echo started; sleep 30", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The shell's login profile may print before the command does.
+	var out BackgroundCommandOutput
+	for deadline := time.Now().Add(5 * time.Second); !strings.Contains(out.Output, "started") && time.Now().Before(deadline); {
+		next, err := s.GetBackgroundCommandOutput(handle)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out.Output += next.Output
+		out.Running = next.Running
+		time.Sleep(50 * time.Millisecond)
+	}
+	if !out.Running || !strings.Contains(out.Output, "started") {
+		t.Fatalf("unexpected output: %+v", out)
+	}
+	if out, _ := s.GetBackgroundCommandOutput(handle); strings.Contains(out.Output, "started") {
+		t.Fatalf("expected only new output on the second read, got %q", out.Output)
+	}
+
+	start := time.Now()
+	out, err = s.StopBackgroundCommand(handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Running || time.Since(start) >= backgroundStopGrace {
+		t.Fatalf("expected the command to stop promptly, got %+v after %s", out, time.Since(start))
+	}
+	if _, err := s.GetBackgroundCommandOutput(handle); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("expected a stopped command to be forgotten, got %v", err)
+	}
+}
+
+func TestBackgroundCommand_FinishedCommandReportsExitCode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a POSIX shell")
+	}
+	s := &Service{workspaceDir: t.TempDir()}
+	handle, err := s.StartBackgroundCommand("echo done; exit 3", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := s.backgroundCommand(handle)
+	select {
+	case <-b.done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("command did not finish")
+	}
+	out, err := s.GetBackgroundCommandOutput(handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Running || out.ExitCode != 3 || !strings.Contains(out.Output, "done") {
+		t.Fatalf("unexpected output of a finished command: %+v", out)
+	}
+	if _, err := s.GetBackgroundCommandOutput(handle); err == nil {
+		t.Fatal("expected a finished command to be forgotten once read")
+	}
+}
+
+func TestStartBackgroundCommand_PrunesExitedCommands(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a POSIX shell")
+	}
+	s := &Service{workspaceDir: t.TempDir()}
+	finished := func(command string) (string, *backgroundCommand) {
+		handle, err := s.StartBackgroundCommand(command, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := s.backgroundCommand(handle)
+		select {
+		case <-b.done:
+		case <-time.After(10 * time.Second):
+			t.Fatal("command did not finish")
+		}
+		return handle, b
+	}
+	unread, _ := finished("echo unread")
+	old, oldCmd := finished("echo old")
+	oldCmd.mu.Lock()
+	oldCmd.exitedAt = time.Now().Add(-backgroundExitedRetention - time.Minute)
+	oldCmd.mu.Unlock()
+
+	if _, err := s.StartBackgroundCommand("true", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.backgroundCommand(old); err == nil {
+		t.Fatal("expected a command that exited long ago to be pruned")
+	}
+	if out, err := s.GetBackgroundCommandOutput(unread); err != nil || !strings.Contains(out.Output, "unread") {
+		t.Fatalf("expected unread output to be kept, got %+v, %v", out, err)
+	}
+}
+
+func TestSendCommandInput_AnswersPrompt(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a POSIX shell")
+	}
+	s := &Service{workspaceDir: t.TempDir()}
+	handle, err := s.StartBackgroundCommand(`printf 'Continue? '; read -r answer; echo "answer=$answer"`, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SendCommandInput(handle, strings.Repeat("y", maxCommandInputBytes+1)); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("expected oversized input to be refused, got %v", err)
+	}
+	if err := s.SendCommandInput(handle, "yes"); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := s.backgroundCommand(handle)
+	select {
+	case <-b.done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("command did not finish after its input was sent")
+	}
+	if err := s.SendCommandInput(handle, "again"); err == nil {
+		t.Fatal("expected input to an exited command to fail")
+	}
+	out, err := s.GetBackgroundCommandOutput(handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.Output, "answer=yes") || out.ExitCode != 0 {
+		t.Fatalf("unexpected output: %+v", out)
+	}
+}
+
+func TestParseSlashCommand_IgnoresModeTag(t *testing.T) {
+	cases := []struct {
+		message  string
+		wantName string
+		wantArgs string
+		wantOK   bool
+	}{
+		{"/help", "help", "", true},
+		{"[MODE: PLAN] /help", "help", "", true},
+		{"[MODE: REVIEW] /Read main.go", "read", "main.go", true},
+		{"[MODE: PLAN] explain /help", "", "", false},
+		{"hello", "", "", false},
+	}
+	for _, c := range cases {
+		name, args, ok := parseSlashCommand(c.message)
+		if name != c.wantName || args != c.wantArgs || ok != c.wantOK {
+			t.Errorf("parseSlashCommand(%q) = %q, %q, %v; want %q, %q, %v", c.message, name, args, ok, c.wantName, c.wantArgs, c.wantOK)
+		}
+	}
+}
+
+func TestExpandCustomCommand_KeepsModeTag(t *testing.T) {
+	tmp := t.TempDir()
+	dir := customCommandsDir(tmp)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "review.md"), []byte("Review {{args}} carefully."), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := &Service{workspaceDir: tmp}
+
+	got, ok := s.expandCustomCommand("[MODE: PLAN] /review main.go")
+	if !ok || got != "[MODE: PLAN] Review main.go carefully." {
+		t.Fatalf("expandCustomCommand = %q, %v", got, ok)
+	}
+	if parseAgentMode(got) != agentModePlan {
+		t.Fatalf("expected the expanded prompt to stay in plan mode: %q", got)
+	}
+	if got, ok := s.expandCustomCommand("/review x"); !ok || got != "Review x carefully." {
+		t.Fatalf("expandCustomCommand without a mode = %q, %v", got, ok)
+	}
+}
+
+func TestExpandFileMentions(t *testing.T) {
+	tmp := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmp, "main.go"), []byte("package main"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := &Service{workspaceDir: tmp}
+	cases := []struct {
+		message  string
+		want     string
+		attached bool
+	}{
+		{"thanks @bob.", "thanks @bob.", false},
+		{"ask @alice, then @bob!", "ask @alice, then @bob!", false},
+		{"mail me@example.com", "mail me@example.com", false},
+		{"see @main.go", "see `main.go` (attached below)", true},
+		{"see @main.go.", "see `main.go` (attached below).", true},
+		{"(look at @./main.go)", "(look at `./main.go` (attached below))", true},
+	}
+	for _, c := range cases {
+		got := s.expandFileMentions(c.message)
+		text, attachments, _ := strings.Cut(got, "\n\nReferenced files:\n\n")
+		if text != c.want {
+			t.Errorf("expandFileMentions(%q) = %q, want %q", c.message, text, c.want)
+		}
+		if attached := strings.Contains(attachments, "package main"); attached != c.attached {
+			t.Errorf("expandFileMentions(%q) attached = %v, want %v", c.message, attached, c.attached)
+		}
+	}
+}
@@ -0,0 +1,782 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sessions are stored one per file under <data>/sessions/<id>.json, with
+// index.json listing their metadata. Saving a session only rewrites its own
+// file and the index.
+
+const (
+	sessionIndexFile     = "index.json"
+	sessionArchiveSuffix = ".archive.jsonl"
+)
+
+// SessionMeta is the metadata kept in the index for each session. It is also
+// what GetSessions returns, so listing sessions never reads messages.
+type SessionMeta struct {
+	ID            string              `json:"id"`
+	Title         string              `json:"title"`
+	Summary       string              `json:"summary,omitempty"`
+	CreatedAt     int64               `json:"createdAt"`
+	UpdatedAt     int64               `json:"updatedAt"`
+	ParentID      string              `json:"parentId,omitempty"`
+	Todos         []TodoItem          `json:"todos,omitempty"`
+	MessageCount  int                 `json:"messageCount"`
+	ArchivedCount int                 `json:"archivedCount,omitempty"`
+	DeletedAt     int64               `json:"deletedAt,omitempty"`
+	Deterministic bool                `json:"deterministic,omitempty"`
+	Generation    *GenerationParams   `json:"generation,omitempty"`
+	ToolStats     map[string]ToolStat `json:"toolStats,omitempty"`
+}
+
+type sessionIndex struct {
+	Version  int                    `json:"_version"`
+	Sessions map[string]SessionMeta `json:"sessions"`
+}
+
+func (s *Service) getSessionsDir() string {
+	if s.sessionsDir != "" {
+		return s.sessionsDir
+	}
+	return filepath.Join(s.dataDir, "sessions")
+}
+
+func (s *Service) sessionFilePath(sessionID string) (string, error) {
+	if sessionID == "" || sessionID != filepath.Base(sessionID) || sessionID == "." || sessionID == ".." ||
+		sessionID+".json" == sessionIndexFile {
+		return "", fmt.Errorf("invalid session ID: %s", sessionID)
+	}
+	return filepath.Join(s.getSessionsDir(), sessionID+".json"), nil
+}
+
+func newSessionMeta(session *Session) SessionMeta {
+	count := len(session.Messages)
+	if session.lazy {
+		count = session.messageCount
+	}
+	return SessionMeta{
+		ID:            session.ID,
+		Title:         session.Title,
+		Summary:       session.Summary,
+		CreatedAt:     session.CreatedAt,
+		UpdatedAt:     session.UpdatedAt,
+		ParentID:      session.ParentID,
+		Todos:         session.Todos,
+		MessageCount:  count,
+		ArchivedCount: session.ArchivedCount,
+		Deterministic: session.Deterministic,
+		Generation:    session.Generation,
+		ToolStats:     session.ToolStats,
+		DeletedAt:     session.DeletedAt,
+	}
+}
+
+// lockSession locks a single session's fields, messages and file, and
+// returns the unlock function. Sessions are locked independently, so a slow
+// save of one session does not hold up the others. Lock order is sessionMux,
+// then the session, then sessionLoad; never take sessionMux or indexMux
+// while holding a session lock.
+func (s *Service) lockSession(sessionID string) func() {
+	mu, _ := s.sessionLocks.LoadOrStore(sessionID, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+// sessionMessages returns a copy of the session's messages that can be read
+// after the session lock is released. Each message and its info map are
+// copied, since saving a variant changes the info of a stored reply; parts
+// are shared and never changed once stored.
+func (s *Service) sessionMessages(session *Session) []map[string]interface{} {
+	unlock := s.lockSession(session.ID)
+	defer unlock()
+	messages := make([]map[string]interface{}, len(session.Messages))
+	for i, msg := range session.Messages {
+		copied := make(map[string]interface{}, len(msg))
+		for k, v := range msg {
+			copied[k] = v
+		}
+		if info, ok := msg["info"].(map[string]interface{}); ok {
+			infoCopy := make(map[string]interface{}, len(info))
+			for k, v := range info {
+				infoCopy[k] = v
+			}
+			copied["info"] = infoCopy
+		}
+		messages[i] = copied
+	}
+	return messages
+}
+
+// sessionMeta is newSessionMeta for a session that may be mid lazy load or
+// being updated. The caller must not hold the session's lock.
+func (s *Service) sessionMeta(session *Session) SessionMeta {
+	unlock := s.lockSession(session.ID)
+	defer unlock()
+	s.sessionLoad.Lock()
+	defer s.sessionLoad.Unlock()
+	return newSessionMeta(session)
+}
+
+// loadSessions loads session metadata from the index, migrating the old
+// monolithic sessions.json first if it is still around. Messages are read
+// from the per-session files on first use.
+func (s *Service) loadSessions() {
+	s.sessionMux.Lock()
+	defer s.sessionMux.Unlock()
+
+	if err := s.migrateSessionsFileLocked(); err != nil {
+		fmt.Printf("Warning: Failed to migrate sessions: %v\n", err)
+	}
+
+	index, err := s.readSessionIndex()
+	if err != nil {
+		fmt.Printf("Warning: Failed to load session index: %v\n", err)
+		return
+	}
+
+	sessions := make(map[string]*Session, len(index.Sessions))
+	trash := make(map[string]*Session)
+	for id, meta := range index.Sessions {
+		session := &Session{
+			ID:            id,
+			Title:         meta.Title,
+			Summary:       meta.Summary,
+			CreatedAt:     meta.CreatedAt,
+			UpdatedAt:     meta.UpdatedAt,
+			ParentID:      meta.ParentID,
+			Todos:         meta.Todos,
+			ArchivedCount: meta.ArchivedCount,
+			DeletedAt:     meta.DeletedAt,
+			Deterministic: meta.Deterministic,
+			Generation:    meta.Generation,
+			ToolStats:     meta.ToolStats,
+			lazy:          true,
+			messageCount:  meta.MessageCount,
+		}
+		if session.DeletedAt != 0 {
+			trash[id] = session
+		} else {
+			sessions[id] = session
+		}
+	}
+	s.sessions = sessions
+	s.trash = trash
+
+	s.storeVersion = index.Version
+	switch {
+	case index.Version > sessionIndexVersion:
+		fmt.Printf("Warning: Session index was written by a newer version (format %d, this build reads %d)\n", index.Version, sessionIndexVersion)
+	case index.Version < sessionIndexVersion && len(index.Sessions) > 0:
+		if err := s.saveSessionIndexLocked(); err != nil {
+			fmt.Printf("Warning: Failed to upgrade session index: %v\n", err)
+		}
+	}
+}
+
+// loadSessionMessages reads the messages of a session that was loaded from
+// the index only. The caller must hold sessionMux, for reading or writing.
+func (s *Service) loadSessionMessages(session *Session) error {
+	s.sessionLoad.Lock()
+	defer s.sessionLoad.Unlock()
+
+	if !session.lazy {
+		return nil
+	}
+	stored, err := s.readSessionFile(session.ID)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("failed to load session messages: %w", err)
+		}
+		stored = &Session{}
+	}
+	session.Messages = stored.Messages
+	if session.Messages == nil {
+		session.Messages = []map[string]interface{}{}
+	}
+	migrateMessageVariants(session.Messages)
+	session.lazy = false
+	session.messageCount = 0
+	return nil
+}
+
+func (s *Service) readSessionIndex() (sessionIndex, error) {
+	index := sessionIndex{Sessions: map[string]SessionMeta{}}
+	data, err := os.ReadFile(filepath.Join(s.getSessionsDir(), sessionIndexFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return index, nil
+		}
+		return index, err
+	}
+	var raw struct {
+		Sessions json.RawMessage `json:"sessions"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return index, fmt.Errorf("failed to parse session index: %w", err)
+	}
+	if isJSONArray(raw.Sessions) {
+		// Version 0 indexes could list the sessions; key them by ID.
+		var list []SessionMeta
+		if err := json.Unmarshal(raw.Sessions, &list); err != nil {
+			return index, fmt.Errorf("failed to parse session index: %w", err)
+		}
+		for _, meta := range list {
+			if meta.ID == "" {
+				fmt.Printf("Warning: Skipping session index entry without an ID\n")
+				continue
+			}
+			index.Sessions[meta.ID] = meta
+		}
+		return index, nil
+	}
+	if err := json.Unmarshal(data, &index); err != nil {
+		return index, fmt.Errorf("failed to parse session index: %w", err)
+	}
+	if index.Sessions == nil {
+		index.Sessions = map[string]SessionMeta{}
+	}
+	return index, nil
+}
+
+// isJSONArray reports whether data holds a JSON array.
+func isJSONArray(data []byte) bool {
+	trimmed := bytes.TrimSpace(data)
+	return len(trimmed) > 0 && trimmed[0] == '['
+}
+
+// decodeLegacySessions parses a legacy sessions.json, which is an object
+// keyed by session ID or, as some older versions wrote it, an array of
+// sessions.
+func decodeLegacySessions(data []byte) (map[string]*Session, error) {
+	if !isJSONArray(data) {
+		var sessions map[string]*Session
+		if err := json.Unmarshal(data, &sessions); err != nil {
+			return nil, err
+		}
+		return sessions, nil
+	}
+	var list []*Session
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	sessions := make(map[string]*Session, len(list))
+	for _, session := range list {
+		if session == nil {
+			continue
+		}
+		if session.ID == "" {
+			fmt.Printf("Warning: Skipping session without an ID in sessions file\n")
+			continue
+		}
+		sessions[session.ID] = session
+	}
+	return sessions, nil
+}
+
+func (s *Service) readSessionFile(sessionID string) (*Session, error) {
+	path, err := s.sessionFilePath(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var session Session
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, fmt.Errorf("failed to parse session file: %w", err)
+	}
+	return &session, nil
+}
+
+// saveSessionLocked writes one session and refreshes the index. The caller
+// must hold sessionMux, but not the session's lock.
+func (s *Service) saveSessionLocked(session *Session) error {
+	unlock := s.lockSession(session.ID)
+	err := s.writeSessionLocked(session)
+	unlock()
+	if err != nil {
+		return err
+	}
+	return s.saveSessionIndexLocked()
+}
+
+// updateSession runs fn on a session while holding only that session's lock
+// and saves the result, so sessions can be updated concurrently. fn's error
+// is returned and nothing is saved; save failures are logged, as elsewhere.
+func (s *Service) updateSession(sessionID string, fn func(session *Session) error) (*Session, error) {
+	s.sessionMux.RLock()
+	session, exists := s.sessions[sessionID]
+	s.sessionMux.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrSessionNotFound, sessionID)
+	}
+
+	unlock := s.lockSession(sessionID)
+	if err := s.loadSessionMessages(session); err != nil {
+		unlock()
+		return nil, err
+	}
+	if err := fn(session); err != nil {
+		unlock()
+		return nil, err
+	}
+	err := s.writeSessionLocked(session)
+	unlock()
+	if err == nil {
+		err = s.saveSessionIndex()
+	}
+	if err != nil {
+		fmt.Printf("Warning: Failed to save session: %v\n", err)
+	}
+	return session, nil
+}
+
+// writeSessionLocked writes one session's file, archiving old messages
+// first. The caller must hold the session's lock.
+func (s *Service) writeSessionLocked(session *Session) error {
+	if _, err := s.sessionFilePath(session.ID); err != nil {
+		return err
+	}
+	// Metadata-only changes still rewrite the whole file, so pull in the
+	// stored messages first.
+	if err := s.loadSessionMessages(session); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.getSessionsDir(), 0755); err != nil {
+		return fmt.Errorf("failed to create sessions directory: %w", err)
+	}
+	if err := s.archiveOldMessagesLocked(session); err != nil {
+		fmt.Printf("Warning: Failed to archive old messages: %v\n", err)
+	}
+	return s.writeSessionFile(session)
+}
+
+func (s *Service) writeSessionFile(session *Session) error {
+	path, err := s.sessionFilePath(session.ID)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(session, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal session: %w", err)
+	}
+	if err := writeFileAtomic(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to save session: %w", err)
+	}
+	return nil
+}
+
+// removeSessionFiles deletes a session's file and message archive. The
+// caller refreshes the index.
+func (s *Service) removeSessionFiles(sessionID string) error {
+	path, err := s.sessionFilePath(sessionID)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete session file: %w", err)
+	}
+	if err := os.Remove(s.sessionArchivePath(sessionID)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete message archive: %w", err)
+	}
+	return nil
+}
+
+func (s *Service) sessionArchivePath(sessionID string) string {
+	return filepath.Join(s.getSessionsDir(), sessionID+sessionArchiveSuffix)
+}
+
+// archiveOldMessagesLocked enforces the maxMessagesPerSession config (no
+// limit by default) by appending the oldest messages to the session's
+// archive, one JSON message per line, and dropping them from the live array.
+func (s *Service) archiveOldMessagesLocked(session *Session) error {
+	limit := s.configInt("maxMessagesPerSession", 0)
+	if limit <= 0 || len(session.Messages) <= limit {
+		return nil
+	}
+	overflow := session.Messages[:len(session.Messages)-limit]
+
+	var buf bytes.Buffer
+	for _, msg := range overflow {
+		line, err := json.Marshal(msg)
+		if err != nil {
+			return fmt.Errorf("failed to marshal message: %w", err)
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	f, err := os.OpenFile(s.sessionArchivePath(session.ID), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open message archive: %w", err)
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write message archive: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close message archive: %w", err)
+	}
+
+	session.Messages = append([]map[string]interface{}{}, session.Messages[len(overflow):]...)
+	session.ArchivedCount += len(overflow)
+	return nil
+}
+
+// GetArchivedMessages returns the messages moved out of a session by the
+// maxMessagesPerSession limit, oldest first.
+func (s *Service) GetArchivedMessages(sessionID string) ([]map[string]interface{}, error) {
+	s.sessionMux.RLock()
+	defer s.sessionMux.RUnlock()
+
+	if _, exists := s.sessions[sessionID]; !exists {
+		return nil, fmt.Errorf("%w: %s", ErrSessionNotFound, sessionID)
+	}
+
+	messages := []map[string]interface{}{}
+	data, err := os.ReadFile(s.sessionArchivePath(sessionID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return messages, nil
+		}
+		return nil, fmt.Errorf("failed to read message archive: %w", err)
+	}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var msg map[string]interface{}
+		if err := json.Unmarshal(line, &msg); err != nil {
+			fmt.Printf("Warning: Skipping unreadable archived message: %v\n", err)
+			continue
+		}
+		messages = append(messages, msg)
+	}
+	return messages, nil
+}
+
+// saveSessionIndex refreshes the index from the current sessions.
+func (s *Service) saveSessionIndex() error {
+	s.sessionMux.RLock()
+	defer s.sessionMux.RUnlock()
+	return s.saveSessionIndexLocked()
+}
+
+// saveSessionIndexLocked writes the index. The caller must hold sessionMux,
+// for reading or writing, and no session lock.
+func (s *Service) saveSessionIndexLocked() error {
+	s.indexMux.Lock()
+	defer s.indexMux.Unlock()
+
+	index := sessionIndex{Version: max(sessionIndexVersion, s.storeVersion), Sessions: make(map[string]SessionMeta, len(s.sessions)+len(s.trash))}
+	for id, session := range s.sessions {
+		index.Sessions[id] = s.sessionMeta(session)
+	}
+	for id, session := range s.trash {
+		index.Sessions[id] = s.sessionMeta(session)
+	}
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal session index: %w", err)
+	}
+	if err := os.MkdirAll(s.getSessionsDir(), 0755); err != nil {
+		return fmt.Errorf("failed to create sessions directory: %w", err)
+	}
+	if err := writeFileAtomic(filepath.Join(s.getSessionsDir(), sessionIndexFile), data, 0644); err != nil {
+		return fmt.Errorf("failed to save session index: %w", err)
+	}
+	return nil
+}
+
+// migrateSessionsFileLocked splits a legacy sessions.json into per-session
+// files. The old file is kept as sessions.json.migrated.
+func (s *Service) migrateSessionsFileLocked() error {
+	if s.sessionsFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(s.sessionsFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	legacy, err := decodeLegacySessions(data)
+	if err != nil {
+		return fmt.Errorf("failed to parse sessions file: %w", err)
+	}
+
+	index, err := s.readSessionIndex()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.getSessionsDir(), 0755); err != nil {
+		return fmt.Errorf("failed to create sessions directory: %w", err)
+	}
+
+	for id, session := range legacy {
+		if session == nil {
+			continue
+		}
+		if session.ID == "" {
+			session.ID = id
+		}
+		// Sessions already in per-file storage take precedence.
+		if _, exists := index.Sessions[session.ID]; exists {
+			continue
+		}
+		path, err := s.sessionFilePath(session.ID)
+		if err != nil {
+			fmt.Printf("Warning: Skipping session during migration: %v\n", err)
+			continue
+		}
+		sessionJSON, err := json.MarshalIndent(session, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal session: %w", err)
+		}
+		if err := writeFileAtomic(path, sessionJSON, 0644); err != nil {
+			return fmt.Errorf("failed to save session: %w", err)
+		}
+		index.Sessions[session.ID] = newSessionMeta(session)
+	}
+
+	index.Version = max(sessionIndexVersion, index.Version)
+	indexJSON, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal session index: %w", err)
+	}
+	if err := writeFileAtomic(filepath.Join(s.getSessionsDir(), sessionIndexFile), indexJSON, 0644); err != nil {
+		return fmt.Errorf("failed to save session index: %w", err)
+	}
+
+	if err := os.Rename(s.sessionsFile, s.sessionsFile+".migrated"); err != nil {
+		return fmt.Errorf("failed to retire sessions file: %w", err)
+	}
+	fmt.Printf("Migrated %d sessions to %s\n", len(legacy), s.getSessionsDir())
+	return nil
+}
+
+// GetTrash returns the sessions in the trash, most recently deleted first.
+func (s *Service) GetTrash() ([]SessionMeta, error) {
+	s.sessionMux.RLock()
+	defer s.sessionMux.RUnlock()
+
+	trash := make([]SessionMeta, 0, len(s.trash))
+	for _, session := range s.trash {
+		trash = append(trash, s.sessionMeta(session))
+	}
+	sort.Slice(trash, func(i, j int) bool {
+		return trash[i].DeletedAt > trash[j].DeletedAt
+	})
+	return trash, nil
+}
+
+// RestoreSession moves a session out of the trash. If its parent is no
+// longer around it comes back as a top-level session.
+func (s *Service) RestoreSession(sessionID string) (SessionMeta, error) {
+	s.sessionMux.Lock()
+	defer s.sessionMux.Unlock()
+
+	session, exists := s.trash[sessionID]
+	if !exists {
+		return SessionMeta{}, fmt.Errorf("session not in trash: %s", sessionID)
+	}
+
+	delete(s.trash, sessionID)
+	unlock := s.lockSession(sessionID)
+	session.DeletedAt = 0
+	if session.ParentID != "" && s.sessions[session.ParentID] == nil {
+		session.ParentID = ""
+	}
+	unlock()
+	s.sessions[sessionID] = session
+
+	if err := s.rewriteSessionFileLocked(session); err != nil {
+		return SessionMeta{}, err
+	}
+	if err := s.saveSessionIndexLocked(); err != nil {
+		return SessionMeta{}, err
+	}
+	return s.sessionMeta(session), nil
+}
+
+// PurgeTrash permanently deletes every session in the trash and returns how
+// many were removed.
+func (s *Service) PurgeTrash() (int, error) {
+	return s.purgeTrash(0)
+}
+
+// purgeExpiredTrash drops trashed sessions older than the "trashRetentionDays"
+// config (30 days by default; 0 or less keeps them until purged by hand).
+func (s *Service) purgeExpiredTrash() {
+	days := s.configInt("trashRetentionDays", 30)
+	if days <= 0 {
+		return
+	}
+	if _, err := s.purgeTrash(time.Duration(days) * 24 * time.Hour); err != nil {
+		fmt.Printf("Warning: Failed to purge trash: %v\n", err)
+	}
+}
+
+// purgeTrash removes trashed sessions deleted more than olderThan ago.
+func (s *Service) purgeTrash(olderThan time.Duration) (int, error) {
+	s.sessionMux.Lock()
+	defer s.sessionMux.Unlock()
+
+	cutoff := time.Now().Add(-olderThan).UnixMilli()
+	purged := 0
+	var firstErr error
+	for id, session := range s.trash {
+		if session.DeletedAt > cutoff {
+			continue
+		}
+		delete(s.trash, id)
+		s.sessionLocks.Delete(id)
+		if err := s.removeSessionFiles(id); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		purged++
+	}
+	if purged > 0 {
+		if err := s.saveSessionIndexLocked(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return purged, firstErr
+}
+
+// CompactStorage rewrites every session file and the index, clears parent
+// references to sessions that no longer exist, and removes files in the
+// sessions directory that no session owns (leftover temp files, files of
+// deleted sessions). It holds the session lock for the whole run.
+func (s *Service) CompactStorage() (map[string]interface{}, error) {
+	s.sessionMux.Lock()
+	defer s.sessionMux.Unlock()
+
+	dir := s.getSessionsDir()
+	before, err := dirSize(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to measure storage: %w", err)
+	}
+
+	clearedParents := 0
+	for _, session := range s.sessions {
+		unlock := s.lockSession(session.ID)
+		if session.ParentID != "" && s.sessions[session.ParentID] == nil {
+			session.ParentID = ""
+			clearedParents++
+		}
+		unlock()
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create sessions directory: %w", err)
+	}
+	for _, session := range s.sessions {
+		if err := s.rewriteSessionFileLocked(session); err != nil {
+			return nil, err
+		}
+	}
+	for _, session := range s.trash {
+		if err := s.rewriteSessionFileLocked(session); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.saveSessionIndexLocked(); err != nil {
+		return nil, err
+	}
+
+	removedFiles := 0
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read sessions directory: %w", err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || name == sessionIndexFile {
+			continue
+		}
+		owner := strings.TrimSuffix(strings.TrimSuffix(name, sessionArchiveSuffix), ".json")
+		if !strings.HasPrefix(name, ".") && owner != name && (s.sessions[owner] != nil || s.trash[owner] != nil) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			fmt.Printf("Warning: Failed to remove %s: %v\n", name, err)
+			continue
+		}
+		removedFiles++
+	}
+
+	after, err := dirSize(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to measure storage: %w", err)
+	}
+	reclaimed := before - after
+	if reclaimed < 0 {
+		reclaimed = 0
+	}
+
+	return map[string]interface{}{
+		"sessions":       len(s.sessions) + len(s.trash),
+		"clearedParents": clearedParents,
+		"removedFiles":   removedFiles,
+		"bytesBefore":    before,
+		"bytesAfter":     after,
+		"bytesReclaimed": reclaimed,
+	}, nil
+}
+
+// rewriteSessionFileLocked re-serializes a session file without pulling the
+// messages of a lazily loaded session into memory. The caller must hold
+// sessionMux, but not the session's lock.
+func (s *Service) rewriteSessionFileLocked(session *Session) error {
+	unlock := s.lockSession(session.ID)
+	defer unlock()
+	if !session.lazy {
+		return s.writeSessionFile(session)
+	}
+	stored, err := s.readSessionFile(session.ID)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to load session %s: %w", session.ID, err)
+	}
+	rewritten := *session
+	rewritten.Messages = []map[string]interface{}{}
+	if stored != nil && stored.Messages != nil {
+		rewritten.Messages = stored.Messages
+	}
+	return s.writeSessionFile(&rewritten)
+}
+
+func dirSize(dir string) (int64, error) {
+	var total int64
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		total += info.Size()
+		return nil
+	})
+	return total, err
+}
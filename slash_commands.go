@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SlashCommandSpec describes a command that can be typed as "/name args".
+type SlashCommandSpec struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Category    string `json:"category"`
+	Usage       string `json:"usage"`
+}
+
+// SlashCommandHandler runs a slash command and returns the reply shown to
+// the user. Commands are answered locally, without calling the LLM.
+type SlashCommandHandler interface {
+	Spec() SlashCommandSpec
+	Run(ctx context.Context, svc *Service, args string) (string, error)
+}
+
+type CommandRegistry struct {
+	handlers map[string]SlashCommandHandler
+}
+
+func newCommandRegistry() *CommandRegistry {
+	r := &CommandRegistry{handlers: map[string]SlashCommandHandler{}}
+	r.register(&helpCommand{registry: r})
+	r.register(&fileCommand{})
+	r.register(&searchCommand{})
+	return r
+}
+
+func (r *CommandRegistry) register(h SlashCommandHandler) {
+	r.handlers[h.Spec().Name] = h
+}
+
+func (r *CommandRegistry) get(name string) (SlashCommandHandler, bool) {
+	h, ok := r.handlers[name]
+	return h, ok
+}
+
+// Specs returns the registered commands sorted by name.
+func (r *CommandRegistry) Specs() []SlashCommandSpec {
+	specs := make([]SlashCommandSpec, 0, len(r.handlers))
+	for _, h := range r.handlers {
+		specs = append(specs, h.Spec())
+	}
+	sort.Slice(specs, func(i, j int) bool { return specs[i].Name < specs[j].Name })
+	return specs
+}
+
+// parseSlashCommand splits "/name args" into its parts, ignoring a leading
+// mode tag. ok is false when message is not a slash command.
+func parseSlashCommand(message string) (name string, args string, ok bool) {
+	_, trimmed := splitModeTag(strings.TrimSpace(message))
+	if !strings.HasPrefix(trimmed, "/") {
+		return "", "", false
+	}
+	fields := strings.SplitN(trimmed[1:], " ", 2)
+	name = strings.ToLower(strings.TrimSpace(fields[0]))
+	if name == "" {
+		return "", "", false
+	}
+	if len(fields) == 2 {
+		args = strings.TrimSpace(fields[1])
+	}
+	return name, args, true
+}
+
+// runSlashCommand answers a slash command message and records the exchange
+// in the session like a normal turn. handled is false when message does not
+// name a registered command, in which case it should go to the LLM.
+func (s *Service) runSlashCommand(ctx context.Context, sessionID string, message string) (map[string]interface{}, bool, error) {
+	name, args, ok := parseSlashCommand(message)
+	if !ok {
+		return nil, false, nil
+	}
+	handler, ok := newCommandRegistry().get(name)
+	if !ok {
+		return nil, false, nil
+	}
+
+	reply, err := handler.Run(ctx, s, args)
+	if err != nil {
+		reply = fmt.Sprintf("Error: /%s failed: %v", name, err)
+	}
+
+	now := time.Now().UnixMilli()
+	userMsg := map[string]interface{}{
+		"info": map[string]interface{}{
+			"role":      "user",
+			"createdAt": now,
+			"id":        fmt.Sprintf("msg_%d", now),
+		},
+		"parts": []map[string]interface{}{
+			{
+				"type": "text",
+				"text": message,
+			},
+		},
+	}
+	assistantMsg := map[string]interface{}{
+		"info": map[string]interface{}{
+			"role":      "assistant",
+			"createdAt": now + 100,
+			"id":        fmt.Sprintf("msg_%d", now+100),
+			"command":   name,
+		},
+		"parts": []map[string]interface{}{
+			{
+				"type":       "text",
+				"text":       reply,
+				"tokenCount": 0,
+			},
+		},
+	}
+	if _, err := s.updateSession(sessionID, func(session *Session) error {
+		session.Messages = append(session.Messages, userMsg, assistantMsg)
+		session.UpdatedAt = now + 100
+		return nil
+	}); err != nil {
+		return nil, true, err
+	}
+	return assistantMsg, true, nil
+}
+
+// maxCommandOutputSize caps the reply of /file and /search.
+const maxCommandOutputSize = 32 * 1024
+
+type helpCommand struct {
+	registry *CommandRegistry
+}
+
+func (c *helpCommand) Spec() SlashCommandSpec {
+	return SlashCommandSpec{Name: "help", Description: "Show help information", Category: "general", Usage: "/help"}
+}
+
+func (c *helpCommand) Run(ctx context.Context, svc *Service, args string) (string, error) {
+	var b strings.Builder
+	b.WriteString("Available commands:\n")
+	for _, spec := range c.registry.Specs() {
+		fmt.Fprintf(&b, "\n- `%s` — %s", spec.Usage, spec.Description)
+	}
+	if custom := svc.customCommandSpecs(); len(custom) > 0 {
+		b.WriteString("\n\nCustom commands (.openspace/commands):\n")
+		for _, spec := range custom {
+			fmt.Fprintf(&b, "\n- `%s` — %s", spec.Usage, spec.Description)
+		}
+	}
+	b.WriteString("\n\nAny other message is sent to the model.")
+	return b.String(), nil
+}
+
+type fileCommand struct{}
+
+func (c *fileCommand) Spec() SlashCommandSpec {
+	return SlashCommandSpec{Name: "file", Description: "Show the content of a file", Category: "file", Usage: "/file <path>"}
+}
+
+func (c *fileCommand) Run(ctx context.Context, svc *Service, args string) (string, error) {
+	if args == "" {
+		return "", fmt.Errorf("usage: /file <path>")
+	}
+	path, err := svc.workspaceFilePath(args)
+	if err != nil {
+		return "", err
+	}
+	content, err := svc.GetFileContent(path)
+	if err != nil {
+		return "", err
+	}
+	if isBinary, _ := content["isBinary"].(bool); isBinary {
+		return fmt.Sprintf("`%s` is a binary file (%v bytes).", args, content["size"]), nil
+	}
+	text, _ := content["content"].(string)
+	truncated := truncateUTF8(text, maxCommandOutputSize)
+	if len(truncated) < len(text) {
+		truncated += "\n... (truncated)"
+	}
+	return fmt.Sprintf("`%s`:\n\n```\n%s\n```", args, strings.TrimRight(truncated, "\n")), nil
+}
+
+type searchCommand struct{}
+
+func (c *searchCommand) Spec() SlashCommandSpec {
+	return SlashCommandSpec{Name: "search", Description: "Search in codebase", Category: "search", Usage: "/search <pattern>"}
+}
+
+func (c *searchCommand) Run(ctx context.Context, svc *Service, args string) (string, error) {
+	if args == "" {
+		return "", fmt.Errorf("usage: /search <pattern>")
+	}
+	results, err := svc.FindTextContext(ctx, args, false)
+	if err != nil {
+		return "", err
+	}
+	if len(results) == 0 {
+		return fmt.Sprintf("No matches for `%s`.", args), nil
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Matches for `%s` in %d file(s):\n", args, len(results))
+	for _, r := range results {
+		if b.Len() > maxCommandOutputSize {
+			b.WriteString("\n... (more results omitted)")
+			break
+		}
+		fmt.Fprintf(&b, "\n- %v (%v)", r["file"], r["count"])
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+)
+
+// The config file and the session index record the format version they were
+// written in under "_version". Files without one are version 0. On load,
+// older files are upgraded one version at a time and saved; files from a
+// newer build are read as well as possible and keep their version, so the
+// newer build does not migrate them a second time.
+
+const (
+	storageVersionKey = "_version"
+
+	// configVersion is the config format this build writes.
+	configVersion = 1
+	// sessionIndexVersion is the session index format this build writes.
+	// Version 1 keys the sessions by ID; version 0 could also list them.
+	sessionIndexVersion = 1
+)
+
+// configMigrations[i] upgrades a config from version i to i+1.
+var configMigrations = []func(config map[string]interface{}){
+	// 0 -> 1: unversioned configs need no changes beyond the version.
+	func(map[string]interface{}) {},
+}
+
+// storedConfigVersion returns the version recorded in config.
+func storedConfigVersion(config map[string]interface{}) int {
+	if v, ok := config[storageVersionKey].(float64); ok && v > 0 {
+		return int(v)
+	}
+	if v, ok := config[storageVersionKey].(int); ok && v > 0 {
+		return v
+	}
+	return 0
+}
+
+// migrateConfig upgrades config in place to configVersion and reports
+// whether anything changed.
+func migrateConfig(config map[string]interface{}) bool {
+	version := storedConfigVersion(config)
+	if version > configVersion {
+		fmt.Printf("Warning: Config was written by a newer version (format %d, this build reads %d); unknown settings are kept but ignored\n", version, configVersion)
+		return false
+	}
+	if version == configVersion {
+		return false
+	}
+	for ; version < configVersion; version++ {
+		configMigrations[version](config)
+	}
+	config[storageVersionKey] = configVersion
+	return true
+}
+
+// stampConfigVersion records the format version before config is written,
+// keeping the version of a file from a newer build.
+func stampConfigVersion(config map[string]interface{}) {
+	if storedConfigVersion(config) < configVersion {
+		config[storageVersionKey] = configVersion
+	}
+}
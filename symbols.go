@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// symbolPatternTemplate is a definition pattern for one kind of symbol. %s is
+// replaced by the quoted symbol name.
+type symbolPatternTemplate struct {
+	kind string
+	tmpl string
+}
+
+// symbolPatternSets holds the definition patterns per language. Within a set
+// the first pattern matching a line decides its kind, so more specific
+// patterns (arrow functions) come before general ones (variables).
+var symbolPatternSets = map[string][]symbolPatternTemplate{
+	"go": {
+		{"function", `\bfunc\s+(\([^)]*\)\s*)?%s\s*[\[(]`},
+		{"type", `\btype\s+%s\b`},
+		{"constant", `\bconst\s+%s\b`},
+		{"variable", `\bvar\s+%s\b`},
+		{"variable", `^\s*%s\s*(,\s*\w+\s*)*:=`},
+	},
+	"python": {
+		{"function", `^\s*(async\s+)?def\s+%s\s*\(`},
+		{"class", `^\s*class\s+%s\b`},
+		{"variable", `^%s\s*(:[^=]*)?=[^=]`},
+	},
+	"javascript": {
+		{"function", `\bfunction\s*\*?\s*%s\s*[(<]`},
+		{"class", `\bclass\s+%s\b`},
+		{"function", `\b(const|let|var)\s+%s\s*(:[^=]+)?=\s*(async\s+)?(function\b|(\([^)]*\)|[A-Za-z_$][\w$]*)\s*(:[^=]+)?=>)`},
+		{"interface", `\binterface\s+%s\b`},
+		{"type", `\btype\s+%s\s*[=<]`},
+		{"enum", `\benum\s+%s\b`},
+		{"variable", `\b(const|let|var)\s+%s\b`},
+		{"method", `^\s*(static\s+|async\s+|public\s+|private\s+|protected\s+)*%s\s*\([^)]*\)\s*(:[^{]+)?\{`},
+	},
+	"generic": {
+		{"class", `\b(class|interface|struct|enum|trait)\s+%s\b`},
+		{"function", `\b(fn|def|function)\s+%s\b`},
+	},
+}
+
+// symbolLanguage picks the pattern set for a source file.
+func symbolLanguage(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".go":
+		return "go"
+	case ".py":
+		return "python"
+	case ".js", ".jsx", ".ts", ".tsx", ".mjs", ".cjs":
+		return "javascript"
+	default:
+		return "generic"
+	}
+}
+
+type symbolPattern struct {
+	kind string
+	re   *regexp.Regexp
+}
+
+// compileSymbolPatterns builds the definition patterns for query in every
+// language.
+func compileSymbolPatterns(query string) map[string][]symbolPattern {
+	quoted := regexp.QuoteMeta(query)
+	compiled := make(map[string][]symbolPattern, len(symbolPatternSets))
+	for lang, templates := range symbolPatternSets {
+		for _, t := range templates {
+			re, err := regexp.Compile(fmt.Sprintf(t.tmpl, quoted))
+			if err != nil {
+				continue
+			}
+			compiled[lang] = append(compiled[lang], symbolPattern{kind: t.kind, re: re})
+		}
+	}
+	return compiled
+}
+
+// symbolDefinition is one line that defines the searched symbol.
+type symbolDefinition struct {
+	Line   int    `json:"line"`
+	Column int    `json:"column,omitempty"`
+	Kind   string `json:"kind"`
+	Text   string `json:"text"`
+}
+
+// findSymbolDefinitions returns the lines of content that define the symbol,
+// using the patterns for the file's language.
+func findSymbolDefinitions(patterns map[string][]symbolPattern, filename string, content []byte) []symbolDefinition {
+	set := patterns[symbolLanguage(filename)]
+	var defs []symbolDefinition
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+		for _, p := range set {
+			if p.re.MatchString(text) {
+				column := len(text) - len(strings.TrimLeft(text, " \t")) + 1
+				defs = append(defs, symbolDefinition{Line: line, Column: column, Kind: p.kind, Text: strings.TrimSpace(text)})
+				break
+			}
+		}
+	}
+	return defs
+}
+
+// goDefinitions finds top-level Go declarations of symbol using the parser.
+// ok is false when the file does not parse, so callers can fall back to the
+// regex patterns.
+func goDefinitions(filename string, content []byte, symbol string) ([]symbolDefinition, bool) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, filename, content, parser.SkipObjectResolution)
+	if err != nil {
+		return nil, false
+	}
+	lines := strings.Split(string(content), "\n")
+	var defs []symbolDefinition
+	add := func(ident *ast.Ident, kind string) {
+		if ident == nil || ident.Name != symbol {
+			return
+		}
+		pos := fset.Position(ident.Pos())
+		text := ""
+		if pos.Line-1 < len(lines) {
+			text = strings.TrimSpace(lines[pos.Line-1])
+		}
+		defs = append(defs, symbolDefinition{Line: pos.Line, Column: pos.Column, Kind: kind, Text: text})
+	}
+	for _, decl := range file.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			if d.Recv != nil {
+				add(d.Name, "method")
+			} else {
+				add(d.Name, "function")
+			}
+		case *ast.GenDecl:
+			for _, spec := range d.Specs {
+				switch sp := spec.(type) {
+				case *ast.TypeSpec:
+					add(sp.Name, "type")
+				case *ast.ValueSpec:
+					kind := "variable"
+					if d.Tok == token.CONST {
+						kind = "constant"
+					}
+					for _, name := range sp.Names {
+						add(name, kind)
+					}
+				}
+			}
+		}
+	}
+	return defs, true
+}
+
+// symbolLocation is where a symbol is defined.
+type symbolLocation struct {
+	File   string `json:"file"`
+	Line   int    `json:"line"`
+	Column int    `json:"column,omitempty"`
+	Kind   string `json:"kind"`
+	Text   string `json:"text"`
+	score  int
+}
+
+// definitionKindScores ranks kinds of definition; types and functions are
+// more likely to be what is meant than a variable of the same name.
+var definitionKindScores = map[string]int{
+	"class":     50,
+	"type":      50,
+	"interface": 45,
+	"function":  40,
+	"enum":      35,
+	"method":    30,
+	"constant":  20,
+	"variable":  10,
+}
+
+// definitionScore ranks a candidate definition: parser results beat regex
+// matches, top-level beats indented, and non-test sources beat tests.
+func definitionScore(relPath string, def symbolDefinition, fromParser bool) int {
+	score := definitionKindScores[def.Kind]
+	if fromParser {
+		score += 100
+	}
+	if fromParser || def.Column <= 1 {
+		score += 5
+	}
+	lower := strings.ToLower(relPath)
+	if strings.Contains(lower, "_test.") || strings.Contains(lower, ".test.") || strings.Contains(lower, ".spec.") || strings.Contains(lower, "test_") {
+		score -= 25
+	}
+	if strings.Contains(filepath.ToSlash(lower), "vendor/") || strings.Contains(filepath.ToSlash(lower), "dist/") {
+		score -= 40
+	}
+	return score
+}
+
+// FindDefinition returns the single most likely definition of symbol in the
+// workspace, and how many candidates were considered. Go files are searched
+// with the parser, other languages with the definition patterns.
+func (s *Service) FindDefinition(ctx context.Context, symbol string) (symbolLocation, int, error) {
+	symbol = strings.TrimSpace(symbol)
+	if symbol == "" {
+		return symbolLocation{}, 0, fmt.Errorf("symbol parameter is required")
+	}
+
+	wd := s.GetWorkspaceDirectory()
+	patterns := compileSymbolPatterns(symbol)
+	var best symbolLocation
+	candidates := 0
+
+	err := filepath.Walk(wd, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		if path != wd {
+			if skip, skipDir := skipSearchEntry(info, false); skipDir {
+				return filepath.SkipDir
+			} else if skip {
+				return nil
+			}
+		}
+		if info.IsDir() || !isSourceFile(info.Name()) {
+			return nil
+		}
+		content, err := os.ReadFile(path)
+		if err != nil || !bytes.Contains(content, []byte(symbol)) {
+			return nil
+		}
+
+		defs, fromParser := []symbolDefinition(nil), false
+		if symbolLanguage(info.Name()) == "go" {
+			defs, fromParser = goDefinitions(path, content, symbol)
+		}
+		if !fromParser {
+			defs = findSymbolDefinitions(patterns, info.Name(), content)
+		}
+
+		relPath := toWorkspaceRel(wd, path)
+		for _, def := range defs {
+			candidates++
+			score := definitionScore(relPath, def, fromParser)
+			if candidates == 1 || score > best.score {
+				best = symbolLocation{File: relPath, Line: def.Line, Column: def.Column, Kind: def.Kind, Text: def.Text, score: score}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return symbolLocation{}, 0, err
+	}
+	if candidates == 0 {
+		return symbolLocation{}, 0, fmt.Errorf("no definition found for %s", symbol)
+	}
+	return best, candidates, nil
+}
+
+// symbolReference is one use of a symbol.
+type symbolReference struct {
+	File   string `json:"file"`
+	Line   int    `json:"line"`
+	Column int    `json:"column"`
+	Text   string `json:"text"`
+	rank   int
+}
+
+const (
+	defaultReferenceLimit = 100
+	maxReferenceLineSize  = 200
+)
+
+// isIdentByte reports whether b can be part of an identifier, so matches can
+// be limited to whole identifiers.
+func isIdentByte(b byte) bool {
+	return b == '_' || b == '$' || b >= '0' && b <= '9' || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= 0x80
+}
+
+// identifierColumns returns the 1-based byte columns where symbol occurs in
+// line as a whole identifier.
+func identifierColumns(line, symbol string) []int {
+	var cols []int
+	for start := 0; ; {
+		i := strings.Index(line[start:], symbol)
+		if i < 0 {
+			return cols
+		}
+		i += start
+		end := i + len(symbol)
+		if (i == 0 || !isIdentByte(line[i-1])) && (end == len(line) || !isIdentByte(line[end])) {
+			cols = append(cols, i+1)
+		}
+		start = i + 1
+	}
+}
+
+// FindReferences returns the places symbol is used as a whole identifier,
+// ranked with definitions first and tests last, and capped at limit. It also
+// returns the total number found.
+func (s *Service) FindReferences(ctx context.Context, symbol string, limit int) ([]symbolReference, int, error) {
+	symbol = strings.TrimSpace(symbol)
+	if symbol == "" {
+		return nil, 0, fmt.Errorf("symbol parameter is required")
+	}
+	if limit <= 0 {
+		limit = defaultReferenceLimit
+	}
+
+	wd := s.GetWorkspaceDirectory()
+	patterns := compileSymbolPatterns(symbol)
+	var refs []symbolReference
+
+	err := filepath.Walk(wd, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		if path != wd {
+			if skip, skipDir := skipSearchEntry(info, false); skipDir {
+				return filepath.SkipDir
+			} else if skip {
+				return nil
+			}
+		}
+		if info.IsDir() || !isSourceFile(info.Name()) {
+			return nil
+		}
+		content, err := os.ReadFile(path)
+		if err != nil || !bytes.Contains(content, []byte(symbol)) {
+			return nil
+		}
+
+		relPath := toWorkspaceRel(wd, path)
+		defLines := map[int]bool{}
+		for _, def := range findSymbolDefinitions(patterns, info.Name(), content) {
+			defLines[def.Line] = true
+		}
+		fileRank := definitionScore(relPath, symbolDefinition{}, false)
+
+		scanner := bufio.NewScanner(bytes.NewReader(content))
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		lineNo := 0
+		for scanner.Scan() {
+			lineNo++
+			line := scanner.Text()
+			cols := identifierColumns(line, symbol)
+			if len(cols) == 0 {
+				continue
+			}
+			text := strings.TrimSpace(line)
+			if kept := truncateRunes(text, maxReferenceLineSize); len(kept) < len(text) {
+				text = kept + "..."
+			}
+			rank := fileRank
+			if defLines[lineNo] {
+				rank += 100
+			}
+			for _, col := range cols {
+				refs = append(refs, symbolReference{File: relPath, Line: lineNo, Column: col, Text: text, rank: rank})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	sort.SliceStable(refs, func(i, j int) bool { return refs[i].rank > refs[j].rank })
+	total := len(refs)
+	if len(refs) > limit {
+		refs = refs[:limit]
+	}
+	return refs, total, nil
+}
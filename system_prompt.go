@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// System prompt verbosity. "auto" uses the compact prompt for models whose
+// context limit is below compactPromptContextLimit, where the full prompt
+// would take a large share of every request.
+const (
+	systemPromptAuto          = "auto"
+	systemPromptFull          = "full"
+	systemPromptCompact       = "compact"
+	compactPromptContextLimit = 16000
+)
+
+// useCompactSystemPrompt reports whether requests to model on config should
+// get the compact system prompt, following config "systemPromptStyle".
+func (s *Service) useCompactSystemPrompt(config CustomLLMService, model string) bool {
+	switch style := s.configString("systemPromptStyle", systemPromptAuto); style {
+	case systemPromptFull:
+		return false
+	case systemPromptCompact:
+		return true
+	case systemPromptAuto, "":
+	default:
+		fmt.Printf("Warning: Unknown systemPromptStyle %q, using %s\n", style, systemPromptAuto)
+	}
+	return effectiveContextLimit(config, model) < compactPromptContextLimit
+}
+
+// compactSystemPrompt is a short system prompt for small-context models. It
+// keeps what the model needs to call tools correctly: one line per tool in
+// registry with its arguments, the call format and the mode restrictions.
+func compactSystemPrompt(toolMode string, mode agentMode, registry *ToolRegistry) string {
+	var b strings.Builder
+	b.WriteString("You are OpenSpace, a software engineer working in the user's workspace. Be precise and direct. Use tools to inspect the code instead of guessing, read files before editing them, and verify your changes.\n\nTools (? = optional):\n")
+	for _, name := range registry.Names() {
+		h, _ := registry.get(name)
+		spec := h.Spec()
+		fmt.Fprintf(&b, "- %s(%s): %s\n", spec.Name, strings.Join(compactToolArgs(spec.Parameters), ", "), firstSentence(spec.Description))
+	}
+	if toolMode == "native" {
+		b.WriteString("\nCall tools through tool calling; do not write <tool_call> blocks.\n")
+	} else {
+		b.WriteString("\nCall a tool with exactly this format, one block per call:\n<tool_call>\n  <name>read_file</name>\n  <args>\n    <path>main.go</path>\n  </args>\n</tool_call>\nResults arrive in the next \"Tool Results\" message.\n")
+	}
+
+	switch mode {
+	case agentModeReview:
+		b.WriteString("\nREVIEW MODE: read-only. Only read, search, list and git status/diff tools run. Report suggested changes instead of applying them.\n")
+	case agentModePlan:
+		b.WriteString("\nPLAN MODE: explore and plan only. Do not modify files; run_command accepts only simple read-only commands. Ask the user to switch to ACT MODE when the plan is ready.\n")
+	default:
+		b.WriteString("\nACT MODE: implement the solution with any tool and verify it.\n")
+	}
+	return b.String()
+}
+
+// compactToolArgs lists the argument names of a tool schema: the required
+// ones in schema order, then the optional ones marked with a trailing "?".
+func compactToolArgs(params map[string]any) []string {
+	props, _ := params["properties"].(map[string]any)
+	required, _ := params["required"].([]string)
+	args := append([]string{}, required...)
+	isRequired := map[string]bool{}
+	for _, name := range required {
+		isRequired[name] = true
+	}
+	var optional []string
+	for name := range props {
+		if !isRequired[name] {
+			optional = append(optional, name+"?")
+		}
+	}
+	sort.Strings(optional)
+	return append(args, optional...)
+}
+
+// firstSentence returns the text up to and including its first ". ".
+func firstSentence(text string) string {
+	if i := strings.Index(text, ". "); i >= 0 {
+		return text[:i+1]
+	}
+	return text
+}
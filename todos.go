@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The values TodoItem.Status and TodoItem.Priority may take.
+var (
+	todoStatuses   = []string{"pending", "in_progress", "completed"}
+	todoPriorities = []string{"low", "medium", "high"}
+)
+
+func validTodoPriority(priority string) bool {
+	return containsString(todoPriorities, priority)
+}
+
+func validTodoStatus(status string) bool {
+	return containsString(todoStatuses, status)
+}
+
+func containsString(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeTodos checks a full todo list and returns a cleaned copy:
+// content is trimmed and required, status defaults to pending and priority
+// to medium, both must be known values, and items without an ID get one.
+// Every problem is reported in one ErrInvalidArgument error.
+func normalizeTodos(todos []TodoItem) ([]TodoItem, error) {
+	normalized := make([]TodoItem, 0, len(todos))
+	seen := map[string]bool{}
+	var problems []string
+	for i, t := range todos {
+		t.ID = strings.TrimSpace(t.ID)
+		t.Content = strings.TrimSpace(t.Content)
+		t.Status = strings.ToLower(strings.TrimSpace(t.Status))
+		t.Priority = strings.ToLower(strings.TrimSpace(t.Priority))
+		if t.Status == "" {
+			t.Status = "pending"
+		}
+		if t.Priority == "" {
+			t.Priority = "medium"
+		}
+		if t.Content == "" {
+			problems = append(problems, fmt.Sprintf("todos[%d]: content cannot be empty", i))
+		}
+		if !validTodoStatus(t.Status) {
+			problems = append(problems, fmt.Sprintf("todos[%d]: status %q is not one of %s", i, t.Status, strings.Join(todoStatuses, ", ")))
+		}
+		if !validTodoPriority(t.Priority) {
+			problems = append(problems, fmt.Sprintf("todos[%d]: priority %q is not one of %s", i, t.Priority, strings.Join(todoPriorities, ", ")))
+		}
+		if t.ID != "" {
+			if seen[t.ID] {
+				problems = append(problems, fmt.Sprintf("todos[%d]: id %q is used more than once", i, t.ID))
+			}
+			seen[t.ID] = true
+		}
+		normalized = append(normalized, t)
+	}
+	if len(problems) > 0 {
+		return nil, withErrorDetails(
+			fmt.Errorf("%w: invalid todos: %s", ErrInvalidArgument, strings.Join(problems, "; ")),
+			map[string]interface{}{"problems": problems},
+		)
+	}
+	for i := range normalized {
+		if normalized[i].ID == "" {
+			normalized[i].ID = newTodoID(normalized)
+		}
+	}
+	return normalized, nil
+}
+
+// The todo list added to the system prompt is capped at maxPromptTodos open
+// items of at most maxPromptTodoBytes each.
+const (
+	maxPromptTodos     = 20
+	maxPromptTodoBytes = 200
+)
+
+// SessionTodos are the todos of one session, as returned by GetAllTodos.
+type SessionTodos struct {
+	SessionID string     `json:"sessionId"`
+	Title     string     `json:"title"`
+	UpdatedAt int64      `json:"updatedAt"`
+	Todos     []TodoItem `json:"todos"`
+}
+
+// modifySessionTodos reads, changes and saves a session's todos under the
+// session's lock, so concurrent changes are never lost. fn gets a copy of
+// the list and returns the new one; if it fails nothing is saved.
+func (s *Service) modifySessionTodos(sessionID string, fn func(todos []TodoItem) ([]TodoItem, error)) ([]TodoItem, error) {
+	var updated []TodoItem
+	_, err := s.updateSession(sessionID, func(session *Session) error {
+		// Work on a copy: the session index keeps a reference to the
+		// current slice.
+		todos, err := fn(append([]TodoItem{}, session.Todos...))
+		if err != nil {
+			return err
+		}
+		session.Todos = todos
+		session.UpdatedAt = time.Now().UnixMilli()
+		updated = todos
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// sessionTodos returns a copy of a session's todos.
+func (s *Service) sessionTodos(sessionID string) ([]TodoItem, error) {
+	s.sessionMux.RLock()
+	session, exists := s.sessions[sessionID]
+	s.sessionMux.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrSessionNotFound, sessionID)
+	}
+	unlock := s.lockSession(sessionID)
+	defer unlock()
+	return append([]TodoItem{}, session.Todos...), nil
+}
+
+// GetAllTodos returns the todos of every session that has any, most
+// recently updated session first. Completed todos are left out unless
+// includeCompleted is set. Sessions in the trash are not included.
+func (s *Service) GetAllTodos(includeCompleted bool) ([]SessionTodos, error) {
+	s.sessionMux.RLock()
+	defer s.sessionMux.RUnlock()
+
+	all := []SessionTodos{}
+	for id, session := range s.sessions {
+		unlock := s.lockSession(id)
+		var todos []TodoItem
+		for _, t := range session.Todos {
+			if includeCompleted || t.Status != "completed" {
+				todos = append(todos, t)
+			}
+		}
+		entry := SessionTodos{SessionID: id, Title: session.Title, UpdatedAt: session.UpdatedAt, Todos: todos}
+		unlock()
+		if len(todos) > 0 {
+			all = append(all, entry)
+		}
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].UpdatedAt != all[j].UpdatedAt {
+			return all[i].UpdatedAt > all[j].UpdatedAt
+		}
+		return all[i].SessionID < all[j].SessionID
+	})
+	return all, nil
+}
+
+// newTodoID returns an ID not used by any of todos.
+func newTodoID(todos []TodoItem) string {
+	used := make(map[string]bool, len(todos))
+	for _, t := range todos {
+		used[t.ID] = true
+	}
+	id := fmt.Sprintf("todo_%d", time.Now().UnixNano())
+	for n := 2; used[id]; n++ {
+		id = fmt.Sprintf("todo_%d_%d", time.Now().UnixNano(), n)
+	}
+	return id
+}
+
+// todoIndex returns the position of the todo with id, or -1.
+func todoIndex(todos []TodoItem, id string) int {
+	for i, t := range todos {
+		if t.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// reorderTodos moves the todos named by ids to the front, in that order;
+// the others keep their relative order after them.
+func reorderTodos(todos []TodoItem, ids []string) ([]TodoItem, error) {
+	seen := make(map[string]bool, len(ids))
+	reordered := make([]TodoItem, 0, len(todos))
+	for _, id := range ids {
+		if seen[id] {
+			return nil, fmt.Errorf("todo %s is listed more than once", id)
+		}
+		seen[id] = true
+		i := todoIndex(todos, id)
+		if i < 0 {
+			return nil, fmt.Errorf("todo %s not found", id)
+		}
+		reordered = append(reordered, todos[i])
+	}
+	for _, t := range todos {
+		if !seen[t.ID] {
+			reordered = append(reordered, t)
+		}
+	}
+	return reordered, nil
+}
+
+// todoLine renders one todo as a checklist line.
+func todoLine(t TodoItem) string {
+	icon := "[ ]"
+	if t.Status == "completed" {
+		icon = "[x]"
+	} else if t.Status == "in_progress" {
+		icon = "[/]"
+	}
+	line := fmt.Sprintf("%s %s (ID: %s)", icon, t.Content, t.ID)
+	if t.Priority != "" && t.Priority != "medium" {
+		line += " [" + t.Priority + "]"
+	}
+	return line
+}
+
+// todoProgress summarizes how many todos are done.
+func todoProgress(todos []TodoItem) string {
+	done := 0
+	for _, t := range todos {
+		if t.Status == "completed" {
+			done++
+		}
+	}
+	return fmt.Sprintf("%d of %d done", done, len(todos))
+}
+
+// todoPromptSection renders the open todos for the system prompt so the
+// model keeps track of its plan, or "" when there are none.
+func todoPromptSection(todos []TodoItem) string {
+	var lines []string
+	open := 0
+	for _, t := range todos {
+		if t.Status == "completed" {
+			continue
+		}
+		open++
+		if len(lines) < maxPromptTodos {
+			if len(t.Content) > maxPromptTodoBytes {
+				t.Content = truncateUTF8(t.Content, maxPromptTodoBytes) + "..."
+			}
+			lines = append(lines, todoLine(t))
+		}
+	}
+	if open == 0 {
+		return ""
+	}
+	if open > len(lines) {
+		lines = append(lines, fmt.Sprintf("... and %d more", open-len(lines)))
+	}
+	return "\n====\nTODO LIST (" + todoProgress(todos) + ")\n====\n" + strings.Join(lines, "\n") + "\nUpdate it with manage_todo as you make progress.\n"
+}
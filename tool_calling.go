@@ -1,13 +1,20 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 type ToolCall struct {
@@ -32,9 +39,61 @@ type ToolSpec struct {
 type ToolHandler interface {
 	Spec() ToolSpec
 	AllowedInPlanMode() bool
+	// ReadOnly reports whether a call with these args has no side effects.
+	// Only read-only calls run in review mode.
+	ReadOnly(args map[string]any) bool
 	Execute(ctx context.Context, svc *Service, sessionID string, args map[string]any) (string, error)
 }
 
+// planModeGate is implemented by tools that are refused in plan mode but
+// can allow some calls, judged from their args.
+type planModeGate interface {
+	AllowedInPlanModeFor(svc *Service, args map[string]any) bool
+}
+
+func allowedInPlanModeFor(h ToolHandler, svc *Service, args map[string]any) bool {
+	g, ok := h.(planModeGate)
+	return ok && svc != nil && g.AllowedInPlanModeFor(svc, args)
+}
+
+// agentMode controls which tools a turn may run.
+type agentMode string
+
+const (
+	agentModeAct    agentMode = "act"
+	agentModePlan   agentMode = "plan"
+	agentModeReview agentMode = "review"
+)
+
+// The mode tags the frontend prepends to a message outside act mode.
+const (
+	planModeTag   = "[MODE: PLAN]"
+	reviewModeTag = "[MODE: REVIEW]"
+)
+
+// parseAgentMode reads the mode tag the frontend prepends to a message.
+func parseAgentMode(message string) agentMode {
+	switch {
+	case strings.HasPrefix(message, planModeTag):
+		return agentModePlan
+	case strings.HasPrefix(message, reviewModeTag):
+		return agentModeReview
+	default:
+		return agentModeAct
+	}
+}
+
+// splitModeTag separates a leading mode tag from the rest of message. tag
+// is "" when there is none.
+func splitModeTag(message string) (tag string, rest string) {
+	for _, t := range []string{planModeTag, reviewModeTag} {
+		if strings.HasPrefix(message, t) {
+			return t, strings.TrimSpace(message[len(t):])
+		}
+	}
+	return "", message
+}
+
 type ToolRegistry struct {
 	handlers map[string]ToolHandler
 }
@@ -44,11 +103,21 @@ func newToolRegistry() *ToolRegistry {
 	r.register(&searchFilesTool{})
 	r.register(&readFileTool{})
 	r.register(&listFilesTool{})
+	r.register(&fileStatTool{})
+	r.register(&treeTool{})
 	r.register(&runCommandTool{})
 	r.register(&saveFileTool{})
+	r.register(&moveFileTool{})
+	r.register(&makeDirTool{})
+	r.register(&findDefinitionTool{})
+	r.register(&findReferencesTool{})
 	r.register(&gitStatusTool{})
 	r.register(&gitDiffTool{})
 	r.register(&manageTodoTool{})
+	r.register(&runTestsTool{})
+	r.register(&lintTool{})
+	r.register(&buildTool{})
+	r.register(&commandOutputTool{})
 	return r
 }
 
@@ -61,14 +130,38 @@ func (r *ToolRegistry) get(name string) (ToolHandler, bool) {
 	return h, ok
 }
 
-func (r *ToolRegistry) OpenAITools() []map[string]any {
-	tools := make([]map[string]any, 0, len(r.handlers))
+// restrictedTo returns a registry holding only the named tools. An empty
+// list keeps every tool.
+func (r *ToolRegistry) restrictedTo(names []string) *ToolRegistry {
+	if len(names) == 0 {
+		return r
+	}
+	filtered := &ToolRegistry{handlers: map[string]ToolHandler{}}
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		h, ok := r.handlers[name]
+		if !ok {
+			fmt.Printf("Warning: Unknown tool in allowed list: %s\n", name)
+			continue
+		}
+		filtered.handlers[name] = h
+	}
+	return filtered
+}
+
+// Names returns the registered tool names, sorted.
+func (r *ToolRegistry) Names() []string {
 	names := make([]string, 0, len(r.handlers))
 	for name := range r.handlers {
 		names = append(names, name)
 	}
 	sort.Strings(names)
-	for _, name := range names {
+	return names
+}
+
+func (r *ToolRegistry) OpenAITools() []map[string]any {
+	tools := make([]map[string]any, 0, len(r.handlers))
+	for _, name := range r.Names() {
 		spec := r.handlers[name].Spec()
 		tools = append(tools, map[string]any{
 			"type": "function",
@@ -82,10 +175,24 @@ func (r *ToolRegistry) OpenAITools() []map[string]any {
 	return tools
 }
 
-func executeToolCall(ctx context.Context, svc *Service, registry *ToolRegistry, sessionID string, call ToolCall, planMode bool) ToolResult {
+func executeToolCall(ctx context.Context, svc *Service, registry *ToolRegistry, sessionID string, call ToolCall, mode agentMode) ToolResult {
 	if call.ID == "" {
 		call.ID = fmt.Sprintf("toolcall_%d", time.Now().UnixNano())
 	}
+	started := time.Now()
+	progress := svc != nil && svc.toolProgressEnabled()
+	if progress {
+		svc.emitToolProgress(sessionID, call, nil, started)
+	}
+	res := dispatchToolCall(ctx, svc, registry, sessionID, call, mode)
+	if progress {
+		svc.emitToolProgress(sessionID, call, &res, started)
+	}
+	svc.recordToolUsage(sessionID, call.Name, res.IsError, time.Since(started))
+	return res
+}
+
+func dispatchToolCall(ctx context.Context, svc *Service, registry *ToolRegistry, sessionID string, call ToolCall, mode agentMode) ToolResult {
 	h, ok := registry.get(call.Name)
 	if !ok {
 		return ToolResult{
@@ -95,7 +202,7 @@ func executeToolCall(ctx context.Context, svc *Service, registry *ToolRegistry,
 			IsError:    true,
 		}
 	}
-	if planMode && !h.AllowedInPlanMode() {
+	if mode == agentModePlan && !h.AllowedInPlanMode() && !allowedInPlanModeFor(h, svc, call.Args) {
 		return ToolResult{
 			ToolCallID: call.ID,
 			Name:       call.Name,
@@ -103,6 +210,28 @@ func executeToolCall(ctx context.Context, svc *Service, registry *ToolRegistry,
 			IsError:    true,
 		}
 	}
+	if mode == agentModeReview && !h.ReadOnly(call.Args) {
+		return ToolResult{
+			ToolCallID: call.ID,
+			Name:       call.Name,
+			Content:    "Tool not allowed in REVIEW mode (read-only): " + call.Name,
+			IsError:    true,
+		}
+	}
+	var before []fileSnapshot
+	if m, ok := h.(fileMutator); ok && svc != nil && svc.hasEventEmitter() {
+		for _, path := range m.MutatedPaths(call.Args) {
+			before = append(before, svc.snapshotFile(path))
+		}
+	}
+	res := runToolHandler(ctx, svc, h, sessionID, call)
+	if len(before) > 0 {
+		svc.emitFileMutations(sessionID, call, before, res)
+	}
+	return res
+}
+
+func runToolHandler(ctx context.Context, svc *Service, h ToolHandler, sessionID string, call ToolCall) ToolResult {
 	out, err := h.Execute(ctx, svc, sessionID, call.Args)
 	if err != nil {
 		return ToolResult{
@@ -120,6 +249,101 @@ func executeToolCall(ctx context.Context, svc *Service, registry *ToolRegistry,
 	}
 }
 
+// toolResultBudgetFraction is the share of the context limit that tool
+// output fed back to the model may use over one turn.
+const toolResultBudgetFraction = 0.5
+
+// toolResultBudget caps the total size of tool results across the tool loop
+// of one turn, so the follow-up requests stay within the context limit.
+type toolResultBudget struct {
+	remaining int // bytes
+}
+
+func newToolResultBudget(contextLimit int) *toolResultBudget {
+	if contextLimit <= 0 {
+		contextLimit = defaultContextLimit
+	}
+	// prepareMessages estimates 4 bytes per token.
+	return &toolResultBudget{remaining: int(float64(contextLimit*4) * toolResultBudgetFraction)}
+}
+
+// fit truncates results so their combined content fits in what is left of
+// the budget, cutting the largest results first, and charges what is kept.
+func (b *toolResultBudget) fit(results []ToolResult) {
+	total := 0
+	for _, r := range results {
+		total += len(r.Content)
+	}
+	if total <= b.remaining {
+		b.remaining -= total
+		return
+	}
+
+	// Find the largest per-result cap that fits: results under it stay whole.
+	sizes := make([]int, len(results))
+	for i, r := range results {
+		sizes[i] = len(r.Content)
+	}
+	sort.Ints(sizes)
+	limit, left := 0, b.remaining
+	for i, size := range sizes {
+		share := left / (len(sizes) - i)
+		if size > share {
+			limit = share
+			break
+		}
+		left -= size
+		limit = size
+	}
+
+	used := 0
+	for i := range results {
+		content := results[i].Content
+		if len(content) > limit {
+			kept := truncateUTF8(content, limit)
+			results[i].Content = kept + fmt.Sprintf("\n... (truncated %d bytes: tool output budget for this turn exhausted)", len(content)-len(kept))
+			used += len(kept)
+		} else {
+			used += len(content)
+		}
+	}
+	b.remaining -= used
+	if b.remaining < 0 {
+		b.remaining = 0
+	}
+}
+
+// truncateUTF8 returns the longest prefix of s no longer than n bytes that
+// does not split a UTF-8 sequence.
+func truncateUTF8(s string, n int) string {
+	if n <= 0 {
+		return ""
+	}
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// truncateRunes returns at most the first n runes of s, for cuts measured in
+// characters rather than bytes.
+func truncateRunes(s string, n int) string {
+	if n <= 0 {
+		return ""
+	}
+	count := 0
+	for i := range s {
+		if count == n {
+			return s[:i]
+		}
+		count++
+	}
+	return s
+}
+
 func buildToolCallTranscriptXML(calls []ToolCall) string {
 	var b strings.Builder
 	for i, c := range calls {
@@ -250,10 +474,13 @@ func parseOpenAIToolCalls(message map[string]any) ([]ToolCall, []map[string]any,
 	return nil, nil, nil
 }
 
+// parseXMLToolCallsFromText returns the tool calls in a model response.
+// <tool_call> blocks are the primary form; see parseAlternativeToolCalls
+// for the others.
 func parseXMLToolCallsFromText(text string) ([]ToolCall, error) {
 	blocks := extractToolCallBlocks(text)
 	if len(blocks) == 0 {
-		return nil, nil
+		return parseAlternativeToolCalls(text), nil
 	}
 	calls := make([]ToolCall, 0, len(blocks))
 	for _, block := range blocks {
@@ -266,16 +493,145 @@ func parseXMLToolCallsFromText(text string) ([]ToolCall, error) {
 	return calls, nil
 }
 
+// Models without native tool calling do not all use <tool_call>. Some write
+// a JSON object such as {"tool": "read_file", "args": {"path": "a.go"}},
+// on its own line, in a ```tool_code / ```tool_call / ```json fence or
+// inside <function_call> tags. These forms are only tried when there is no
+// <tool_call> block, and only for names of registered tools, so ordinary
+// JSON in an answer is not mistaken for a call. A ```json fence or a bare
+// line must also carry an arguments object, since answers often hold JSON
+// with a "name" key.
+
+// toolCallFence matches a fenced code block and captures its info string
+// and body.
+var toolCallFence = regexp.MustCompile("(?s)```([A-Za-z_]*)[ \t]*\r?\n(.*?)```")
+
+// toolCallFenceLangs are the fence info strings that may hold a tool call,
+// mapped to whether the call must carry an arguments object.
+var toolCallFenceLangs = map[string]bool{"tool_code": false, "tool_call": false, "tool": false, "json": true}
+
+// parseAlternativeToolCalls returns the tool calls written in one of the
+// alternative forms.
+func parseAlternativeToolCalls(text string) []ToolCall {
+	known := newToolRegistry()
+	var calls []ToolCall
+	add := func(candidate string, requireArgs bool) {
+		call, hasArgs, ok := parseJSONToolCall(candidate)
+		if !ok || (requireArgs && !hasArgs) {
+			return
+		}
+		if _, exists := known.get(call.Name); exists {
+			calls = append(calls, call)
+		}
+	}
+
+	rest := text
+	for _, m := range toolCallFence.FindAllStringSubmatch(text, -1) {
+		rest = strings.Replace(rest, m[0], "", 1)
+		if requireArgs, ok := toolCallFenceLangs[strings.ToLower(m[1])]; ok {
+			add(m[2], requireArgs)
+		}
+	}
+	for {
+		inner, ok := extractTagInner(rest, "function_call")
+		if !ok {
+			break
+		}
+		add(inner, false)
+		rest = strings.Replace(rest, "<function_call>"+inner+"</function_call>", "", 1)
+	}
+	for _, line := range strings.Split(rest, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "{") && strings.HasSuffix(line, "}") {
+			add(line, true)
+		}
+	}
+	return calls
+}
+
+// parseJSONToolCall reads a JSON tool call. The name may be under "tool",
+// "name" or "function", and the arguments under "args", "arguments",
+// "parameters" or "input", either as an object or as a JSON-encoded
+// string; hasArgs reports whether they were given.
+func parseJSONToolCall(candidate string) (call ToolCall, hasArgs bool, ok bool) {
+	var obj map[string]any
+	if err := json.Unmarshal([]byte(strings.TrimSpace(candidate)), &obj); err != nil {
+		return ToolCall{}, false, false
+	}
+	var name string
+	for _, key := range []string{"tool", "name", "function"} {
+		if v, ok := obj[key].(string); ok && strings.TrimSpace(v) != "" {
+			name = strings.TrimSpace(v)
+			break
+		}
+	}
+	if name == "" {
+		return ToolCall{}, false, false
+	}
+	args := map[string]any{}
+	for _, key := range []string{"args", "arguments", "parameters", "input"} {
+		value, ok := obj[key]
+		if !ok || value == nil {
+			continue
+		}
+		switch v := value.(type) {
+		case map[string]any:
+			args = v
+		case string:
+			if err := json.Unmarshal([]byte(v), &args); err != nil {
+				return ToolCall{}, false, false
+			}
+		default:
+			return ToolCall{}, false, false
+		}
+		hasArgs = true
+		break
+	}
+	return ToolCall{Name: name, Args: args}, hasArgs, true
+}
+
+// malformedToolCall reports why a response that tried to call a tool
+// produced no usable calls: a block that failed to parse or a <tool_call>
+// that was never closed. calls and parseErr are the result of
+// parseXMLToolCallsFromText(text).
+func malformedToolCall(text string, calls []ToolCall, parseErr error) (string, bool) {
+	if parseErr != nil {
+		return parseErr.Error(), true
+	}
+	if len(calls) > 0 {
+		return "", false
+	}
+	last := strings.LastIndex(text, "<tool_call>")
+	if last >= 0 && !strings.Contains(text[last:], "</tool_call>") {
+		return "<tool_call> is not closed with </tool_call>", true
+	}
+	return "", false
+}
+
+// toolCallRepairPrompt asks the model to re-emit a tool call that could not
+// be parsed.
+func toolCallRepairPrompt(reason string) string {
+	return fmt.Sprintf(`Your last message tried to call a tool, but the tool call could not be parsed: %s.
+Re-emit the tool call as valid XML, with every tag closed:
+<tool_call>
+  <name>tool_name</name>
+  <args>
+    <arg_name>value</arg_name>
+  </args>
+</tool_call>`, reason)
+}
+
 func extractToolCallBlocks(text string) []string {
 	var blocks []string
+	masked := maskCDATA(text)
 	searchFrom := 0
 	for {
-		start := strings.Index(text[searchFrom:], "<tool_call>")
+		start := strings.Index(masked[searchFrom:], "<tool_call>")
 		if start < 0 {
 			break
 		}
 		start += searchFrom
-		end := strings.Index(text[start:], "</tool_call>")
+		end := strings.Index(masked[start:], "</tool_call>")
 		if end < 0 {
 			break
 		}
@@ -295,7 +651,10 @@ func parseToolCallBlock(block string) (ToolCall, error) {
 	if !ok || strings.TrimSpace(name) == "" {
 		return ToolCall{}, errors.New("missing tool name")
 	}
-	argsInner, _ := extractTagInner(inner, "args")
+	argsInner, ok := extractTagInner(inner, "args")
+	if !ok && strings.Contains(inner, "<args>") {
+		return ToolCall{}, fmt.Errorf("<args> of %s is not closed with </args>", strings.TrimSpace(name))
+	}
 	argsRaw := parseArgsFirstLevel(argsInner)
 	args := map[string]any{}
 	for k, v := range argsRaw {
@@ -309,9 +668,12 @@ func parseToolCallBlock(block string) (ToolCall, error) {
 
 func parseArgsFirstLevel(argsInner string) map[string]string {
 	out := map[string]string{}
+	// Tags are looked up in a copy with CDATA sections blanked out, so
+	// markup inside them is taken literally.
+	masked := maskCDATA(argsInner)
 	i := 0
 	for {
-		openStart := strings.Index(argsInner[i:], "<")
+		openStart := strings.Index(masked[i:], "<")
 		if openStart < 0 {
 			break
 		}
@@ -319,11 +681,11 @@ func parseArgsFirstLevel(argsInner string) map[string]string {
 		if openStart+1 >= len(argsInner) {
 			break
 		}
-		if argsInner[openStart+1] == '/' {
+		if masked[openStart+1] == '/' {
 			i = openStart + 2
 			continue
 		}
-		openEnd := strings.Index(argsInner[openStart:], ">")
+		openEnd := strings.Index(masked[openStart:], ">")
 		if openEnd < 0 {
 			break
 		}
@@ -336,26 +698,125 @@ func parseArgsFirstLevel(argsInner string) map[string]string {
 			i = openEnd + 1
 			continue
 		}
-		closeStart := strings.Index(argsInner[openEnd+1:], "</"+tagName+">")
+		closeStart := matchingCloseTag(masked, openEnd+1, tagName)
 		if closeStart < 0 {
 			break
 		}
-		closeStart += openEnd + 1
-		out[tagName] = argsInner[openEnd+1 : closeStart]
+		out[tagName] = unwrapCDATA(argsInner[openEnd+1 : closeStart])
 		i = closeStart + len("</"+tagName+">")
 	}
 	return out
 }
 
+const (
+	cdataOpen  = "<![CDATA["
+	cdataClose = "]]>"
+)
+
+// maskCDATA returns s with every complete CDATA section replaced by spaces
+// of the same length.
+func maskCDATA(s string) string {
+	if !strings.Contains(s, cdataOpen) {
+		return s
+	}
+	b := []byte(s)
+	i := 0
+	for {
+		start := strings.Index(s[i:], cdataOpen)
+		if start < 0 {
+			break
+		}
+		start += i
+		end := strings.Index(s[start+len(cdataOpen):], cdataClose)
+		if end < 0 {
+			break
+		}
+		end += start + len(cdataOpen) + len(cdataClose)
+		for j := start; j < end; j++ {
+			b[j] = ' '
+		}
+		i = end
+	}
+	return string(b)
+}
+
+// unwrapCDATA replaces each CDATA section in s with its content. A "]]>"
+// split across two sections, as buildToolCallTranscriptXML writes it, comes
+// back whole.
+func unwrapCDATA(s string) string {
+	if !strings.Contains(s, cdataOpen) {
+		return s
+	}
+	var b strings.Builder
+	i := 0
+	for {
+		start := strings.Index(s[i:], cdataOpen)
+		if start < 0 {
+			break
+		}
+		start += i
+		end := strings.Index(s[start+len(cdataOpen):], cdataClose)
+		if end < 0 {
+			break
+		}
+		end += start + len(cdataOpen)
+		b.WriteString(s[i:start])
+		b.WriteString(s[start+len(cdataOpen) : end])
+		i = end + len(cdataClose)
+	}
+	b.WriteString(s[i:])
+	return b.String()
+}
+
+// matchingCloseTag returns the index of the </tag> that closes an element
+// whose content starts at from, or -1. Identically named tags nested in the
+// content are balanced. A close that is followed by plain text rather than
+// another tag or the end of s is taken to be part of the content (say, a
+// code sample that mentions </tag>) as long as a later </tag> exists.
+func matchingCloseTag(s string, from int, tag string) int {
+	open, close := "<"+tag, "</"+tag+">"
+	depth := 0
+	i := from
+	for {
+		next := strings.Index(s[i:], close)
+		if next < 0 {
+			return -1
+		}
+		next += i
+		// Count nested opens of the same tag before this close.
+		for j := i; ; {
+			k := strings.Index(s[j:next], open)
+			if k < 0 {
+				break
+			}
+			k += j
+			if rest := s[k+len(open):]; rest != "" && (rest[0] == '>' || rest[0] == ' ') {
+				depth++
+			}
+			j = k + len(open)
+		}
+		i = next + len(close)
+		if depth > 0 {
+			depth--
+			continue
+		}
+		after := strings.TrimLeft(s[i:], " \t\r\n")
+		if after == "" || strings.HasPrefix(after, "<") || !strings.Contains(s[i:], close) {
+			return next
+		}
+	}
+}
+
 func extractTagInner(s, tag string) (string, bool) {
 	open := "<" + tag + ">"
 	close := "</" + tag + ">"
-	start := strings.Index(s, open)
+	masked := maskCDATA(s)
+	start := strings.Index(masked, open)
 	if start < 0 {
 		return "", false
 	}
 	start += len(open)
-	end := strings.Index(s[start:], close)
+	end := strings.Index(masked[start:], close)
 	if end < 0 {
 		return "", false
 	}
@@ -419,6 +880,58 @@ func requireStringArg(args map[string]any, key string) (string, error) {
 	return "", fmt.Errorf("arg %s must be a string", key)
 }
 
+// requirePathArg reads a file path argument, accepting either separator.
+func requirePathArg(args map[string]any, key string) (string, error) {
+	path, err := requireStringArg(args, key)
+	if err != nil {
+		return "", err
+	}
+	return fromToolPath(path), nil
+}
+
+// requireStringListArg reads a list of strings given as an array or, as
+// XML tool calls send it, as a JSON array or comma-separated text.
+func requireStringListArg(args map[string]any, key string) ([]string, error) {
+	v, ok := args[key]
+	if !ok || v == nil {
+		return nil, fmt.Errorf("missing required arg: %s", key)
+	}
+	var items []string
+	switch t := v.(type) {
+	case []string:
+		items = t
+	case []any:
+		for _, item := range t {
+			str, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("arg %s must be a list of strings", key)
+			}
+			items = append(items, str)
+		}
+	case string:
+		text := strings.TrimSpace(t)
+		if strings.HasPrefix(text, "[") {
+			if err := json.Unmarshal([]byte(text), &items); err != nil {
+				return nil, fmt.Errorf("arg %s must be a list of strings", key)
+			}
+			break
+		}
+		items = strings.FieldsFunc(text, func(r rune) bool { return r == ',' || r == '\n' })
+	default:
+		return nil, fmt.Errorf("arg %s must be a list of strings", key)
+	}
+	list := make([]string, 0, len(items))
+	for _, item := range items {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("arg %s cannot be empty", key)
+	}
+	return list, nil
+}
+
 func optionalBoolArg(args map[string]any, key string, def bool) (bool, error) {
 	v, ok := args[key]
 	if !ok || v == nil {
@@ -440,16 +953,41 @@ func optionalBoolArg(args map[string]any, key string, def bool) (bool, error) {
 	}
 }
 
+func optionalIntArg(args map[string]any, key string, def int) (int, error) {
+	v, ok := args[key]
+	if !ok || v == nil {
+		return def, nil
+	}
+	switch t := v.(type) {
+	case float64:
+		return int(t), nil
+	case int:
+		return t, nil
+	case string:
+		if strings.TrimSpace(t) == "" {
+			return def, nil
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(t))
+		if err != nil {
+			return def, fmt.Errorf("arg %s must be an integer", key)
+		}
+		return n, nil
+	default:
+		return def, fmt.Errorf("arg %s must be an integer", key)
+	}
+}
+
 type searchFilesTool struct{}
 
 func (t *searchFilesTool) Spec() ToolSpec {
 	return ToolSpec{
 		Name:        "search_files",
-		Description: "Search for files by name.",
+		Description: "Search for files by name. Dotfiles are skipped unless include_hidden is true.",
 		Parameters: map[string]any{
 			"type": "object",
 			"properties": map[string]any{
-				"query": map[string]any{"type": "string"},
+				"query":          map[string]any{"type": "string"},
+				"include_hidden": map[string]any{"type": "boolean"},
 			},
 			"required": []string{"query"},
 			"additionalProperties": false,
@@ -459,14 +997,20 @@ func (t *searchFilesTool) Spec() ToolSpec {
 
 func (t *searchFilesTool) AllowedInPlanMode() bool { return true }
 
+func (t *searchFilesTool) ReadOnly(args map[string]any) bool { return true }
+
 func (t *searchFilesTool) Execute(ctx context.Context, svc *Service, sessionID string, args map[string]any) (string, error) {
 	query, err := requireStringArg(args, "query")
 	if err != nil {
 		return "", err
 	}
+	includeHidden, err := optionalBoolArg(args, "include_hidden", false)
+	if err != nil {
+		return "", err
+	}
 	ctxTool, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
-	files, err := svc.FindFilesByNameContext(ctxTool, query, "", 10)
+	files, err := svc.FindFilesByNameContext(ctxTool, query, "", 10, includeHidden)
 	if err != nil {
 		return "", err
 	}
@@ -492,22 +1036,38 @@ func (t *readFileTool) Spec() ToolSpec {
 
 func (t *readFileTool) AllowedInPlanMode() bool { return true }
 
+func (t *readFileTool) ReadOnly(args map[string]any) bool { return true }
+
 func (t *readFileTool) Execute(ctx context.Context, svc *Service, sessionID string, args map[string]any) (string, error) {
-	path, err := requireStringArg(args, "path")
+	path, err := requirePathArg(args, "path")
 	if err != nil {
 		return "", err
 	}
-	content, err := svc.GetFileContent(path)
+	// Only the head of the file is read, so a huge file never has to fit
+	// in memory.
+	limit := svc.configInt("readFileMaxBytes", defaultReadFileMaxBytes)
+	content, err := svc.GetFileContentRange(path, 0, int64(limit))
 	if err != nil {
 		return "", err
 	}
+	if isBinary, _ := content["isBinary"].(bool); isBinary {
+		return "", fmt.Errorf("%s is a binary file (%v bytes); read_file only returns text. Use run_command with a tool such as `file` or `xxd` to inspect it", path, content["totalSize"])
+	}
 	fileContent, _ := content["content"].(string)
-	if len(fileContent) > 5000 {
-		fileContent = fileContent[:5000] + "... (truncated)"
+	if total, _ := content["totalSize"].(int64); total > int64(len(fileContent)) {
+		fileContent += fmt.Sprintf("\n... (truncated: showing %d of %d bytes; use search_files or run_command with head, tail or sed to see the rest)", len(fileContent), total)
 	}
 	return fileContent, nil
 }
 
+// defaultReadFileMaxBytes is how much of a file read_file returns unless
+// "readFileMaxBytes" is configured.
+const defaultReadFileMaxBytes = 20000
+
+// defaultSaveFileMaxBytes is the largest content save_file writes unless
+// "saveFileMaxBytes" is configured.
+const defaultSaveFileMaxBytes = 1 << 20
+
 type listFilesTool struct{}
 
 func (t *listFilesTool) Spec() ToolSpec {
@@ -527,8 +1087,10 @@ func (t *listFilesTool) Spec() ToolSpec {
 
 func (t *listFilesTool) AllowedInPlanMode() bool { return true }
 
+func (t *listFilesTool) ReadOnly(args map[string]any) bool { return true }
+
 func (t *listFilesTool) Execute(ctx context.Context, svc *Service, sessionID string, args map[string]any) (string, error) {
-	path, err := requireStringArg(args, "path")
+	path, err := requirePathArg(args, "path")
 	if err != nil {
 		return "", err
 	}
@@ -538,81 +1100,649 @@ func (t *listFilesTool) Execute(ctx context.Context, svc *Service, sessionID str
 	}
 	var result []string
 	for _, f := range files {
-		name, _ := f["name"].(string)
+		filePath, _ := f["path"].(string)
 		typ, _ := f["type"].(string)
-		result = append(result, fmt.Sprintf("%s (%s)", name, typ))
+		result = append(result, fmt.Sprintf("%s (%s)", svc.workspaceRel(filePath), typ))
 	}
 	return strings.Join(result, "\n"), nil
 }
 
-type runCommandTool struct{}
+type fileStatTool struct{}
 
-func (t *runCommandTool) Spec() ToolSpec {
+func (t *fileStatTool) Spec() ToolSpec {
 	return ToolSpec{
-		Name:        "run_command",
-		Description: "Execute a shell command.",
+		Name:        "file_stat",
+		Description: "Get a file's line count, size in bytes, last-modified time and language without reading its content.",
 		Parameters: map[string]any{
 			"type": "object",
 			"properties": map[string]any{
-				"command": map[string]any{"type": "string"},
+				"path": map[string]any{"type": "string"},
 			},
-			"required": []string{"command"},
+			"required":             []string{"path"},
 			"additionalProperties": false,
 		},
 	}
 }
 
-func (t *runCommandTool) AllowedInPlanMode() bool { return false }
+func (t *fileStatTool) AllowedInPlanMode() bool { return true }
 
-func (t *runCommandTool) Execute(ctx context.Context, svc *Service, sessionID string, args map[string]any) (string, error) {
-	command, err := requireStringArg(args, "command")
+func (t *fileStatTool) ReadOnly(args map[string]any) bool { return true }
+
+func (t *fileStatTool) Execute(ctx context.Context, svc *Service, sessionID string, args map[string]any) (string, error) {
+	path, err := requirePathArg(args, "path")
 	if err != nil {
 		return "", err
 	}
-	ctxTool, cancel := context.WithTimeout(ctx, 60*time.Second)
-	defer cancel()
-	result, err := svc.RunCommandWithCwdContext(ctxTool, command, "")
+	resolved, err := svc.workspaceFilePath(path)
 	if err != nil {
-		return "", fmt.Errorf("%v\nOutput: %s", err, result.Output)
+		return "", err
 	}
-	return result.Output, nil
+	f, err := os.Open(resolved)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return "", fmt.Errorf("%s is a directory; use list_files instead", path)
+	}
+
+	lines, binary, err := countLines(f)
+	if err != nil {
+		return "", err
+	}
+	language := fileLanguage(path)
+	if language == "" {
+		language = "unknown"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "path: %s\n", svc.workspaceRel(resolved))
+	fmt.Fprintf(&b, "size: %d bytes\n", info.Size())
+	if binary {
+		b.WriteString("lines: n/a (binary file)\n")
+	} else {
+		fmt.Fprintf(&b, "lines: %d\n", lines)
+	}
+	fmt.Fprintf(&b, "modified: %s\n", info.ModTime().Format(time.RFC3339))
+	fmt.Fprintf(&b, "language: %s", language)
+	return b.String(), nil
 }
 
-type saveFileTool struct{}
+// countLines counts the lines in r without holding it in memory; a last
+// line without a trailing newline still counts. binary is set when the
+// start of the content looks binary.
+func countLines(r io.Reader) (lines int, binary bool, err error) {
+	buf := make([]byte, 32*1024)
+	first := true
+	var last byte
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if first {
+				sniff := buf[:n]
+				if len(sniff) > binarySniffSize {
+					sniff = sniff[:binarySniffSize]
+				}
+				if looksBinary(sniff) {
+					return 0, true, nil
+				}
+				first = false
+			}
+			lines += bytes.Count(buf[:n], []byte{'\n'})
+			last = buf[n-1]
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, false, err
+		}
+	}
+	if !first && last != '\n' {
+		lines++
+	}
+	return lines, false, nil
+}
 
-func (t *saveFileTool) Spec() ToolSpec {
+// Limits of the tree tool.
+const (
+	defaultTreeDepth = 3
+	maxTreeDepth     = 10
+	maxTreeNodes     = 500
+)
+
+type treeTool struct{}
+
+func (t *treeTool) Spec() ToolSpec {
 	return ToolSpec{
-		Name:        "save_file",
-		Description: "Save content to a file.",
+		Name:        "tree",
+		Description: "Show the directory tree under path (default the workspace root) down to depth levels (default 3), skipping ignored directories such as node_modules and .git.",
 		Parameters: map[string]any{
 			"type": "object",
 			"properties": map[string]any{
-				"path":    map[string]any{"type": "string"},
-				"content": map[string]any{"type": "string"},
+				"path":  map[string]any{"type": "string"},
+				"depth": map[string]any{"type": "integer"},
 			},
-			"required": []string{"path", "content"},
 			"additionalProperties": false,
 		},
 	}
 }
 
-func (t *saveFileTool) AllowedInPlanMode() bool { return false }
+func (t *treeTool) AllowedInPlanMode() bool { return true }
 
-func (t *saveFileTool) Execute(ctx context.Context, svc *Service, sessionID string, args map[string]any) (string, error) {
-	path, err := requireStringArg(args, "path")
-	if err != nil {
+func (t *treeTool) ReadOnly(args map[string]any) bool { return true }
+
+func (t *treeTool) Execute(ctx context.Context, svc *Service, sessionID string, args map[string]any) (string, error) {
+	path, _ := args["path"].(string)
+	if strings.TrimSpace(path) == "" {
+		path = "."
+	}
+	path = fromToolPath(path)
+	depth, err := optionalIntArg(args, "depth", defaultTreeDepth)
+	if err != nil {
+		return "", err
+	}
+	if depth < 1 {
+		depth = 1
+	}
+	if depth > maxTreeDepth {
+		depth = maxTreeDepth
+	}
+	root, err := svc.workspaceFilePath(path)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", path)
+	}
+
+	r := &treeRenderer{ctx: ctx, ignored: loadIgnoredDirs(root)}
+	r.b.WriteString(svc.workspaceRel(root) + "/\n")
+	r.walk(root, "", depth)
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	out := strings.TrimRight(r.b.String(), "\n")
+	if r.truncated {
+		out += fmt.Sprintf("\n... (truncated at %d entries; use a deeper path or a smaller depth)", maxTreeNodes)
+	}
+	return out, nil
+}
+
+// treeRenderer draws a directory tree with ASCII connectors.
+type treeRenderer struct {
+	ctx       context.Context
+	ignored   map[string]bool // from the root, applied at every level
+	b         strings.Builder
+	nodes     int
+	truncated bool
+}
+
+func (r *treeRenderer) walk(dir string, prefix string, depth int) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	local := loadIgnoredDirs(dir)
+	kept := entries[:0]
+	for _, e := range entries {
+		if e.IsDir() && (r.ignored[e.Name()] || local[e.Name()]) {
+			continue
+		}
+		kept = append(kept, e)
+	}
+	// Directories first, then files, each by name.
+	sort.SliceStable(kept, func(i, j int) bool {
+		if kept[i].IsDir() != kept[j].IsDir() {
+			return kept[i].IsDir()
+		}
+		return kept[i].Name() < kept[j].Name()
+	})
+
+	for i, e := range kept {
+		if r.ctx.Err() != nil {
+			return
+		}
+		if r.nodes >= maxTreeNodes {
+			r.truncated = true
+			return
+		}
+		r.nodes++
+		connector, childPrefix := "|-- ", prefix+"|   "
+		if i == len(kept)-1 {
+			connector, childPrefix = "`-- ", prefix+"    "
+		}
+		name := e.Name()
+		if e.IsDir() {
+			name += "/"
+		}
+		r.b.WriteString(prefix + connector + name + "\n")
+		if e.IsDir() && depth > 1 {
+			r.walk(filepath.Join(dir, e.Name()), childPrefix, depth-1)
+		}
+	}
+}
+
+type runCommandTool struct{}
+
+func (t *runCommandTool) Spec() ToolSpec {
+	return ToolSpec{
+		Name:        "run_command",
+		Description: "Execute a shell command. It runs without a terminal and stdin is empty, so interactive programs (editors, REPLs, prompts such as `npm init` or `git commit` without -m) are refused; times out after 60 seconds. Set background to true for dev servers and watchers: the command keeps running and command_output reads its output or stops it.",
+		Parameters: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"command":    map[string]any{"type": "string"},
+				"background": map[string]any{"type": "boolean"},
+			},
+			"required": []string{"command"},
+			"additionalProperties": false,
+		},
+	}
+}
+
+func (t *runCommandTool) AllowedInPlanMode() bool { return false }
+
+func (t *runCommandTool) ReadOnly(args map[string]any) bool { return false }
+
+// defaultPlanModeCommands are the command prefixes run_command accepts in
+// plan mode unless "planModeCommandPrefixes" is configured.
+var defaultPlanModeCommands = []string{
+	"ls", "pwd", "cat", "head", "tail", "wc", "grep", "find", "tree",
+	"git status", "git log", "git diff", "git show", "git blame",
+}
+
+// planModeDeniedArgs are flags that make otherwise read-only commands write
+// files or run other programs.
+var planModeDeniedArgs = map[string]bool{
+	"-exec": true, "-execdir": true, "-ok": true, "-okdir": true, "-delete": true,
+	"-fprint": true, "-fprint0": true, "-fprintf": true, "-fls": true,
+}
+
+// planModeDeniedShortFlags are single-letter flags, alone or in a cluster,
+// that make a read-only command write files: tree -o writes its listing to
+// a file and -R writes one into each directory.
+var planModeDeniedShortFlags = map[string]string{
+	"tree": "oR",
+}
+
+// AllowedInPlanModeFor permits single commands starting with one of the
+// read-only prefixes. Anything chaining, redirecting or substituting
+// commands is refused.
+func (t *runCommandTool) AllowedInPlanModeFor(svc *Service, args map[string]any) bool {
+	command, _ := args["command"].(string)
+	command = strings.TrimSpace(command)
+	if command == "" || strings.ContainsAny(command, ";&|<>`$\n\r") {
+		return false
+	}
+	if background, err := optionalBoolArg(args, "background", false); err != nil || background {
+		return false
+	}
+	fields := strings.Fields(command)
+	for _, f := range fields {
+		if planModeDeniedArgs[f] || strings.HasPrefix(f, "--output") {
+			return false
+		}
+	}
+	if short, ok := planModeDeniedShortFlags[fields[0]]; ok && hasFlag(fields[1:], short) {
+		return false
+	}
+
+	prefixes := defaultPlanModeCommands
+	if configured, ok := svc.configValue("planModeCommandPrefixes").([]interface{}); ok {
+		prefixes = []string{}
+		for _, p := range configured {
+			if str, ok := p.(string); ok && strings.TrimSpace(str) != "" {
+				prefixes = append(prefixes, str)
+			}
+		}
+	}
+	normalized := strings.Join(fields, " ")
+	for _, prefix := range prefixes {
+		prefix = strings.Join(strings.Fields(prefix), " ")
+		if normalized == prefix || strings.HasPrefix(normalized, prefix+" ") {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *runCommandTool) Execute(ctx context.Context, svc *Service, sessionID string, args map[string]any) (string, error) {
+	command, err := requireStringArg(args, "command")
+	if err != nil {
+		return "", err
+	}
+	if reason := interactiveCommandReason(command); reason != "" {
+		return "", fmt.Errorf("interactive commands are not supported: %s", reason)
+	}
+	background, err := optionalBoolArg(args, "background", false)
+	if err != nil {
+		return "", err
+	}
+	if background {
+		handle, err := svc.StartBackgroundCommand(command, "")
+		if err != nil {
+			return "", err
+		}
+		b, err := svc.backgroundCommand(handle)
+		if err != nil {
+			return "", err
+		}
+		b.waitForOutput(ctx, 0, backgroundStartupWait)
+		out, err := svc.GetBackgroundCommandOutput(handle)
+		if err != nil {
+			return "", err
+		}
+		return formatBackgroundOutput(out), nil
+	}
+	ctxTool, cancel := context.WithTimeout(ctx, 60*time.Second)
+	defer cancel()
+	result, err := svc.RunCommandWithCwdContext(ctxTool, command, "")
+	if err != nil {
+		return "", fmt.Errorf("%v\nOutput: %s", err, result.Output)
+	}
+	return result.Output, nil
+}
+
+type commandOutputTool struct{}
+
+func (t *commandOutputTool) Spec() ToolSpec {
+	return ToolSpec{
+		Name:        "command_output",
+		Description: "Read the new output of a command started with run_command background=true, given its handle. Set input to answer a prompt such as a y/n question (a newline is added); full-screen programs and password prompts are not supported. Set stop to true to stop the command and everything it started.",
+		Parameters: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"handle": map[string]any{"type": "string"},
+				"input":  map[string]any{"type": "string"},
+				"stop":   map[string]any{"type": "boolean"},
+			},
+			"required":             []string{"handle"},
+			"additionalProperties": false,
+		},
+	}
+}
+
+func (t *commandOutputTool) AllowedInPlanMode() bool { return false }
+
+// AllowedInPlanModeFor permits reading output; sending input or stopping a
+// command is refused.
+func (t *commandOutputTool) AllowedInPlanModeFor(svc *Service, args map[string]any) bool {
+	return t.ReadOnly(args)
+}
+
+func (t *commandOutputTool) ReadOnly(args map[string]any) bool {
+	stop, err := optionalBoolArg(args, "stop", false)
+	input, _ := args["input"].(string)
+	return err == nil && !stop && input == ""
+}
+
+func (t *commandOutputTool) Execute(ctx context.Context, svc *Service, sessionID string, args map[string]any) (string, error) {
+	handle, err := requireStringArg(args, "handle")
+	if err != nil {
+		return "", err
+	}
+	stop, err := optionalBoolArg(args, "stop", false)
+	if err != nil {
+		return "", err
+	}
+	if input, _ := args["input"].(string); input != "" && !stop {
+		b, err := svc.backgroundCommand(handle)
+		if err != nil {
+			return "", err
+		}
+		since := b.writtenBytes()
+		if err := svc.SendCommandInput(handle, input); err != nil {
+			return "", err
+		}
+		b.waitForOutput(ctx, since, backgroundStartupWait)
+	}
+	var out BackgroundCommandOutput
+	if stop {
+		out, err = svc.StopBackgroundCommand(handle)
+	} else {
+		out, err = svc.GetBackgroundCommandOutput(handle)
+	}
+	if err != nil {
+		return "", err
+	}
+	return formatBackgroundOutput(out), nil
+}
+
+type saveFileTool struct{}
+
+func (t *saveFileTool) Spec() ToolSpec {
+	return ToolSpec{
+		Name:        "save_file",
+		Description: "Save content to a file.",
+		Parameters: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"path":    map[string]any{"type": "string"},
+				"content": map[string]any{"type": "string"},
+			},
+			"required": []string{"path", "content"},
+			"additionalProperties": false,
+		},
+	}
+}
+
+func (t *saveFileTool) AllowedInPlanMode() bool { return false }
+
+func (t *saveFileTool) ReadOnly(args map[string]any) bool { return false }
+
+func (t *saveFileTool) MutatedPaths(args map[string]any) []string {
+	if path, ok := args["path"].(string); ok && path != "" {
+		return []string{path}
+	}
+	return nil
+}
+
+func (t *saveFileTool) Execute(ctx context.Context, svc *Service, sessionID string, args map[string]any) (string, error) {
+	path, err := requirePathArg(args, "path")
+	if err != nil {
 		return "", err
 	}
 	content, err := requireStringArg(args, "content")
 	if err != nil {
 		return "", err
 	}
-	if err := svc.SaveFileContent(path, content); err != nil {
+	if limit := svc.configInt("saveFileMaxBytes", defaultSaveFileMaxBytes); len(content) > limit {
+		return "", fmt.Errorf("content is %d bytes, over the save_file limit of %d bytes; split it into several smaller files, or generate large files with run_command", len(content), limit)
+	}
+	if err := svc.saveFileContent(sessionID, path, content, ""); err != nil {
 		return "", err
 	}
 	return "File saved successfully", nil
 }
 
+type moveFileTool struct{}
+
+func (t *moveFileTool) Spec() ToolSpec {
+	return ToolSpec{
+		Name:        "move_file",
+		Description: "Move or rename a file or directory within the workspace. Refuses to replace an existing destination unless overwrite is true.",
+		Parameters: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"source":      map[string]any{"type": "string"},
+				"destination": map[string]any{"type": "string"},
+				"overwrite":   map[string]any{"type": "boolean"},
+			},
+			"required":             []string{"source", "destination"},
+			"additionalProperties": false,
+		},
+	}
+}
+
+func (t *moveFileTool) AllowedInPlanMode() bool { return false }
+
+func (t *moveFileTool) ReadOnly(args map[string]any) bool { return false }
+
+func (t *moveFileTool) MutatedPaths(args map[string]any) []string {
+	paths := []string{}
+	for _, key := range []string{"source", "destination"} {
+		if path, ok := args[key].(string); ok && path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+func (t *moveFileTool) Execute(ctx context.Context, svc *Service, sessionID string, args map[string]any) (string, error) {
+	source, err := requirePathArg(args, "source")
+	if err != nil {
+		return "", err
+	}
+	destination, err := requirePathArg(args, "destination")
+	if err != nil {
+		return "", err
+	}
+	overwrite, err := optionalBoolArg(args, "overwrite", false)
+	if err != nil {
+		return "", err
+	}
+	if err := svc.moveFile(sessionID, source, destination, overwrite); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Moved %s to %s", svc.workspaceRel(source), svc.workspaceRel(destination)), nil
+}
+
+type makeDirTool struct{}
+
+func (t *makeDirTool) Spec() ToolSpec {
+	return ToolSpec{
+		Name:        "make_dir",
+		Description: "Create a directory, including missing parents, within the workspace.",
+		Parameters: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"path": map[string]any{"type": "string"},
+			},
+			"required":             []string{"path"},
+			"additionalProperties": false,
+		},
+	}
+}
+
+func (t *makeDirTool) AllowedInPlanMode() bool { return false }
+
+func (t *makeDirTool) ReadOnly(args map[string]any) bool { return false }
+
+func (t *makeDirTool) MutatedPaths(args map[string]any) []string {
+	if path, ok := args["path"].(string); ok && path != "" {
+		return []string{path}
+	}
+	return nil
+}
+
+func (t *makeDirTool) Execute(ctx context.Context, svc *Service, sessionID string, args map[string]any) (string, error) {
+	path, err := requirePathArg(args, "path")
+	if err != nil {
+		return "", err
+	}
+	if err := svc.makeDir(path); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Directory created: %s", svc.workspaceRel(path)), nil
+}
+
+type findDefinitionTool struct{}
+
+func (t *findDefinitionTool) Spec() ToolSpec {
+	return ToolSpec{
+		Name:        "find_definition",
+		Description: "Find where a symbol (function, type, class, variable) is defined. Returns the single best file:line.",
+		Parameters: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"symbol": map[string]any{"type": "string"},
+			},
+			"required":             []string{"symbol"},
+			"additionalProperties": false,
+		},
+	}
+}
+
+func (t *findDefinitionTool) AllowedInPlanMode() bool { return true }
+
+func (t *findDefinitionTool) ReadOnly(args map[string]any) bool { return true }
+
+func (t *findDefinitionTool) Execute(ctx context.Context, svc *Service, sessionID string, args map[string]any) (string, error) {
+	symbol, err := requireStringArg(args, "symbol")
+	if err != nil {
+		return "", err
+	}
+	ctxTool, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	loc, candidates, err := svc.FindDefinition(ctxTool, symbol)
+	if err != nil {
+		return "", err
+	}
+	out := fmt.Sprintf("%s:%d: %s (%s)", loc.File, loc.Line, loc.Text, loc.Kind)
+	if candidates > 1 {
+		out += fmt.Sprintf("\n(%d other candidate definitions ranked lower)", candidates-1)
+	}
+	return out, nil
+}
+
+type findReferencesTool struct{}
+
+func (t *findReferencesTool) Spec() ToolSpec {
+	return ToolSpec{
+		Name:        "find_references",
+		Description: "Find where a symbol is used (whole identifiers only). Returns file:line:column and the line text, definitions first.",
+		Parameters: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"symbol": map[string]any{"type": "string"},
+				"limit":  map[string]any{"type": "integer"},
+			},
+			"required":             []string{"symbol"},
+			"additionalProperties": false,
+		},
+	}
+}
+
+func (t *findReferencesTool) AllowedInPlanMode() bool { return true }
+
+func (t *findReferencesTool) ReadOnly(args map[string]any) bool { return true }
+
+func (t *findReferencesTool) Execute(ctx context.Context, svc *Service, sessionID string, args map[string]any) (string, error) {
+	symbol, err := requireStringArg(args, "symbol")
+	if err != nil {
+		return "", err
+	}
+	limit, err := optionalIntArg(args, "limit", defaultReferenceLimit)
+	if err != nil {
+		return "", err
+	}
+	ctxTool, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	refs, total, err := svc.FindReferences(ctxTool, symbol, limit)
+	if err != nil {
+		return "", err
+	}
+	if total == 0 {
+		return fmt.Sprintf("No references to %s found", symbol), nil
+	}
+	var b strings.Builder
+	for _, ref := range refs {
+		fmt.Fprintf(&b, "%s:%d:%d: %s\n", ref.File, ref.Line, ref.Column, ref.Text)
+	}
+	if total > len(refs) {
+		fmt.Fprintf(&b, "... %d more references omitted\n", total-len(refs))
+	}
+	return strings.TrimRight(b.String(), "\n"), nil
+}
+
 type gitStatusTool struct{}
 
 func (t *gitStatusTool) Spec() ToolSpec {
@@ -629,6 +1759,8 @@ func (t *gitStatusTool) Spec() ToolSpec {
 
 func (t *gitStatusTool) AllowedInPlanMode() bool { return true }
 
+func (t *gitStatusTool) ReadOnly(args map[string]any) bool { return true }
+
 func (t *gitStatusTool) Execute(ctx context.Context, svc *Service, sessionID string, args map[string]any) (string, error) {
 	ctxTool, cancel := context.WithTimeout(ctx, 15*time.Second)
 	defer cancel()
@@ -661,6 +1793,8 @@ func (t *gitDiffTool) Spec() ToolSpec {
 
 func (t *gitDiffTool) AllowedInPlanMode() bool { return true }
 
+func (t *gitDiffTool) ReadOnly(args map[string]any) bool { return true }
+
 func (t *gitDiffTool) Execute(ctx context.Context, svc *Service, sessionID string, args map[string]any) (string, error) {
 	staged, err := optionalBoolArg(args, "staged", false)
 	if err != nil {
@@ -688,14 +1822,16 @@ type manageTodoTool struct{}
 func (t *manageTodoTool) Spec() ToolSpec {
 	return ToolSpec{
 		Name:        "manage_todo",
-		Description: "Manage session todo list.",
+		Description: "Manage session todo list. update changes a todo's status and/or priority; reorder takes the todo IDs in their new order; clear_completed removes the completed ones.",
 		Parameters: map[string]any{
 			"type": "object",
 			"properties": map[string]any{
-				"action":  map[string]any{"type": "string", "enum": []string{"add", "update", "delete", "list"}},
-				"content": map[string]any{"type": "string"},
-				"id":      map[string]any{"type": "string"},
-				"status":  map[string]any{"type": "string", "enum": []string{"pending", "in_progress", "completed"}},
+				"action":   map[string]any{"type": "string", "enum": []string{"add", "update", "delete", "list", "reorder", "clear_completed"}},
+				"content":  map[string]any{"type": "string"},
+				"id":       map[string]any{"type": "string"},
+				"status":   map[string]any{"type": "string", "enum": todoStatuses},
+				"priority": map[string]any{"type": "string", "enum": todoPriorities},
+				"ids":      map[string]any{"type": "array", "items": map[string]any{"type": "string"}},
 			},
 			"required": []string{"action"},
 			"additionalProperties": false,
@@ -705,33 +1841,34 @@ func (t *manageTodoTool) Spec() ToolSpec {
 
 func (t *manageTodoTool) AllowedInPlanMode() bool { return true }
 
+func (t *manageTodoTool) ReadOnly(args map[string]any) bool {
+	action, _ := args["action"].(string)
+	return action == "list"
+}
+
 func (t *manageTodoTool) Execute(ctx context.Context, svc *Service, sessionID string, args map[string]any) (string, error) {
 	action, err := requireStringArg(args, "action")
 	if err != nil {
 		return "", err
 	}
-	session, err := svc.GetSession(sessionID)
-	if err != nil {
-		return "", errors.New("session not found")
-	}
-	todos := session.Todos
-	if todos == nil {
-		todos = []TodoItem{}
-	}
 	switch action {
 	case "add":
 		content, err := requireStringArg(args, "content")
 		if err != nil {
 			return "", err
 		}
-		newTodo := TodoItem{
-			ID:       fmt.Sprintf("todo_%d", time.Now().UnixNano()),
-			Content:  content,
-			Status:   "pending",
-			Priority: "medium",
+		var newTodo TodoItem
+		if _, err := svc.modifySessionTodos(sessionID, func(todos []TodoItem) ([]TodoItem, error) {
+			newTodo = TodoItem{
+				ID:       newTodoID(todos),
+				Content:  content,
+				Status:   "pending",
+				Priority: "medium",
+			}
+			return append(todos, newTodo), nil
+		}); err != nil {
+			return "", err
 		}
-		todos = append(todos, newTodo)
-		svc.UpdateSessionTodos(sessionID, todos)
 		return fmt.Sprintf("Todo added: %s (ID: %s)", content, newTodo.ID), nil
 	case "update":
 		id, err := requireStringArg(args, "id")
@@ -740,56 +1877,88 @@ func (t *manageTodoTool) Execute(ctx context.Context, svc *Service, sessionID st
 		}
 		statusAny, hasStatus := args["status"]
 		status, _ := statusAny.(string)
-		found := false
-		for i, t := range todos {
-			if t.ID == id {
-				if hasStatus && strings.TrimSpace(status) != "" {
-					todos[i].Status = status
-				}
-				found = true
-				break
-			}
+		status = strings.TrimSpace(status)
+		if hasStatus && status != "" && !validTodoStatus(status) {
+			return "", fmt.Errorf("invalid status %q: use %s", status, strings.Join(todoStatuses, ", "))
+		}
+		priority, _ := args["priority"].(string)
+		priority = strings.TrimSpace(priority)
+		if priority != "" && !validTodoPriority(priority) {
+			return "", fmt.Errorf("invalid priority %q: use %s", priority, strings.Join(todoPriorities, ", "))
 		}
-		if !found {
-			return "", fmt.Errorf("todo %s not found", id)
+		if _, err := svc.modifySessionTodos(sessionID, func(todos []TodoItem) ([]TodoItem, error) {
+			i := todoIndex(todos, id)
+			if i < 0 {
+				return nil, fmt.Errorf("todo %s not found", id)
+			}
+			if hasStatus && status != "" {
+				todos[i].Status = status
+			}
+			if priority != "" {
+				todos[i].Priority = priority
+			}
+			return todos, nil
+		}); err != nil {
+			return "", err
 		}
-		svc.UpdateSessionTodos(sessionID, todos)
 		return fmt.Sprintf("Todo updated: %s", id), nil
 	case "delete":
 		id, err := requireStringArg(args, "id")
 		if err != nil {
 			return "", err
 		}
-		newTodos := []TodoItem{}
-		found := false
-		for _, t := range todos {
-			if t.ID != id {
-				newTodos = append(newTodos, t)
-			} else {
-				found = true
+		if _, err := svc.modifySessionTodos(sessionID, func(todos []TodoItem) ([]TodoItem, error) {
+			i := todoIndex(todos, id)
+			if i < 0 {
+				return nil, fmt.Errorf("todo %s not found", id)
 			}
+			return append(todos[:i], todos[i+1:]...), nil
+		}); err != nil {
+			return "", err
 		}
-		if !found {
-			return "", fmt.Errorf("todo %s not found", id)
-		}
-		svc.UpdateSessionTodos(sessionID, newTodos)
 		return fmt.Sprintf("Todo deleted: %s", id), nil
+	case "reorder":
+		ids, err := requireStringListArg(args, "ids")
+		if err != nil {
+			return "", err
+		}
+		if _, err := svc.modifySessionTodos(sessionID, func(todos []TodoItem) ([]TodoItem, error) {
+			return reorderTodos(todos, ids)
+		}); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Todos reordered: %s", strings.Join(ids, ", ")), nil
 	case "list":
+		todos, err := svc.sessionTodos(sessionID)
+		if err != nil {
+			return "", err
+		}
 		if len(todos) == 0 {
 			return "No todos in this session.", nil
 		}
 		var list []string
 		for _, t := range todos {
-			icon := "[ ]"
-			if t.Status == "completed" {
-				icon = "[x]"
-			} else if t.Status == "in_progress" {
-				icon = "[/]"
+			list = append(list, todoLine(t))
+		}
+		return todoProgress(todos) + "\n" + strings.Join(list, "\n"), nil
+	case "clear_completed":
+		removed := 0
+		todos, err := svc.modifySessionTodos(sessionID, func(todos []TodoItem) ([]TodoItem, error) {
+			kept := make([]TodoItem, 0, len(todos))
+			for _, t := range todos {
+				if t.Status == "completed" {
+					removed++
+					continue
+				}
+				kept = append(kept, t)
 			}
-			list = append(list, fmt.Sprintf("%s %s (ID: %s)", icon, t.Content, t.ID))
+			return kept, nil
+		})
+		if err != nil {
+			return "", err
 		}
-		return strings.Join(list, "\n"), nil
+		return fmt.Sprintf("Cleared %d completed todos; %d remaining.", removed, len(todos)), nil
 	default:
-		return "", errors.New("unknown action. Use add, update, delete, or list.")
+		return "", errors.New("unknown action. Use add, update, delete, list, reorder, or clear_completed.")
 	}
 }
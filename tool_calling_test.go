@@ -1,6 +1,16 @@
 package main
 
-import "testing"
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"unicode/utf8"
+)
 
 func TestParseToolCallBlock_Basic(t *testing.T) {
 	block := `<tool_call>
@@ -39,6 +49,109 @@ func TestParseToolCallBlock_ContentContainsTags(t *testing.T) {
 	}
 }
 
+func TestParseArgsFirstLevel_ContentEmbedsItsOwnCloseTag(t *testing.T) {
+	cases := []struct {
+		args string
+		want string
+	}{
+		// A code sample that mentions the closing tag.
+		{`<path>gen.py</path><content>print("</content>")
+done</content>`, "print(\"</content>\")\ndone"},
+		// Balanced nested tags of the same name.
+		{`<content><content>inner</content></content><path>gen.py</path>`, "<content>inner</content>"},
+		{`<content>plain</content><path>gen.py</path>`, "plain"},
+	}
+	for _, c := range cases {
+		args := parseArgsFirstLevel(c.args)
+		if args["content"] != c.want {
+			t.Errorf("parseArgsFirstLevel(%q) content = %q, want %q", c.args, args["content"], c.want)
+		}
+		if args["path"] != "gen.py" {
+			t.Errorf("parseArgsFirstLevel(%q) path = %q, want gen.py", c.args, args["path"])
+		}
+	}
+}
+
+func TestToolCallTranscript_RoundTripsCDATA(t *testing.T) {
+	content := "if a < b && c > d {\n\treturn \"</content></args></tool_call>]]>\"\n}"
+	transcript := buildToolCallTranscriptXML([]ToolCall{{
+		Name: "save_file",
+		Args: map[string]any{"path": "main.go", "content": content},
+	}})
+	if !strings.Contains(transcript, "<![CDATA[") {
+		t.Fatalf("expected the content to be wrapped in CDATA, got %s", transcript)
+	}
+
+	calls, err := parseXMLToolCallsFromText(transcript)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(calls) != 1 || calls[0].Name != "save_file" {
+		t.Fatalf("unexpected calls: %+v", calls)
+	}
+	if calls[0].Args["content"] != content {
+		t.Fatalf("content did not round-trip:\n got %q\nwant %q", calls[0].Args["content"], content)
+	}
+	if calls[0].Args["path"] != "main.go" {
+		t.Fatalf("expected path main.go, got %#v", calls[0].Args["path"])
+	}
+}
+
+func TestParseXMLToolCallsFromText_AlternativeForms(t *testing.T) {
+	cases := map[string]string{
+		"json line":     "I'll read it.\n{\"tool\": \"read_file\", \"args\": {\"path\": \"a.go\"}}",
+		"tool_code":     "```tool_code\n{\"name\": \"read_file\", \"arguments\": {\"path\": \"a.go\"}}\n```",
+		"json fence":    "```json\n{\"tool\": \"read_file\", \"parameters\": {\"path\": \"a.go\"}}\n```",
+		"function_call": "<function_call>{\"name\": \"read_file\", \"arguments\": \"{\\\"path\\\": \\\"a.go\\\"}\"}</function_call>",
+	}
+	for name, text := range cases {
+		calls, err := parseXMLToolCallsFromText(text)
+		if err != nil {
+			t.Fatalf("%s: expected no error, got %v", name, err)
+		}
+		if len(calls) != 1 || calls[0].Name != "read_file" || calls[0].Args["path"] != "a.go" {
+			t.Fatalf("%s: unexpected calls %+v", name, calls)
+		}
+	}
+
+	for _, text := range []string{
+		"```json\n{\"name\": \"openspace\", \"version\": 1}\n```",
+		"{\"tool\": \"rm_rf\", \"args\": {}}",
+		"```go\n{\"tool\": \"read_file\", \"args\": {\"path\": \"a.go\"}}\n```",
+		"```json\n{\"name\": \"git_status\", \"description\": \"shows changes\"}\n```",
+		"The tool is configured as:\n{\"name\": \"git_status\"}",
+	} {
+		if calls, _ := parseXMLToolCallsFromText(text); len(calls) != 0 {
+			t.Fatalf("expected no calls from %q, got %+v", text, calls)
+		}
+	}
+
+	// The tool call fences are explicit enough without arguments.
+	if calls, _ := parseXMLToolCallsFromText("```tool_code\n{\"name\": \"git_status\"}\n```"); len(calls) != 1 || calls[0].Name != "git_status" {
+		t.Fatalf("expected the tool_code call without arguments, got %+v", calls)
+	}
+
+	// <tool_call> stays primary when both forms appear.
+	text := "<tool_call><name>git_status</name><args></args></tool_call>\n{\"tool\": \"read_file\", \"args\": {\"path\": \"a.go\"}}"
+	if calls, _ := parseXMLToolCallsFromText(text); len(calls) != 1 || calls[0].Name != "git_status" {
+		t.Fatalf("expected only the <tool_call> block, got %+v", calls)
+	}
+}
+
+func TestMalformedToolCall(t *testing.T) {
+	text := `<tool_call><name>read_file</name><args><path>a.txt</path></tool_call>`
+	calls, err := parseXMLToolCallsFromText(text)
+	if reason, ok := malformedToolCall(text, calls, err); !ok || !strings.Contains(reason, "</args>") {
+		t.Fatalf("expected the unclosed args to be reported, got %q %v", reason, ok)
+	}
+
+	text = "no tools needed, just an answer"
+	calls, err = parseXMLToolCallsFromText(text)
+	if _, ok := malformedToolCall(text, calls, err); ok {
+		t.Fatalf("plain text should not be treated as a malformed call")
+	}
+}
+
 func TestParseXMLToolCallsFromText_Multiple(t *testing.T) {
 	text := `hello
 <tool_call><name>search_files</name><args><query>main</query></args></tool_call>
@@ -131,3 +244,701 @@ func TestParseOpenAIToolCalls_ToolCallsSliceMap(t *testing.T) {
 		t.Fatalf("expected query main, got %#v", calls[0].Args["query"])
 	}
 }
+
+func TestExecuteToolCall_ReviewModeRefusesSaveFile(t *testing.T) {
+	tmp := t.TempDir()
+	s := &Service{workspaceDir: tmp}
+
+	res := executeToolCall(context.Background(), s, newToolRegistry(), "s1", ToolCall{
+		Name: "save_file",
+		Args: map[string]any{"path": "a.txt", "content": "hello"},
+	}, agentModeReview)
+	if !res.IsError {
+		t.Fatalf("expected save_file to be refused in review mode, got %q", res.Content)
+	}
+	if !strings.Contains(res.Content, "REVIEW mode") {
+		t.Fatalf("unexpected error content: %q", res.Content)
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "a.txt")); !os.IsNotExist(err) {
+		t.Fatalf("expected file not to be written, stat err: %v", err)
+	}
+}
+
+func TestExecuteToolCall_ReviewModeAllowsReads(t *testing.T) {
+	tmp := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmp, "a.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatalf("failed to write fixture: %v", err)
+	}
+	s := &Service{workspaceDir: tmp}
+
+	res := executeToolCall(context.Background(), s, newToolRegistry(), "s1", ToolCall{
+		Name: "read_file",
+		Args: map[string]any{"path": "a.txt"},
+	}, agentModeReview)
+	if res.IsError {
+		t.Fatalf("expected read_file to run in review mode, got %q", res.Content)
+	}
+
+	res = executeToolCall(context.Background(), s, newToolRegistry(), "s1", ToolCall{
+		Name: "manage_todo",
+		Args: map[string]any{"action": "add", "content": "x"},
+	}, agentModeReview)
+	if !res.IsError {
+		t.Fatalf("expected todo mutation to be refused in review mode")
+	}
+}
+
+func TestParseAgentMode(t *testing.T) {
+	cases := map[string]agentMode{
+		"[MODE: PLAN] do it":   agentModePlan,
+		"[MODE: REVIEW] check": agentModeReview,
+		"just do it":           agentModeAct,
+	}
+	for msg, want := range cases {
+		if got := parseAgentMode(msg); got != want {
+			t.Fatalf("parseAgentMode(%q) = %q, want %q", msg, got, want)
+		}
+	}
+}
+
+func TestToolRegistry_RestrictedToRejectsOtherTools(t *testing.T) {
+	registry := newToolRegistry().restrictedTo([]string{"read_file", "list_files"})
+
+	if got := registry.Names(); strings.Join(got, ",") != "list_files,read_file" {
+		t.Fatalf("unexpected tools: %v", got)
+	}
+	res := executeToolCall(context.Background(), &Service{}, registry, "s1", ToolCall{
+		Name: "save_file",
+		Args: map[string]any{"path": "x.txt", "content": "x"},
+	}, agentModeAct)
+	if !res.IsError || !strings.Contains(res.Content, "Unknown tool") {
+		t.Fatalf("expected save_file to be rejected, got %+v", res)
+	}
+}
+
+func TestGetToolSpecs_ListsRegistry(t *testing.T) {
+	tools, err := (&Service{}).GetToolSpecs()
+	if err != nil {
+		t.Fatalf("GetToolSpecs: %v", err)
+	}
+	if len(tools) != len(newToolRegistry().Names()) {
+		t.Fatalf("expected every registered tool, got %d", len(tools))
+	}
+	byName := map[string]map[string]interface{}{}
+	for _, tool := range tools {
+		byName[tool["name"].(string)] = tool
+	}
+	if byName["read_file"]["allowedInPlanMode"] != true || byName["save_file"]["allowedInPlanMode"] != false {
+		t.Fatalf("unexpected plan mode flags: %v / %v", byName["read_file"], byName["save_file"])
+	}
+	if _, ok := byName["read_file"]["parameters"].(map[string]any); !ok {
+		t.Fatalf("expected a parameter schema, got %v", byName["read_file"])
+	}
+}
+
+func TestReadFileTool_TruncatesOnRuneBoundary(t *testing.T) {
+	tmp := t.TempDir()
+	// 3-byte runes, so a 10-byte limit falls inside the fourth one.
+	content := strings.Repeat("文", 100)
+	if err := os.WriteFile(filepath.Join(tmp, "cjk.txt"), []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write fixture: %v", err)
+	}
+	s := &Service{workspaceDir: tmp, config: map[string]interface{}{"readFileMaxBytes": float64(10)}}
+
+	res := executeToolCall(context.Background(), s, newToolRegistry(), "s1", ToolCall{
+		Name: "read_file",
+		Args: map[string]any{"path": "cjk.txt"},
+	}, agentModeAct)
+	if res.IsError {
+		t.Fatalf("unexpected error: %q", res.Content)
+	}
+	if !utf8.ValidString(res.Content) {
+		t.Fatalf("output is not valid UTF-8: %q", res.Content)
+	}
+	if !strings.HasPrefix(res.Content, "文文文\n") {
+		t.Fatalf("expected three whole runes, got %q", res.Content)
+	}
+	if !strings.Contains(res.Content, "showing 9 of 300 bytes") {
+		t.Fatalf("expected truncation report, got %q", res.Content)
+	}
+}
+
+func TestSaveFileTool_RejectsOversizedContent(t *testing.T) {
+	tmp := t.TempDir()
+	s := &Service{workspaceDir: tmp, config: map[string]interface{}{"saveFileMaxBytes": float64(16)}}
+
+	res := executeToolCall(context.Background(), s, newToolRegistry(), "s1", ToolCall{
+		Name: "save_file",
+		Args: map[string]any{"path": "big.txt", "content": strings.Repeat("x", 17)},
+	}, agentModeAct)
+	if !res.IsError || !strings.Contains(res.Content, "over the save_file limit of 16 bytes") {
+		t.Fatalf("expected oversized content to be rejected, got %+v", res)
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "big.txt")); !os.IsNotExist(err) {
+		t.Fatalf("expected file not to be written, stat err: %v", err)
+	}
+
+	res = executeToolCall(context.Background(), s, newToolRegistry(), "s1", ToolCall{
+		Name: "save_file",
+		Args: map[string]any{"path": "small.txt", "content": strings.Repeat("x", 16)},
+	}, agentModeAct)
+	if res.IsError {
+		t.Fatalf("expected content at the limit to be saved, got %q", res.Content)
+	}
+}
+
+func TestFileStatTool_ReportsLinesAndLanguage(t *testing.T) {
+	tmp := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmp, "main.go"), []byte("package main\n\nfunc main() {}"), 0644); err != nil {
+		t.Fatalf("failed to write fixture: %v", err)
+	}
+	s := &Service{workspaceDir: tmp}
+
+	res := executeToolCall(context.Background(), s, newToolRegistry(), "s1", ToolCall{
+		Name: "file_stat",
+		Args: map[string]any{"path": "main.go"},
+	}, agentModePlan)
+	if res.IsError {
+		t.Fatalf("unexpected error: %q", res.Content)
+	}
+	for _, want := range []string{"size: 28 bytes", "lines: 3", "language: go", "modified: "} {
+		if !strings.Contains(res.Content, want) {
+			t.Fatalf("expected %q in %q", want, res.Content)
+		}
+	}
+
+	res = executeToolCall(context.Background(), s, newToolRegistry(), "s1", ToolCall{
+		Name: "file_stat",
+		Args: map[string]any{"path": "../outside.txt"},
+	}, agentModePlan)
+	if !res.IsError || !strings.Contains(res.Content, "outside the workspace") {
+		t.Fatalf("expected paths outside the workspace to be refused, got %+v", res)
+	}
+}
+
+func TestTreeTool_RendersIndentedTree(t *testing.T) {
+	tmp := t.TempDir()
+	for _, f := range []string{"README.md", "cmd/app/main.go", "cmd/app/deep/x.go", "node_modules/pkg/index.js"} {
+		path := filepath.Join(tmp, f)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &Service{workspaceDir: tmp}
+
+	res := executeToolCall(context.Background(), s, newToolRegistry(), "s1", ToolCall{
+		Name: "tree",
+		Args: map[string]any{"depth": float64(2)},
+	}, agentModePlan)
+	if res.IsError {
+		t.Fatalf("unexpected error: %q", res.Content)
+	}
+	want := "./\n" +
+		"|-- cmd/\n" +
+		"|   `-- app/\n" +
+		"`-- README.md"
+	if res.Content != want {
+		t.Fatalf("unexpected tree:\n%s\nwant:\n%s", res.Content, want)
+	}
+}
+
+func TestTruncateHelpers_MultibyteInput(t *testing.T) {
+	cases := []struct {
+		in    string
+		bytes int
+		runes int
+		wantB string
+		wantR string
+	}{
+		{"你好世界", 7, 3, "你好", "你好世"},
+		{"😀😃😄", 5, 2, "😀", "😀😃"},
+		{"ab你😀", 4, 3, "ab", "ab你"},
+		{"short", 10, 10, "short", "short"},
+	}
+	for _, c := range cases {
+		if got := truncateUTF8(c.in, c.bytes); got != c.wantB || !utf8.ValidString(got) {
+			t.Errorf("truncateUTF8(%q, %d) = %q, want %q", c.in, c.bytes, got, c.wantB)
+		}
+		if got := truncateRunes(c.in, c.runes); got != c.wantR || !utf8.ValidString(got) {
+			t.Errorf("truncateRunes(%q, %d) = %q, want %q", c.in, c.runes, got, c.wantR)
+		}
+	}
+}
+
+func TestManageTodoTool_ConcurrentAddsAreNotLost(t *testing.T) {
+	s, parent, _, _ := newSessionChain(t)
+	tool := &manageTodoTool{}
+
+	const n = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := tool.Execute(context.Background(), s, parent, map[string]any{"action": "add", "content": fmt.Sprintf("task %d", i)})
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	todos, err := s.sessionTodos(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(todos) != n {
+		t.Fatalf("expected %d todos, got %d", n, len(todos))
+	}
+	ids := map[string]bool{}
+	for _, todo := range todos {
+		ids[todo.ID] = true
+	}
+	if len(ids) != n {
+		t.Fatalf("expected unique todo IDs, got %d distinct of %d", len(ids), n)
+	}
+}
+
+func TestManageTodoTool_PriorityAndReorder(t *testing.T) {
+	s, parent, _, _ := newSessionChain(t)
+	tool := &manageTodoTool{}
+	run := func(args map[string]any) (string, error) {
+		return tool.Execute(context.Background(), s, parent, args)
+	}
+	for _, content := range []string{"a", "b", "c"} {
+		if _, err := run(map[string]any{"action": "add", "content": content}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	todos, _ := s.sessionTodos(parent)
+	a, b, c := todos[0].ID, todos[1].ID, todos[2].ID
+
+	if _, err := run(map[string]any{"action": "update", "id": b, "priority": "high"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := run(map[string]any{"action": "update", "id": b, "priority": "urgent"}); err == nil {
+		t.Fatalf("expected an invalid priority to be rejected")
+	}
+
+	// XML calls send the list as text.
+	if _, err := run(map[string]any{"action": "reorder", "ids": c + ", " + a}); err != nil {
+		t.Fatal(err)
+	}
+	todos, _ = s.sessionTodos(parent)
+	var order []string
+	for _, todo := range todos {
+		order = append(order, todo.Content+":"+todo.Priority)
+	}
+	if got := strings.Join(order, ","); got != "c:medium,a:medium,b:high" {
+		t.Fatalf("unexpected todos after reorder: %s", got)
+	}
+
+	for _, ids := range []any{[]any{a, a}, []any{"missing"}, ""} {
+		if _, err := run(map[string]any{"action": "reorder", "ids": ids}); err == nil {
+			t.Fatalf("expected reorder with %v to fail", ids)
+		}
+	}
+	todos, _ = s.sessionTodos(parent)
+	if len(todos) != 3 || todos[0].ID != c {
+		t.Fatalf("a failed reorder changed the todos: %+v", todos)
+	}
+}
+
+func TestManageTodoTool_ProgressAndClearCompleted(t *testing.T) {
+	s, parent, _, _ := newSessionChain(t)
+	tool := &manageTodoTool{}
+	run := func(args map[string]any) string {
+		t.Helper()
+		out, err := tool.Execute(context.Background(), s, parent, args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+	for _, content := range []string{"a", "b", "c"} {
+		run(map[string]any{"action": "add", "content": content})
+	}
+	todos, _ := s.sessionTodos(parent)
+	run(map[string]any{"action": "update", "id": todos[0].ID, "status": "completed"})
+
+	if out := run(map[string]any{"action": "list"}); !strings.HasPrefix(out, "1 of 3 done\n") {
+		t.Fatalf("expected progress in list output, got %q", out)
+	}
+	session, _ := s.GetSession(parent)
+	messages, _ := s.buildLLMMessages(session, "next", messageAttachments{}, CustomLLMService{ID: "svc"}, "m", s.agentByID(defaultAgentID))
+	if prompt, _ := messages[0]["content"].(string); !strings.Contains(prompt, "TODO LIST (1 of 3 done)") || !strings.Contains(prompt, "] b (ID: ") {
+		t.Fatalf("expected the open todos in the system prompt:\n%s", prompt)
+	}
+
+	if out := run(map[string]any{"action": "clear_completed"}); out != "Cleared 1 completed todos; 2 remaining." {
+		t.Fatalf("unexpected clear_completed output: %q", out)
+	}
+	todos, _ = s.sessionTodos(parent)
+	if len(todos) != 2 || todos[0].Content != "b" {
+		t.Fatalf("unexpected todos after clear_completed: %+v", todos)
+	}
+}
+
+func TestTodoPromptSection_IsBounded(t *testing.T) {
+	var todos []TodoItem
+	for i := 0; i < maxPromptTodos+5; i++ {
+		todos = append(todos, TodoItem{ID: fmt.Sprintf("t%d", i), Content: strings.Repeat("x", 1000), Status: "pending"})
+	}
+	todos = append(todos, TodoItem{ID: "done", Content: "finished", Status: "completed"})
+
+	section := todoPromptSection(todos)
+	if !strings.Contains(section, "(1 of 26 done)") || !strings.Contains(section, "... and 5 more") {
+		t.Fatalf("unexpected section:\n%s", section)
+	}
+	if strings.Contains(section, "finished") {
+		t.Fatalf("completed todos should not be listed")
+	}
+	if limit := maxPromptTodos*(maxPromptTodoBytes+50) + 200; len(section) > limit {
+		t.Fatalf("section is %d bytes, want at most %d", len(section), limit)
+	}
+	if todoPromptSection([]TodoItem{{ID: "done", Content: "x", Status: "completed"}}) != "" {
+		t.Fatalf("expected no section when every todo is done")
+	}
+}
+
+func TestDetectProjectCommand(t *testing.T) {
+	write := func(dir, name, content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	goDir := t.TempDir()
+	write(goDir, "go.mod", "module x\n")
+	write(goDir, "Makefile", "test:\n")
+	if cmd, marker, ok := detectProjectCommand(goDir, defaultTestCommands); !ok || cmd != "go test ./..." || marker != "go.mod" {
+		t.Fatalf("go project: %q %q %v", cmd, marker, ok)
+	}
+
+	nodeDir := t.TempDir()
+	write(nodeDir, "package.json", `{"scripts": {"test": "echo \"Error: no test specified\" && exit 1"}}`)
+	if cmd, _, ok := detectProjectCommand(nodeDir, defaultTestCommands); ok {
+		t.Fatalf("expected npm's placeholder test script to be ignored, got %q", cmd)
+	}
+	write(nodeDir, "package.json", `{"scripts": {"test": "vitest run"}}`)
+	write(nodeDir, "pnpm-lock.yaml", "")
+	if cmd, _, ok := detectProjectCommand(nodeDir, defaultTestCommands); !ok || cmd != "pnpm test" {
+		t.Fatalf("pnpm project: %q %v", cmd, ok)
+	}
+
+	s := &Service{config: map[string]interface{}{
+		"testCommands": []interface{}{map[string]interface{}{"marker": "go.mod", "command": "make check"}},
+	}}
+	commands := append(s.configProjectCommands("testCommands"), defaultTestCommands...)
+	if cmd, _, _ := detectProjectCommand(goDir, commands); cmd != "make check" {
+		t.Fatalf("expected the configured command to win, got %q", cmd)
+	}
+}
+
+func TestRunTestsTool_SummarizesFailures(t *testing.T) {
+	tmp := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmp, "suite.txt"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := &Service{workspaceDir: tmp, config: map[string]interface{}{
+		"testCommands": []interface{}{map[string]interface{}{"marker": "suite.txt", "command": "echo ok"}},
+	}}
+	tool := &runTestsTool{}
+
+	out, err := tool.Execute(context.Background(), s, "s1", map[string]any{})
+	if err != nil || !strings.HasPrefix(out, "PASS: `echo ok`") {
+		t.Fatalf("expected a pass, got %q %v", out, err)
+	}
+
+	s.config["testCommands"] = []interface{}{map[string]interface{}{
+		"marker": "suite.txt", "command": "echo '=== RUN TestA'; echo '--- FAIL: TestA (0.00s)'; echo '    a_test.go:9: boom'; exit 1",
+	}}
+	out, err = tool.Execute(context.Background(), s, "s1", map[string]any{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out, "FAIL: ") || !strings.Contains(out, "exited with code 1") || !strings.Contains(out, "Failures:\n--- FAIL: TestA") || !strings.Contains(out, "a_test.go:9: boom") {
+		t.Fatalf("unexpected failure summary:\n%s", out)
+	}
+
+	if _, err := tool.Execute(context.Background(), &Service{workspaceDir: t.TempDir(), config: map[string]interface{}{}}, "s1", map[string]any{}); err == nil {
+		t.Fatalf("expected an error when no project is detected")
+	}
+}
+
+func TestLintTool_ReportsAndFixesFormatting(t *testing.T) {
+	if _, err := exec.LookPath("gofmt"); err != nil {
+		t.Skip("gofmt not installed")
+	}
+	tmp := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmp, "go.mod"), []byte("module x\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(tmp, "a.go")
+	if err := os.WriteFile(path, []byte("package x\nfunc  F( ) {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := &Service{workspaceDir: tmp, config: map[string]interface{}{
+		// Pin gofmt so the result does not depend on goimports being installed.
+		"lintCommands": []interface{}{map[string]interface{}{"marker": "go.mod", "command": "gofmt -l -d .", "fix": "gofmt -l -w ."}},
+	}}
+	tool := &lintTool{}
+
+	out, err := tool.Execute(context.Background(), s, "s1", map[string]any{})
+	if err != nil || !strings.Contains(out, "`gofmt -l -d .`") || !strings.Contains(out, "+func F() {}") {
+		t.Fatalf("expected a formatting diff, got %q %v", out, err)
+	}
+	if out, err = tool.Execute(context.Background(), s, "s1", map[string]any{"fix": true}); err != nil || !strings.HasPrefix(out, "FIXED: ") {
+		t.Fatalf("expected the files to be fixed, got %q %v", out, err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "package x\n\nfunc F() {}\n" {
+		t.Fatalf("file was not formatted: %q", data)
+	}
+	// Login shells may print their own noise, so only the diff is checked.
+	if out, err = tool.Execute(context.Background(), s, "s1", map[string]any{}); err != nil || strings.Contains(out, "+func") {
+		t.Fatalf("expected no diff after fixing, got %q %v", out, err)
+	}
+}
+
+func TestLintTool_MissingLinterDegradesGracefully(t *testing.T) {
+	tmp := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmp, "lint.cfg"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := &Service{workspaceDir: tmp, config: map[string]interface{}{
+		"lintCommands": []interface{}{map[string]interface{}{"marker": "lint.cfg", "command": "openspace-no-such-linter ."}},
+	}}
+	out, err := (&lintTool{}).Execute(context.Background(), s, "s1", map[string]any{})
+	if err != nil || !strings.Contains(out, "No formatter or linter is installed") || !strings.Contains(out, "openspace-no-such-linter") {
+		t.Fatalf("expected a graceful skip, got %q %v", out, err)
+	}
+}
+
+func TestParseBuildErrors(t *testing.T) {
+	output := strings.Join([]string{
+		"# example.com/x",
+		"./main.go:10:5: undefined: foo",
+		"pkg/util.go:3: syntax error: unexpected }",
+		"src/app.ts(12,7): error TS2304: Cannot find name 'bar'.",
+		"error[E0425]: cannot find value `baz` in this scope",
+		"  --> src/main.rs:2:13",
+		"[ERROR] /repo/src/A.java:[8,15] cannot find symbol",
+		"lib.c:4:1: warning: unused variable",
+		"./main.go:10:5: undefined: foo",
+	}, "\n")
+	got := parseBuildErrors(output)
+	want := []BuildError{
+		{File: "main.go", Line: 10, Column: 5, Message: "undefined: foo"},
+		{File: "pkg/util.go", Line: 3, Message: "syntax error: unexpected }"},
+		{File: "src/app.ts", Line: 12, Column: 7, Message: "error TS2304: Cannot find name 'bar'."},
+		{File: "src/main.rs", Line: 2, Column: 13, Message: "cannot find value `baz` in this scope"},
+		{File: "/repo/src/A.java", Line: 8, Column: 15, Message: "cannot find symbol"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d errors, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("error %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestBuildTool_ReturnsStructuredErrors(t *testing.T) {
+	tmp := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmp, "build.cfg"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := &Service{workspaceDir: tmp, config: map[string]interface{}{
+		"buildCommands": []interface{}{map[string]interface{}{"marker": "build.cfg", "command": "echo './main.go:3:2: undefined: x'; exit 2"}},
+	}}
+	out, err := (&buildTool{}).Execute(context.Background(), s, "s1", map[string]any{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out, "BUILD FAILED: ") || !strings.Contains(out, "exited with code 2") || !strings.Contains(out, `"file": "main.go"`) || !strings.Contains(out, `"line": 3`) {
+		t.Fatalf("unexpected build summary:\n%s", out)
+	}
+}
+
+func TestToWorkspaceRel(t *testing.T) {
+	root := filepath.Join(string(filepath.Separator), "work", "repo")
+	cases := map[string]string{
+		filepath.Join(root, "cmd", "main.go"):        "cmd/main.go",
+		filepath.Join("cmd", "app", "..", "main.go"): "cmd/main.go",
+		root: ".",
+		filepath.Join(string(filepath.Separator), "etc", "hosts"): "/etc/hosts",
+	}
+	for in, want := range cases {
+		if got := toWorkspaceRel(root, in); got != want {
+			t.Errorf("toWorkspaceRel(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestListFilesTool_ShowsWorkspaceRelativePaths(t *testing.T) {
+	tmp := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(tmp, "src", "pkg"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tmp, "src", "main.go"), []byte("package main"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := &Service{workspaceDir: tmp}
+
+	res := executeToolCall(context.Background(), s, newToolRegistry(), "s1", ToolCall{
+		Name: "list_files",
+		Args: map[string]any{"path": "src"},
+	}, agentModePlan)
+	if res.IsError {
+		t.Fatalf("unexpected error: %q", res.Content)
+	}
+	want := "src/main.go (file)\nsrc/pkg (directory)"
+	if res.Content != want {
+		t.Fatalf("unexpected listing:\n%s\nwant:\n%s", res.Content, want)
+	}
+}
+
+func TestFileTools_AcceptWindowsSeparators(t *testing.T) {
+	tmp := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(tmp, "src", "pkg"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tmp, "src", "pkg", "util.go"), []byte("package pkg"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := &Service{workspaceDir: tmp}
+	registry := newToolRegistry()
+
+	found := executeToolCall(context.Background(), s, registry, "s1", ToolCall{
+		Name: "search_files",
+		Args: map[string]any{"query": "util"},
+	}, agentModePlan)
+	if found.IsError || found.Content != "src/pkg/util.go" {
+		t.Fatalf("search_files = %+v, want src/pkg/util.go", found)
+	}
+
+	winPath := strings.Join([]string{"src", "pkg", "util.go"}, `\`)
+	for _, path := range []string{found.Content, winPath} {
+		res := executeToolCall(context.Background(), s, registry, "s1", ToolCall{
+			Name: "read_file",
+			Args: map[string]any{"path": path},
+		}, agentModePlan)
+		if res.IsError || res.Content != "package pkg" {
+			t.Fatalf("read_file(%q) = %+v", path, res)
+		}
+	}
+	if got := fromToolPath(winPath); got != filepath.Join("src", "pkg", "util.go") {
+		t.Fatalf("fromToolPath(%q) = %q", winPath, got)
+	}
+}
+
+func TestInteractiveCommandReason(t *testing.T) {
+	interactive := []string{
+		"vim main.go",
+		"cd src && nano x.txt",
+		"python3",
+		"python -i script.py",
+		"FOO=1 node",
+		"sudo top",
+		"npm init",
+		"git commit",
+		"git commit -a",
+		"git rebase -i HEAD~3",
+		"git add -p",
+		"/usr/bin/psql",
+	}
+	for _, command := range interactive {
+		if interactiveCommandReason(command) == "" {
+			t.Errorf("expected %q to be reported as interactive", command)
+		}
+	}
+	batch := []string{
+		"go test ./...",
+		"python3 script.py",
+		"node -e 'console.log(1)'",
+		"npm init -y",
+		"yarn init --yes",
+		"git commit -am 'fix'",
+		"git commit --amend --no-edit",
+		"git commit --message=done",
+		"git rebase main",
+		"git add -A",
+		"echo vim | cat",
+	}
+	for _, command := range batch {
+		if reason := interactiveCommandReason(command); reason != "" {
+			t.Errorf("expected %q to be allowed, got %q", command, reason)
+		}
+	}
+}
+
+func TestRunCommandTool_RefusesInteractiveCommands(t *testing.T) {
+	s := &Service{workspaceDir: t.TempDir()}
+	res := executeToolCall(context.Background(), s, newToolRegistry(), "s1", ToolCall{
+		Name: "run_command",
+		Args: map[string]any{"command": "vim notes.txt"},
+	}, agentModeAct)
+	if !res.IsError || !strings.Contains(res.Content, "interactive commands are not supported") {
+		t.Fatalf("expected vim to be refused, got %+v", res)
+	}
+}
+
+func TestRunCommandTool_PlanModeCommands(t *testing.T) {
+	s := &Service{workspaceDir: t.TempDir()}
+	cases := map[string]bool{
+		"ls -la":                  true,
+		"tree -L 2":               true,
+		"git log --oneline":       true,
+		"tree -o out.txt":         false,
+		"tree -ao out.txt":        false,
+		"tree -R -H . -L 1":       false,
+		"find . -delete":          false,
+		"git diff --output=x.txt": false,
+		"rm -rf build":            false,
+		"ls > files.txt":          false,
+	}
+	for command, want := range cases {
+		if got := (&runCommandTool{}).AllowedInPlanModeFor(s, map[string]any{"command": command}); got != want {
+			t.Errorf("AllowedInPlanModeFor(%q) = %v, want %v", command, got, want)
+		}
+	}
+}
+
+func TestCommandOutputTool_ModeGating(t *testing.T) {
+	s := &Service{workspaceDir: t.TempDir()}
+	registry := newToolRegistry()
+	run := func(mode agentMode, args map[string]any) ToolResult {
+		return executeToolCall(context.Background(), s, registry, "s1", ToolCall{Name: "command_output", Args: args}, mode)
+	}
+
+	for _, args := range []map[string]any{
+		{"handle": "bg_1", "stop": "true"},
+		{"handle": "bg_1", "stop": true},
+		{"handle": "bg_1", "input": "y"},
+	} {
+		if res := run(agentModePlan, args); !strings.Contains(res.Content, "not allowed in PLAN mode") {
+			t.Errorf("plan mode with %v: got %q", args, res.Content)
+		}
+		if res := run(agentModeReview, args); !strings.Contains(res.Content, "not allowed in REVIEW mode") {
+			t.Errorf("review mode with %v: got %q", args, res.Content)
+		}
+	}
+	// Reading output is allowed; the unknown handle is the only problem.
+	if res := run(agentModePlan, map[string]any{"handle": "bg_1", "stop": "false"}); !strings.Contains(res.Content, "no background command") {
+		t.Errorf("expected reading output to be allowed in plan mode, got %q", res.Content)
+	}
+
+	if (&runCommandTool{}).AllowedInPlanModeFor(s, map[string]any{"command": "ls", "background": "true"}) {
+		t.Error("expected a background command to be refused in plan mode")
+	}
+}
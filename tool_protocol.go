@@ -6,7 +6,7 @@ func resolveToolCallingMode(cfg CustomLLMService) string {
 	mode := strings.ToLower(strings.TrimSpace(cfg.ToolCalling))
 	switch mode {
 	case "native":
-		if cfg.Provider == "anthropic" {
+		if cfg.Provider.isAnthropic() {
 			return "xml"
 		}
 		return "native"
@@ -15,7 +15,7 @@ func resolveToolCallingMode(cfg CustomLLMService) string {
 	case "auto", "":
 	default:
 	}
-	if cfg.Provider == "openai" {
+	if cfg.Provider == ProviderOpenAI {
 		return "native"
 	}
 	return "xml"
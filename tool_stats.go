@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// ToolStat accumulates the calls one tool received in a session.
+type ToolStat struct {
+	Calls           int   `json:"calls"`
+	Errors          int   `json:"errors"`
+	TotalDurationMs int64 `json:"totalDurationMs"`
+}
+
+// add returns the sum of two stats.
+func (t ToolStat) add(other ToolStat) ToolStat {
+	t.Calls += other.Calls
+	t.Errors += other.Errors
+	t.TotalDurationMs += other.TotalDurationMs
+	return t
+}
+
+// recordToolUsage adds one call of tool to the session's stats. The stats
+// are kept in memory until the reply is saved, see mergeToolStats. Calls
+// made outside a known session are not counted.
+func (s *Service) recordToolUsage(sessionID string, tool string, isError bool, elapsed time.Duration) {
+	if s == nil || sessionID == "" {
+		return
+	}
+	s.sessionMux.RLock()
+	_, exists := s.sessions[sessionID]
+	s.sessionMux.RUnlock()
+	if !exists {
+		return
+	}
+	call := ToolStat{Calls: 1, TotalDurationMs: elapsed.Milliseconds()}
+	if isError {
+		call.Errors = 1
+	}
+	s.toolStatsMux.Lock()
+	defer s.toolStatsMux.Unlock()
+	if s.toolStats == nil {
+		s.toolStats = map[string]map[string]ToolStat{}
+	}
+	if s.toolStats[sessionID] == nil {
+		s.toolStats[sessionID] = map[string]ToolStat{}
+	}
+	s.toolStats[sessionID][tool] = s.toolStats[sessionID][tool].add(call)
+}
+
+// mergeToolStats moves the session's unsaved stats into session.ToolStats.
+// It is called from the updateSession that saves a reply.
+func (s *Service) mergeToolStats(session *Session) {
+	s.toolStatsMux.Lock()
+	pending := s.toolStats[session.ID]
+	delete(s.toolStats, session.ID)
+	s.toolStatsMux.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+	// Replace the map rather than changing it in place: the session index
+	// keeps a reference to it.
+	stats := make(map[string]ToolStat, len(session.ToolStats)+len(pending))
+	for name, stat := range session.ToolStats {
+		stats[name] = stat
+	}
+	for name, stat := range pending {
+		stats[name] = stats[name].add(stat)
+	}
+	session.ToolStats = stats
+}
+
+// saveToolStats saves the session's unsaved stats on their own, for a turn
+// that ended without a reply.
+func (s *Service) saveToolStats(sessionID string) {
+	s.toolStatsMux.Lock()
+	_, pending := s.toolStats[sessionID]
+	s.toolStatsMux.Unlock()
+	if !pending {
+		return
+	}
+	if _, err := s.updateSession(sessionID, func(session *Session) error {
+		s.mergeToolStats(session)
+		return nil
+	}); err != nil {
+		fmt.Printf("Warning: Failed to save tool stats for session %s: %v\n", sessionID, err)
+	}
+}
+
+// GetSessionToolStats returns how often each tool was called in a session
+// and how long the calls took in total.
+func (s *Service) GetSessionToolStats(sessionID string) (map[string]ToolStat, error) {
+	s.sessionMux.RLock()
+	session, exists := s.sessions[sessionID]
+	s.sessionMux.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrSessionNotFound, sessionID)
+	}
+	unlock := s.lockSession(sessionID)
+	defer unlock()
+
+	stats := make(map[string]ToolStat, len(session.ToolStats))
+	for name, stat := range session.ToolStats {
+		stats[name] = stat
+	}
+	s.toolStatsMux.Lock()
+	for name, stat := range s.toolStats[sessionID] {
+		stats[name] = stats[name].add(stat)
+	}
+	s.toolStatsMux.Unlock()
+	return stats, nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+)
+
+// messageRole returns the role recorded in a stored message's info.
+func messageRole(msg map[string]interface{}) string {
+	info, _ := msg["info"].(map[string]interface{})
+	role, _ := info["role"].(string)
+	return role
+}
+
+// An assistant reply can carry sibling variants: the replies it replaced,
+// kept oldest first in info["variants"] as {"info", "parts"} messages. Index
+// i < len(variants) names a variant and len(variants) the reply's own
+// content. info["selectedVariant"] holds the index picked with
+// SelectVariant; without it the reply's own content is used. Context
+// assembly sends the selected variant.
+
+// messageVariants returns the sibling variants kept on a stored reply.
+func messageVariants(msg map[string]interface{}) []map[string]interface{} {
+	info, _ := msg["info"].(map[string]interface{})
+	switch raw := info["variants"].(type) {
+	case []map[string]interface{}:
+		return raw
+	case []interface{}:
+		variants := make([]map[string]interface{}, 0, len(raw))
+		for _, v := range raw {
+			if variant, ok := v.(map[string]interface{}); ok {
+				variants = append(variants, variant)
+			}
+		}
+		return variants
+	}
+	return nil
+}
+
+// selectedVariant returns the variant picked for a stored reply, or nil
+// when its own content is used.
+func selectedVariant(msg map[string]interface{}) map[string]interface{} {
+	info, _ := msg["info"].(map[string]interface{})
+	index := -1
+	switch v := info["selectedVariant"].(type) {
+	case float64:
+		index = int(v)
+	case int:
+		index = v
+	}
+	variants := messageVariants(msg)
+	if index < 0 || index >= len(variants) {
+		return nil
+	}
+	return variants[index]
+}
+
+// asVariant copies a reply into the form kept in info["variants"], without
+// its own variants.
+func asVariant(msg map[string]interface{}) map[string]interface{} {
+	info, _ := msg["info"].(map[string]interface{})
+	variantInfo := make(map[string]interface{}, len(info))
+	for k, v := range info {
+		if k != "variants" && k != "selectedVariant" {
+			variantInfo[k] = v
+		}
+	}
+	return map[string]interface{}{"info": variantInfo, "parts": msg["parts"]}
+}
+
+// migrateMessageVariants moves variants saved at the top level of a message,
+// where RegenerateWithModel first kept them, into its info.
+func migrateMessageVariants(messages []map[string]interface{}) {
+	for _, msg := range messages {
+		legacy, ok := msg["variants"]
+		if !ok {
+			continue
+		}
+		delete(msg, "variants")
+		if info, ok := msg["info"].(map[string]interface{}); ok {
+			if _, exists := info["variants"]; !exists {
+				info["variants"] = legacy
+			}
+		}
+	}
+}
+
+// RegenerateWithModel re-sends the last user turn of a session to model and
+// replaces the reply. The replaced reply and its variants become variants of
+// the new one, so the UI can page through every answer; each variant's info
+// records its model and service. If the new request fails the session is
+// left as it was.
+func (s *Service) RegenerateWithModel(sessionID string, model string) (map[string]interface{}, error) {
+	var userMsg, replyMsg map[string]interface{}
+	if _, err := s.updateSession(sessionID, func(session *Session) error {
+		n := len(session.Messages)
+		if n < 2 || messageRole(session.Messages[n-1]) != "assistant" || messageRole(session.Messages[n-2]) != "user" {
+			return fmt.Errorf("%w: session has no reply to regenerate", ErrInvalidArgument)
+		}
+		userMsg, replyMsg = session.Messages[n-2], session.Messages[n-1]
+		session.Messages = session.Messages[:n-2]
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	// Re-send the turn with the same text, images and files.
+	_, text, imageParts, _ := normalizeStoredMessageParts(userMsg)
+	images := s.historyAttachments(imageParts)
+	files := storedFileAttachments(userMsg)
+	replyInfo, _ := replyMsg["info"].(map[string]interface{})
+	agent, _ := replyInfo["agent"].(string)
+
+	reply, err := s.sendMessage(sessionID, text, model, agent, images, files)
+	if err != nil {
+		if _, restoreErr := s.updateSession(sessionID, func(session *Session) error {
+			session.Messages = append(session.Messages, userMsg, replyMsg)
+			return nil
+		}); restoreErr != nil {
+			fmt.Printf("Warning: Failed to restore replaced reply: %v\n", restoreErr)
+		}
+		return nil, err
+	}
+
+	variants := append(messageVariants(replyMsg), asVariant(replyMsg))
+
+	newInfo, _ := reply["info"].(map[string]interface{})
+	newID := newInfo["id"]
+	result := reply
+	if _, err := s.updateSession(sessionID, func(session *Session) error {
+		for _, msg := range session.Messages {
+			if info, ok := msg["info"].(map[string]interface{}); ok && info["id"] == newID {
+				info["variants"] = variants
+				result = make(map[string]interface{}, len(msg))
+				for k, v := range msg {
+					result[k] = v
+				}
+				break
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// SelectVariant picks which answer of a reply is used as context from now
+// on: a variant index, or len(variants) for the reply's own content.
+func (s *Service) SelectVariant(sessionID string, messageID string, variantIndex int) (map[string]interface{}, error) {
+	var result map[string]interface{}
+	if _, err := s.updateSession(sessionID, func(session *Session) error {
+		for _, msg := range session.Messages {
+			info, ok := msg["info"].(map[string]interface{})
+			if !ok || info["id"] != messageID {
+				continue
+			}
+			count := len(messageVariants(msg))
+			if variantIndex < 0 || variantIndex > count {
+				return fmt.Errorf("%w: variant %d out of range (message has %d)", ErrInvalidArgument, variantIndex, count+1)
+			}
+			if variantIndex == count {
+				delete(info, "selectedVariant")
+			} else {
+				info["selectedVariant"] = variantIndex
+			}
+			result = make(map[string]interface{}, len(msg))
+			for k, v := range msg {
+				result[k] = v
+			}
+			return nil
+		}
+		return fmt.Errorf("%w: message %s", ErrInvalidArgument, messageID)
+	}); err != nil {
+		return nil, err
+	}
+	return result, nil
+}